@@ -2,51 +2,104 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"p2p-chat/internal/peerlist"
 )
 
-type registerRequest struct {
-	Addr string `json:"addr"`
+const (
+	maxPageSize   = 500
+	maxRecordSize = 16 << 10
+)
+
+type registerResponse struct {
+	OK bool `json:"ok"`
+	// TTL is how many seconds the registration lasts without a heartbeat.
+	TTL int `json:"ttl"`
 }
 
 func main() {
 	addr := flag.String("addr", ":8000", "address bootstrap listens on")
+	ttl := flag.Duration("ttl", 2*time.Minute, "how long a registration lasts without a heartbeat")
+	maxPeers := flag.Int("max-peers", 10000, "cap on registered peers per namespace (0 = no cap)")
+	replicas := flag.String("replicas", "", "comma separated base urls of bootstrap servers to replicate with")
+	syncSecret := flag.String("sync-secret", "", "shared secret replicas use for /sync (required to serve or pull it)")
+	syncEvery := flag.Duration("sync-interval", 10*time.Second, "how often replicas are pulled")
 	flag.Parse()
 
-	store := peerlist.NewStore(2 * time.Minute)
+	store := peerlist.NewStore(*ttl, *maxPeers)
+	http.HandleFunc("/sync", syncHandler(store, *syncSecret))
+	if list := splitList(*replicas); len(list) > 0 {
+		if *syncSecret == "" {
+			log.Fatal("--replicas needs --sync-secret")
+		}
+		go syncLoop(store, list, *syncSecret, *syncEvery)
+	}
 
+	// /register takes a signed peerlist.Record: POST registers or refreshes
+	// it, DELETE removes it.
 	http.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		var req registerRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var rec peerlist.Record
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxRecordSize)).Decode(&rec); err != nil {
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
-		if req.Addr == "" {
-			http.Error(w, "missing addr", http.StatusBadRequest)
+		if r.Method == http.MethodDelete {
+			if err := store.Remove(rec); err != nil {
+				http.Error(w, err.Error(), statusFor(err))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if _, err := store.Register(rec); err != nil {
+			http.Error(w, err.Error(), statusFor(err))
 			return
 		}
-		store.Register(req.Addr)
 		w.Header().Set("Content-Type", "application/json")
-		_, _ = w.Write([]byte(`{"ok":true}`))
+		_ = json.NewEncoder(w).Encode(registerResponse{OK: true, TTL: int(store.ExpireIn() / time.Second)})
 	})
 
+	// /peers lists live peers of one namespace (?namespace=, "default" when
+	// absent), sorted by address. Without ?detail=1 it returns bare
+	// addresses, as older peers expect. Filters: nick (substring), cap
+	// (repeatable, all required) and min_version. Pages are requested with
+	// limit and after; X-Next-After carries the cursor of the next page.
 	http.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		peers := store.List()
+		filter, err := parseFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		records, next := store.Query(filter)
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(peers); err != nil {
+		if next != "" {
+			w.Header().Set("X-Next-After", next)
+		}
+		var body any = records
+		if r.URL.Query().Get("detail") != "1" {
+			addrs := make([]string, len(records))
+			for i, rec := range records {
+				addrs[i] = rec.Addr
+			}
+			body = addrs
+		}
+		if err := json.NewEncoder(w).Encode(body); err != nil {
 			log.Printf("encode peers: %v", err)
 		}
 	})
@@ -54,3 +107,66 @@ func main() {
 	log.Printf("bootstrap server listening on %s", *addr)
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
+
+func parseFilter(r *http.Request) (peerlist.Filter, error) {
+	q := r.URL.Query()
+	namespace, err := peerlist.NormalizeNamespace(q.Get("namespace"))
+	if err != nil {
+		return peerlist.Filter{}, err
+	}
+	filter := peerlist.Filter{
+		Namespace: namespace,
+		Nick:      strings.TrimSpace(q.Get("nick")),
+		After:     q.Get("after"),
+		Limit:     maxPageSize,
+	}
+	for _, c := range q["cap"] {
+		for _, part := range strings.Split(c, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				filter.Capabilities = append(filter.Capabilities, part)
+			}
+		}
+	}
+	if v := q.Get("min_version"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return filter, errors.New("bad min_version")
+		}
+		filter.MinVersion = n
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return filter, errors.New("bad limit")
+		}
+		if n < maxPageSize {
+			filter.Limit = n
+		}
+	}
+	return filter, nil
+}
+
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, peerlist.ErrBadSignature):
+		return http.StatusUnauthorized
+	case errors.Is(err, peerlist.ErrAddrTaken), errors.Is(err, peerlist.ErrStale):
+		return http.StatusConflict
+	case errors.Is(err, peerlist.ErrFull):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, peerlist.ErrNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func splitList(raw string) []string {
+	var out []string
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
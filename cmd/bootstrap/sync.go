@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"p2p-chat/internal/peerlist"
+)
+
+// maxDeltaSize bounds a sync response read from a replica.
+const maxDeltaSize = 64 << 20
+
+// syncHandler serves the store to replicas. It lists every namespace, so it
+// is only available with a shared secret.
+func syncHandler(store *peerlist.Store, secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if secret == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var since int64
+		if v := r.URL.Query().Get("since"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, "bad since", http.StatusBadRequest)
+				return
+			}
+			since = n
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(store.Since(since)); err != nil {
+			log.Printf("encode sync: %v", err)
+		}
+	}
+}
+
+// syncLoop pulls from every replica each interval and merges what it gets.
+// After the first full pull it only asks for entries signed since the last
+// one, less twice the allowed clock skew: an entry a replica accepted after
+// that pull cannot be signed earlier than that.
+func syncLoop(store *peerlist.Store, replicas []string, secret string, every time.Duration) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	last := make(map[string]time.Time, len(replicas))
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		for _, replica := range replicas {
+			started := time.Now()
+			var since int64
+			if prev, ok := last[replica]; ok {
+				since = prev.Add(-2 * peerlist.MaxClockSkew).UnixMilli()
+			}
+			delta, err := pull(client, replica, secret, since)
+			if err != nil {
+				log.Printf("sync from %s: %v", replica, err)
+				continue
+			}
+			last[replica] = started
+			if n := store.Merge(delta); n > 0 {
+				log.Printf("sync from %s: merged %d entries", replica, n)
+			}
+		}
+	}
+}
+
+func pull(client *http.Client, replica, secret string, since int64) (peerlist.Delta, error) {
+	var delta peerlist.Delta
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(replica, "/")+"/sync?since="+strconv.FormatInt(since, 10), nil)
+	if err != nil {
+		return delta, err
+	}
+	req.Header.Set("Authorization", "Bearer "+secret)
+	resp, err := client.Do(req)
+	if err != nil {
+		return delta, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return delta, fmt.Errorf("%s", resp.Status)
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxDeltaSize)).Decode(&delta)
+	return delta, err
+}
@@ -0,0 +1,108 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// KeyPair is an X25519 keypair used to seal direct messages so that only the
+// recipient can open them, regardless of how many peers relay the payload.
+type KeyPair struct {
+	Public  [32]byte
+	private [32]byte
+}
+
+// GenerateKeyPair returns a fresh random keypair.
+func GenerateKeyPair() (*KeyPair, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Public: *pub, private: *priv}, nil
+}
+
+// LoadOrCreateKeyPair reads the private key stored at path, generating and
+// persisting a new one when the file does not exist yet.
+func LoadOrCreateKeyPair(path string) (*KeyPair, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if len(data) != 32 {
+			return nil, errors.New("invalid key file")
+		}
+		kp := &KeyPair{}
+		copy(kp.private[:], data)
+		curve25519.ScalarBaseMult(&kp.Public, &kp.private)
+		return kp, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	kp, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, kp.private[:], 0o600); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// PublicKeyString encodes the public half for inclusion in handshakes.
+func (k *KeyPair) PublicKeyString() string {
+	if k == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(k.Public[:])
+}
+
+// Open decrypts a payload produced by SealFor with this keypair's public key.
+func (k *KeyPair) Open(sealed string) ([]byte, error) {
+	if k == nil {
+		return nil, errors.New("no keypair")
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	plain, ok := box.OpenAnonymous(nil, data, &k.Public, &k.private)
+	if !ok {
+		return nil, errors.New("unable to open sealed payload")
+	}
+	return plain, nil
+}
+
+// ParsePublicKey decodes a key produced by PublicKeyString.
+func ParsePublicKey(encoded string) (*[32]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 32 {
+		return nil, errors.New("invalid public key length")
+	}
+	var key [32]byte
+	copy(key[:], data)
+	return &key, nil
+}
+
+// SealFor encrypts plaintext to recipient using an ephemeral sender key and
+// returns it base64 encoded.
+func SealFor(recipient *[32]byte, plaintext []byte) (string, error) {
+	if recipient == nil {
+		return "", errors.New("missing recipient key")
+	}
+	sealed, err := box.SealAnonymous(nil, plaintext, recipient, rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
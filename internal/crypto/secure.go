@@ -82,3 +82,28 @@ func (b *Box) Decrypt(payload []byte) ([]byte, error) {
 	}
 	return b.gcm.Open(nil, nonce, ciphertext, nil)
 }
+
+// Seal encrypts plaintext into a compact nonce||ciphertext frame for binary
+// transports that do not need the JSON envelope.
+func (b *Box) Seal(plaintext []byte) ([]byte, error) {
+	if b == nil {
+		return plaintext, nil
+	}
+	nonce := make([]byte, b.gcm.NonceSize(), b.gcm.NonceSize()+len(plaintext)+b.gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return b.gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Open reverses Seal.
+func (b *Box) Open(frame []byte) ([]byte, error) {
+	if b == nil {
+		return frame, nil
+	}
+	size := b.gcm.NonceSize()
+	if len(frame) < size {
+		return nil, errors.New("frame too short")
+	}
+	return b.gcm.Open(nil, frame[:size], frame[size:], nil)
+}
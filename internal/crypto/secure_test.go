@@ -1,6 +1,10 @@
 package crypto
 
-import "testing"
+import (
+	"crypto/ed25519"
+	"path/filepath"
+	"testing"
+)
 
 func TestBoxEncryptDecrypt(t *testing.T) {
 	box, err := NewBox("secret")
@@ -50,3 +54,67 @@ func TestBoxRejectsTamperedPayload(t *testing.T) {
 		t.Fatalf("expected decrypt error for tampered payload")
 	}
 }
+
+func TestSealForRecipientOnly(t *testing.T) {
+	alice, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair error: %v", err)
+	}
+	mallory, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair error: %v", err)
+	}
+	sealed, err := SealFor(&alice.Public, []byte("for alice"))
+	if err != nil {
+		t.Fatalf("SealFor error: %v", err)
+	}
+	plain, err := alice.Open(sealed)
+	if err != nil || string(plain) != "for alice" {
+		t.Fatalf("recipient failed to open: %v %q", err, plain)
+	}
+	if _, err := mallory.Open(sealed); err == nil {
+		t.Fatalf("expected other keys to fail opening the payload")
+	}
+}
+
+func TestLoadOrCreateKeyPairPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dm.key")
+	first, err := LoadOrCreateKeyPair(path)
+	if err != nil {
+		t.Fatalf("create error: %v", err)
+	}
+	second, err := LoadOrCreateKeyPair(path)
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+	if first.PublicKeyString() != second.PublicKeyString() {
+		t.Fatalf("expected reloaded key to match")
+	}
+	parsed, err := ParsePublicKey(first.PublicKeyString())
+	if err != nil || *parsed != first.Public {
+		t.Fatalf("public key round trip failed: %v", err)
+	}
+}
+
+func TestLoadOrCreateSigningKeyPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	first, err := LoadOrCreateSigningKey(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	second, err := LoadOrCreateSigningKey(path)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if !first.Equal(second) {
+		t.Fatalf("expected the same identity after reload")
+	}
+	encoded := EncodeSigningKey(first.Public().(ed25519.PublicKey))
+	parsed, err := ParseSigningKey(encoded)
+	if err != nil || !parsed.Equal(first.Public()) {
+		t.Fatalf("public key round trip failed: %v", err)
+	}
+	if fp := Fingerprint(encoded); len(fp) != 19 || fp != Fingerprint(encoded) {
+		t.Fatalf("unexpected fingerprint %q", fp)
+	}
+}
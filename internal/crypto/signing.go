@@ -0,0 +1,70 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadOrCreateSigningKey reads the Ed25519 seed stored at path, generating
+// and persisting a new identity when the file does not exist yet.
+func LoadOrCreateSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if len(data) != ed25519.SeedSize {
+			return nil, errors.New("invalid signing key file")
+		}
+		return ed25519.NewKeyFromSeed(data), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, priv.Seed(), 0o600); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+// EncodeSigningKey renders a public key the way it travels on the wire.
+func EncodeSigningKey(pub ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(pub)
+}
+
+// ParseSigningKey decodes a key produced by EncodeSigningKey.
+func ParseSigningKey(encoded string) (ed25519.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid signing key length")
+	}
+	return ed25519.PublicKey(data), nil
+}
+
+// Fingerprint is a short, human comparable digest of an encoded public key.
+func Fingerprint(encoded string) string {
+	if encoded == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(encoded))
+	digest := hex.EncodeToString(sum[:8])
+	groups := make([]string, 0, 4)
+	for i := 0; i < len(digest); i += 4 {
+		groups = append(groups, digest[i:i+4])
+	}
+	return strings.Join(groups, ":")
+}
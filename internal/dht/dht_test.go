@@ -0,0 +1,285 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"p2p-chat/internal/crypto"
+	"p2p-chat/internal/network"
+)
+
+// testNet routes calls between in-memory nodes and counts the ones that are
+// part of a lookup or store, leaving out pings.
+type testNet struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	down  map[string]bool
+	calls int
+}
+
+func (tn *testNet) call(addr string, req []byte) ([]byte, error) {
+	var r request
+	_ = json.Unmarshal(req, &r)
+	tn.mu.Lock()
+	node, ok := tn.nodes[addr]
+	down := tn.down[addr]
+	if r.Op != opPing {
+		tn.calls++
+	}
+	tn.mu.Unlock()
+	if !ok || down {
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	}
+	return node.HandleRPC("", req), nil
+}
+
+func (tn *testNet) add(t *testing.T, addr string) *Node {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	n := New(Config{Addr: addr, Key: key, Call: tn.call})
+	tn.mu.Lock()
+	tn.nodes[addr] = n
+	tn.mu.Unlock()
+	return n
+}
+
+func (tn *testNet) resetCalls() int {
+	tn.mu.Lock()
+	defer tn.mu.Unlock()
+	calls := tn.calls
+	tn.calls = 0
+	return calls
+}
+
+// buildNet starts size nodes, each joining through the first one.
+func buildNet(t *testing.T, size int) (*testNet, []*Node) {
+	t.Helper()
+	tn := &testNet{nodes: make(map[string]*Node), down: make(map[string]bool)}
+	nodes := make([]*Node, size)
+	for i := range nodes {
+		nodes[i] = tn.add(t, fmt.Sprintf("10.0.%d.%d:9001", i/256, i%256))
+	}
+	ctx := context.Background()
+	for _, n := range nodes[1:] {
+		n.Bootstrap(ctx, []string{nodes[0].Self().Addr})
+	}
+	// Nodes learn about callers by pinging them back in the background; a
+	// second pass, once they have, lets early joiners learn about the later
+	// ones as the periodic bucket refresh would.
+	waitPings()
+	for _, n := range nodes {
+		n.Bootstrap(ctx, nil)
+	}
+	waitPings()
+	return tn, nodes
+}
+
+// waitPings gives the background pings nodes send to new callers a moment
+// to finish.
+func waitPings() {
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestParseIDPrefix(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	pub := key.Public().(ed25519.PublicKey)
+	id := NodeID(pub)
+	peerID := network.PeerID(pub)
+	if !strings.HasPrefix(id.String(), peerID) {
+		t.Fatalf("peer id %s is not a prefix of node id %s", peerID, id)
+	}
+	prefix, bits, err := ParseID(peerID)
+	if err != nil || bits != 4*len(peerID) || !id.HasPrefix(prefix, bits) {
+		t.Fatalf("ParseID(%s) = %s, %d, %v", peerID, prefix, bits, err)
+	}
+	if _, _, err := ParseID("xyz"); err == nil {
+		t.Fatalf("expected non-hex id to fail")
+	}
+	var decoded ID
+	if err := decoded.UnmarshalText([]byte(peerID)); err == nil {
+		t.Fatalf("expected a prefix to be refused as a full id")
+	}
+}
+
+func TestTableKeepsLiveContacts(t *testing.T) {
+	self := ID{}
+	tb := newTable(self, 2)
+	now := time.Now()
+	// IDs with the top bit set all land in bucket 0.
+	contact := func(b byte) Contact {
+		var id ID
+		id[0], id[19] = 0x80, b
+		return Contact{ID: id, Addr: fmt.Sprintf("10.0.0.%d:9001", b)}
+	}
+	tb.seen(contact(1), now.Add(-time.Hour), staleContact)
+	tb.seen(contact(2), now, staleContact)
+	check, stale := tb.seen(contact(3), now, staleContact)
+	if !stale || check.ID != contact(1).ID || tb.hasAddr(contact(3).Addr) {
+		t.Fatalf("a full bucket should keep its contacts and ask to check the oldest: %v %v", check, stale)
+	}
+	tb.failed(contact(1).ID, maxFailures)
+	tb.seen(contact(3), now, staleContact)
+	if tb.hasAddr(contact(1).Addr) || !tb.hasAddr(contact(3).Addr) {
+		t.Fatalf("a contact that failed should make room for a newcomer")
+	}
+	if got := tb.closest(contact(2).ID, 1); len(got) != 1 || got[0].ID != contact(2).ID {
+		t.Fatalf("closest = %v", got)
+	}
+
+	for i := 0; i < 40; i++ {
+		if got := commonPrefixLen(self, tb.randomInBucket(i)); got != i {
+			t.Fatalf("randomInBucket(%d) landed in bucket %d", i, got)
+		}
+	}
+}
+
+func TestRecordVerification(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Now()
+	rec := Record{Kind: KindPeer, Name: "Alice", Addr: "10.0.0.1:9001", BoxKey: "box"}
+	if err := rec.sign(key, now); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if rec.Key != PeerKey("alice") {
+		t.Fatalf("nicknames should be keyed case-insensitively")
+	}
+	tampered := rec
+	tampered.Addr = "10.6.6.6:9001"
+	if err := tampered.verify(now); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("expected a tampered record to fail, got %v", err)
+	}
+	moved := rec
+	moved.Name = "bob"
+	if err := moved.verify(now); !errors.Is(err, ErrBadRecord) {
+		t.Fatalf("expected a record under the wrong key to fail, got %v", err)
+	}
+	if err := rec.verify(now.Add(RecordTTL + time.Second)); !errors.Is(err, ErrExpired) {
+		t.Fatalf("expected an old record to fail, got %v", err)
+	}
+
+	store := newRecordStore()
+	if err := store.put(rec, now); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	older := rec
+	_ = older.sign(key, now.Add(-time.Minute))
+	_ = store.put(older, now)
+	if got := store.get(rec.Key, now); len(got) != 1 || got[0].Timestamp != rec.Timestamp {
+		t.Fatalf("an older record should not replace a newer one: %v", got)
+	}
+	store.expire(now.Add(RecordTTL))
+	if store.size() != 0 {
+		t.Fatalf("expected the record to expire")
+	}
+}
+
+func TestLookupFindsNodesAndRecords(t *testing.T) {
+	tn, nodes := buildNet(t, 48)
+	ctx := context.Background()
+	for _, n := range nodes {
+		if contacts, _ := n.Size(); contacts < DefaultK {
+			t.Fatalf("%s knows only %d contacts", n.Self().Addr, contacts)
+		}
+	}
+
+	target := nodes[37].Self()
+	tn.resetCalls()
+	found, err := nodes[3].FindPeer(ctx, network.PeerID(mustKey(t, target.Key)))
+	if err != nil || len(found) != 1 || found[0].Addr != target.Addr {
+		t.Fatalf("FindPeer = %v, %v", found, err)
+	}
+	if calls := tn.resetCalls(); calls > 30 {
+		t.Fatalf("lookup took %d calls", calls)
+	}
+
+	if stored, err := nodes[10].Publish(ctx, Record{Kind: KindPeer, Name: "alice", BoxKey: "box"}); err != nil || stored == 0 {
+		t.Fatalf("publish = %d, %v", stored, err)
+	}
+	waitPings()
+	tn.resetCalls()
+	records := nodes[40].Get(ctx, PeerKey("ALICE"))
+	if len(records) != 1 || records[0].Addr != nodes[10].Self().Addr || records[0].BoxKey != "box" {
+		t.Fatalf("Get = %+v", records)
+	}
+	if calls := tn.resetCalls(); calls > 20 {
+		t.Fatalf("record lookup took %d calls", calls)
+	}
+
+	// A new nickname retires the old record from republishing.
+	if _, err := nodes[10].Publish(ctx, Record{Kind: KindPeer, Name: "alicia"}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	nodes[10].mu.Lock()
+	_, old := nodes[10].published[PeerKey("alice")]
+	nodes[10].mu.Unlock()
+	if old {
+		t.Fatalf("the old nickname should no longer be republished")
+	}
+
+	// Rendezvous records from several publishers share one key.
+	for _, n := range []*Node{nodes[20], nodes[21]} {
+		if _, err := n.Publish(ctx, Record{Kind: KindRendezvous, Name: "standup"}); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+	waitPings()
+	if records := nodes[45].Get(ctx, RendezvousKey("standup")); len(records) != 2 {
+		t.Fatalf("expected both rendezvous records, got %+v", records)
+	}
+}
+
+func TestLookupSurvivesDeadNodes(t *testing.T) {
+	tn, nodes := buildNet(t, 32)
+	ctx := context.Background()
+	if _, err := nodes[5].Publish(ctx, Record{Kind: KindPeer, Name: "carol"}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	waitPings()
+	tn.mu.Lock()
+	for _, n := range nodes[20:26] {
+		tn.down[n.Self().Addr] = true
+	}
+	tn.mu.Unlock()
+	if records := nodes[30].Get(ctx, PeerKey("carol")); len(records) != 1 {
+		t.Fatalf("expected the record to survive dead nodes, got %+v", records)
+	}
+}
+
+func TestImpostorRepliesAreRejected(t *testing.T) {
+	tn := &testNet{nodes: make(map[string]*Node), down: make(map[string]bool)}
+	a := tn.add(t, "10.0.0.1:9001")
+	b := tn.add(t, "10.0.0.2:9001")
+	c := tn.add(t, "10.0.0.3:9001")
+	// c answers on b's address, so b's ID is not what a finds there.
+	tn.nodes[b.Self().Addr] = c
+	id := b.Self().ID
+	if _, err := a.call(b.Self().Addr, &id, request{Op: opPing}); !errors.Is(err, errWrongNode) {
+		t.Fatalf("expected errWrongNode, got %v", err)
+	}
+	forged := c.Self()
+	forged.ID = id
+	reply := reply{From: forged}
+	if err := reply.verify("nonce"); err == nil {
+		t.Fatalf("expected a reply claiming someone else's id to fail")
+	}
+}
+
+func mustKey(t *testing.T, encoded string) ed25519.PublicKey {
+	t.Helper()
+	pub, err := crypto.ParseSigningKey(encoded)
+	if err != nil {
+		t.Fatalf("parse key: %v", err)
+	}
+	return pub
+}
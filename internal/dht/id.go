@@ -0,0 +1,111 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// IDBits is the size of node IDs and record keys.
+const IDBits = 160
+
+// ID names a node or a record key. Distance between IDs is their XOR.
+type ID [IDBits / 8]byte
+
+// NodeID derives a node's ID from its signing key. network.PeerID, the ID a
+// peer reserves on relays, is a prefix of its hex form.
+func NodeID(pub ed25519.PublicKey) ID {
+	sum := sha256.Sum256(pub)
+	var id ID
+	copy(id[:], sum[:])
+	return id
+}
+
+func hashID(parts ...string) ID {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	var id ID
+	copy(id[:], sum[:])
+	return id
+}
+
+// ParseID decodes a hex ID. A shorter hex string is a prefix; the rest of
+// the ID is zero and prefix reports how many bits were given.
+func ParseID(s string) (id ID, prefix int, err error) {
+	if len(s) > 2*len(id) {
+		return ID{}, 0, fmt.Errorf("id %q is longer than %d hex digits", s, 2*len(id))
+	}
+	padded := s
+	if len(padded)%2 == 1 {
+		padded += "0"
+	}
+	raw, err := hex.DecodeString(padded)
+	if err != nil || s == "" {
+		return ID{}, 0, fmt.Errorf("id %q is not hex", s)
+	}
+	copy(id[:], raw)
+	return id, 4 * len(s), nil
+}
+
+func randomID() ID {
+	var id ID
+	_, _ = rand.Read(id[:])
+	return id
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id ID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *ID) UnmarshalText(text []byte) error {
+	parsed, bits, err := ParseID(string(text))
+	if err != nil {
+		return err
+	}
+	if bits != IDBits {
+		return fmt.Errorf("id %q is too short", text)
+	}
+	*id = parsed
+	return nil
+}
+
+// HasPrefix reports whether the first bits of id match those of prefix.
+func (id ID) HasPrefix(prefix ID, bits int) bool {
+	return commonPrefixLen(id, prefix) >= bits
+}
+
+func xor(a, b ID) ID {
+	var d ID
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// closer reports whether a is closer to target than b.
+func closer(target, a, b ID) bool {
+	da, db := xor(a, target), xor(b, target)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// commonPrefixLen counts the leading bits a and b share.
+func commonPrefixLen(a, b ID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			n := i * 8
+			for x&0x80 == 0 {
+				x <<= 1
+				n++
+			}
+			return n
+		}
+	}
+	return IDBits
+}
@@ -0,0 +1,530 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"p2p-chat/internal/crypto"
+)
+
+const (
+	// DefaultK is the bucket size and the number of nodes a record is
+	// stored on.
+	DefaultK = 8
+	// alpha is how many nodes a lookup queries at once.
+	alpha = 3
+	// maxLookupRounds bounds a lookup; it normally finishes in about
+	// log2(N)/alpha rounds.
+	maxLookupRounds = 20
+	maxFailures     = 2
+	// staleContact is how long a contact may stay silent before a newcomer
+	// to its full bucket triggers a check on it.
+	staleContact   = 15 * time.Minute
+	bucketRefresh  = 30 * time.Minute
+	republishEvery = 20 * time.Minute
+
+	replyDomain = "p2p-chat/dht-reply"
+)
+
+const (
+	opPing      = "ping"
+	opFindNode  = "find_node"
+	opFindValue = "find_value"
+	opStore     = "store"
+)
+
+var errWrongNode = errors.New("a different node answered")
+
+// Config describes a DHT node.
+type Config struct {
+	// Addr is the address other nodes reach this one at.
+	Addr string
+	// Key is the signing key the node ID is derived from.
+	Key ed25519.PrivateKey
+	// Call sends a request to the node at addr and returns its reply;
+	// normally ConnManager.Call.
+	Call func(addr string, req []byte) ([]byte, error)
+	// K is the bucket size and replication factor; zero means DefaultK.
+	K int
+}
+
+type request struct {
+	Op     string  `json:"op"`
+	From   Contact `json:"from"`
+	Nonce  string  `json:"nonce"`
+	Target ID      `json:"target"`
+	Record *Record `json:"record,omitempty"`
+}
+
+// reply carries the answering node's signature over the request nonce, which
+// proves the node at the dialed address holds the key for the ID it claims.
+type reply struct {
+	From    Contact   `json:"from"`
+	Sig     string    `json:"sig"`
+	Nodes   []Contact `json:"nodes,omitempty"`
+	Records []Record  `json:"records,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func replyPayload(nonce string, id ID) []byte {
+	return []byte(replyDomain + "\n" + nonce + "\n" + id.String())
+}
+
+func (r reply) verify(nonce string) error {
+	pub, err := crypto.ParseSigningKey(r.From.Key)
+	if err != nil || NodeID(pub) != r.From.ID {
+		return fmt.Errorf("node key does not match id %s", r.From.ID)
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Sig)
+	if err != nil || !ed25519.Verify(pub, replyPayload(nonce, r.From.ID), sig) {
+		return errors.New("bad reply signature")
+	}
+	return nil
+}
+
+// Node is a Kademlia DHT node. Nodes find each other by XOR distance between
+// IDs derived from their signing keys, and store signed records on the nodes
+// closest to the record key, so a nickname or rendezvous key resolves in
+// O(log N) hops without a bootstrap server.
+type Node struct {
+	cfg   Config
+	self  Contact
+	table *table
+	store *recordStore
+
+	mu        sync.Mutex
+	published map[ID]Record
+	pings     map[string]*pingCall
+}
+
+// pingCall is a ping in flight; concurrent pings of the same address share
+// it.
+type pingCall struct {
+	done    chan struct{}
+	contact Contact
+	err     error
+}
+
+func New(cfg Config) *Node {
+	if cfg.K <= 0 {
+		cfg.K = DefaultK
+	}
+	pub := cfg.Key.Public().(ed25519.PublicKey)
+	self := Contact{ID: NodeID(pub), Addr: cfg.Addr, Key: crypto.EncodeSigningKey(pub)}
+	return &Node{
+		cfg:       cfg,
+		self:      self,
+		table:     newTable(self.ID, cfg.K),
+		store:     newRecordStore(),
+		published: make(map[ID]Record),
+		pings:     make(map[string]*pingCall),
+	}
+}
+
+// Self is this node's contact.
+func (n *Node) Self() Contact {
+	return n.self
+}
+
+// Size reports the contacts in the routing table and the records stored for
+// other nodes.
+func (n *Node) Size() (contacts, records int) {
+	return n.table.size(), n.store.size()
+}
+
+// HandleRPC answers a request from another node; it fits
+// network.RPCHandler.
+func (n *Node) HandleRPC(_ string, data []byte) []byte {
+	var req request
+	if err := json.Unmarshal(data, &req); err != nil || req.Nonce == "" {
+		return nil
+	}
+	now := time.Now()
+	rep := reply{From: n.self}
+	switch req.Op {
+	case opPing:
+	case opFindNode:
+		rep.Nodes = n.closestExcept(req.Target, req.From.ID)
+	case opFindValue:
+		rep.Records = n.store.get(req.Target, now)
+		rep.Nodes = n.closestExcept(req.Target, req.From.ID)
+	case opStore:
+		if req.Record == nil {
+			rep.Error = "no record"
+		} else if err := n.store.put(*req.Record, now); err != nil {
+			rep.Error = err.Error()
+		}
+	default:
+		rep.Error = fmt.Sprintf("unknown op %q", req.Op)
+	}
+	n.observe(req.From)
+	rep.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(n.cfg.Key, replyPayload(req.Nonce, n.self.ID)))
+	out, err := json.Marshal(rep)
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+func (n *Node) closestExcept(target, except ID) []Contact {
+	contacts := n.table.closest(target, n.cfg.K+1)
+	out := contacts[:0]
+	for _, c := range contacts {
+		if c.ID != except {
+			out = append(out, c)
+		}
+	}
+	if len(out) > n.cfg.K {
+		out = out[:n.cfg.K]
+	}
+	return out
+}
+
+// observe considers a node that sent us a request for the routing table. Its
+// address is only a claim, so the node is pinged back before it is added,
+// and only if there is room for it.
+func (n *Node) observe(c Contact) {
+	if c.Addr == "" || c.Addr == n.self.Addr || !n.table.wants(c) {
+		return
+	}
+	go func() { _, _ = n.Ping(c.Addr) }()
+}
+
+// seen adds a node that answered us to the routing table, checking on the
+// oldest contact of a full bucket that has gone quiet.
+func (n *Node) seen(c Contact) {
+	check, stale := n.table.seen(c, time.Now(), staleContact)
+	if stale {
+		go func() {
+			id := check.ID
+			_, _ = n.call(check.Addr, &id, request{Op: opPing})
+		}()
+	}
+}
+
+// call sends req to addr and verifies the reply. When want is set the reply
+// must come from that node, and a failure counts against it.
+func (n *Node) call(addr string, want *ID, req request) (reply, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return reply{}, err
+	}
+	req.From = n.self
+	req.Nonce = hex.EncodeToString(nonce)
+	rep, err := n.exchange(addr, req)
+	if err == nil && want != nil && rep.From.ID != *want {
+		err = errWrongNode
+	}
+	if err != nil {
+		if want != nil {
+			n.table.failed(*want, maxFailures)
+		}
+		return reply{}, fmt.Errorf("%s: %w", addr, err)
+	}
+	// Nodes advertise whatever address they were configured with; the one
+	// that just worked is the one to keep.
+	rep.From.Addr = addr
+	n.seen(rep.From)
+	if rep.Error != "" {
+		return rep, fmt.Errorf("%s: %s", addr, rep.Error)
+	}
+	return rep, nil
+}
+
+func (n *Node) exchange(addr string, req request) (reply, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return reply{}, err
+	}
+	raw, err := n.cfg.Call(addr, data)
+	if err != nil {
+		return reply{}, err
+	}
+	var rep reply
+	if err := json.Unmarshal(raw, &rep); err != nil {
+		return reply{}, fmt.Errorf("bad reply: %w", err)
+	}
+	return rep, rep.verify(req.Nonce)
+}
+
+// Ping asks the node at addr who it is and adds it to the routing table.
+// Peers call it for every address they connect to, which is how the table
+// is first filled.
+func (n *Node) Ping(addr string) (Contact, error) {
+	n.mu.Lock()
+	if call, ok := n.pings[addr]; ok {
+		n.mu.Unlock()
+		<-call.done
+		return call.contact, call.err
+	}
+	call := &pingCall{done: make(chan struct{})}
+	n.pings[addr] = call
+	n.mu.Unlock()
+
+	rep, err := n.call(addr, nil, request{Op: opPing})
+	call.contact, call.err = rep.From, err
+	n.mu.Lock()
+	delete(n.pings, addr)
+	n.mu.Unlock()
+	close(call.done)
+	return call.contact, call.err
+}
+
+// Known reports whether a node at addr is in the routing table.
+func (n *Node) Known(addr string) bool {
+	return n.table.hasAddr(addr)
+}
+
+// Bootstrap pings the nodes at addrs and then looks up our own ID, which
+// fills the buckets near us and makes us known to our neighbours, and a
+// random ID in each sparse bucket farther out. It returns how many contacts
+// the table holds afterwards.
+func (n *Node) Bootstrap(ctx context.Context, addrs []string) int {
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		if addr == n.self.Addr || n.table.hasAddr(addr) {
+			continue
+		}
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			_, _ = n.Ping(addr)
+		}(addr)
+	}
+	wg.Wait()
+	n.lookup(ctx, n.self.ID, opFindNode)
+	for _, i := range n.table.sparseBuckets() {
+		n.lookup(ctx, n.table.randomInBucket(i), opFindNode)
+	}
+	return n.table.size()
+}
+
+type candidate struct {
+	Contact
+	queried  bool
+	answered bool
+}
+
+// lookup walks towards target, asking alpha of the closest nodes it knows at
+// a time for closer ones, until the k closest it has heard of have all
+// answered. It returns those nodes, nearest first, and for opFindValue the
+// records any of them hold; a key can have several publishers whose records
+// landed on slightly different nodes, so the walk does not stop at the
+// first record.
+func (n *Node) lookup(ctx context.Context, target ID, op string) ([]Contact, []Record) {
+	k := n.cfg.K
+	known := map[ID]bool{n.self.ID: true}
+	var shortlist []*candidate
+	add := func(contacts []Contact) {
+		for _, c := range contacts {
+			if c.Addr == "" || known[c.ID] {
+				continue
+			}
+			known[c.ID] = true
+			shortlist = append(shortlist, &candidate{Contact: c})
+		}
+	}
+	add(n.table.closest(target, k))
+	var records []Record
+
+	for round := 0; round < maxLookupRounds && ctx.Err() == nil; round++ {
+		sortCandidates(shortlist, target)
+		var batch []*candidate
+		for _, c := range shortlist[:min(k, len(shortlist))] {
+			if !c.queried {
+				c.queried = true
+				batch = append(batch, c)
+				if len(batch) == alpha {
+					break
+				}
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+		replies := make([]reply, len(batch))
+		errs := make([]error, len(batch))
+		var wg sync.WaitGroup
+		for i, c := range batch {
+			wg.Add(1)
+			go func(i int, c *candidate) {
+				defer wg.Done()
+				id := c.ID
+				replies[i], errs[i] = n.call(c.Addr, &id, request{Op: op, Target: target})
+			}(i, c)
+		}
+		wg.Wait()
+
+		now := time.Now()
+		for i, c := range batch {
+			if errs[i] != nil {
+				continue
+			}
+			c.answered = true
+			add(replies[i].Nodes)
+			for _, rec := range replies[i].Records {
+				if rec.Key == target && rec.verify(now) == nil {
+					records = append(records, rec)
+				}
+			}
+		}
+		live := shortlist[:0]
+		for _, c := range shortlist {
+			if !c.queried || c.answered {
+				live = append(live, c)
+			}
+		}
+		shortlist = live
+	}
+	return answered(shortlist, target, k), records
+}
+
+func sortCandidates(list []*candidate, target ID) {
+	sort.Slice(list, func(i, j int) bool { return closer(target, list[i].ID, list[j].ID) })
+}
+
+func answered(list []*candidate, target ID, k int) []Contact {
+	sortCandidates(list, target)
+	var out []Contact
+	for _, c := range list {
+		if c.answered {
+			out = append(out, c.Contact)
+			if len(out) == k {
+				break
+			}
+		}
+	}
+	return out
+}
+
+// FindNode returns the nodes closest to target that answered, nearest first.
+func (n *Node) FindNode(ctx context.Context, target ID) []Contact {
+	contacts, _ := n.lookup(ctx, target, opFindNode)
+	return contacts
+}
+
+// FindPeer returns the nodes whose ID starts with the hex prefix, which may
+// be a full ID or a network.PeerID.
+func (n *Node) FindPeer(ctx context.Context, prefix string) ([]Contact, error) {
+	target, bits, err := ParseID(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var out []Contact
+	for _, c := range n.FindNode(ctx, target) {
+		if c.ID.HasPrefix(target, bits) {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// Get returns the live records stored under key, newest first and one per
+// publisher.
+func (n *Node) Get(ctx context.Context, key ID) []Record {
+	_, records := n.lookup(ctx, key, opFindValue)
+	records = append(records, n.store.get(key, time.Now())...)
+	sortNewestFirst(records)
+	seen := make(map[string]bool)
+	out := records[:0]
+	for _, rec := range records {
+		if !seen[rec.Publisher] {
+			seen[rec.Publisher] = true
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// Publish signs rec with the node key and our address and stores it on the
+// k nodes closest to its key, and on this node, then keeps republishing it.
+// A node has a single nickname, so publishing a peer record retires the
+// previous one. It returns how many other nodes accepted the record.
+func (n *Node) Publish(ctx context.Context, rec Record) (int, error) {
+	rec.Addr = n.self.Addr
+	if err := rec.sign(n.cfg.Key, time.Now()); err != nil {
+		return 0, err
+	}
+	n.mu.Lock()
+	for key, old := range n.published {
+		if rec.Kind == KindPeer && old.Kind == KindPeer && key != rec.Key {
+			delete(n.published, key)
+		}
+	}
+	n.published[rec.Key] = rec
+	n.mu.Unlock()
+	return n.replicate(ctx, rec)
+}
+
+func (n *Node) replicate(ctx context.Context, rec Record) (int, error) {
+	if err := n.store.put(rec, time.Now()); err != nil {
+		return 0, err
+	}
+	contacts, _ := n.lookup(ctx, rec.Key, opFindNode)
+	stored := 0
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range contacts {
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+			id := c.ID
+			if _, err := n.call(c.Addr, &id, request{Op: opStore, Record: &rec}); err == nil {
+				mu.Lock()
+				stored++
+				mu.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+	return stored, nil
+}
+
+// republish signs our records afresh and stores them again.
+func (n *Node) republish(ctx context.Context) {
+	n.mu.Lock()
+	records := make([]Record, 0, len(n.published))
+	for _, rec := range n.published {
+		records = append(records, rec)
+	}
+	n.mu.Unlock()
+	for _, rec := range records {
+		if _, err := n.Publish(ctx, rec); err != nil {
+			log.Printf("dht republish %s %q: %v", rec.Kind, rec.Name, err)
+		}
+	}
+}
+
+// Run expires stored records, refreshes buckets nobody was heard from in a
+// while and republishes our records until ctx is done.
+func (n *Node) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	lastPublish := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		n.store.expire(now)
+		for _, i := range n.table.staleBuckets(now.Add(-bucketRefresh)) {
+			n.lookup(ctx, n.table.randomInBucket(i), opFindNode)
+		}
+		if now.Sub(lastPublish) >= republishEvery {
+			n.republish(ctx)
+			lastPublish = now
+		}
+	}
+}
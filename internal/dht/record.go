@@ -0,0 +1,231 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"p2p-chat/internal/crypto"
+)
+
+// Record kinds.
+const (
+	// KindPeer maps a nickname to the publisher's address and DM key.
+	KindPeer = "peer"
+	// KindRendezvous announces the publisher's address under an agreed key.
+	KindRendezvous = "rendezvous"
+)
+
+const (
+	// RecordTTL is how long a record lives after it was signed; publishers
+	// republish well before that.
+	RecordTTL    = time.Hour
+	maxClockSkew = 2 * time.Minute
+	maxNameLen   = 128
+	maxValueLen  = 1024
+	// maxPerKey and maxRecords bound what a node stores for others.
+	maxPerKey  = 16
+	maxRecords = 4096
+
+	recordDomain = "p2p-chat/dht-record"
+)
+
+var (
+	ErrBadRecord    = errors.New("invalid record")
+	ErrBadSignature = errors.New("record signature does not verify")
+	ErrExpired      = errors.New("record expired or from the future")
+	errStoreFull    = errors.New("record store full")
+)
+
+// Record is a signed entry stored on the nodes closest to its key.
+type Record struct {
+	Key  ID     `json:"key"`
+	Kind string `json:"kind"`
+	// Name is the nickname or rendezvous key hashed into Key.
+	Name string `json:"name"`
+	// Addr is where the publisher can be reached.
+	Addr   string `json:"addr"`
+	BoxKey string `json:"box,omitempty"`
+	Value  string `json:"value,omitempty"`
+	// Publisher is the signing key of the node that published the record.
+	Publisher string `json:"pub"`
+	// Timestamp is when the record was signed, in Unix milliseconds.
+	Timestamp int64  `json:"ts"`
+	Signature string `json:"sig"`
+}
+
+// PeerKey is the key peer records for nick are stored under. Nicknames are
+// matched case-insensitively.
+func PeerKey(nick string) ID {
+	return hashID(KindPeer, strings.ToLower(nick))
+}
+
+// RendezvousKey is the key rendezvous records for name are stored under.
+func RendezvousKey(name string) ID {
+	return hashID(KindRendezvous, name)
+}
+
+func keyFor(kind, name string) (ID, bool) {
+	switch kind {
+	case KindPeer:
+		return PeerKey(name), true
+	case KindRendezvous:
+		return RendezvousKey(name), true
+	}
+	return ID{}, false
+}
+
+func (r Record) payload() []byte {
+	return []byte(strings.Join([]string{
+		recordDomain, r.Key.String(), r.Kind, r.Name, r.Addr, r.BoxKey, r.Value,
+		r.Publisher, strconv.FormatInt(r.Timestamp, 10),
+	}, "\n"))
+}
+
+// sign fills in the key, publisher, timestamp and signature of r.
+func (r *Record) sign(key ed25519.PrivateKey, now time.Time) error {
+	id, ok := keyFor(r.Kind, r.Name)
+	if !ok {
+		return fmt.Errorf("%w: unknown kind %q", ErrBadRecord, r.Kind)
+	}
+	r.Key = id
+	r.Publisher = crypto.EncodeSigningKey(key.Public().(ed25519.PublicKey))
+	r.Timestamp = now.UnixMilli()
+	r.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, r.payload()))
+	return r.verify(now)
+}
+
+// verify checks that r is well formed, signed by its publisher and alive at
+// now.
+func (r Record) verify(now time.Time) error {
+	if id, ok := keyFor(r.Kind, r.Name); !ok || id != r.Key {
+		return fmt.Errorf("%w: key does not match %s %q", ErrBadRecord, r.Kind, r.Name)
+	}
+	if r.Name == "" || len(r.Name) > maxNameLen || len(r.Value) > maxValueLen || r.Addr == "" {
+		return fmt.Errorf("%w: bad size", ErrBadRecord)
+	}
+	for _, field := range []string{r.Name, r.Addr, r.BoxKey, r.Value} {
+		if strings.ContainsAny(field, "\r\n") {
+			return fmt.Errorf("%w: newline in field", ErrBadRecord)
+		}
+	}
+	pub, err := crypto.ParseSigningKey(r.Publisher)
+	if err != nil {
+		return fmt.Errorf("%w: publisher: %v", ErrBadRecord, err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil || !ed25519.Verify(pub, r.payload(), sig) {
+		return ErrBadSignature
+	}
+	signed := time.UnixMilli(r.Timestamp)
+	if signed.After(now.Add(maxClockSkew)) || now.Sub(signed) > RecordTTL {
+		return ErrExpired
+	}
+	return nil
+}
+
+// Expires is when r stops being served.
+func (r Record) Expires() time.Time {
+	return time.UnixMilli(r.Timestamp).Add(RecordTTL)
+}
+
+// recordStore holds the records other nodes asked us to keep, one per key and
+// publisher.
+type recordStore struct {
+	mu    sync.Mutex
+	byKey map[ID]map[string]Record
+	count int
+}
+
+func newRecordStore() *recordStore {
+	return &recordStore{byKey: make(map[ID]map[string]Record)}
+}
+
+// put stores rec unless a newer record from the same publisher is already
+// there. When the key is full the record expiring first makes room.
+func (s *recordStore) put(rec Record, now time.Time) error {
+	if err := rec.verify(now); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := s.byKey[rec.Key]
+	if old, ok := records[rec.Publisher]; ok {
+		if old.Timestamp < rec.Timestamp {
+			records[rec.Publisher] = rec
+		}
+		return nil
+	}
+	if records == nil {
+		records = make(map[string]Record)
+		s.byKey[rec.Key] = records
+	}
+	if len(records) >= maxPerKey {
+		var oldest string
+		for pub, r := range records {
+			if oldest == "" || r.Timestamp < records[oldest].Timestamp {
+				oldest = pub
+			}
+		}
+		if records[oldest].Timestamp > rec.Timestamp {
+			return nil
+		}
+		delete(records, oldest)
+		s.count--
+	}
+	if s.count >= maxRecords {
+		return errStoreFull
+	}
+	records[rec.Publisher] = rec
+	s.count++
+	return nil
+}
+
+// get returns the live records under key, newest first.
+func (s *recordStore) get(key ID, now time.Time) []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Record
+	for _, rec := range s.byKey[key] {
+		if now.Before(rec.Expires()) {
+			out = append(out, rec)
+		}
+	}
+	sortNewestFirst(out)
+	return out
+}
+
+// expire drops the records past their TTL.
+func (s *recordStore) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, records := range s.byKey {
+		for pub, rec := range records {
+			if !now.Before(rec.Expires()) {
+				delete(records, pub)
+				s.count--
+			}
+		}
+		if len(records) == 0 {
+			delete(s.byKey, key)
+		}
+	}
+}
+
+func (s *recordStore) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+func sortNewestFirst(records []Record) {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Timestamp > records[j].Timestamp
+	})
+}
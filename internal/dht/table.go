@@ -0,0 +1,200 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Contact is how a node is reached. Key is its signing key, from which ID is
+// derived, so a node can prove it owns the ID it answers with.
+type Contact struct {
+	ID   ID     `json:"id"`
+	Addr string `json:"addr"`
+	Key  string `json:"key"`
+}
+
+type tableEntry struct {
+	Contact
+	seen     time.Time
+	failures int
+}
+
+// table is a Kademlia routing table: bucket i holds up to k contacts whose ID
+// shares exactly i leading bits with ours, least recently seen first.
+// Long-lived contacts are kept over newcomers; a newcomer only takes the
+// place of a contact that stopped answering.
+type table struct {
+	self ID
+	k    int
+
+	mu      sync.Mutex
+	buckets [IDBits][]tableEntry
+}
+
+func newTable(self ID, k int) *table {
+	return &table{self: self, k: k}
+}
+
+// seen records that c answered us. When its bucket is full, c is dropped
+// unless the oldest contact has failed since, and that contact is returned
+// if it has not been heard from in staleAfter so the caller can check on it.
+func (t *table) seen(c Contact, now time.Time, staleAfter time.Duration) (check Contact, ok bool) {
+	if c.ID == t.self {
+		return Contact{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i := commonPrefixLen(t.self, c.ID)
+	bucket := t.buckets[i]
+	for j, e := range bucket {
+		if e.ID == c.ID {
+			bucket = append(bucket[:j], bucket[j+1:]...)
+			t.buckets[i] = append(bucket, tableEntry{Contact: c, seen: now})
+			return Contact{}, false
+		}
+	}
+	if len(bucket) < t.k {
+		t.buckets[i] = append(bucket, tableEntry{Contact: c, seen: now})
+		return Contact{}, false
+	}
+	head := bucket[0]
+	if head.failures > 0 {
+		t.buckets[i] = append(bucket[1:], tableEntry{Contact: c, seen: now})
+		return Contact{}, false
+	}
+	return head.Contact, now.Sub(head.seen) > staleAfter
+}
+
+// failed records that id did not answer. Contacts are dropped after
+// maxFailures in a row.
+func (t *table) failed(id ID, maxFailures int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i := commonPrefixLen(t.self, id)
+	if i == IDBits {
+		return
+	}
+	bucket := t.buckets[i]
+	for j := range bucket {
+		if bucket[j].ID != id {
+			continue
+		}
+		bucket[j].failures++
+		if bucket[j].failures >= maxFailures {
+			t.buckets[i] = append(bucket[:j], bucket[j+1:]...)
+		}
+		return
+	}
+}
+
+// closest returns up to n contacts closest to target, nearest first.
+func (t *table) closest(target ID, n int) []Contact {
+	t.mu.Lock()
+	out := make([]Contact, 0, n)
+	for _, bucket := range t.buckets {
+		for _, e := range bucket {
+			out = append(out, e.Contact)
+		}
+	}
+	t.mu.Unlock()
+	sortByDistance(out, target)
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// wants reports whether c would be added if it answered: it is new and its
+// bucket has room or a contact that stopped answering.
+func (t *table) wants(c Contact) bool {
+	if c.ID == t.self {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bucket := t.buckets[commonPrefixLen(t.self, c.ID)]
+	for _, e := range bucket {
+		if e.ID == c.ID || e.Addr == c.Addr {
+			return false
+		}
+	}
+	return len(bucket) < t.k || bucket[0].failures > 0
+}
+
+func (t *table) hasAddr(addr string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, bucket := range t.buckets {
+		for _, e := range bucket {
+			if e.Addr == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t *table) size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, bucket := range t.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+// staleBuckets returns the indexes of non-empty buckets none of whose
+// contacts were seen since cutoff; a lookup into them refreshes them.
+func (t *table) staleBuckets(cutoff time.Time) []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []int
+	for i, bucket := range t.buckets {
+		if len(bucket) > 0 && bucket[len(bucket)-1].seen.Before(cutoff) {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// sparseBuckets returns the indexes of the buckets farther from us than our
+// closest contact that hold fewer than k contacts.
+func (t *table) sparseBuckets() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	depth := 0
+	for i, bucket := range t.buckets {
+		if len(bucket) > 0 {
+			depth = i
+		}
+	}
+	var out []int
+	for i := 0; i < depth; i++ {
+		if len(t.buckets[i]) < t.k {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// randomInBucket returns a random ID that falls into bucket i.
+func (t *table) randomInBucket(i int) ID {
+	id := randomID()
+	for b := 0; b <= i && b < IDBits; b++ {
+		mask := byte(0x80) >> (b % 8)
+		if b == i {
+			id[b/8] = id[b/8]&^mask | ^t.self[b/8]&mask
+		} else {
+			id[b/8] = id[b/8]&^mask | t.self[b/8]&mask
+		}
+	}
+	return id
+}
+
+func sortByDistance(contacts []Contact, target ID) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return closer(target, contacts[i].ID, contacts[j].ID)
+	})
+}
@@ -0,0 +1,118 @@
+package discovery
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxBeaconAge is how far a beacon timestamp may be from our clock.
+	maxBeaconAge = 30 * time.Second
+	// maxBeaconNick bounds the announced nickname in bytes, so its field
+	// fits in one mDNS TXT string.
+	maxBeaconNick = maxTXTString - len("nick=")
+)
+
+var (
+	errBadMAC    = errors.New("beacon not signed with the mesh secret")
+	errStale     = errors.New("beacon timestamp out of range")
+	errMalformed = errors.New("malformed beacon")
+)
+
+// Beacon is what a peer announces about itself on the LAN.
+type Beacon struct {
+	// ID is random per process; a peer recognises its own beacons by it,
+	// whatever address they carry.
+	ID      string
+	Addr    string
+	Nick    string
+	Version int
+	// Timestamp is when the beacon was sent, in Unix milliseconds.
+	Timestamp int64
+}
+
+// beaconKey derives the HMAC key for beacons from the mesh secret, so the
+// secret itself is never used for two purposes.
+func beaconKey(secret string) []byte {
+	sum := sha256.Sum256([]byte("p2p-chat/discovery\n" + secret))
+	return sum[:]
+}
+
+// fields renders b as the key=value strings both transports carry, in the
+// order they are authenticated.
+func (b Beacon) fields() []string {
+	return []string{
+		"id=" + b.ID,
+		"addr=" + b.Addr,
+		"nick=" + b.Nick,
+		"v=" + strconv.Itoa(b.Version),
+		"ts=" + strconv.FormatInt(b.Timestamp, 10),
+	}
+}
+
+func mac(key []byte, fields []string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// beaconNick makes nick safe to announce: one line, at most maxBeaconNick
+// bytes and cut on a character boundary.
+func beaconNick(nick string) string {
+	nick = strings.NewReplacer("\n", " ", "\r", " ").Replace(nick)
+	if len(nick) <= maxBeaconNick {
+		return nick
+	}
+	cut := maxBeaconNick
+	for cut > 0 && !utf8.RuneStart(nick[cut]) {
+		cut--
+	}
+	return nick[:cut]
+}
+
+// seal returns the fields of b followed by their MAC.
+func seal(key []byte, b Beacon) []string {
+	fields := b.fields()
+	return append(fields, "mac="+mac(key, fields))
+}
+
+// open checks the MAC and age of sealed fields and decodes the beacon.
+func open(key []byte, fields []string, now time.Time) (Beacon, error) {
+	if len(fields) != 6 || !strings.HasPrefix(fields[5], "mac=") {
+		return Beacon{}, errMalformed
+	}
+	want := mac(key, fields[:5])
+	if !hmac.Equal([]byte(want), []byte(strings.TrimPrefix(fields[5], "mac="))) {
+		return Beacon{}, errBadMAC
+	}
+	values := make([]string, 5)
+	for i, name := range []string{"id", "addr", "nick", "v", "ts"} {
+		value, ok := strings.CutPrefix(fields[i], name+"=")
+		if !ok {
+			return Beacon{}, errMalformed
+		}
+		values[i] = value
+	}
+	version, err := strconv.Atoi(values[3])
+	if err != nil {
+		return Beacon{}, fmt.Errorf("%w: version", errMalformed)
+	}
+	ts, err := strconv.ParseInt(values[4], 10, 64)
+	if err != nil {
+		return Beacon{}, fmt.Errorf("%w: timestamp", errMalformed)
+	}
+	if age := now.Sub(time.UnixMilli(ts)); age > maxBeaconAge || age < -maxBeaconAge {
+		return Beacon{}, errStale
+	}
+	if values[1] == "" {
+		return Beacon{}, fmt.Errorf("%w: empty address", errMalformed)
+	}
+	return Beacon{ID: values[0], Addr: values[1], Nick: values[2], Version: version, Timestamp: ts}, nil
+}
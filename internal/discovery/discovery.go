@@ -0,0 +1,231 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Modes accepted by --discover.
+const (
+	ModeMulticast = "multicast"
+	ModeMDNS      = "mdns"
+)
+
+const (
+	// DefaultInterval is how often a beacon is sent.
+	DefaultInterval = 10 * time.Second
+
+	multicastGroup = "239.255.77.77:47777"
+	mdnsGroup      = "224.0.0.251:5353"
+	multicastMagic = "P2PCHAT-BEACON/1\n"
+	maxPacket      = 9000
+)
+
+// Config describes a discovery service.
+type Config struct {
+	Mode string
+	// Secret is the mesh secret; beacons of other meshes fail to verify.
+	Secret string
+	// Addr is the address announced to others. An unspecified host, as in
+	// 0.0.0.0:9001, is replaced by the source address of the beacon on the
+	// receiving side.
+	Addr    string
+	Nick    func() string
+	Version int
+	// Interval between beacons; zero means DefaultInterval.
+	Interval time.Duration
+	// Found is called with the address of every peer heard from.
+	Found func(addr string)
+}
+
+// Service finds peers of the same mesh on the local network. It multicasts a
+// beacon with this peer's address, nickname and protocol version every
+// interval, authenticated with an HMAC keyed by the mesh secret, and reports
+// the addresses in valid beacons from other peers.
+type Service struct {
+	cfg   Config
+	id    string
+	key   []byte
+	group *net.UDPAddr
+	conn  *net.UDPConn
+
+	closeOnce sync.Once
+}
+
+// New joins the multicast group of cfg.Mode. It fails without a secret, so a
+// peer never auto-dials strangers.
+func New(cfg Config) (*Service, error) {
+	if cfg.Secret == "" {
+		return nil, errors.New("discovery needs the mesh secret (--secret)")
+	}
+	var groupAddr string
+	switch cfg.Mode {
+	case ModeMulticast:
+		groupAddr = multicastGroup
+	case ModeMDNS:
+		groupAddr = mdnsGroup
+	default:
+		return nil, fmt.Errorf("unknown discovery mode %q (want %s or %s)", cfg.Mode, ModeMulticast, ModeMDNS)
+	}
+	if cfg.Mode == ModeMDNS && len("addr="+cfg.Addr) > maxTXTString {
+		return nil, fmt.Errorf("address %q is too long to announce over mDNS", cfg.Addr)
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Nick == nil {
+		cfg.Nick = func() string { return "" }
+	}
+	group, err := net.ResolveUDPAddr("udp4", groupAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, fmt.Errorf("join %s: %w", groupAddr, err)
+	}
+	_ = conn.SetReadBuffer(1 << 20)
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &Service{cfg: cfg, id: hex.EncodeToString(id), key: beaconKey(cfg.Secret), group: group, conn: conn}, nil
+}
+
+// Run announces this peer and listens for others until ctx is done or the
+// service is closed.
+func (s *Service) Run(ctx context.Context) {
+	go s.listen()
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := s.announce(); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("discovery beacon: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Service) announce() error {
+	fields := seal(s.key, Beacon{
+		ID:        s.id,
+		Addr:      s.cfg.Addr,
+		Nick:      beaconNick(s.cfg.Nick()),
+		Version:   s.cfg.Version,
+		Timestamp: time.Now().UnixMilli(),
+	})
+	packet, err := s.encode(fields)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteToUDP(packet, s.group)
+	return err
+}
+
+func (s *Service) encode(fields []string) ([]byte, error) {
+	if s.cfg.Mode == ModeMDNS {
+		return encodeMDNS(mdnsInstance(s.cfg.Addr), fields)
+	}
+	return []byte(multicastMagic + strings.Join(fields, "\n")), nil
+}
+
+func (s *Service) decode(packet []byte) [][]string {
+	if s.cfg.Mode == ModeMDNS {
+		records, _ := decodeMDNS(packet)
+		return records
+	}
+	body, ok := bytes.CutPrefix(packet, []byte(multicastMagic))
+	if !ok {
+		return nil
+	}
+	return [][]string{strings.Split(string(body), "\n")}
+}
+
+func (s *Service) listen() {
+	buf := make([]byte, maxPacket)
+	for {
+		n, src, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("discovery: %v", err)
+			}
+			return
+		}
+		s.handle(buf[:n], src, time.Now())
+	}
+}
+
+// handle reports the peers announced in packet.
+func (s *Service) handle(packet []byte, src *net.UDPAddr, now time.Time) {
+	for _, fields := range s.decode(packet) {
+		beacon, err := open(s.key, fields, now)
+		if err != nil || beacon.ID == s.id {
+			// Other meshes share the group; their beacons are expected.
+			continue
+		}
+		addr, ok := dialable(beacon.Addr, src)
+		if !ok {
+			continue
+		}
+		if s.cfg.Found != nil {
+			s.cfg.Found(addr)
+		}
+	}
+}
+
+// dialable turns an announced address into one we can dial: an unspecified
+// host becomes the beacon's source, and loopback addresses are only usable
+// when the beacon came from this machine.
+func dialable(addr string, src *net.UDPAddr) (string, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", false
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case host == "" || (ip != nil && ip.IsUnspecified()):
+		if src == nil {
+			return "", false
+		}
+		return net.JoinHostPort(src.IP.String(), port), true
+	case ip != nil && ip.IsLoopback():
+		return addr, src == nil || src.IP.IsLoopback() || isLocal(src.IP)
+	}
+	return addr, true
+}
+
+// isLocal reports whether ip belongs to one of this machine's interfaces.
+func isLocal(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close leaves the multicast group.
+func (s *Service) Close() {
+	s.closeOnce.Do(func() {
+		_ = s.conn.Close()
+	})
+}
@@ -0,0 +1,110 @@
+package discovery
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestBeaconSealOpen(t *testing.T) {
+	key := beaconKey("s3cret")
+	now := time.Now()
+	b := Beacon{ID: "ab", Addr: "10.0.0.2:9001", Nick: "bob", Version: 2, Timestamp: now.UnixMilli()}
+	fields := seal(key, b)
+	if got, err := open(key, fields, now); err != nil || got != b {
+		t.Fatalf("open = %+v, %v", got, err)
+	}
+	if _, err := open(beaconKey("other mesh"), fields, now); !errors.Is(err, errBadMAC) {
+		t.Fatalf("expected a stranger's beacon to fail, got %v", err)
+	}
+	tampered := append([]string(nil), fields...)
+	tampered[1] = "addr=10.6.6.6:9001"
+	if _, err := open(key, tampered, now); !errors.Is(err, errBadMAC) {
+		t.Fatalf("expected a tampered beacon to fail, got %v", err)
+	}
+	if _, err := open(key, fields, now.Add(time.Minute)); !errors.Is(err, errStale) {
+		t.Fatalf("expected an old beacon to fail, got %v", err)
+	}
+
+	// A long nickname is cut before sealing, on a character boundary, so
+	// the mDNS beacon still verifies.
+	b.Nick = beaconNick(strings.Repeat("é", 200))
+	if len(b.Nick) > maxBeaconNick || !utf8.ValidString(b.Nick) {
+		t.Fatalf("unexpected nick of %d bytes", len(b.Nick))
+	}
+	packet, err := encodeMDNS(mdnsInstance(b.Addr), seal(key, b))
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	records, err := decodeMDNS(packet)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("decode = %v, %v", records, err)
+	}
+	if got, err := open(key, records[0], now); err != nil || got != b {
+		t.Fatalf("open long nick = %+v, %v", got, err)
+	}
+}
+
+func TestMDNSRoundTrip(t *testing.T) {
+	txt := []string{"id=ab", "addr=10.0.0.2:9001"}
+	packet, err := encodeMDNS(mdnsInstance("10.0.0.2:9001"), txt)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	records, err := decodeMDNS(packet)
+	if err != nil || len(records) != 1 || len(records[0]) != 2 || records[0][1] != txt[1] {
+		t.Fatalf("decode = %v, %v", records, err)
+	}
+	if _, err := encodeMDNS(mdnsInstance("10.0.0.2:9001"), []string{strings.Repeat("x", 256)}); !errors.Is(err, errTXTSize) {
+		t.Fatalf("expected an oversized TXT string to be refused, got %v", err)
+	}
+
+	// A second answer whose name points back into the first one, as mDNS
+	// responders compress names, and an unrelated record are both handled.
+	compressed := append([]byte(nil), packet...)
+	compressed[7] = 3
+	compressed = append(compressed, 0xC0, 12)
+	compressed = append(compressed, 0, mdnsTypeTXT, 0, mdnsClassIN, 0, 0, 0, 120, 0, 4, 3, 'x', '=', '1')
+	compressed = append(compressed, 0, 0, 1, 0, 1, 0, 0, 0, 120, 0, 4, 10, 0, 0, 1)
+	records, err = decodeMDNS(compressed)
+	if err != nil || len(records) != 2 || records[1][0] != "x=1" {
+		t.Fatalf("decode compressed = %v, %v", records, err)
+	}
+
+	if _, err := decodeMDNS(packet[:len(packet)-3]); err == nil {
+		t.Fatalf("expected a truncated packet to fail")
+	}
+}
+
+func TestServiceReportsMeshPeersOnly(t *testing.T) {
+	for _, mode := range []string{ModeMulticast, ModeMDNS} {
+		var found []string
+		s := &Service{
+			cfg: Config{Mode: mode, Addr: "0.0.0.0:9001", Found: func(addr string) { found = append(found, addr) }},
+			id:  "self",
+			key: beaconKey("s3cret"),
+		}
+		stranger := &Service{cfg: Config{Mode: mode}, key: beaconKey("other")}
+		now := time.Now()
+		src := &net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 47777}
+		beacon := func(svc *Service, id, addr string) []byte {
+			packet, err := svc.encode(seal(svc.key, Beacon{ID: id, Addr: addr, Version: 2, Timestamp: now.UnixMilli()}))
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			return packet
+		}
+
+		s.handle(beacon(s, "self", "0.0.0.0:9001"), src, now)
+		s.handle(beacon(stranger, "x", "192.168.1.30:9001"), src, now)
+		s.handle(beacon(s, "peer", "127.0.0.1:9002"), src, now)
+		s.handle(beacon(s, "peer", "0.0.0.0:9003"), src, now)
+		s.handle(beacon(s, "peer", "192.168.1.21:9004"), src, now)
+		if len(found) != 2 || found[0] != "192.168.1.20:9003" || found[1] != "192.168.1.21:9004" {
+			t.Fatalf("%s: unexpected discoveries %v", mode, found)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package discovery
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// In mdns mode beacons travel as unsolicited mDNS responses: one TXT record
+// for <instance>._p2p-chat._tcp.local whose strings are the sealed beacon
+// fields. Other mDNS traffic on the group is ignored.
+const (
+	mdnsService = "_p2p-chat._tcp.local"
+	mdnsTypeTXT = 16
+	mdnsClassIN = 1
+	// mdnsCacheFlush marks the record as the only one for its name.
+	mdnsCacheFlush = 0x8000
+	mdnsTTL        = 120
+	maxNameJumps   = 16
+	// maxTXTString is the longest string a TXT record can hold.
+	maxTXTString = 255
+)
+
+var (
+	errDNS     = errors.New("malformed mDNS packet")
+	errTXTSize = errors.New("TXT string longer than 255 bytes")
+)
+
+// mdnsInstance names the TXT record of the peer announcing addr.
+func mdnsInstance(addr string) string {
+	sum := sha256.Sum256([]byte(addr))
+	return "p2p-chat-" + hex.EncodeToString(sum[:4]) + "." + mdnsService
+}
+
+// encodeMDNS builds the response carrying txt. Strings are never cut short,
+// since a shortened beacon field would no longer match its MAC.
+func encodeMDNS(name string, txt []string) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400) // response, authoritative
+	binary.BigEndian.PutUint16(msg[6:], 1)      // one answer
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	var rr [10]byte
+	binary.BigEndian.PutUint16(rr[0:], mdnsTypeTXT)
+	binary.BigEndian.PutUint16(rr[2:], mdnsClassIN|mdnsCacheFlush)
+	binary.BigEndian.PutUint32(rr[4:], mdnsTTL)
+	var rdata []byte
+	for _, s := range txt {
+		if len(s) > maxTXTString {
+			return nil, errTXTSize
+		}
+		rdata = append(rdata, byte(len(s)))
+		rdata = append(rdata, s...)
+	}
+	binary.BigEndian.PutUint16(rr[8:], uint16(len(rdata)))
+	msg = append(msg, rr[:]...)
+	return append(msg, rdata...), nil
+}
+
+// decodeMDNS returns the TXT strings of every p2p-chat record in a response.
+func decodeMDNS(msg []byte) ([][]string, error) {
+	if len(msg) < 12 {
+		return nil, errDNS
+	}
+	if binary.BigEndian.Uint16(msg[2:])&0x8000 == 0 {
+		return nil, nil // a query
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	records := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for i := 0; i < questions; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return nil, errDNS
+		}
+		off = next + 4
+	}
+	var out [][]string
+	for i := 0; i < records; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return nil, errDNS
+		}
+		rrType := binary.BigEndian.Uint16(msg[next:])
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		start := next + 10
+		if start+length > len(msg) {
+			return nil, errDNS
+		}
+		off = start + length
+		if rrType != mdnsTypeTXT || !strings.HasSuffix(strings.ToLower(name), "."+mdnsService) {
+			continue
+		}
+		var txt []string
+		for p := start; p < off; {
+			n := int(msg[p])
+			if p+1+n > off {
+				return nil, errDNS
+			}
+			txt = append(txt, string(msg[p+1:p+1+n]))
+			p += 1 + n
+		}
+		out = append(out, txt)
+	}
+	return out, nil
+}
+
+// readName decodes the possibly compressed name at off and returns the offset
+// just past it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNS
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps >= maxNameJumps {
+				return "", 0, errDNS
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		case n&0xC0 != 0:
+			return "", 0, errDNS
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errDNS
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package message
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // Message describes the payload exchanged between peers.
 type Message struct {
@@ -9,13 +12,59 @@ type Message struct {
 	From        string       `json:"from"`
 	Origin      string       `json:"origin"`
 	AuthToken   string       `json:"auth_token,omitempty"`
+	PublicKey   string       `json:"public_key,omitempty"`
 	To          string       `json:"to,omitempty"`
 	ToAddr      string       `json:"to_addr,omitempty"`
+	Channel     string       `json:"channel,omitempty"`
 	Content     string       `json:"content"`
+	Sealed      bool         `json:"sealed,omitempty"`
 	Timestamp   time.Time    `json:"timestamp"`
 	AckFor      string       `json:"ack_for,omitempty"`
 	PeerList    []string     `json:"peer_list,omitempty"`
+	MsgIDs      []string     `json:"msg_ids,omitempty"`
 	Attachments []Attachment `json:"attachments,omitempty"`
+	SigningKey  string       `json:"signing_key,omitempty"`
+	Signature   string       `json:"signature,omitempty"`
+	Cursors     []SyncCursor `json:"cursors,omitempty"`
+	Batch       []Message    `json:"batch,omitempty"`
+	Target      string       `json:"target,omitempty"`
+	Edited      bool         `json:"edited,omitempty"`
+	Deleted     bool         `json:"deleted,omitempty"`
+	ReplyTo     string       `json:"reply_to,omitempty"`
+	ThreadRoot  string       `json:"thread_root,omitempty"`
+	Reactions   []Reaction   `json:"reactions,omitempty"`
+	Chunk       *FileChunk   `json:"chunk,omitempty"`
+}
+
+// SigningBytes returns the canonical encoding covered by Signature: the
+// message itself with the signature cleared and every time in UTC, including
+// those of cursors and batched messages, so the bytes survive a round trip
+// through either codec unchanged.
+func (m Message) SigningBytes() ([]byte, error) {
+	m.Signature = ""
+	return json.Marshal(m.inUTC())
+}
+
+// inUTC returns a copy of m with its times in UTC. The cursor and batch
+// slices are copied rather than changed in place.
+func (m Message) inUTC() Message {
+	m.Timestamp = m.Timestamp.UTC()
+	if len(m.Cursors) > 0 {
+		cursors := make([]SyncCursor, len(m.Cursors))
+		for i, c := range m.Cursors {
+			c.Since = c.Since.UTC()
+			cursors[i] = c
+		}
+		m.Cursors = cursors
+	}
+	if len(m.Batch) > 0 {
+		batch := make([]Message, len(m.Batch))
+		for i, b := range m.Batch {
+			batch[i] = b.inUTC()
+		}
+		m.Batch = batch
+	}
+	return m
 }
 
 // Attachment describes a downloadable payload shared alongside a message.
@@ -25,4 +74,42 @@ type Attachment struct {
 	Size int64  `json:"size"`
 	Mime string `json:"mime,omitempty"`
 	URL  string `json:"url,omitempty"`
+	// SHA256 is the hex digest of the whole file; peers need it to fetch the
+	// file over the mesh.
+	SHA256 string `json:"sha256,omitempty"`
+	// Width and Height give an image's pixel size and ThumbWidth and
+	// ThumbHeight its preview's, so receivers can lay out a preview before
+	// fetching anything.
+	Width       int `json:"width,omitempty"`
+	Height      int `json:"height,omitempty"`
+	ThumbWidth  int `json:"thumb_width,omitempty"`
+	ThumbHeight int `json:"thumb_height,omitempty"`
+}
+
+// SyncCursor marks the newest message a peer holds for a room so neighbours
+// can send whatever came after it.
+type SyncCursor struct {
+	Channel string    `json:"channel"`
+	Since   time.Time `json:"since"`
+	MsgID   string    `json:"msg_id,omitempty"`
+}
+
+// Reaction tallies one emoji on a message. Peers fill it in locally from the
+// reaction messages they have seen; whatever a sender put here is ignored.
+type Reaction struct {
+	Emoji string   `json:"emoji"`
+	Count int      `json:"count"`
+	By    []string `json:"by,omitempty"`
+}
+
+// FileChunk carries part of a file between peers. A file_req asks for Count
+// chunks starting at Index; a file_chunk answers with one chunk in Data and
+// its SHA-256 in SHA256. Total is the number of chunks in the file.
+type FileChunk struct {
+	FileID string `json:"file_id"`
+	Index  int    `json:"index"`
+	Count  int    `json:"count,omitempty"`
+	Total  int    `json:"total,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Data   []byte `json:"data,omitempty"`
 }
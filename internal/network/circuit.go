@@ -0,0 +1,510 @@
+package network
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A circuit lets a peer that cannot accept connections be reached through a
+// relay it dials out to. The peer keeps a control connection to the relay
+// open (a reservation); a dialer asks the relay for the peer by ID, the relay
+// tells the peer over the control connection, the peer dials back, and the
+// relay splices the two sockets. The usual hello and frames then flow over the
+// spliced pair as if it were a direct connection.
+//
+// The exchange is a few text lines sent before the hello:
+//
+//	P2PCHAT-RELAY/1 reserve <peer-id>   → challenge <nonce> ← prove <key> <sig> → ok
+//	P2PCHAT-RELAY/1 connect <peer-id>   → ok
+//	P2PCHAT-RELAY/1 accept <token>      → ok
+//
+// Failures are answered with "error <reason>" and the socket is closed.
+const (
+	circuitPrefix = "P2PCHAT-RELAY/1 "
+	// circuitSep joins a relay address and a peer ID into the address the
+	// peer advertises: 203.0.113.5:9001/p/<peer-id>.
+	circuitSep = "/p/"
+	// circuitReserveDomain is signed together with the relay's nonce so a
+	// reservation proof cannot be replayed as any other signature.
+	circuitReserveDomain = "p2pchat-relay-reserve "
+
+	defaultMaxReservations = 32
+	defaultMaxCircuits     = 64
+	// circuitAcceptTimeout bounds how long a dialer waits for the reserved
+	// peer to dial back.
+	circuitAcceptTimeout = 10 * time.Second
+	reserveRetry         = 5 * time.Second
+)
+
+// PeerID derives the ID a peer reserves on relays from its signing key.
+func PeerID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:10])
+}
+
+// CircuitAddr is the address of the peer id reached through relay.
+func CircuitAddr(relay, id string) string {
+	return relay + circuitSep + id
+}
+
+// ParseCircuitAddr splits a relayed address into the relay's host:port and the
+// peer ID. Relays cannot be chained, so the relay part must be a plain address.
+func ParseCircuitAddr(addr string) (relay, id string, ok bool) {
+	relay, id, ok = strings.Cut(addr, circuitSep)
+	if !ok || id == "" || strings.Contains(id, "/") {
+		return "", "", false
+	}
+	if _, _, err := net.SplitHostPort(relay); err != nil {
+		return "", "", false
+	}
+	return relay, id, true
+}
+
+// IsCircuitAddr reports whether addr looks like a relayed address, well
+// formed or not.
+func IsCircuitAddr(addr string) bool {
+	return strings.Contains(addr, circuitSep)
+}
+
+// relayService is the relay side: reservations by peer ID and dialers waiting
+// for the reserved peer to dial back.
+type relayService struct {
+	maxReservations int
+	maxCircuits     int
+
+	mu           sync.Mutex
+	reservations map[string]*reservation
+	pending      map[string]chan circuitEnd
+	circuits     int
+}
+
+type reservation struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+}
+
+// circuitEnd is one side of a circuit with anything already read from it.
+type circuitEnd struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRelayService(opts ConnOptions) *relayService {
+	rs := &relayService{
+		maxReservations: opts.MaxReservations,
+		maxCircuits:     opts.MaxCircuits,
+		reservations:    make(map[string]*reservation),
+		pending:         make(map[string]chan circuitEnd),
+	}
+	if rs.maxReservations <= 0 {
+		rs.maxReservations = defaultMaxReservations
+	}
+	if rs.maxCircuits <= 0 {
+		rs.maxCircuits = defaultMaxCircuits
+	}
+	return rs
+}
+
+// serve answers one relay request on conn.
+func (rs *relayService) serve(conn net.Conn, reader *bufio.Reader, timeout time.Duration) {
+	line, err := readCircuitLine(conn, reader, timeout)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	verb, arg, _ := strings.Cut(strings.TrimPrefix(line, circuitPrefix), " ")
+	switch verb {
+	case "reserve":
+		rs.reserve(conn, reader, arg, timeout)
+	case "connect":
+		rs.connect(conn, reader, arg)
+	case "accept":
+		rs.accept(conn, reader, arg)
+	default:
+		refuseCircuit(conn, "unknown request")
+	}
+}
+
+func (rs *relayService) reserve(conn net.Conn, reader *bufio.Reader, id string, timeout time.Duration) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		refuseCircuit(conn, "internal error")
+		return
+	}
+	challenge := hex.EncodeToString(nonce)
+	if _, err := io.WriteString(conn, "challenge "+challenge+"\n"); err != nil {
+		_ = conn.Close()
+		return
+	}
+	line, err := readCircuitLine(conn, reader, timeout)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	if err := verifyReservation(line, id, challenge); err != nil {
+		refuseCircuit(conn, err.Error())
+		return
+	}
+
+	res := &reservation{conn: conn}
+	rs.mu.Lock()
+	old, replacing := rs.reservations[id]
+	if !replacing && len(rs.reservations) >= rs.maxReservations {
+		rs.mu.Unlock()
+		refuseCircuit(conn, "reservation limit reached")
+		return
+	}
+	rs.reservations[id] = res
+	rs.mu.Unlock()
+	if replacing {
+		_ = old.conn.Close()
+	}
+	if _, err := io.WriteString(conn, "ok\n"); err != nil {
+		rs.release(id, res)
+		return
+	}
+	log.Printf("relay: reservation for %s from %s", id, conn.RemoteAddr())
+
+	// The peer never writes on its control connection; reading only notices
+	// when it goes away.
+	_, _ = io.Copy(io.Discard, reader)
+	rs.release(id, res)
+}
+
+func (rs *relayService) release(id string, res *reservation) {
+	_ = res.conn.Close()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.reservations[id] == res {
+		delete(rs.reservations, id)
+		log.Printf("relay: reservation for %s ended", id)
+	}
+}
+
+// close drops every reservation; open circuits end when their peers hang up.
+func (rs *relayService) close() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, res := range rs.reservations {
+		_ = res.conn.Close()
+	}
+}
+
+// verifyReservation checks that a prove line signs challenge with the key id
+// was derived from.
+func verifyReservation(line, id, challenge string) error {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "prove" {
+		return errors.New("expected proof")
+	}
+	pub, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("bad key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return errors.New("bad signature")
+	}
+	if PeerID(pub) != id {
+		return errors.New("key does not match peer id")
+	}
+	if !ed25519.Verify(pub, []byte(circuitReserveDomain+challenge), sig) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+func (rs *relayService) connect(conn net.Conn, reader *bufio.Reader, id string) {
+	token := make([]byte, 12)
+	if _, err := rand.Read(token); err != nil {
+		refuseCircuit(conn, "internal error")
+		return
+	}
+	key := hex.EncodeToString(token)
+	back := make(chan circuitEnd, 1)
+
+	rs.mu.Lock()
+	res, ok := rs.reservations[id]
+	switch {
+	case !ok:
+		rs.mu.Unlock()
+		refuseCircuit(conn, "no reservation for "+id)
+		return
+	case rs.circuits >= rs.maxCircuits:
+		rs.mu.Unlock()
+		refuseCircuit(conn, "circuit limit reached")
+		return
+	}
+	rs.circuits++
+	rs.pending[key] = back
+	rs.mu.Unlock()
+	defer func() {
+		rs.mu.Lock()
+		rs.circuits--
+		delete(rs.pending, key)
+		rs.mu.Unlock()
+	}()
+
+	res.writeMu.Lock()
+	_ = res.conn.SetWriteDeadline(time.Now().Add(circuitAcceptTimeout))
+	_, err := io.WriteString(res.conn, "incoming "+key+"\n")
+	_ = res.conn.SetWriteDeadline(time.Time{})
+	res.writeMu.Unlock()
+	if err != nil {
+		refuseCircuit(conn, "reserved peer unreachable")
+		return
+	}
+
+	timer := time.NewTimer(circuitAcceptTimeout)
+	defer timer.Stop()
+	var peer circuitEnd
+	select {
+	case peer = <-back:
+	case <-timer.C:
+		rs.mu.Lock()
+		delete(rs.pending, key)
+		rs.mu.Unlock()
+		select {
+		case late := <-back:
+			_ = late.conn.Close()
+		default:
+		}
+		refuseCircuit(conn, "reserved peer did not answer")
+		return
+	}
+	for _, end := range []net.Conn{conn, peer.conn} {
+		if _, err := io.WriteString(end, "ok\n"); err != nil {
+			_ = conn.Close()
+			_ = peer.conn.Close()
+			return
+		}
+	}
+	log.Printf("relay: circuit %s -> %s open", conn.RemoteAddr(), id)
+	splice(circuitEnd{conn: conn, reader: reader}, peer)
+	log.Printf("relay: circuit %s -> %s closed", conn.RemoteAddr(), id)
+}
+
+func (rs *relayService) accept(conn net.Conn, reader *bufio.Reader, key string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	back, ok := rs.pending[key]
+	if !ok {
+		refuseCircuit(conn, "unknown circuit")
+		return
+	}
+	delete(rs.pending, key)
+	// The connect side owns both sockets from here on. The channel has room
+	// for exactly this send, so it never blocks while holding the lock.
+	back <- circuitEnd{conn: conn, reader: reader}
+}
+
+// splice copies between a and b until either side closes.
+func splice(a, b circuitEnd) {
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(b.conn, a.reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(a.conn, b.reader)
+		done <- struct{}{}
+	}()
+	<-done
+	_ = a.conn.Close()
+	_ = b.conn.Close()
+	<-done
+}
+
+func refuseCircuit(conn net.Conn, reason string) {
+	_, _ = io.WriteString(conn, "error "+reason+"\n")
+	_ = conn.Close()
+}
+
+// readCircuitLine reads one line of the relay exchange within timeout.
+func readCircuitLine(conn net.Conn, reader *bufio.Reader, timeout time.Duration) (string, error) {
+	if timeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// expectCircuitOK reads the relay's answer to a request.
+func expectCircuitOK(conn net.Conn, reader *bufio.Reader, relay string, timeout time.Duration) error {
+	line, err := readCircuitLine(conn, reader, timeout)
+	if err != nil {
+		return fmt.Errorf("relay %s: %w", relay, err)
+	}
+	switch {
+	case line == "ok":
+		return nil
+	case strings.HasPrefix(line, "error "):
+		return fmt.Errorf("relay %s: %s", relay, strings.TrimPrefix(line, "error "))
+	default:
+		return fmt.Errorf("relay %s: not a relay", relay)
+	}
+}
+
+// dialCircuit opens a connection to the peer behind a relayed address.
+func (cm *ConnManager) dialCircuit(addr, relay, id string) (*peerConn, error) {
+	conn, err := net.DialTimeout("tcp", relay, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(conn, circuitPrefix+"connect "+id+"\n"); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	pc := newPeerConn(addr, conn)
+	if err := expectCircuitOK(conn, pc.reader, relay, circuitAcceptTimeout+cm.helloTimeout()); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return pc, nil
+}
+
+// Reserve makes this peer reachable through relay for as long as the manager
+// runs, re-reserving whenever the control connection drops. It returns the
+// address other peers should dial.
+func (cm *ConnManager) Reserve(relay string, key ed25519.PrivateKey) (string, error) {
+	if _, _, err := net.SplitHostPort(relay); err != nil {
+		return "", fmt.Errorf("relay address %q: %w", relay, err)
+	}
+	id := PeerID(key.Public().(ed25519.PublicKey))
+	addr := CircuitAddr(relay, id)
+	cm.connsMu.Lock()
+	cm.reserved[addr] = true
+	cm.connsMu.Unlock()
+	go cm.keepReservation(relay, id, key)
+	return addr, nil
+}
+
+func (cm *ConnManager) keepReservation(relay, id string, key ed25519.PrivateKey) {
+	for {
+		err := cm.reserveOnce(relay, id, key)
+		select {
+		case <-cm.quit:
+			return
+		default:
+		}
+		log.Printf("reservation on relay %s lost: %v", relay, err)
+		timer := time.NewTimer(reserveRetry)
+		select {
+		case <-cm.quit:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// reserveOnce holds one reservation until the control connection drops,
+// answering every incoming circuit by dialing back.
+func (cm *ConnManager) reserveOnce(relay, id string, key ed25519.PrivateKey) error {
+	conn, err := net.DialTimeout("tcp", relay, 3*time.Second)
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-cm.quit:
+		case <-stop:
+		}
+		_ = conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	if _, err := io.WriteString(conn, circuitPrefix+"reserve "+id+"\n"); err != nil {
+		return err
+	}
+	line, err := readCircuitLine(conn, reader, cm.helloTimeout())
+	if err != nil {
+		return err
+	}
+	challenge, ok := strings.CutPrefix(line, "challenge ")
+	if !ok {
+		return fmt.Errorf("relay %s: unexpected reply %q", relay, line)
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	sig := ed25519.Sign(key, []byte(circuitReserveDomain+challenge))
+	proof := fmt.Sprintf("prove %s %s\n", base64.StdEncoding.EncodeToString(pub), base64.StdEncoding.EncodeToString(sig))
+	if _, err := io.WriteString(conn, proof); err != nil {
+		return err
+	}
+	if err := expectCircuitOK(conn, reader, relay, cm.helloTimeout()); err != nil {
+		return err
+	}
+	log.Printf("reachable through relay %s as %s", relay, CircuitAddr(relay, id))
+	for {
+		line, err := readCircuitLine(conn, reader, 0)
+		if err != nil {
+			return err
+		}
+		if token, ok := strings.CutPrefix(line, "incoming "); ok {
+			go cm.acceptCircuit(relay, token)
+		}
+	}
+}
+
+// acceptCircuit dials the relay back to take up a circuit a dialer asked for.
+func (cm *ConnManager) acceptCircuit(relay, token string) {
+	conn, err := net.DialTimeout("tcp", relay, 3*time.Second)
+	if err != nil {
+		log.Printf("circuit via %s: %v", relay, err)
+		return
+	}
+	if _, err := io.WriteString(conn, circuitPrefix+"accept "+token+"\n"); err != nil {
+		_ = conn.Close()
+		return
+	}
+	pc := newPeerConn(relay+"/c/"+token, conn)
+	if err := expectCircuitOK(conn, pc.reader, relay, circuitAcceptTimeout); err != nil {
+		log.Printf("circuit via %s: %v", relay, err)
+		_ = conn.Close()
+		return
+	}
+	select {
+	case <-cm.quit:
+		_ = conn.Close()
+		return
+	default:
+	}
+	if cm.rpcHandler() != nil && isRPC(cm.peekRequest(pc)) {
+		cm.serveRPC(pc)
+		return
+	}
+	if err := cm.admit(pc); err != nil {
+		log.Printf("refusing circuit via %s: %v", relay, err)
+		_ = conn.Close()
+		return
+	}
+	cm.handleConn(pc)
+}
+
+// isSelf reports whether addr is one of the addresses this manager answers on.
+func (cm *ConnManager) isSelf(addr string) bool {
+	if addr == cm.addr {
+		return true
+	}
+	cm.connsMu.RLock()
+	defer cm.connsMu.RUnlock()
+	return cm.reserved[addr]
+}
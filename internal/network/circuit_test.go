@@ -0,0 +1,139 @@
+package network
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-chat/internal/message"
+)
+
+func newSigningKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key
+}
+
+func waitReservation(t *testing.T, relay *ConnManager, id string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		relay.relay.mu.Lock()
+		_, ok := relay.relay.reservations[id]
+		relay.relay.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("reservation for %s never arrived", id)
+}
+
+func TestParseCircuitAddr(t *testing.T) {
+	cases := []struct {
+		addr      string
+		relay, id string
+		ok        bool
+	}{
+		{"127.0.0.1:9001/p/abc123", "127.0.0.1:9001", "abc123", true},
+		{"[::1]:9001/p/abc123", "[::1]:9001", "abc123", true},
+		{"127.0.0.1:9001", "", "", false},
+		{"127.0.0.1:9001/p/", "", "", false},
+		{"relay/p/abc123", "", "", false},
+		{"127.0.0.1:9001/p/a/p/b", "", "", false},
+	}
+	for _, tc := range cases {
+		relay, id, ok := ParseCircuitAddr(tc.addr)
+		if relay != tc.relay || id != tc.id || ok != tc.ok {
+			t.Errorf("ParseCircuitAddr(%q) = %q, %q, %v", tc.addr, relay, id, ok)
+		}
+	}
+}
+
+func TestCircuitRelayConnectsReservedPeer(t *testing.T) {
+	relay := startManager(t, nil, ConnOptions{RelayService: true})
+	hidden := startManager(t, nil, ConnOptions{})
+	dialer := startManager(t, nil, ConnOptions{})
+	key := newSigningKey(t)
+
+	addr, err := hidden.Reserve(relay.Addr(), key)
+	if err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	id := PeerID(key.Public().(ed25519.PublicKey))
+	if addr != CircuitAddr(relay.Addr(), id) {
+		t.Fatalf("unexpected advertised address %s", addr)
+	}
+	waitReservation(t, relay, id)
+
+	if err := dialer.ConnectToPeer(addr); err != nil {
+		t.Fatalf("connect through relay: %v", err)
+	}
+	dialer.Broadcast(message.Message{MsgID: "via-relay", Content: "hi"}, "")
+	if msg := waitIncoming(t, hidden); msg.MsgID != "via-relay" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	hidden.Broadcast(message.Message{MsgID: "reply"}, "")
+	if msg := waitIncoming(t, dialer); msg.MsgID != "reply" {
+		t.Fatalf("unexpected reply %+v", msg)
+	}
+	if conns := dialer.ConnsList(); len(conns) != 1 || conns[0] != addr {
+		t.Fatalf("expected connection keyed by relayed address, got %v", conns)
+	}
+	if err := hidden.ConnectToPeer(addr); err != nil || len(hidden.ConnsList()) != 1 {
+		t.Fatalf("dialing our own relayed address should be a no-op: %v %v", err, hidden.ConnsList())
+	}
+}
+
+func TestCircuitRelayRefusals(t *testing.T) {
+	relay := startManager(t, nil, ConnOptions{RelayService: true})
+	plain := startManager(t, nil, ConnOptions{})
+	dialer := startManager(t, nil, ConnOptions{})
+
+	err := dialer.ConnectToPeer(CircuitAddr(relay.Addr(), "00112233"))
+	if err == nil || !strings.Contains(err.Error(), "no reservation") {
+		t.Fatalf("expected missing reservation error, got %v", err)
+	}
+	err = dialer.ConnectToPeer(CircuitAddr(plain.Addr(), "00112233"))
+	if err == nil || !strings.Contains(err.Error(), "not a relay") {
+		t.Fatalf("expected non-relay peer to be detected, got %v", err)
+	}
+	if err := dialer.ConnectToPeer("127.0.0.1:1/p/a/p/b"); err == nil {
+		t.Fatalf("expected malformed relayed address to be refused")
+	}
+
+	// A reservation must be signed by the key the peer ID was derived from.
+	victim := PeerID(newSigningKey(t).Public().(ed25519.PublicKey))
+	conn, err := net.Dial("tcp", relay.Addr())
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if _, err := io.WriteString(conn, circuitPrefix+"reserve "+victim+"\n"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	line, err := readCircuitLine(conn, reader, 3*time.Second)
+	challenge, ok := strings.CutPrefix(line, "challenge ")
+	if err != nil || !ok {
+		t.Fatalf("expected challenge, got %q (%v)", line, err)
+	}
+	forger := newSigningKey(t)
+	sig := ed25519.Sign(forger, []byte(circuitReserveDomain+challenge))
+	pub := base64.StdEncoding.EncodeToString(forger.Public().(ed25519.PublicKey))
+	if _, err := io.WriteString(conn, "prove "+pub+" "+base64.StdEncoding.EncodeToString(sig)+"\n"); err != nil {
+		t.Fatalf("write proof: %v", err)
+	}
+	if line, _ := readCircuitLine(conn, reader, 3*time.Second); !strings.HasPrefix(line, "error ") {
+		t.Fatalf("forged reservation accepted: %q", line)
+	}
+}
@@ -0,0 +1,452 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"p2p-chat/internal/message"
+)
+
+// Codec turns messages into frame payloads and back.
+type Codec interface {
+	Name() string
+	Marshal(message.Message) ([]byte, error)
+	Unmarshal([]byte, *message.Message) error
+}
+
+const (
+	CodecJSON   = "json"
+	CodecBinary = "bin"
+)
+
+// codecRank lists codecs from most to least preferred. Both ends pick the
+// first entry they have in common so negotiation is symmetric.
+var codecRank = []string{CodecBinary, CodecJSON}
+
+func codecByName(name string) Codec {
+	switch name {
+	case CodecBinary:
+		return binaryCodec{}
+	case CodecJSON:
+		return jsonCodec{}
+	}
+	return nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return CodecJSON }
+
+func (jsonCodec) Marshal(msg message.Message) ([]byte, error) { return json.Marshal(msg) }
+
+func (jsonCodec) Unmarshal(data []byte, msg *message.Message) error {
+	return json.Unmarshal(data, msg)
+}
+
+// binaryCodec is a compact tag-length-value encoding. Every field is written
+// as a uvarint key (field number << 3 | wire type) followed by either a
+// uvarint value or a length-prefixed byte string. Unknown fields are skipped
+// so newer peers can add fields without breaking older ones.
+type binaryCodec struct{}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// Field numbers for message.Message. Never reuse or renumber a tag.
+const (
+	tagMsgID       = 1
+	tagType        = 2
+	tagFrom        = 3
+	tagOrigin      = 4
+	tagAuthToken   = 5
+	tagPublicKey   = 6
+	tagTo          = 7
+	tagToAddr      = 8
+	tagChannel     = 9
+	tagContent     = 10
+	tagSealed      = 11
+	tagTimestamp   = 12
+	tagAckFor      = 13
+	tagPeerList    = 14
+	tagAttachments = 15
+	tagSigningKey  = 16
+	tagSignature   = 17
+	tagMsgIDs      = 18
+	tagCursors     = 19
+	tagBatch       = 20
+	tagTarget      = 21
+	tagEdited      = 22
+	tagDeleted     = 23
+	tagReplyTo     = 24
+	tagThreadRoot  = 25
+	tagReactions   = 26
+	tagChunk       = 27
+)
+
+// Field numbers for message.Attachment.
+const (
+	tagAttID   = 1
+	tagAttName = 2
+	tagAttSize = 3
+	tagAttMime = 4
+	tagAttURL  = 5
+	tagAttHash = 6
+	tagAttW    = 7
+	tagAttH    = 8
+	tagAttTW   = 9
+	tagAttTH   = 10
+)
+
+// Field numbers for message.SyncCursor.
+const (
+	tagCursorChannel = 1
+	tagCursorSince   = 2
+	tagCursorMsgID   = 3
+)
+
+// Field numbers for message.Reaction.
+const (
+	tagReactionEmoji = 1
+	tagReactionCount = 2
+	tagReactionBy    = 3
+)
+
+// Field numbers for message.FileChunk.
+const (
+	tagChunkFileID = 1
+	tagChunkIndex  = 2
+	tagChunkCount  = 3
+	tagChunkTotal  = 4
+	tagChunkHash   = 5
+	tagChunkData   = 6
+)
+
+var (
+	errTruncated   = errors.New("truncated binary frame")
+	errNestedBatch = errors.New("batch inside a batch")
+)
+
+func (binaryCodec) Name() string { return CodecBinary }
+
+func (c binaryCodec) Marshal(msg message.Message) ([]byte, error) {
+	var w tlvWriter
+	w.str(tagMsgID, msg.MsgID)
+	w.str(tagType, msg.Type)
+	w.str(tagFrom, msg.From)
+	w.str(tagOrigin, msg.Origin)
+	w.str(tagAuthToken, msg.AuthToken)
+	w.str(tagPublicKey, msg.PublicKey)
+	w.str(tagTo, msg.To)
+	w.str(tagToAddr, msg.ToAddr)
+	w.str(tagChannel, msg.Channel)
+	w.str(tagContent, msg.Content)
+	w.boolean(tagSealed, msg.Sealed)
+	w.time(tagTimestamp, msg.Timestamp)
+	w.str(tagAckFor, msg.AckFor)
+	for _, peer := range msg.PeerList {
+		w.bytes(tagPeerList, []byte(peer))
+	}
+	for _, att := range msg.Attachments {
+		var aw tlvWriter
+		aw.str(tagAttID, att.ID)
+		aw.str(tagAttName, att.Name)
+		aw.varint(tagAttSize, uint64(att.Size))
+		aw.str(tagAttMime, att.Mime)
+		aw.str(tagAttURL, att.URL)
+		aw.str(tagAttHash, att.SHA256)
+		aw.varint(tagAttW, uint64(att.Width))
+		aw.varint(tagAttH, uint64(att.Height))
+		aw.varint(tagAttTW, uint64(att.ThumbWidth))
+		aw.varint(tagAttTH, uint64(att.ThumbHeight))
+		w.bytes(tagAttachments, aw.buf)
+	}
+	w.str(tagSigningKey, msg.SigningKey)
+	w.str(tagSignature, msg.Signature)
+	for _, id := range msg.MsgIDs {
+		w.bytes(tagMsgIDs, []byte(id))
+	}
+	for _, cursor := range msg.Cursors {
+		var cw tlvWriter
+		cw.str(tagCursorChannel, cursor.Channel)
+		cw.time(tagCursorSince, cursor.Since)
+		cw.str(tagCursorMsgID, cursor.MsgID)
+		w.bytes(tagCursors, cw.buf)
+	}
+	for _, inner := range msg.Batch {
+		if len(inner.Batch) > 0 {
+			return nil, errNestedBatch
+		}
+		data, err := c.Marshal(inner)
+		if err != nil {
+			return nil, err
+		}
+		w.bytes(tagBatch, data)
+	}
+	w.str(tagTarget, msg.Target)
+	w.boolean(tagEdited, msg.Edited)
+	w.boolean(tagDeleted, msg.Deleted)
+	w.str(tagReplyTo, msg.ReplyTo)
+	w.str(tagThreadRoot, msg.ThreadRoot)
+	for _, reaction := range msg.Reactions {
+		var rw tlvWriter
+		rw.str(tagReactionEmoji, reaction.Emoji)
+		rw.varint(tagReactionCount, uint64(reaction.Count))
+		for _, by := range reaction.By {
+			rw.bytes(tagReactionBy, []byte(by))
+		}
+		w.bytes(tagReactions, rw.buf)
+	}
+	if chunk := msg.Chunk; chunk != nil {
+		var kw tlvWriter
+		kw.str(tagChunkFileID, chunk.FileID)
+		kw.varint(tagChunkIndex, uint64(chunk.Index))
+		kw.varint(tagChunkCount, uint64(chunk.Count))
+		kw.varint(tagChunkTotal, uint64(chunk.Total))
+		kw.str(tagChunkHash, chunk.SHA256)
+		if len(chunk.Data) > 0 {
+			kw.bytes(tagChunkData, chunk.Data)
+		}
+		w.bytes(tagChunk, kw.buf)
+	}
+	return w.buf, nil
+}
+
+func (c binaryCodec) Unmarshal(data []byte, msg *message.Message) error {
+	return c.unmarshal(data, msg, false)
+}
+
+// unmarshal decodes one message. Batches carry plain messages only, so a
+// batch found while decoding a batch entry fails the frame instead of
+// recursing further.
+func (c binaryCodec) unmarshal(data []byte, msg *message.Message, inBatch bool) error {
+	*msg = message.Message{}
+	return readTLV(data, func(tag int, num uint64, raw []byte) error {
+		switch tag {
+		case tagMsgID:
+			msg.MsgID = string(raw)
+		case tagType:
+			msg.Type = string(raw)
+		case tagFrom:
+			msg.From = string(raw)
+		case tagOrigin:
+			msg.Origin = string(raw)
+		case tagAuthToken:
+			msg.AuthToken = string(raw)
+		case tagPublicKey:
+			msg.PublicKey = string(raw)
+		case tagTo:
+			msg.To = string(raw)
+		case tagToAddr:
+			msg.ToAddr = string(raw)
+		case tagChannel:
+			msg.Channel = string(raw)
+		case tagContent:
+			msg.Content = string(raw)
+		case tagSealed:
+			msg.Sealed = num != 0
+		case tagTimestamp:
+			msg.Timestamp = time.Unix(0, int64(num))
+		case tagAckFor:
+			msg.AckFor = string(raw)
+		case tagPeerList:
+			msg.PeerList = append(msg.PeerList, string(raw))
+		case tagAttachments:
+			var att message.Attachment
+			err := readTLV(raw, func(tag int, num uint64, raw []byte) error {
+				switch tag {
+				case tagAttID:
+					att.ID = string(raw)
+				case tagAttName:
+					att.Name = string(raw)
+				case tagAttSize:
+					att.Size = int64(num)
+				case tagAttMime:
+					att.Mime = string(raw)
+				case tagAttURL:
+					att.URL = string(raw)
+				case tagAttHash:
+					att.SHA256 = string(raw)
+				case tagAttW:
+					att.Width = int(num)
+				case tagAttH:
+					att.Height = int(num)
+				case tagAttTW:
+					att.ThumbWidth = int(num)
+				case tagAttTH:
+					att.ThumbHeight = int(num)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			msg.Attachments = append(msg.Attachments, att)
+		case tagSigningKey:
+			msg.SigningKey = string(raw)
+		case tagSignature:
+			msg.Signature = string(raw)
+		case tagMsgIDs:
+			msg.MsgIDs = append(msg.MsgIDs, string(raw))
+		case tagCursors:
+			var cursor message.SyncCursor
+			err := readTLV(raw, func(tag int, num uint64, raw []byte) error {
+				switch tag {
+				case tagCursorChannel:
+					cursor.Channel = string(raw)
+				case tagCursorSince:
+					cursor.Since = time.Unix(0, int64(num))
+				case tagCursorMsgID:
+					cursor.MsgID = string(raw)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			msg.Cursors = append(msg.Cursors, cursor)
+		case tagBatch:
+			if inBatch {
+				return errNestedBatch
+			}
+			var inner message.Message
+			if err := c.unmarshal(raw, &inner, true); err != nil {
+				return err
+			}
+			msg.Batch = append(msg.Batch, inner)
+		case tagTarget:
+			msg.Target = string(raw)
+		case tagEdited:
+			msg.Edited = num != 0
+		case tagDeleted:
+			msg.Deleted = num != 0
+		case tagReplyTo:
+			msg.ReplyTo = string(raw)
+		case tagThreadRoot:
+			msg.ThreadRoot = string(raw)
+		case tagReactions:
+			var reaction message.Reaction
+			err := readTLV(raw, func(tag int, num uint64, raw []byte) error {
+				switch tag {
+				case tagReactionEmoji:
+					reaction.Emoji = string(raw)
+				case tagReactionCount:
+					reaction.Count = int(num)
+				case tagReactionBy:
+					reaction.By = append(reaction.By, string(raw))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			msg.Reactions = append(msg.Reactions, reaction)
+		case tagChunk:
+			chunk := &message.FileChunk{}
+			err := readTLV(raw, func(tag int, num uint64, raw []byte) error {
+				switch tag {
+				case tagChunkFileID:
+					chunk.FileID = string(raw)
+				case tagChunkIndex:
+					chunk.Index = int(num)
+				case tagChunkCount:
+					chunk.Count = int(num)
+				case tagChunkTotal:
+					chunk.Total = int(num)
+				case tagChunkHash:
+					chunk.SHA256 = string(raw)
+				case tagChunkData:
+					chunk.Data = append([]byte(nil), raw...)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			msg.Chunk = chunk
+		}
+		return nil
+	})
+}
+
+type tlvWriter struct {
+	buf []byte
+}
+
+func (w *tlvWriter) key(tag, wire int) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(tag)<<3|uint64(wire))
+}
+
+func (w *tlvWriter) varint(tag int, v uint64) {
+	if v == 0 {
+		return
+	}
+	w.key(tag, wireVarint)
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+func (w *tlvWriter) bytes(tag int, b []byte) {
+	w.key(tag, wireBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *tlvWriter) str(tag int, s string) {
+	if s == "" {
+		return
+	}
+	w.bytes(tag, []byte(s))
+}
+
+func (w *tlvWriter) boolean(tag int, v bool) {
+	if v {
+		w.varint(tag, 1)
+	}
+}
+
+func (w *tlvWriter) time(tag int, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	w.varint(tag, uint64(t.UnixNano()))
+}
+
+// readTLV walks data and calls fn with each field. Varint fields carry their
+// value in num, byte fields in raw.
+func readTLV(data []byte, fn func(tag int, num uint64, raw []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		tag := int(key >> 3)
+		switch key & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errTruncated
+			}
+			data = data[n:]
+			if err := fn(tag, v, nil); err != nil {
+				return err
+			}
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return errTruncated
+			}
+			raw := data[n : n+int(size)]
+			data = data[n+int(size):]
+			if err := fn(tag, 0, raw); err != nil {
+				return err
+			}
+		default:
+			return errors.New("unknown wire type in binary frame")
+		}
+	}
+	return nil
+}
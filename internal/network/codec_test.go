@@ -0,0 +1,221 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"p2p-chat/internal/message"
+)
+
+// fillValue sets every exported field reachable from v to a non-zero value so
+// that a field missing from a codec shows up as a round-trip mismatch.
+func fillValue(t *testing.T, v reflect.Value, seed *int) {
+	t.Helper()
+	fillNested(t, v, seed, 0)
+}
+
+// fillNested does the work for fillValue. Messages nested inside a message
+// (sync batches) are filled without a batch of their own, which the codecs
+// refuse.
+func fillNested(t *testing.T, v reflect.Value, seed *int, depth int) {
+	t.Helper()
+	*seed++
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(fmt.Sprintf("v%d", *seed))
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		v.SetInt(int64(*seed) * 1000)
+	case reflect.Uint, reflect.Uint64, reflect.Uint32:
+		v.SetUint(uint64(*seed) * 1000)
+	case reflect.Uint8:
+		v.SetUint(uint64(*seed % 256))
+	case reflect.Slice:
+		s := reflect.MakeSlice(v.Type(), 2, 2)
+		for i := 0; i < 2; i++ {
+			fillNested(t, s.Index(i), seed, depth)
+		}
+		v.Set(s)
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		for i := 0; i < 2; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			fillNested(t, key, seed, depth)
+			val := reflect.New(v.Type().Elem()).Elem()
+			fillNested(t, val, seed, depth)
+			m.SetMapIndex(key, val)
+		}
+		v.Set(m)
+	case reflect.Ptr:
+		p := reflect.New(v.Type().Elem())
+		fillNested(t, p.Elem(), seed, depth)
+		v.Set(p)
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			v.Set(reflect.ValueOf(time.Unix(1700000000, int64(*seed))))
+			return
+		}
+		nested := false
+		if v.Type() == reflect.TypeOf(message.Message{}) {
+			nested = depth > 0
+			depth++
+		}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.IsExported() && !(nested && field.Name == "Batch") {
+				fillNested(t, v.Field(i), seed, depth)
+			}
+		}
+	default:
+		t.Fatalf("fillValue: unsupported kind %s", v.Kind())
+	}
+}
+
+func canonical(t *testing.T, msg message.Message) string {
+	t.Helper()
+	msg.Timestamp = msg.Timestamp.UTC()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return string(data)
+}
+
+func TestCodecsRoundTripEveryField(t *testing.T) {
+	var msg message.Message
+	seed := 0
+	fillValue(t, reflect.ValueOf(&msg).Elem(), &seed)
+	for _, name := range codecRank {
+		codec := codecByName(name)
+		data, err := codec.Marshal(msg)
+		if err != nil {
+			t.Fatalf("%s marshal: %v", name, err)
+		}
+		var out message.Message
+		if err := codec.Unmarshal(data, &out); err != nil {
+			t.Fatalf("%s unmarshal: %v", name, err)
+		}
+		if got, want := canonical(t, out), canonical(t, msg); got != want {
+			t.Fatalf("%s codec lost fields:\n got %s\nwant %s", name, got, want)
+		}
+	}
+}
+
+func TestBinaryCodecSkipsUnknownFields(t *testing.T) {
+	data, err := binaryCodec{}.Marshal(message.Message{MsgID: "m1", Content: "hi"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var w tlvWriter
+	w.bytes(999, []byte("future"))
+	w.varint(998, 42)
+	data = append(w.buf, data...)
+	var out message.Message
+	if err := (binaryCodec{}).Unmarshal(data, &out); err != nil {
+		t.Fatalf("unknown fields should be skipped: %v", err)
+	}
+	if out.MsgID != "m1" || out.Content != "hi" {
+		t.Fatalf("unexpected decode %+v", out)
+	}
+}
+
+func TestBinaryCodecRejectsTruncatedFrame(t *testing.T) {
+	data := binary.AppendUvarint(nil, tagContent<<3|wireBytes)
+	data = binary.AppendUvarint(data, 10)
+	data = append(data, "short"...)
+	var out message.Message
+	if err := (binaryCodec{}).Unmarshal(data, &out); err == nil {
+		t.Fatalf("expected truncated frame error")
+	}
+}
+
+func TestBinaryCodecRejectsNestedBatch(t *testing.T) {
+	c := binaryCodec{}
+	if _, err := c.Marshal(message.Message{Batch: []message.Message{{Batch: []message.Message{{MsgID: "x"}}}}}); !errors.Is(err, errNestedBatch) {
+		t.Fatalf("expected marshal to refuse a nested batch, got %v", err)
+	}
+
+	leaf, _ := c.Marshal(message.Message{MsgID: "leaf"})
+	var mid tlvWriter
+	mid.str(tagMsgID, "mid")
+	mid.bytes(tagBatch, leaf)
+	var outer tlvWriter
+	outer.str(tagMsgID, "outer")
+	outer.bytes(tagBatch, mid.buf)
+	var out message.Message
+	if err := c.Unmarshal(outer.buf, &out); !errors.Is(err, errNestedBatch) {
+		t.Fatalf("expected a nested batch to be rejected, got %v", err)
+	}
+	if err := c.Unmarshal(mid.buf, &out); err != nil || len(out.Batch) != 1 || out.Batch[0].MsgID != "leaf" {
+		t.Fatalf("expected a flat batch to decode, got %+v, %v", out, err)
+	}
+}
+
+func TestBinaryRoundTripKeepsSyncSignatureAcrossZones(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	sent := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+	msg := message.Message{
+		MsgID:     "resp1",
+		Type:      "sync_resp",
+		Timestamp: sent,
+		Cursors:   []message.SyncCursor{{Channel: "general", Since: sent.Add(-time.Hour), MsgID: "m0"}},
+		Batch:     []message.Message{{MsgID: "m1", Type: "chat", Content: "hi", Timestamp: sent.Add(-time.Minute)}},
+	}
+	signed, err := msg.SigningBytes()
+	if err != nil {
+		t.Fatalf("signing bytes: %v", err)
+	}
+	sig := ed25519.Sign(key, signed)
+
+	data, err := binaryCodec{}.Marshal(msg)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var out message.Message
+	if err := (binaryCodec{}).Unmarshal(data, &out); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	// The receiver may sit in yet another zone.
+	est := time.FixedZone("EST", -5*3600)
+	out.Cursors[0].Since = out.Cursors[0].Since.In(est)
+	out.Batch[0].Timestamp = out.Batch[0].Timestamp.In(est)
+	received, err := out.SigningBytes()
+	if err != nil {
+		t.Fatalf("signing bytes: %v", err)
+	}
+	if !ed25519.Verify(pub, received, sig) {
+		t.Fatalf("signature broke across zones:\n sent %s\n got  %s", signed, received)
+	}
+	if msg.Cursors[0].Since.Location() != sent.Location() {
+		t.Fatalf("SigningBytes must not change the caller's cursors")
+	}
+}
+
+func TestNegotiatePicksCommonCodecAndSmallerFrame(t *testing.T) {
+	local := hello{Version: ProtocolVersion, Codecs: []string{CodecBinary, CodecJSON}, MaxFrame: 1 << 20}
+	remote, ok := parseHello([]byte("P2PCHAT/3 codecs=json max=65536\n"))
+	if !ok {
+		t.Fatalf("expected hello to parse")
+	}
+	mode, err := negotiate(local, remote)
+	if err != nil {
+		t.Fatalf("negotiate: %v", err)
+	}
+	if mode.Version != ProtocolVersion || mode.Codec.Name() != CodecJSON || mode.MaxFrame != 65536 {
+		t.Fatalf("unexpected mode %s", mode)
+	}
+	if _, ok := parseHello([]byte(`{"msg_id":"x"}`)); ok {
+		t.Fatalf("json line must not parse as hello")
+	}
+}
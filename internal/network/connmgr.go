@@ -3,13 +3,14 @@ package network
 import (
 	"bufio"
 	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"p2p-chat/internal/crypto"
@@ -21,23 +22,147 @@ type ConnManager struct {
 	addr     string
 	listener net.Listener
 	secure   *crypto.Box
+	opts     ConnOptions
 
-	connsMu sync.RWMutex
-	conns   map[string]net.Conn
+	connsMu  sync.RWMutex
+	conns    map[string]*peerConn
+	reserved map[string]bool
+	pruned   []PeerInfo
+	relay    *relayService
+	rpc      atomic.Pointer[RPCHandler]
+	rpcSlots chan struct{}
 
-	Incoming chan message.Message
+	acksMu sync.Mutex
+	acks   map[string]*ackWait
+
+	Incoming chan Inbound
 	quit     chan struct{}
 }
 
+// Inbound is a decoded message together with the key of the connection it
+// arrived on, so relays can avoid echoing it back to the sender.
+type Inbound struct {
+	From string
+	Msg  message.Message
+}
+
+// ConnOptions tunes the wire protocol. The zero value negotiates every
+// supported codec with the default frame limit and keeps talking to peers
+// that predate the hello exchange.
+type ConnOptions struct {
+	// MaxFrameSize caps a single framed payload in bytes.
+	MaxFrameSize int
+	// Codecs lists the codecs offered during negotiation.
+	Codecs []string
+	// HelloTimeout bounds how long to wait for the remote hello before
+	// assuming a legacy newline-JSON peer.
+	HelloTimeout time.Duration
+	// DisableLegacy drops peers that never send a hello instead of falling
+	// back to newline-delimited JSON.
+	DisableLegacy bool
+	// RelayService lets peers that cannot be dialed directly reserve a slot
+	// on this one and be reached through it.
+	RelayService bool
+	// MaxReservations and MaxCircuits bound the load a relay takes on. Zero
+	// picks a default.
+	MaxReservations int
+	MaxCircuits     int
+	// MaxPeers caps peer connections in total, MaxInbound and MaxOutbound
+	// per direction. When MaxPeers is set, unset direction quotas default to
+	// two thirds inbound and one third outbound. Zero means unlimited.
+	MaxPeers    int
+	MaxInbound  int
+	MaxOutbound int
+}
+
+const (
+	sendQueueSize = 256
+	// bulkQueueSize bounds the low-priority queue used for file chunks.
+	// Senders wait for room instead of dropping, which paces transfers to
+	// the speed of the link.
+	bulkQueueSize   = 16
+	bulkSendTimeout = 15 * time.Second
+)
+
+// peerConn pairs a socket with its outbound queues. Frames are written by a
+// single goroutine once the wire mode has been negotiated; the bulk queue is
+// only drained while the regular queue is empty.
+type peerConn struct {
+	key       string
+	conn      net.Conn
+	reader    *bufio.Reader
+	out       chan message.Message
+	bulk      chan message.Message
+	ready     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	mode      wireMode
+	outbound  bool
+	since     time.Time
+	stats     connStats
+}
+
+func newPeerConn(key string, conn net.Conn) *peerConn {
+	return &peerConn{
+		key:    key,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		out:    make(chan message.Message, sendQueueSize),
+		bulk:   make(chan message.Message, bulkQueueSize),
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+		since:  time.Now(),
+	}
+}
+
+func (pc *peerConn) setMode(mode wireMode) {
+	pc.mode = mode
+	close(pc.ready)
+}
+
+func (pc *peerConn) enqueue(msg message.Message) {
+	select {
+	case pc.out <- msg:
+	case <-pc.done:
+	default:
+		log.Printf("send queue full for %s, dropping msg %s", pc.key, msg.MsgID)
+	}
+}
+
+func (pc *peerConn) close() {
+	pc.closeOnce.Do(func() {
+		close(pc.done)
+		_ = pc.conn.Close()
+	})
+}
+
 // NewConnManager returns a configured manager for addr.
-func NewConnManager(addr string, box *crypto.Box) *ConnManager {
-	return &ConnManager{
+func NewConnManager(addr string, box *crypto.Box, opts ConnOptions) *ConnManager {
+	cm := &ConnManager{
 		addr:     addr,
 		secure:   box,
-		conns:    make(map[string]net.Conn),
-		Incoming: make(chan message.Message, 128),
+		opts:     opts,
+		conns:    make(map[string]*peerConn),
+		reserved: make(map[string]bool),
+		rpcSlots: make(chan struct{}, maxRPCsInFlight),
+		Incoming: make(chan Inbound, 128),
 		quit:     make(chan struct{}),
 	}
+	if opts.RelayService {
+		cm.relay = newRelayService(opts)
+	}
+	return cm
+}
+
+// CodecsFor returns the codec list to offer when preferred is the best codec
+// this peer is willing to speak.
+func CodecsFor(preferred string) ([]string, error) {
+	for i, name := range codecRank {
+		if name == preferred {
+			return append([]string(nil), codecRank[i:]...), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec %q (want one of %v)", preferred, codecRank)
 }
 
 // StartListen starts accepting inbound peers.
@@ -66,15 +191,38 @@ func (cm *ConnManager) acceptLoop() {
 			}
 			continue
 		}
-		remote := conn.RemoteAddr().String()
-		cm.addConn(remote, conn)
-		go cm.handleConn(conn, remote)
+		go cm.serveInbound(conn)
+	}
+}
+
+// serveInbound hands an accepted socket to the relay service or the RPC
+// handler if it opened with a request for them and treats it as a peer
+// otherwise.
+func (cm *ConnManager) serveInbound(conn net.Conn) {
+	pc := newPeerConn(conn.RemoteAddr().String(), conn)
+	if cm.relay != nil || cm.rpcHandler() != nil {
+		head := cm.peekRequest(pc)
+		switch {
+		case cm.relay != nil && strings.HasPrefix(head, circuitPrefix):
+			cm.relay.serve(conn, pc.reader, cm.helloTimeout())
+			return
+		case isRPC(head):
+			cm.serveRPC(pc)
+			return
+		}
 	}
+	if err := cm.admit(pc); err != nil {
+		log.Printf("refusing %s: %v", pc.key, err)
+		_ = conn.Close()
+		return
+	}
+	cm.handleConn(pc)
 }
 
-// ConnectToPeer dials an outbound connection if missing.
+// ConnectToPeer dials an outbound connection if missing. Relayed addresses
+// (relay-addr/p/peer-id) are dialed through their relay.
 func (cm *ConnManager) ConnectToPeer(peerAddr string) error {
-	if peerAddr == cm.addr {
+	if cm.isSelf(peerAddr) {
 		return nil
 	}
 	cm.connsMu.RLock()
@@ -83,86 +231,229 @@ func (cm *ConnManager) ConnectToPeer(peerAddr string) error {
 	if exists {
 		return nil
 	}
-	conn, err := net.DialTimeout("tcp", peerAddr, 3*time.Second)
-	if err != nil {
+	if err := cm.checkRoom(true); err != nil {
+		return err
+	}
+	var pc *peerConn
+	if relay, id, ok := ParseCircuitAddr(peerAddr); ok {
+		var err error
+		if pc, err = cm.dialCircuit(peerAddr, relay, id); err != nil {
+			return err
+		}
+	} else if IsCircuitAddr(peerAddr) {
+		return fmt.Errorf("malformed relayed address %q", peerAddr)
+	} else {
+		conn, err := net.DialTimeout("tcp", peerAddr, 3*time.Second)
+		if err != nil {
+			return err
+		}
+		pc = newPeerConn(peerAddr, conn)
+	}
+	pc.outbound = true
+	if err := cm.admit(pc); err != nil {
+		_ = pc.conn.Close()
 		return err
 	}
-	cm.addConn(peerAddr, conn)
-	go cm.handleConn(conn, peerAddr)
+	go cm.handleConn(pc)
 	return nil
 }
 
-func (cm *ConnManager) handleConn(conn net.Conn, key string) {
-	defer func() {
-		cm.removeConn(key)
-		_ = conn.Close()
-	}()
+func (cm *ConnManager) handleConn(pc *peerConn) {
+	defer cm.dropConn(pc)
+	go cm.writeLoop(pc)
 
-	reader := bufio.NewReader(conn)
+	first, err := cm.negotiateWire(pc, pc.reader)
+	if err != nil {
+		log.Printf("negotiation with %s failed: %v", pc.key, err)
+		return
+	}
+	if len(first) > 0 {
+		cm.deliver(pc, first)
+	}
 	for {
-		line, err := reader.ReadBytes('\n')
+		payload, err := readFrame(pc.reader, pc.mode)
 		if err != nil {
-			if !errors.Is(err, io.EOF) {
-				log.Printf("read error from %s: %v", key, err)
+			select {
+			case <-pc.done:
+			default:
+				if !errors.Is(err, io.EOF) {
+					log.Printf("read error from %s: %v", pc.key, err)
+				}
 			}
 			return
 		}
-		payload := bytes.TrimSpace(line)
 		if len(payload) == 0 {
 			continue
 		}
-		if cm.secure != nil {
-			payload, err = cm.secure.Decrypt(payload)
+		cm.deliver(pc, payload)
+	}
+}
+
+// negotiateWire reads the remote hello and settles the wire mode. Peers that
+// never send one are treated as legacy newline-JSON peers; if such a peer
+// spoke first, its opening frame is returned so it is not lost.
+func (cm *ConnManager) negotiateWire(pc *peerConn, reader *bufio.Reader) ([]byte, error) {
+	_ = pc.conn.SetReadDeadline(time.Now().Add(cm.helloTimeout()))
+	line, err := readLine(reader, cm.maxFrameSize())
+	_ = pc.conn.SetReadDeadline(time.Time{})
+	if err == nil {
+		if remote, ok := parseHello(line); ok {
+			mode, err := negotiate(cm.localHello(), remote)
 			if err != nil {
-				log.Printf("decrypt error from %s: %v", key, err)
-				continue
+				return nil, err
 			}
+			pc.setMode(mode)
+			log.Printf("peer %s speaks %s", pc.key, mode)
+			return nil, nil
 		}
-		var msg message.Message
-		if err := json.Unmarshal(payload, &msg); err != nil {
-			log.Printf("json decode error from %s: %v", key, err)
-			continue
+	}
+	if err != nil && !isTimeout(err) {
+		return nil, err
+	}
+	if cm.opts.DisableLegacy {
+		return nil, errors.New("peer did not send a protocol hello")
+	}
+	pc.setMode(legacyMode(cm.maxFrameSize()))
+	log.Printf("peer %s speaks %s", pc.key, pc.mode)
+	if err != nil && len(line) > 0 {
+		rest, err := readLine(reader, cm.maxFrameSize()-len(line))
+		if err != nil {
+			return nil, err
 		}
-		cm.Incoming <- msg
+		line = append(line, rest...)
 	}
+	return bytes.TrimSpace(line), nil
 }
 
-// Broadcast sends a message to all peers except the provided address.
-func (cm *ConnManager) Broadcast(msg message.Message, except string) {
-	data, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("marshal message error: %v", err)
+func (cm *ConnManager) writeLoop(pc *peerConn) {
+	if _, err := io.WriteString(pc.conn, cm.localHello().String()+"\n"); err != nil {
+		log.Printf("hello to %s failed: %v", pc.key, err)
+		cm.dropConn(pc)
 		return
 	}
-	if cm.secure != nil {
-		data, err = cm.secure.Encrypt(data)
+	select {
+	case <-pc.ready:
+	case <-pc.done:
+		return
+	}
+	for {
+		var msg message.Message
+		select {
+		case msg = <-pc.out:
+		case <-pc.done:
+			return
+		default:
+			select {
+			case msg = <-pc.out:
+			case msg = <-pc.bulk:
+			case <-pc.done:
+				return
+			}
+		}
+		frame, err := encodeFrame(pc.mode, cm.secure, msg)
 		if err != nil {
-			log.Printf("encrypt message error: %v", err)
+			log.Printf("encode msg %s for %s: %v", msg.MsgID, pc.key, err)
+			continue
+		}
+		if _, err := pc.conn.Write(frame); err != nil {
+			log.Printf("write error to %s: %v", pc.key, err)
+			cm.dropConn(pc)
 			return
 		}
 	}
-	data = append(data, '\n')
+}
+
+func (cm *ConnManager) deliver(pc *peerConn, payload []byte) {
+	msg, err := decodeFrame(pc.mode, cm.secure, payload)
+	if err != nil {
+		pc.noteFrameError(err)
+		log.Printf("%v from %s", err, pc.key)
+		return
+	}
+	cm.Incoming <- Inbound{From: pc.key, Msg: msg}
+}
+
+func (cm *ConnManager) localHello() hello {
+	codecs := cm.opts.Codecs
+	if len(codecs) == 0 {
+		codecs = codecRank
+	}
+	return hello{Version: ProtocolVersion, Codecs: codecs, MaxFrame: cm.maxFrameSize()}
+}
 
+func (cm *ConnManager) maxFrameSize() int {
+	switch size := cm.opts.MaxFrameSize; {
+	case size <= 0:
+		return DefaultMaxFrameSize
+	case size < minFrameSize:
+		return minFrameSize
+	default:
+		return size
+	}
+}
+
+func (cm *ConnManager) helloTimeout() time.Duration {
+	if cm.opts.HelloTimeout > 0 {
+		return cm.opts.HelloTimeout
+	}
+	return defaultHelloTimeout
+}
+
+// Broadcast sends a message to all peers except the provided address.
+func (cm *ConnManager) Broadcast(msg message.Message, except string) {
 	cm.connsMu.RLock()
 	defer cm.connsMu.RUnlock()
-	for addr, conn := range cm.conns {
+	for addr, pc := range cm.conns {
 		if addr == except {
 			continue
 		}
-		if _, err := conn.Write(data); err != nil {
-			log.Printf("write error to %s: %v", addr, err)
-			go cm.removeConn(addr)
-		}
+		pc.enqueue(msg)
 	}
 }
 
-func (cm *ConnManager) addConn(addr string, conn net.Conn) {
-	cm.connsMu.Lock()
-	defer cm.connsMu.Unlock()
-	if old, ok := cm.conns[addr]; ok {
-		_ = old.Close()
+// SendTo queues msg for a single connection.
+func (cm *ConnManager) SendTo(addr string, msg message.Message) error {
+	cm.connsMu.RLock()
+	pc, ok := cm.conns[addr]
+	cm.connsMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("not connected to %s", addr)
 	}
-	cm.conns[addr] = conn
+	pc.enqueue(msg)
+	return nil
+}
+
+// SendBulk queues msg for a single connection behind any regular traffic. It
+// blocks while the connection's bulk queue is full.
+func (cm *ConnManager) SendBulk(addr string, msg message.Message) error {
+	cm.connsMu.RLock()
+	pc, ok := cm.conns[addr]
+	cm.connsMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("not connected to %s", addr)
+	}
+	timer := time.NewTimer(bulkSendTimeout)
+	defer timer.Stop()
+	select {
+	case pc.bulk <- msg:
+		return nil
+	case <-pc.done:
+		return fmt.Errorf("connection to %s closed", addr)
+	case <-timer.C:
+		return fmt.Errorf("bulk queue to %s stalled", addr)
+	}
+}
+
+// Disconnect closes the connection keyed by addr and reports whether there
+// was one.
+func (cm *ConnManager) Disconnect(addr string) bool {
+	cm.connsMu.RLock()
+	pc, ok := cm.conns[addr]
+	cm.connsMu.RUnlock()
+	if ok {
+		cm.dropConn(pc)
+	}
+	return ok
 }
 
 // ConnsList returns current peer addresses.
@@ -176,12 +467,14 @@ func (cm *ConnManager) ConnsList() []string {
 	return list
 }
 
-func (cm *ConnManager) removeConn(addr string) {
+// dropConn closes pc and forgets it unless it has already been replaced by a
+// newer connection under the same key.
+func (cm *ConnManager) dropConn(pc *peerConn) {
+	pc.close()
 	cm.connsMu.Lock()
 	defer cm.connsMu.Unlock()
-	if conn, ok := cm.conns[addr]; ok {
-		_ = conn.Close()
-		delete(cm.conns, addr)
+	if cm.conns[pc.key] == pc {
+		delete(cm.conns, pc.key)
 	}
 }
 
@@ -192,11 +485,14 @@ func (cm *ConnManager) Stop() {
 		_ = cm.listener.Close()
 	}
 	cm.connsMu.Lock()
-	for addr, conn := range cm.conns {
-		_ = conn.Close()
+	for addr, pc := range cm.conns {
+		pc.close()
 		delete(cm.conns, addr)
 	}
 	cm.connsMu.Unlock()
+	if cm.relay != nil {
+		cm.relay.close()
+	}
 	close(cm.Incoming)
 }
 
@@ -210,6 +506,11 @@ func (cm *ConnManager) EncryptionEnabled() bool {
 	return cm.secure != nil
 }
 
+// RelayService reports whether peers may reserve a circuit through us.
+func (cm *ConnManager) RelayService() bool {
+	return cm.relay != nil
+}
+
 // DialAddr formats host:port helper.
 func DialAddr(host string, port int) string {
 	return fmt.Sprintf("%s:%d", host, port)
@@ -0,0 +1,240 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"p2p-chat/internal/crypto"
+	"p2p-chat/internal/message"
+)
+
+const (
+	// ProtocolVersion is the wire version announced in the hello line.
+	// Version 1 is the original newline-delimited JSON stream, which never
+	// sent a hello.
+	ProtocolVersion = 2
+	legacyVersion   = 1
+
+	helloPrefix = "P2PCHAT/"
+
+	DefaultMaxFrameSize = 1 << 20
+	minFrameSize        = 4 << 10
+	defaultHelloTimeout = 3 * time.Second
+)
+
+var (
+	errFrameTooLarge = errors.New("frame exceeds negotiated size")
+	errDecrypt       = errors.New("decrypt")
+	errDecode        = errors.New("decode")
+)
+
+// hello is the first line each side writes on a new connection:
+//
+//	P2PCHAT/2 codecs=bin,json max=1048576
+type hello struct {
+	Version  int
+	Codecs   []string
+	MaxFrame int
+}
+
+func (h hello) String() string {
+	return fmt.Sprintf("%s%d codecs=%s max=%d", helloPrefix, h.Version, strings.Join(h.Codecs, ","), h.MaxFrame)
+}
+
+func parseHello(line []byte) (hello, bool) {
+	text := strings.TrimSpace(string(line))
+	if !strings.HasPrefix(text, helloPrefix) {
+		return hello{}, false
+	}
+	fields := strings.Fields(strings.TrimPrefix(text, helloPrefix))
+	if len(fields) == 0 {
+		return hello{}, false
+	}
+	version, err := strconv.Atoi(fields[0])
+	if err != nil || version < 1 {
+		return hello{}, false
+	}
+	h := hello{Version: version}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "codecs":
+			h.Codecs = strings.Split(value, ",")
+		case "max":
+			if n, err := strconv.Atoi(value); err == nil {
+				h.MaxFrame = n
+			}
+		}
+	}
+	return h, true
+}
+
+// wireMode is the outcome of negotiation for one connection.
+type wireMode struct {
+	Version  int
+	Codec    Codec
+	MaxFrame int
+}
+
+func (m wireMode) legacy() bool { return m.Version < ProtocolVersion }
+
+func (m wireMode) String() string {
+	if m.legacy() {
+		return "legacy newline-json"
+	}
+	return fmt.Sprintf("v%d codec=%s max=%d", m.Version, m.Codec.Name(), m.MaxFrame)
+}
+
+// legacyMode is the newline-JSON stream. maxFrame bounds a line, which a
+// legacy peer never announces, so our own limit applies.
+func legacyMode(maxFrame int) wireMode {
+	return wireMode{Version: legacyVersion, Codec: jsonCodec{}, MaxFrame: maxFrame}
+}
+
+// negotiate picks the highest common version, the best codec both sides
+// support and the smaller of the two frame limits.
+func negotiate(local, remote hello) (wireMode, error) {
+	version := local.Version
+	if remote.Version < version {
+		version = remote.Version
+	}
+	if version < ProtocolVersion {
+		return legacyMode(local.MaxFrame), nil
+	}
+	var codec Codec
+	for _, name := range codecRank {
+		if contains(local.Codecs, name) && contains(remote.Codecs, name) {
+			codec = codecByName(name)
+			break
+		}
+	}
+	if codec == nil {
+		return wireMode{}, fmt.Errorf("no common codec (local %v, remote %v)", local.Codecs, remote.Codecs)
+	}
+	max := local.MaxFrame
+	if remote.MaxFrame > 0 && remote.MaxFrame < max {
+		max = remote.MaxFrame
+	}
+	return wireMode{Version: version, Codec: codec, MaxFrame: max}, nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeFrame renders msg for the wire in the given mode.
+func encodeFrame(mode wireMode, box *crypto.Box, msg message.Message) ([]byte, error) {
+	if mode.legacy() {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		if box != nil {
+			if data, err = box.Encrypt(data); err != nil {
+				return nil, err
+			}
+		}
+		if len(data) > mode.MaxFrame {
+			return nil, errFrameTooLarge
+		}
+		return append(data, '\n'), nil
+	}
+	payload, err := mode.Codec.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	if box != nil {
+		if payload, err = box.Seal(payload); err != nil {
+			return nil, err
+		}
+	}
+	if len(payload) > mode.MaxFrame {
+		return nil, errFrameTooLarge
+	}
+	frame := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	return append(frame, payload...), nil
+}
+
+// readFrame reads one payload from r. It returns a nil payload for blank
+// legacy lines.
+func readFrame(r *bufio.Reader, mode wireMode) ([]byte, error) {
+	if mode.legacy() {
+		line, err := readLine(r, mode.MaxFrame)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimSpace(line), nil
+	}
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if int64(size) > int64(mode.MaxFrame) {
+		return nil, errFrameTooLarge
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// readLine reads through the next newline like ReadBytes, but fails with
+// errFrameTooLarge once more than max bytes arrive without one.
+func readLine(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > max+1 {
+			return nil, errFrameTooLarge
+		}
+		line = append(line, chunk...)
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return line, err
+		}
+	}
+}
+
+// decodeFrame reverses encodeFrame.
+func decodeFrame(mode wireMode, box *crypto.Box, payload []byte) (message.Message, error) {
+	var msg message.Message
+	var err error
+	if box != nil {
+		if mode.legacy() {
+			payload, err = box.Decrypt(payload)
+		} else {
+			payload, err = box.Open(payload)
+		}
+		if err != nil {
+			return msg, fmt.Errorf("%w: %v", errDecrypt, err)
+		}
+	}
+	if err := mode.Codec.Unmarshal(payload, &msg); err != nil {
+		return msg, fmt.Errorf("%w: %v", errDecode, err)
+	}
+	return msg, nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,157 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"p2p-chat/internal/crypto"
+)
+
+// Besides peer connections, the listener answers one-shot requests used by
+// lookups that should not cost a peer slot. The caller sends one line and
+// reads one line back, then both sides hang up:
+//
+//	P2PCHAT-RPC/1 <base64 payload>
+//
+// The payload is sealed with the mesh secret when there is one. Relayed
+// addresses are called through their relay like any other dial.
+const (
+	rpcPrefix  = "P2PCHAT-RPC/1 "
+	rpcTimeout = 5 * time.Second
+	// maxRPCLine bounds a request or reply line, prefix and encoding included.
+	maxRPCLine = 96 << 10
+	// maxRPCsInFlight bounds the requests served at once; more are refused.
+	maxRPCsInFlight = 32
+)
+
+var (
+	errNoRPC      = errors.New("peer does not answer requests")
+	errRPCTooLong = errors.New("request too long")
+)
+
+// RPCHandler answers a request that arrived from the socket address from.
+type RPCHandler func(from string, req []byte) []byte
+
+// HandleRPC installs the handler for one-shot requests. Until it is called,
+// such requests are treated like any other inbound connection.
+func (cm *ConnManager) HandleRPC(h RPCHandler) {
+	cm.rpc.Store(&h)
+}
+
+func (cm *ConnManager) rpcHandler() RPCHandler {
+	if h := cm.rpc.Load(); h != nil {
+		return *h
+	}
+	return nil
+}
+
+// Call sends req to the peer listening on addr and returns its reply.
+func (cm *ConnManager) Call(addr string, req []byte) ([]byte, error) {
+	var conn net.Conn
+	var reader *bufio.Reader
+	if relay, id, ok := ParseCircuitAddr(addr); ok {
+		pc, err := cm.dialCircuit(addr, relay, id)
+		if err != nil {
+			return nil, err
+		}
+		conn, reader = pc.conn, pc.reader
+	} else if IsCircuitAddr(addr) {
+		return nil, fmt.Errorf("malformed relayed address %q", addr)
+	} else {
+		var err error
+		if conn, err = net.DialTimeout("tcp", addr, 3*time.Second); err != nil {
+			return nil, err
+		}
+		reader = bufio.NewReader(conn)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(rpcTimeout))
+	if err := writeRPC(conn, cm.secure, req); err != nil {
+		return nil, err
+	}
+	reply, err := readRPC(reader, cm.secure)
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", addr, errNoRPC)
+	}
+	return reply, err
+}
+
+// serveRPC answers the request pc opened with and closes it.
+func (cm *ConnManager) serveRPC(pc *peerConn) {
+	defer pc.conn.Close()
+	select {
+	case cm.rpcSlots <- struct{}{}:
+		defer func() { <-cm.rpcSlots }()
+	default:
+		return
+	}
+	handler := cm.rpcHandler()
+	if handler == nil {
+		return
+	}
+	_ = pc.conn.SetDeadline(time.Now().Add(rpcTimeout))
+	req, err := readRPC(pc.reader, cm.secure)
+	if err != nil {
+		log.Printf("request from %s: %v", pc.key, err)
+		return
+	}
+	_ = writeRPC(pc.conn, cm.secure, handler(pc.key, req))
+}
+
+// peekRequest returns the start of what an inbound connection sent first,
+// which tells relay requests and RPCs apart from a hello. Peers send their
+// hello straight away, so the wait only costs anything for silent legacy
+// peers.
+func (cm *ConnManager) peekRequest(pc *peerConn) string {
+	_ = pc.conn.SetReadDeadline(time.Now().Add(cm.helloTimeout()))
+	head, _ := pc.reader.Peek(len(circuitPrefix))
+	_ = pc.conn.SetReadDeadline(time.Time{})
+	return string(head)
+}
+
+func isRPC(head string) bool {
+	return strings.HasPrefix(head, rpcPrefix)
+}
+
+func writeRPC(w io.Writer, box *crypto.Box, payload []byte) error {
+	sealed, err := box.Seal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, rpcPrefix+base64.StdEncoding.EncodeToString(sealed)+"\n")
+	return err
+}
+
+func readRPC(reader *bufio.Reader, box *crypto.Box) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxRPCLine {
+			return nil, errRPCTooLong
+		}
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+	}
+	body, ok := bytes.CutPrefix(bytes.TrimRight(line, "\r\n"), []byte(rpcPrefix))
+	if !ok {
+		return nil, errNoRPC
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(body))
+	if err != nil {
+		return nil, err
+	}
+	return box.Open(sealed)
+}
@@ -0,0 +1,70 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-chat/internal/crypto"
+)
+
+func echoRPC(from string, req []byte) []byte {
+	return []byte("echo " + string(req))
+}
+
+func TestCallAnswersWithoutAdmittingPeer(t *testing.T) {
+	box, err := crypto.NewBox("s3cret")
+	if err != nil {
+		t.Fatalf("box: %v", err)
+	}
+	server := startManager(t, box, ConnOptions{MaxPeers: 1})
+	server.HandleRPC(echoRPC)
+	client := startManager(t, box, ConnOptions{})
+
+	big := strings.Repeat("x", 40<<10)
+	for _, req := range []string{"ping", big} {
+		reply, err := client.Call(server.Addr(), []byte(req))
+		if err != nil || string(reply) != "echo "+req {
+			t.Fatalf("call = %.20q, %v", reply, err)
+		}
+	}
+	if conns := server.ConnsList(); len(conns) != 0 {
+		t.Fatalf("an RPC should not become a peer connection, got %v", conns)
+	}
+
+	stranger := startManager(t, nil, ConnOptions{})
+	if _, err := stranger.Call(server.Addr(), []byte("ping")); err == nil {
+		t.Fatalf("expected a caller without the mesh secret to fail")
+	}
+	if _, err := client.Call(server.Addr(), []byte(strings.Repeat("x", maxRPCLine))); err == nil {
+		t.Fatalf("expected an oversized request to fail")
+	}
+}
+
+func TestCallWithoutHandler(t *testing.T) {
+	server := startManager(t, nil, ConnOptions{HelloTimeout: 100 * time.Millisecond, DisableLegacy: true})
+	client := startManager(t, nil, ConnOptions{})
+	if _, err := client.Call(server.Addr(), []byte("ping")); !errors.Is(err, errNoRPC) {
+		t.Fatalf("expected errNoRPC, got %v", err)
+	}
+}
+
+func TestCallThroughRelay(t *testing.T) {
+	relay := startManager(t, nil, ConnOptions{RelayService: true})
+	hidden := startManager(t, nil, ConnOptions{})
+	hidden.HandleRPC(echoRPC)
+	client := startManager(t, nil, ConnOptions{})
+	key := newSigningKey(t)
+
+	addr, err := hidden.Reserve(relay.Addr(), key)
+	if err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	waitReservation(t, relay, PeerID(key.Public().(ed25519.PublicKey)))
+	reply, err := client.Call(addr, []byte("hi"))
+	if err != nil || string(reply) != "echo hi" {
+		t.Fatalf("call through relay = %q, %v", reply, err)
+	}
+}
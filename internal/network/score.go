@@ -0,0 +1,392 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrPeerLimit is returned when a connection would exceed the peer limits and
+// no existing connection may be pruned to make room.
+var ErrPeerLimit = errors.New("peer limit reached")
+
+const (
+	// pruneGrace protects new connections from being pruned before they had
+	// a chance to earn a score.
+	pruneGrace = 30 * time.Second
+	// poorScore is the score below which a connection is dropped to make
+	// room for a newcomer.
+	poorScore = 40
+
+	uptimeFull    = 10 * time.Minute
+	latencyGood   = 100 * time.Millisecond
+	latencyBad    = 2 * time.Second
+	minAckSamples = 3
+	errorPenalty  = 10
+	ackWindow     = 10 * time.Second
+	// channelAckFresh is how long after its last ack in a room a neighbour
+	// is still expected to ack the room's messages.
+	channelAckFresh = 10 * time.Minute
+	maxAckWaits     = 1024
+	prunedKept      = 10
+	latencySmoothN  = 4
+)
+
+// connStats is what a connection is scored on.
+type connStats struct {
+	mu            sync.Mutex
+	acksExpected  int
+	acksSeen      int
+	latency       time.Duration
+	decodeErrors  int
+	decryptErrors int
+	// ackChannels holds when the neighbour last acked a message in each
+	// room. Only members ack, so only they owe us acks for a room.
+	ackChannels map[string]time.Time
+}
+
+// PeerInfo describes one peer connection and its score.
+type PeerInfo struct {
+	Addr          string
+	Inbound       bool
+	Since         time.Time
+	Score         int
+	Reasons       []string
+	Latency       time.Duration
+	AcksSeen      int
+	AcksExpected  int
+	DecodeErrors  int
+	DecryptErrors int
+	// PrunedAt is set for entries returned by Pruned.
+	PrunedAt time.Time
+}
+
+// ackWait records the connections a room message went out on, so the acks
+// coming back can be credited to them. A connection maps to true when it
+// was counted as owing the ack.
+type ackWait struct {
+	sent    time.Time
+	channel string
+	conns   map[*peerConn]bool
+}
+
+// info scores pc at now. Every connection starts from 20 and earns up to 20
+// for uptime, 30 for latency and 30 for its ack rate; latency and acks count
+// half until they have been measured. Each frame that failed to decrypt or
+// decode costs 10.
+func (pc *peerConn) info(now time.Time) PeerInfo {
+	pc.stats.mu.Lock()
+	st := PeerInfo{
+		Addr:          pc.key,
+		Inbound:       !pc.outbound,
+		Since:         pc.since,
+		Latency:       pc.stats.latency,
+		AcksSeen:      pc.stats.acksSeen,
+		AcksExpected:  pc.stats.acksExpected,
+		DecodeErrors:  pc.stats.decodeErrors,
+		DecryptErrors: pc.stats.decryptErrors,
+	}
+	pc.stats.mu.Unlock()
+
+	score := 20
+	up := now.Sub(st.Since)
+	if up >= uptimeFull {
+		score += 20
+	} else {
+		score += int(20 * up / uptimeFull)
+	}
+	if up < pruneGrace {
+		st.Reasons = append(st.Reasons, "new")
+	}
+
+	switch {
+	case st.Latency == 0:
+		score += 15
+	case st.Latency <= latencyGood:
+		score += 30
+	case st.Latency >= latencyBad:
+		st.Reasons = append(st.Reasons, fmt.Sprintf("slow (%s)", st.Latency.Round(time.Millisecond)))
+	default:
+		score += int(30 * (latencyBad - st.Latency) / (latencyBad - latencyGood))
+		if st.Latency > 4*latencyGood {
+			st.Reasons = append(st.Reasons, fmt.Sprintf("slow (%s)", st.Latency.Round(time.Millisecond)))
+		}
+	}
+
+	if st.AcksExpected < minAckSamples {
+		score += 15
+	} else {
+		seen := st.AcksSeen
+		if seen > st.AcksExpected {
+			seen = st.AcksExpected
+		}
+		score += 30 * seen / st.AcksExpected
+		if seen*5 < st.AcksExpected*4 {
+			st.Reasons = append(st.Reasons, fmt.Sprintf("acked %d/%d", seen, st.AcksExpected))
+		}
+	}
+
+	if n := st.DecodeErrors; n > 0 {
+		score -= errorPenalty * n
+		st.Reasons = append(st.Reasons, plural(n, "decode error"))
+	}
+	if n := st.DecryptErrors; n > 0 {
+		score -= errorPenalty * n
+		st.Reasons = append(st.Reasons, plural(n, "decrypt error"))
+	}
+	switch {
+	case score < 0:
+		score = 0
+	case score > 100:
+		score = 100
+	}
+	st.Score = score
+	return st
+}
+
+func plural(n int, what string) string {
+	if n == 1 {
+		return "1 " + what
+	}
+	return fmt.Sprintf("%d %ss", n, what)
+}
+
+// noteFrameError counts a frame from pc that could not be decrypted or
+// decoded.
+func (pc *peerConn) noteFrameError(err error) {
+	pc.stats.mu.Lock()
+	defer pc.stats.mu.Unlock()
+	switch {
+	case errors.Is(err, errDecrypt):
+		pc.stats.decryptErrors++
+	case errors.Is(err, errDecode):
+		pc.stats.decodeErrors++
+	}
+}
+
+// quotas returns the total, inbound and outbound limits; zero means
+// unlimited. Unset direction quotas split MaxPeers one third outbound, two
+// thirds inbound.
+func (cm *ConnManager) quotas() (total, in, out int) {
+	total = cm.opts.MaxPeers
+	in, out = cm.opts.MaxInbound, cm.opts.MaxOutbound
+	if total > 0 {
+		if out <= 0 {
+			out = total / 3
+			if out < 1 {
+				out = 1
+			}
+		}
+		if in <= 0 {
+			in = total - out
+			if in < 1 {
+				in = 1
+			}
+		}
+	}
+	return total, in, out
+}
+
+// victimLocked decides whether a new connection in the given direction fits.
+// It returns the connection to prune to make room, if one is needed, or
+// ErrPeerLimit. A newcomer displaces the lowest-scoring peer in its own
+// direction, and only one scoring below poorScore, so neither the dial
+// scheduler nor a stream of cheap inbound connections churns through good
+// peers. The caller holds connsMu.
+func (cm *ConnManager) victimLocked(outbound bool, now time.Time) (*peerConn, PeerInfo, error) {
+	total, in, out := cm.quotas()
+	count, all := 0, 0
+	for _, pc := range cm.conns {
+		all++
+		if pc.outbound == outbound {
+			count++
+		}
+	}
+	quota := in
+	if outbound {
+		quota = out
+	}
+	if (quota <= 0 || count < quota) && (total <= 0 || all < total) {
+		return nil, PeerInfo{}, nil
+	}
+	var victim *peerConn
+	var worst PeerInfo
+	for _, pc := range cm.conns {
+		if pc.outbound != outbound || now.Sub(pc.since) < pruneGrace {
+			continue
+		}
+		info := pc.info(now)
+		if victim == nil || info.Score < worst.Score {
+			victim, worst = pc, info
+		}
+	}
+	if victim == nil || worst.Score >= poorScore {
+		return nil, PeerInfo{}, ErrPeerLimit
+	}
+	return victim, worst, nil
+}
+
+// checkRoom reports whether a dial in the given direction could be admitted
+// right now, without pruning anything.
+func (cm *ConnManager) checkRoom(outbound bool) error {
+	cm.connsMu.RLock()
+	defer cm.connsMu.RUnlock()
+	_, _, err := cm.victimLocked(outbound, time.Now())
+	return err
+}
+
+// admit registers pc, pruning the lowest-scoring connection if the limits
+// are reached. It fails with ErrPeerLimit when nothing may be pruned.
+func (cm *ConnManager) admit(pc *peerConn) error {
+	now := time.Now()
+	cm.connsMu.Lock()
+	if cm.conns == nil {
+		cm.conns = make(map[string]*peerConn)
+	}
+	old, replacing := cm.conns[pc.key]
+	var victim *peerConn
+	var info PeerInfo
+	if !replacing {
+		var err error
+		if victim, info, err = cm.victimLocked(pc.outbound, now); err != nil {
+			cm.connsMu.Unlock()
+			return err
+		}
+		if victim != nil {
+			delete(cm.conns, victim.key)
+			info.PrunedAt = now
+			cm.pruned = append(cm.pruned, info)
+			if len(cm.pruned) > prunedKept {
+				cm.pruned = cm.pruned[len(cm.pruned)-prunedKept:]
+			}
+		}
+	}
+	cm.conns[pc.key] = pc
+	cm.connsMu.Unlock()
+	if replacing {
+		old.close()
+	}
+	if victim != nil {
+		log.Printf("pruning %s (score %d%s) for %s", victim.key, info.Score, reasonSuffix(info.Reasons), pc.key)
+		victim.close()
+	}
+	return nil
+}
+
+func reasonSuffix(reasons []string) string {
+	if len(reasons) == 0 {
+		return ""
+	}
+	return ": " + strings.Join(reasons, ", ")
+}
+
+// Peers returns every peer connection with its score, best first.
+func (cm *ConnManager) Peers() []PeerInfo {
+	now := time.Now()
+	cm.connsMu.RLock()
+	list := make([]PeerInfo, 0, len(cm.conns))
+	for _, pc := range cm.conns {
+		list = append(list, pc.info(now))
+	}
+	cm.connsMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Score != list[j].Score {
+			return list[i].Score > list[j].Score
+		}
+		return list[i].Addr < list[j].Addr
+	})
+	return list
+}
+
+// Pruned returns the most recently pruned connections, oldest first, with the
+// score and reasons they had when they were dropped.
+func (cm *ConnManager) Pruned() []PeerInfo {
+	cm.connsMu.RLock()
+	defer cm.connsMu.RUnlock()
+	return append([]PeerInfo(nil), cm.pruned...)
+}
+
+// ExpectAck notes that the message msgID for room channel was just sent to
+// every current connection. Neighbours that joined the room ack it, which
+// feeds the ack rate and latency of their connection; the others only
+// forward it, so a connection only owes acks for rooms it acked in recently.
+func (cm *ConnManager) ExpectAck(msgID, channel string) {
+	if msgID == "" {
+		return
+	}
+	now := time.Now()
+	cm.connsMu.RLock()
+	wait := &ackWait{sent: now, channel: channel, conns: make(map[*peerConn]bool, len(cm.conns))}
+	for _, pc := range cm.conns {
+		wait.conns[pc] = false
+	}
+	cm.connsMu.RUnlock()
+	if len(wait.conns) == 0 {
+		return
+	}
+	for pc := range wait.conns {
+		pc.stats.mu.Lock()
+		if last, ok := pc.stats.ackChannels[channel]; ok && now.Sub(last) < channelAckFresh {
+			pc.stats.acksExpected++
+			wait.conns[pc] = true
+		}
+		pc.stats.mu.Unlock()
+	}
+
+	cm.acksMu.Lock()
+	defer cm.acksMu.Unlock()
+	if cm.acks == nil {
+		cm.acks = make(map[string]*ackWait)
+	}
+	for id, w := range cm.acks {
+		if now.Sub(w.sent) > ackWindow {
+			delete(cm.acks, id)
+		}
+	}
+	if len(cm.acks) >= maxAckWaits {
+		return
+	}
+	cm.acks[msgID] = wait
+}
+
+// ObserveAck credits the connection from with an ack for msgID.
+func (cm *ConnManager) ObserveAck(from, msgID string) {
+	cm.connsMu.RLock()
+	pc, ok := cm.conns[from]
+	cm.connsMu.RUnlock()
+	if !ok {
+		return
+	}
+	cm.acksMu.Lock()
+	wait, ok := cm.acks[msgID]
+	owed := false
+	if ok {
+		owed, ok = wait.conns[pc]
+		delete(wait.conns, pc)
+	}
+	cm.acksMu.Unlock()
+	if !ok {
+		return
+	}
+	now := time.Now()
+	rtt := now.Sub(wait.sent)
+	pc.stats.mu.Lock()
+	defer pc.stats.mu.Unlock()
+	if pc.stats.ackChannels == nil {
+		pc.stats.ackChannels = make(map[string]time.Time)
+	}
+	pc.stats.ackChannels[wait.channel] = now
+	if !owed {
+		pc.stats.acksExpected++
+	}
+	pc.stats.acksSeen++
+	if pc.stats.latency == 0 {
+		pc.stats.latency = rtt
+	} else {
+		pc.stats.latency += (rtt - pc.stats.latency) / latencySmoothN
+	}
+}
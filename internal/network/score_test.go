@@ -0,0 +1,194 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitConns(t *testing.T, cm *ConnManager, want int) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(cm.ConnsList()) == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d connections, have %v", want, cm.ConnsList())
+}
+
+// age backdates every connection of cm past the prune grace period and gives
+// them errors, so they score poorly.
+func age(cm *ConnManager, frameErrors int) {
+	cm.connsMu.Lock()
+	defer cm.connsMu.Unlock()
+	for _, pc := range cm.conns {
+		pc.since = time.Now().Add(-2 * pruneGrace)
+		pc.stats.mu.Lock()
+		pc.stats.decryptErrors = frameErrors
+		pc.stats.mu.Unlock()
+	}
+}
+
+func TestPeerScoreReflectsQuality(t *testing.T) {
+	now := time.Now()
+	good := newPeerConn("good", nil)
+	good.since = now.Add(-uptimeFull)
+	good.stats.latency = 40 * time.Millisecond
+	good.stats.acksExpected, good.stats.acksSeen = 10, 10
+	if info := good.info(now); info.Score != 100 || len(info.Reasons) != 0 {
+		t.Fatalf("expected a perfect score, got %d %v", info.Score, info.Reasons)
+	}
+
+	bad := newPeerConn("bad", nil)
+	bad.since = now.Add(-uptimeFull)
+	bad.stats.latency = 3 * time.Second
+	bad.stats.acksExpected, bad.stats.acksSeen = 10, 2
+	bad.stats.decodeErrors = 1
+	info := bad.info(now)
+	if info.Score >= poorScore {
+		t.Fatalf("expected a poor score, got %d", info.Score)
+	}
+	reasons := strings.Join(info.Reasons, "; ")
+	for _, want := range []string{"slow (3s)", "acked 2/10", "1 decode error"} {
+		if !strings.Contains(reasons, want) {
+			t.Fatalf("expected reason %q in %q", want, reasons)
+		}
+	}
+}
+
+func TestConnManagerCreditsAcks(t *testing.T) {
+	a := startManager(t, nil, ConnOptions{})
+	b := startManager(t, nil, ConnOptions{})
+	if err := a.ConnectToPeer(b.Addr()); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		id := string(rune('a' + i))
+		a.ExpectAck(id, "#general")
+		if i < 2 {
+			a.ObserveAck(b.Addr(), id)
+			a.ObserveAck(b.Addr(), id)
+		}
+	}
+	peers := a.Peers()
+	if len(peers) != 1 || peers[0].AcksExpected != 4 || peers[0].AcksSeen != 2 || peers[0].Latency == 0 {
+		t.Fatalf("unexpected ack stats %+v", peers)
+	}
+}
+
+func TestUnjoinedNeighbourOwesNoAcks(t *testing.T) {
+	a := startManager(t, nil, ConnOptions{})
+	member := startManager(t, nil, ConnOptions{})
+	outsider := startManager(t, nil, ConnOptions{})
+	for _, peer := range []*ConnManager{member, outsider} {
+		if err := a.ConnectToPeer(peer.Addr()); err != nil {
+			t.Fatalf("connect: %v", err)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		id := string(rune('a' + i))
+		a.ExpectAck(id, "#ops")
+		a.ObserveAck(member.Addr(), id)
+	}
+	for _, p := range a.Peers() {
+		switch p.Addr {
+		case member.Addr():
+			if p.AcksExpected != 6 || p.AcksSeen != 6 {
+				t.Fatalf("unexpected member stats %+v", p)
+			}
+		case outsider.Addr():
+			if p.AcksExpected != 0 || strings.Contains(strings.Join(p.Reasons, ","), "acked") {
+				t.Fatalf("a neighbour outside the room should owe no acks, got %+v", p)
+			}
+		}
+	}
+
+	// A member that stops acking still loses points.
+	for i := 0; i < 4; i++ {
+		a.ExpectAck(string(rune('m'+i)), "#ops")
+	}
+	for _, p := range a.Peers() {
+		if p.Addr == member.Addr() && (p.AcksExpected != 10 || p.AcksSeen != 6) {
+			t.Fatalf("unexpected member stats %+v", p)
+		}
+	}
+}
+
+func TestConnManagerPrunesLowestInbound(t *testing.T) {
+	cm := startManager(t, nil, ConnOptions{MaxPeers: 4, MaxInbound: 1})
+	first, err := net.Dial("tcp", cm.Addr())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer first.Close()
+	waitConns(t, cm, 1)
+
+	// The first peer is still within its grace period, so a second one is
+	// turned away.
+	second, err := net.Dial("tcp", cm.Addr())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected the extra inbound peer to be refused")
+	}
+
+	// Past its grace period a healthy peer still keeps its slot.
+	age(cm, 0)
+	extra, err := net.Dial("tcp", cm.Addr())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer extra.Close()
+	_ = extra.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := extra.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected a newcomer not to displace a healthy inbound peer")
+	}
+	if pruned := cm.Pruned(); len(pruned) != 0 {
+		t.Fatalf("nothing should be pruned for a healthy peer, got %+v", pruned)
+	}
+
+	age(cm, 2)
+	third, err := net.Dial("tcp", cm.Addr())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer third.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for len(cm.Pruned()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conns := cm.ConnsList(); conns[0] != third.LocalAddr().String() {
+		t.Fatalf("expected the newcomer to replace the poor peer, have %v", conns)
+	}
+	pruned := cm.Pruned()
+	if len(pruned) != 1 || pruned[0].Addr != first.LocalAddr().String() || !strings.Contains(strings.Join(pruned[0].Reasons, ","), "2 decrypt errors") {
+		t.Fatalf("unexpected pruned list %+v", pruned)
+	}
+}
+
+func TestConnManagerOutboundQuota(t *testing.T) {
+	a := startManager(t, nil, ConnOptions{MaxOutbound: 1})
+	b := startManager(t, nil, ConnOptions{})
+	c := startManager(t, nil, ConnOptions{})
+	if err := a.ConnectToPeer(b.Addr()); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	age(a, 0)
+	if err := a.ConnectToPeer(c.Addr()); !errors.Is(err, ErrPeerLimit) {
+		t.Fatalf("expected the outbound quota to hold against a healthy peer, got %v", err)
+	}
+	age(a, 3)
+	if err := a.ConnectToPeer(c.Addr()); err != nil {
+		t.Fatalf("expected a poor outbound peer to make room: %v", err)
+	}
+	if conns := a.ConnsList(); len(conns) != 1 || conns[0] != c.Addr() {
+		t.Fatalf("unexpected connections %v", conns)
+	}
+}
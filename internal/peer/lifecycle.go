@@ -31,6 +31,7 @@ func (a *App) Start() {
 			go web.Run(rt.Context())
 		}
 
+		rt.SeedFromAddressBook()
 		if err := rt.RegisterSelf(); err != nil {
 			log.Printf("register failed: %v", err)
 		}
@@ -38,9 +39,17 @@ func (a *App) Start() {
 		rt.BroadcastHandshake()
 
 		go rt.Dialer().Run(rt.Context())
+		if a.discovery != nil {
+			go a.discovery.Run(rt.Context())
+		}
+		go rt.DHTLoop()
 		go rt.HandleIncoming()
 		go rt.PollBootstrapLoop()
 		go rt.GossipLoop()
+		go rt.RelayLoop()
+		go rt.OutboxLoop()
+		go rt.TransferLoop()
+		go rt.FileGCLoop()
 		go rt.UpdatePeerListLoop()
 		go rt.PresenceHeartbeatLoop()
 	})
@@ -52,16 +61,24 @@ func (a *App) Shutdown() {
 		return
 	}
 	a.shutdownOnce.Do(func() {
+		rt := a.runtime
+		if rt != nil {
+			if err := rt.DeregisterSelf(); err != nil {
+				log.Printf("deregister failed: %v", err)
+			}
+		}
 		if a.cancel != nil {
 			a.cancel()
 		}
-		rt := a.runtime
 		if rt == nil {
 			return
 		}
 		if web := rt.Web(); web != nil {
 			web.Close()
 		}
+		if a.discovery != nil {
+			a.discovery.Close()
+		}
 		if dialer := rt.Dialer(); dialer != nil {
 			dialer.Close()
 		}
@@ -77,6 +94,12 @@ func (a *App) Shutdown() {
 		if files := rt.Files(); files != nil {
 			files.Close()
 		}
+		if outbox := rt.Outbox(); outbox != nil {
+			outbox.Close()
+		}
+		if book := rt.AddressBook(); book != nil {
+			book.Close()
+		}
 	})
 }
 
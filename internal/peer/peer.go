@@ -13,7 +13,10 @@ import (
 	"time"
 
 	"p2p-chat/internal/crypto"
+	"p2p-chat/internal/dht"
+	"p2p-chat/internal/discovery"
 	"p2p-chat/internal/network"
+	"p2p-chat/internal/peerlist"
 	"p2p-chat/internal/protocol"
 	"p2p-chat/internal/storage"
 	"p2p-chat/internal/ui"
@@ -26,46 +29,86 @@ const (
 )
 
 var (
-	bootstrapFlag = flag.String("bootstrap", "http://127.0.0.1:8000", "bootstrap base url")
-	listenFlag    = flag.String("listen", "", "address to listen on (host:port)")
-	portFlag      = flag.Int("port", 9001, "port to listen on when --listen empty")
-	nickFlag      = flag.String("nick", "", "nickname displayed in chat")
-	usernameFlag  = flag.String("username", "", "authenticated username (overrides --nick)")
-	tokenFlag     = flag.String("token", "", "JWT token for authenticated username")
-	secretFlag    = flag.String("secret", "", "shared secret for AES-256 encryption")
-	pollFlag      = flag.Duration("poll", 5*time.Second, "interval to refresh peers list")
-	historyFlag   = flag.Int("history", 200, "amount of messages kept locally")
-	noColorFlag   = flag.Bool("no-color", false, "disable ANSI colors in CLI output")
-	enableTUIFlag = flag.Bool("tui", false, "enable terminal UI mode")
-	enableWebFlag = flag.Bool("web", false, "serve local web UI")
-	webAddrFlag   = flag.String("web-addr", "127.0.0.1:8081", "address for embedded web UI server")
-	historyDBFlag = flag.String("history-db", defaultHistoryDBPath, "path to persisted chat history db")
-	filesDirFlag  = flag.String("files-dir", defaultFilesDirPath, "directory to store uploaded files")
-	filesDBFlag   = flag.String("files-db", defaultFilesDBPath, "path to persisted file metadata db")
-	dataDirFlag   = flag.String("data-dir", "p2p-data", "base directory for auto-generated peer data (history/files)")
-	authAPIFlag   = flag.String("auth-api", "http://127.0.0.1:8089", "authentication server base url")
+	bootstrapFlag     = flag.String("bootstrap", "http://127.0.0.1:8000", "bootstrap base url; separate replicas with commas")
+	listenFlag        = flag.String("listen", "", "address to listen on (host:port)")
+	portFlag          = flag.Int("port", 9001, "port to listen on when --listen empty")
+	nickFlag          = flag.String("nick", "", "nickname displayed in chat")
+	usernameFlag      = flag.String("username", "", "authenticated username (overrides --nick)")
+	tokenFlag         = flag.String("token", "", "JWT token for authenticated username")
+	secretFlag        = flag.String("secret", "", "shared secret for AES-256 encryption")
+	pollFlag          = flag.Duration("poll", 5*time.Second, "interval to refresh peers list")
+	historyFlag       = flag.Int("history", 200, "amount of messages kept locally")
+	noColorFlag       = flag.Bool("no-color", false, "disable ANSI colors in CLI output")
+	enableTUIFlag     = flag.Bool("tui", false, "enable terminal UI mode")
+	enableWebFlag     = flag.Bool("web", false, "serve local web UI")
+	webAddrFlag       = flag.String("web-addr", "127.0.0.1:8081", "address for embedded web UI server")
+	historyDBFlag     = flag.String("history-db", defaultHistoryDBPath, "path to persisted chat history db")
+	filesDirFlag      = flag.String("files-dir", defaultFilesDirPath, "directory to store uploaded files")
+	filesDBFlag       = flag.String("files-db", defaultFilesDBPath, "path to persisted file metadata db")
+	dataDirFlag       = flag.String("data-dir", "p2p-data", "base directory for auto-generated peer data (history/files)")
+	authAPIFlag       = flag.String("auth-api", "http://127.0.0.1:8089", "authentication server base url")
+	requireSignedFlag = flag.Bool("require-signed", false, "drop unsigned messages even from peers without a pinned key")
+	maxFrameFlag      = flag.Int("max-frame", network.DefaultMaxFrameSize, "largest wire frame in bytes accepted from or sent to a peer")
+	wireCodecFlag     = flag.String("wire-codec", network.CodecBinary, "preferred wire codec (bin or json)")
+	legacyWireFlag    = flag.Bool("legacy-wire", true, "fall back to newline-delimited JSON for peers that do not negotiate")
+	relayModeFlag     = flag.String("relay-mode", protocol.RelayFlood, "how messages are relayed: flood or gossip")
+	holdOfflineFlag   = flag.Bool("hold-offline", false, "keep copies of relayed direct messages for offline recipients")
+	fanoutFlag        = flag.Int("fanout", 3, "peers that receive a full copy of each relayed message in gossip mode")
+	filesMaxAgeFlag   = flag.Duration("files-max-age", 0, "delete stored files older than this (0 keeps them)")
+	filesMaxMBFlag    = flag.Int64("files-max-mb", 0, "cap on disk used by stored files in MiB; oldest files are evicted (0 = no cap)")
+	filesQuotaMBFlag  = flag.Int64("files-quota-mb", 0, "per-uploader cap on stored files in MiB (0 = no quota)")
+	shareKeyTTLFlag   = flag.Duration("share-key-ttl", 0, "how long file share links stay valid (0 = until revoked)")
+	filesGCFlag       = flag.Duration("files-gc-interval", time.Hour, "how often file retention is enforced (0 disables)")
+	circuitRelayFlag  = flag.Bool("circuit-relay", false, "accept reservations from peers that cannot be dialed directly and relay connections to them")
+	maxPeersFlag      = flag.Int("max-peers", 48, "cap on peer connections; the lowest-scoring one is pruned when full (0 = no cap)")
+	maxInboundFlag    = flag.Int("max-inbound", 0, "cap on inbound peer connections (0 = two thirds of --max-peers)")
+	maxOutboundFlag   = flag.Int("max-outbound", 0, "cap on outbound peer connections (0 = one third of --max-peers)")
+	viaRelayFlag      = flag.String("via-relay", "", "reserve a slot on this relay (host:port) and advertise the relayed address")
+	discoverFlag      = flag.String("discover", "", "find peers of the same --secret on the LAN: multicast or mdns (empty disables)")
+	dhtFlag           = flag.Bool("dht", true, "find peers and nicknames through a Kademlia DHT run by the peers themselves")
+	namespaceFlag     = flag.String("namespace", "", "rendezvous namespace on the bootstrap server (default: derived from --secret, else \"default\")")
 )
 
 // Config captures runtime settings for a peer instance.
 type Config struct {
-	BootstrapURL string
-	ListenAddr   string
-	Port         int
-	Nick         string
-	Username     string
-	Token        string
-	Secret       string
-	PollEvery    time.Duration
-	HistorySize  int
-	NoColor      bool
-	EnableTUI    bool
-	EnableWeb    bool
-	WebAddr      string
-	HistoryDB    string
-	FilesDir     string
-	FilesDB      string
-	DataDir      string
-	AuthAPI      string
+	BootstrapURL  string
+	ListenAddr    string
+	Port          int
+	Nick          string
+	Username      string
+	Token         string
+	Secret        string
+	PollEvery     time.Duration
+	HistorySize   int
+	NoColor       bool
+	EnableTUI     bool
+	EnableWeb     bool
+	WebAddr       string
+	HistoryDB     string
+	FilesDir      string
+	FilesDB       string
+	DataDir       string
+	AuthAPI       string
+	RequireSigned bool
+	MaxFrame      int
+	WireCodec     string
+	LegacyWire    bool
+	RelayMode     string
+	Fanout        int
+	HoldOffline   bool
+	FilesMaxAge   time.Duration
+	FilesMaxMB    int64
+	FilesQuotaMB  int64
+	ShareKeyTTL   time.Duration
+	FilesGCEvery  time.Duration
+	CircuitRelay  bool
+	ViaRelay      string
+	MaxPeers      int
+	MaxInbound    int
+	MaxOutbound   int
+	Namespace     string
+	Discover      string
+	DHT           bool
 }
 
 var (
@@ -78,24 +121,44 @@ func LoadConfig() Config {
 	cfgOnce.Do(func() {
 		flag.Parse()
 		parsedConfig = Config{
-			BootstrapURL: *bootstrapFlag,
-			ListenAddr:   *listenFlag,
-			Port:         *portFlag,
-			Nick:         *nickFlag,
-			Username:     *usernameFlag,
-			Token:        *tokenFlag,
-			Secret:       *secretFlag,
-			PollEvery:    *pollFlag,
-			HistorySize:  *historyFlag,
-			NoColor:      *noColorFlag,
-			EnableTUI:    *enableTUIFlag,
-			EnableWeb:    *enableWebFlag,
-			WebAddr:      *webAddrFlag,
-			HistoryDB:    *historyDBFlag,
-			FilesDir:     *filesDirFlag,
-			FilesDB:      *filesDBFlag,
-			DataDir:      *dataDirFlag,
-			AuthAPI:      *authAPIFlag,
+			BootstrapURL:  *bootstrapFlag,
+			ListenAddr:    *listenFlag,
+			Port:          *portFlag,
+			Nick:          *nickFlag,
+			Username:      *usernameFlag,
+			Token:         *tokenFlag,
+			Secret:        *secretFlag,
+			PollEvery:     *pollFlag,
+			HistorySize:   *historyFlag,
+			NoColor:       *noColorFlag,
+			EnableTUI:     *enableTUIFlag,
+			EnableWeb:     *enableWebFlag,
+			WebAddr:       *webAddrFlag,
+			HistoryDB:     *historyDBFlag,
+			FilesDir:      *filesDirFlag,
+			FilesDB:       *filesDBFlag,
+			DataDir:       *dataDirFlag,
+			AuthAPI:       *authAPIFlag,
+			RequireSigned: *requireSignedFlag,
+			MaxFrame:      *maxFrameFlag,
+			WireCodec:     *wireCodecFlag,
+			LegacyWire:    *legacyWireFlag,
+			RelayMode:     *relayModeFlag,
+			Fanout:        *fanoutFlag,
+			HoldOffline:   *holdOfflineFlag,
+			FilesMaxAge:   *filesMaxAgeFlag,
+			FilesMaxMB:    *filesMaxMBFlag,
+			FilesQuotaMB:  *filesQuotaMBFlag,
+			ShareKeyTTL:   *shareKeyTTLFlag,
+			FilesGCEvery:  *filesGCFlag,
+			CircuitRelay:  *circuitRelayFlag,
+			ViaRelay:      *viaRelayFlag,
+			MaxPeers:      *maxPeersFlag,
+			MaxInbound:    *maxInboundFlag,
+			MaxOutbound:   *maxOutboundFlag,
+			Namespace:     *namespaceFlag,
+			Discover:      *discoverFlag,
+			DHT:           *dhtFlag,
 		}
 	})
 	return parsedConfig
@@ -108,6 +171,7 @@ type App struct {
 	enableCLI    bool
 	enableTUI    bool
 	tui          *ui.TUIDisplay
+	discovery    *discovery.Service
 	startOnce    sync.Once
 	shutdownOnce sync.Once
 }
@@ -156,6 +220,15 @@ func NewApp(cfg Config) (*App, error) {
 	if historySize <= 0 {
 		historySize = 200
 	}
+	namespace := cfg.Namespace
+	if namespace == "" && cfg.Secret != "" {
+		namespace = peerlist.SecretNamespace(cfg.Secret)
+	}
+	namespace, err := peerlist.NormalizeNamespace(namespace)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
 
 	box, err := crypto.NewBox(cfg.Secret)
 	if err != nil {
@@ -163,28 +236,95 @@ func NewApp(cfg Config) (*App, error) {
 		return nil, fmt.Errorf("init encryption: %w", err)
 	}
 
-	cm := network.NewConnManager(addr, box)
+	codec := cfg.WireCodec
+	if codec == "" {
+		codec = network.CodecBinary
+	}
+	codecs, err := network.CodecsFor(codec)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("wire codec: %w", err)
+	}
+
+	relayMode, err := protocol.ParseRelayMode(cfg.RelayMode)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	cm := network.NewConnManager(addr, box, network.ConnOptions{
+		MaxFrameSize:  cfg.MaxFrame,
+		Codecs:        codecs,
+		DisableLegacy: !cfg.LegacyWire,
+		RelayService:  cfg.CircuitRelay,
+		MaxPeers:      cfg.MaxPeers,
+		MaxInbound:    cfg.MaxInbound,
+		MaxOutbound:   cfg.MaxOutbound,
+	})
 	if err := cm.StartListen(); err != nil {
 		cancel()
 		return nil, fmt.Errorf("listen failed: %w", err)
 	}
-	log.Printf("peer listening on %s (encryption:%t)", addr, cm.EncryptionEnabled())
+	log.Printf("peer listening on %s (encryption:%t relay:%t)", addr, cm.EncryptionEnabled(), cfg.CircuitRelay)
 
 	store, err := storage.OpenHistoryStore(historyPath)
 	if err != nil {
 		log.Printf("history db unavailable (%v), running without persistence", err)
 	}
 
-	var files *storage.FileStore
-	if cfg.EnableWeb {
-		files, err = storage.OpenFileStore(filesDBPath, filesDir)
-		if err != nil {
+	outbox, err := storage.OpenOutbox(filepath.Join(peerDir, "outbox.db"))
+	if err != nil {
+		log.Printf("outbox unavailable (%v), undelivered messages will be dropped", err)
+	}
+
+	book, err := storage.OpenAddressBook(filepath.Join(peerDir, "peers.db"))
+	if err != nil {
+		log.Printf("address book unavailable (%v), known peers will not be saved", err)
+	}
+
+	files, err := storage.OpenFileStore(filesDBPath, filesDir)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("file store: %w", err)
+	}
+	files.SetRetention(storage.RetentionPolicy{
+		MaxAge:        cfg.FilesMaxAge,
+		MaxTotalBytes: cfg.FilesMaxMB << 20,
+		UserQuota:     cfg.FilesQuotaMB << 20,
+		ShareKeyTTL:   cfg.ShareKeyTTL,
+	})
+
+	signingKey, err := crypto.LoadOrCreateSigningKey(filepath.Join(peerDir, "identity.key"))
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("identity key: %w", err)
+	}
+	keyring, err := protocol.NewKeyRing(filepath.Join(peerDir, "known_keys.json"), cfg.RequireSigned)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("known keys: %w", err)
+	}
+
+	// Behind a relay, other peers reach us at relay-addr/p/<peer-id>; that is
+	// the address we announce everywhere instead of the listen address.
+	selfAddr := addr
+	if cfg.ViaRelay != "" {
+		if selfAddr, err = cm.Reserve(cfg.ViaRelay, signingKey); err != nil {
 			cancel()
-			return nil, fmt.Errorf("file store: %w", err)
+			return nil, fmt.Errorf("via relay: %w", err)
 		}
+		log.Printf("advertising %s", selfAddr)
 	}
 
-	identity := protocol.NewIdentity(cfg.Nick, addr)
+	dmKeys, err := crypto.LoadOrCreateKeyPair(filepath.Join(peerDir, "dm.key"))
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("dm keys: %w", err)
+	}
+
+	identity := protocol.NewIdentity(cfg.Nick, selfAddr)
+	identity.SetKeyPair(dmKeys)
+	identity.SetSigningKey(signingKey)
 	if cfg.Username != "" && cfg.Token != "" {
 		identity.SetAuth(cfg.Username, cfg.Token)
 	}
@@ -192,31 +332,71 @@ func NewApp(cfg Config) (*App, error) {
 	blocklist := protocol.NewBlockList()
 	directory := protocol.NewPeerDirectory()
 	metrics := protocol.NewMetrics()
-	dialer := protocol.NewDialScheduler(cm, addr)
+	dialer := protocol.NewDialScheduler(cm, selfAddr)
+	if cfg.ViaRelay != "" {
+		dialer.Add(cfg.ViaRelay)
+	}
 	ack := protocol.NewAckTracker(cm)
 
+	var disc *discovery.Service
+	if cfg.Discover != "" {
+		disc, err = discovery.New(discovery.Config{
+			Mode:    cfg.Discover,
+			Secret:  cfg.Secret,
+			Addr:    selfAddr,
+			Nick:    identity.Get,
+			Version: network.ProtocolVersion,
+			Found:   dialer.Add,
+		})
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("discovery: %w", err)
+		}
+		if host, _, _ := net.SplitHostPort(selfAddr); net.ParseIP(host).IsLoopback() {
+			log.Printf("discovery: %s is only reachable from this machine; listen on a LAN address for other hosts to dial it", selfAddr)
+		}
+	}
+
+	// DHT requests arrive on the peer listener as one-shot RPCs, so they reach
+	// us through a relay too and do not take up peer slots.
+	var node *dht.Node
+	if cfg.DHT {
+		node = dht.New(dht.Config{Addr: selfAddr, Key: signingKey, Call: cm.Call})
+		cm.HandleRPC(node.HandleRPC)
+	}
+
 	runtime := protocol.NewRuntime(ctx, protocol.RuntimeOptions{
-		ConnManager:  cm,
-		CacheTTL:     10 * time.Minute,
-		HistorySize:  historySize,
-		Store:        store,
-		Files:        files,
-		Blocklist:    blocklist,
-		Directory:    directory,
-		Metrics:      metrics,
-		Ack:          ack,
-		Dialer:       dialer,
-		Sink:         nil,
-		Identity:     identity,
-		SelfAddr:     addr,
-		Web:          nil,
-		BootstrapURL: cfg.BootstrapURL,
-		PollInterval: pollEvery,
-		AuthAPI:      cfg.AuthAPI,
+		ConnManager:   cm,
+		CacheTTL:      10 * time.Minute,
+		HistorySize:   historySize,
+		KeyRing:       keyring,
+		RelayMode:     relayMode,
+		Fanout:        cfg.Fanout,
+		Store:         store,
+		Files:         files,
+		Outbox:        outbox,
+		AddressBook:   book,
+		DHT:           node,
+		HoldOffline:   cfg.HoldOffline,
+		Blocklist:     blocklist,
+		Directory:     directory,
+		Metrics:       metrics,
+		Ack:           ack,
+		Dialer:        dialer,
+		Sink:          nil,
+		Identity:      identity,
+		SelfAddr:      selfAddr,
+		Web:           nil,
+		BootstrapURLs: splitList(cfg.BootstrapURL),
+		Namespace:     namespace,
+		PollInterval:  pollEvery,
+		AuthAPI:       cfg.AuthAPI,
+
+		FileGCInterval: cfg.FilesGCEvery,
 	})
 
 	if name := identity.Get(); name != "" {
-		directory.Record(name, addr)
+		directory.Record(name, selfAddr)
 	}
 
 	sinks := []ui.Sink{}
@@ -251,6 +431,9 @@ func NewApp(cfg Config) (*App, error) {
 			cancel()
 			return nil, fmt.Errorf("web ui: %w", err)
 		}
+		if store != nil {
+			webSink.SetHistoryIndex(store)
+		}
 		sinks = append(sinks, webSink)
 		runtime.SetWeb(webSink)
 	}
@@ -263,6 +446,7 @@ func NewApp(cfg Config) (*App, error) {
 		enableCLI: enableCLI,
 		enableTUI: cfg.EnableTUI,
 		tui:       tuiSink,
+		discovery: disc,
 	}, nil
 }
 
@@ -308,3 +492,14 @@ func sanitizePathToken(val string) string {
 	}
 	return out
 }
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(raw string) []string {
+	var out []string
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
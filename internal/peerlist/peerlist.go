@@ -1,54 +1,265 @@
 package peerlist
 
 import (
+	"errors"
+	"fmt"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
-// Store keeps track of live peers registering with the bootstrap server.
+// Record describes a registered peer as the peer signed it. The server only
+// adds FirstSeen and LastSeen.
+type Record struct {
+	Namespace    string   `json:"namespace"`
+	Addr         string   `json:"addr"`
+	Nick         string   `json:"nick,omitempty"`
+	PublicKey    string   `json:"public_key"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Version      int      `json:"version,omitempty"`
+	// Timestamp is when the peer signed the record, in Unix milliseconds.
+	Timestamp int64     `json:"ts"`
+	Signature string    `json:"sig"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Has reports whether the record announces capability c.
+func (r Record) Has(c string) bool {
+	for _, have := range r.Capabilities {
+		if have == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter selects records for Query. Zero fields match everything, except
+// that only one namespace is ever searched.
+type Filter struct {
+	Namespace string
+	// Nick matches nicknames containing it, ignoring case.
+	Nick string
+	// Capabilities must all be announced by a record.
+	Capabilities []string
+	MinVersion   int
+	// After skips records whose address sorts at or before it; it is the
+	// cursor returned by the previous page.
+	After string
+	// Limit caps the page size; zero means no limit.
+	Limit int
+}
+
+func (f Filter) match(r Record) bool {
+	if f.Nick != "" && !strings.Contains(strings.ToLower(r.Nick), strings.ToLower(f.Nick)) {
+		return false
+	}
+	if r.Version < f.MinVersion {
+		return false
+	}
+	for _, c := range f.Capabilities {
+		if !r.Has(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Store keeps track of live peers registering with the bootstrap server,
+// grouped by namespace. Peers in one namespace never see those of another.
 type Store struct {
-	mu       sync.Mutex
-	peers    map[string]time.Time
-	expireIn time.Duration
+	mu     sync.Mutex
+	spaces map[string]map[string]Record
+	// removed keeps recent signed deregistrations, so the registration they
+	// cancelled cannot be replayed and replicas learn about them.
+	removed         map[string]Record
+	expireIn        time.Duration
+	maxPerNamespace int
 }
 
-// NewStore creates a peer list store with a given expiry window.
-func NewStore(expireIn time.Duration) *Store {
+// NewStore creates a peer list store with a given expiry window. Each
+// namespace holds at most maxPerNamespace peers; zero means no limit.
+func NewStore(expireIn time.Duration, maxPerNamespace int) *Store {
 	return &Store{
-		peers:    make(map[string]time.Time),
-		expireIn: expireIn,
+		spaces:          make(map[string]map[string]Record),
+		removed:         make(map[string]Record),
+		expireIn:        expireIn,
+		maxPerNamespace: maxPerNamespace,
 	}
 }
 
-// Register upserts a peer address.
-func (s *Store) Register(addr string) {
+// ExpireIn is how long a registration lasts without a heartbeat.
+func (s *Store) ExpireIn() time.Duration {
+	return s.expireIn
+}
+
+// check verifies rec for op and that its timestamp is within MaxClockSkew of
+// now.
+func check(rec Record, op string, now time.Time) error {
+	if !namespacePattern.MatchString(rec.Namespace) {
+		return fmt.Errorf("invalid namespace %q", rec.Namespace)
+	}
+	if rec.Addr == "" {
+		return errors.New("missing addr")
+	}
+	if err := rec.Verify(op); err != nil {
+		return err
+	}
+	skew := now.Sub(time.UnixMilli(rec.Timestamp))
+	if skew > MaxClockSkew || skew < -MaxClockSkew {
+		return ErrStale
+	}
+	return nil
+}
+
+func removedKey(ns, addr string) string {
+	return ns + "\n" + addr
+}
+
+// Register verifies and upserts a signed peer record and returns it as
+// stored. Re-registering refreshes the record and keeps its FirstSeen. The
+// timestamp must be newer than any earlier request for the address, and an
+// address stays bound to the key that registered it until it expires or is
+// removed. A key registering a new address replaces its old one, provided
+// the new request is the newer of the two.
+func (s *Store) Register(rec Record) (Record, error) {
+	now := time.Now()
+	if err := check(rec, OpRegister, now); err != nil {
+		return Record{}, err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.peers[addr] = time.Now()
+	return s.registerLocked(rec, now)
 }
 
-// List returns all non-expired peers.
-func (s *Store) List() []string {
+// registerLocked stores a verified record last seen at seen. The caller holds
+// mu.
+func (s *Store) registerLocked(rec Record, seen time.Time) (Record, error) {
+	s.pruneExpired()
+	space := s.spaces[rec.Namespace]
+	old, exists := space[rec.Addr]
+	if exists && old.PublicKey != rec.PublicKey {
+		return Record{}, ErrAddrTaken
+	}
+	if (exists && rec.Timestamp <= old.Timestamp) || rec.Timestamp <= s.removed[removedKey(rec.Namespace, rec.Addr)].Timestamp {
+		return Record{}, ErrStale
+	}
+	if !exists {
+		for _, other := range space {
+			if other.PublicKey == rec.PublicKey && rec.Timestamp <= other.Timestamp {
+				return Record{}, ErrStale
+			}
+		}
+		for addr, other := range space {
+			if other.PublicKey == rec.PublicKey {
+				delete(space, addr)
+			}
+		}
+		if s.maxPerNamespace > 0 && len(space) >= s.maxPerNamespace {
+			return Record{}, ErrFull
+		}
+	}
+	if space == nil {
+		space = make(map[string]Record)
+		s.spaces[rec.Namespace] = space
+	}
+	rec.FirstSeen = seen
+	if exists {
+		rec.FirstSeen = old.FirstSeen
+	}
+	rec.LastSeen = seen
+	rec.Capabilities = append([]string(nil), rec.Capabilities...)
+	space[rec.Addr] = rec
+	return rec, nil
+}
+
+// Remove drops a registration on behalf of a deregistration signed by the
+// key that registered it.
+func (s *Store) Remove(rec Record) error {
+	if err := check(rec, OpDeregister, time.Now()); err != nil {
+		return err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.pruneExpired()
-	addrs := make([]string, 0, len(s.peers))
-	for addr := range s.peers {
-		addrs = append(addrs, addr)
+	return s.removeLocked(rec)
+}
+
+// removeLocked applies a verified deregistration. The caller holds mu.
+func (s *Store) removeLocked(rec Record) error {
+	space := s.spaces[rec.Namespace]
+	old, ok := space[rec.Addr]
+	switch {
+	case !ok:
+		return ErrNotFound
+	case old.PublicKey != rec.PublicKey:
+		return ErrAddrTaken
+	case rec.Timestamp < old.Timestamp:
+		// A deregistration may carry the same millisecond as the
+		// registration it cancels.
+		return ErrStale
+	}
+	delete(space, rec.Addr)
+	if len(space) == 0 {
+		delete(s.spaces, rec.Namespace)
+	}
+	s.removed[removedKey(rec.Namespace, rec.Addr)] = rec
+	return nil
+}
+
+// List returns all non-expired peer addresses in namespace.
+func (s *Store) List(namespace string) []string {
+	records, _ := s.Query(Filter{Namespace: namespace})
+	addrs := make([]string, len(records))
+	for i, rec := range records {
+		addrs[i] = rec.Addr
 	}
-	sort.Strings(addrs)
 	return addrs
 }
 
+// Query returns the non-expired records matching f, sorted by address, and
+// the cursor for the next page, which is empty on the last one.
+func (s *Store) Query(f Filter) ([]Record, string) {
+	s.mu.Lock()
+	s.pruneExpired()
+	space := s.spaces[f.Namespace]
+	records := make([]Record, 0, len(space))
+	for addr, rec := range space {
+		if f.After != "" && addr <= f.After {
+			continue
+		}
+		if f.match(rec) {
+			records = append(records, rec)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(records, func(i, j int) bool { return records[i].Addr < records[j].Addr })
+	if f.Limit > 0 && len(records) > f.Limit {
+		records = records[:f.Limit]
+		return records, records[len(records)-1].Addr
+	}
+	return records, ""
+}
+
 func (s *Store) pruneExpired() {
+	replayable := time.Now().Add(-MaxClockSkew).UnixMilli()
+	for key, rec := range s.removed {
+		if rec.Timestamp < replayable {
+			delete(s.removed, key)
+		}
+	}
 	if s.expireIn <= 0 {
 		return
 	}
 	deadline := time.Now().Add(-s.expireIn)
-	for addr, ts := range s.peers {
-		if ts.Before(deadline) {
-			delete(s.peers, addr)
+	for ns, space := range s.spaces {
+		for addr, rec := range space {
+			if rec.LastSeen.Before(deadline) {
+				delete(space, addr)
+			}
+		}
+		if len(space) == 0 {
+			delete(s.spaces, ns)
 		}
 	}
 }
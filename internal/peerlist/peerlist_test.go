@@ -0,0 +1,200 @@
+package peerlist
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"p2p-chat/internal/crypto"
+	"p2p-chat/internal/network"
+)
+
+func newKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key
+}
+
+// signAt signs rec for op as if at the given time, so tests control the
+// order of timestamps.
+func signAt(rec Record, op string, key ed25519.PrivateKey, at time.Time) Record {
+	if rec.Namespace == "" {
+		rec.Namespace = DefaultNamespace
+	}
+	rec.PublicKey = crypto.EncodeSigningKey(key.Public().(ed25519.PublicKey))
+	rec.Timestamp = at.UnixMilli()
+	rec.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, rec.payload(op)))
+	return rec
+}
+
+func mustRegister(t *testing.T, s *Store, rec Record) Record {
+	t.Helper()
+	stored, err := s.Register(rec)
+	if err != nil {
+		t.Fatalf("register %s: %v", rec.Addr, err)
+	}
+	return stored
+}
+
+func TestStoreRegisterKeepsFirstSeen(t *testing.T) {
+	s := NewStore(time.Minute, 0)
+	key := newKey(t)
+	now := time.Now()
+	first := mustRegister(t, s, signAt(Record{Addr: "a:1", Nick: "alice"}, OpRegister, key, now.Add(-time.Second)))
+	again := mustRegister(t, s, signAt(Record{Addr: "a:1", Nick: "alicia", Version: 2}, OpRegister, key, now))
+	if !again.FirstSeen.Equal(first.FirstSeen) || again.Nick != "alicia" {
+		t.Fatalf("unexpected record after heartbeat %+v", again)
+	}
+	leave := signAt(Record{Addr: "a:1"}, OpDeregister, key, now)
+	if err := s.Remove(leave); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := s.Remove(leave); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected a second removal to fail, got %v", err)
+	}
+	if list := s.List(DefaultNamespace); len(list) != 0 {
+		t.Fatalf("expected empty list, got %v", list)
+	}
+}
+
+func TestStoreExpiresSilentPeers(t *testing.T) {
+	s := NewStore(time.Minute, 0)
+	mustRegister(t, s, signAt(Record{Addr: "a:1"}, OpRegister, newKey(t), time.Now()))
+	mustRegister(t, s, signAt(Record{Addr: "b:1"}, OpRegister, newKey(t), time.Now()))
+	s.mu.Lock()
+	rec := s.spaces[DefaultNamespace]["a:1"]
+	rec.LastSeen = time.Now().Add(-2 * time.Minute)
+	s.spaces[DefaultNamespace]["a:1"] = rec
+	s.mu.Unlock()
+	if list := s.List(DefaultNamespace); len(list) != 1 || list[0] != "b:1" {
+		t.Fatalf("expected only the live peer, got %v", list)
+	}
+}
+
+func TestStoreRejectsForgedAndReplayedRecords(t *testing.T) {
+	s := NewStore(time.Minute, 0)
+	owner, other := newKey(t), newKey(t)
+	now := time.Now()
+	reg := signAt(Record{Addr: "a:1", Nick: "alice"}, OpRegister, owner, now.Add(-time.Second))
+	mustRegister(t, s, reg)
+
+	tampered := reg
+	tampered.Nick = "mallory"
+	if _, err := s.Register(tampered); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("expected tampered record to be refused, got %v", err)
+	}
+	if _, err := s.Register(reg); !errors.Is(err, ErrStale) {
+		t.Fatalf("expected replayed record to be refused, got %v", err)
+	}
+	if _, err := s.Register(signAt(Record{Addr: "b:1"}, OpRegister, owner, now.Add(-time.Hour))); !errors.Is(err, ErrStale) {
+		t.Fatalf("expected old timestamp to be refused, got %v", err)
+	}
+	if _, err := s.Register(signAt(Record{Addr: "a:1"}, OpRegister, other, now)); !errors.Is(err, ErrAddrTaken) {
+		t.Fatalf("expected another key to be refused the address, got %v", err)
+	}
+	if err := s.Remove(signAt(Record{Addr: "a:1"}, OpDeregister, other, now)); !errors.Is(err, ErrAddrTaken) {
+		t.Fatalf("expected another key to be refused removal, got %v", err)
+	}
+	relayed := network.CircuitAddr("127.0.0.1:9001", network.PeerID(owner.Public().(ed25519.PublicKey)))
+	if _, err := s.Register(signAt(Record{Addr: relayed}, OpRegister, other, now)); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("expected relayed address of another peer to be refused, got %v", err)
+	}
+
+	if err := s.Remove(signAt(Record{Addr: "a:1"}, OpDeregister, owner, now)); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := s.Register(reg); !errors.Is(err, ErrStale) {
+		t.Fatalf("expected registration replayed after removal to be refused, got %v", err)
+	}
+
+	// ["relay,dm"] and ["relay","dm"] would sign the same payload.
+	split := signAt(Record{Addr: "c:1", Capabilities: []string{"relay", "dm"}}, OpRegister, owner, now)
+	merged := split
+	merged.Capabilities = []string{"relay,dm"}
+	if err := merged.Verify(OpRegister); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("expected a capability containing a comma to be refused, got %v", err)
+	}
+	empty := signAt(Record{Addr: "c:1", Capabilities: []string{""}}, OpRegister, owner, now)
+	if err := empty.Verify(OpRegister); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("expected an empty capability to be refused, got %v", err)
+	}
+	if err := split.Verify(OpRegister); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+}
+
+func TestStoreSeparatesNamespaces(t *testing.T) {
+	s := NewStore(time.Minute, 1)
+	now := time.Now()
+	mustRegister(t, s, signAt(Record{Namespace: "team-a", Addr: "a:1"}, OpRegister, newKey(t), now))
+	mustRegister(t, s, signAt(Record{Namespace: "team-b", Addr: "b:1"}, OpRegister, newKey(t), now))
+	if list := s.List("team-a"); len(list) != 1 || list[0] != "a:1" {
+		t.Fatalf("unexpected team-a peers %v", list)
+	}
+	if list := s.List(DefaultNamespace); len(list) != 0 {
+		t.Fatalf("expected no default peers, got %v", list)
+	}
+	if _, err := s.Register(signAt(Record{Namespace: "team-a", Addr: "c:1"}, OpRegister, newKey(t), now)); !errors.Is(err, ErrFull) {
+		t.Fatalf("expected a full namespace to refuse, got %v", err)
+	}
+	if _, err := s.Register(signAt(Record{Namespace: "bad namespace", Addr: "c:1"}, OpRegister, newKey(t), now)); err == nil {
+		t.Fatalf("expected an invalid namespace to be refused")
+	}
+}
+
+func TestStoreQueryFiltersAndPages(t *testing.T) {
+	s := NewStore(time.Minute, 0)
+	now := time.Now()
+	mustRegister(t, s, signAt(Record{Addr: "a:1", Nick: "Alice", Version: 2, Capabilities: []string{"relay", "files"}}, OpRegister, newKey(t), now))
+	mustRegister(t, s, signAt(Record{Addr: "b:1", Nick: "bob", Version: 1, Capabilities: []string{"relay"}}, OpRegister, newKey(t), now))
+	mustRegister(t, s, signAt(Record{Addr: "c:1", Nick: "carol", Version: 2, Capabilities: []string{"relay"}}, OpRegister, newKey(t), now))
+	mustRegister(t, s, signAt(Record{Addr: "d:1", Nick: "malice", Version: 2}, OpRegister, newKey(t), now))
+
+	addrs := func(records []Record) []string {
+		out := make([]string, len(records))
+		for i, r := range records {
+			out[i] = r.Addr
+		}
+		return out
+	}
+	cases := []struct {
+		filter Filter
+		want   []string
+	}{
+		{Filter{Nick: "ALICE"}, []string{"a:1", "d:1"}},
+		{Filter{Capabilities: []string{"relay"}, MinVersion: 2}, []string{"a:1", "c:1"}},
+		{Filter{Capabilities: []string{"relay", "files"}}, []string{"a:1"}},
+	}
+	for _, tc := range cases {
+		tc.filter.Namespace = DefaultNamespace
+		got, next := s.Query(tc.filter)
+		if next != "" || len(got) != len(tc.want) {
+			t.Fatalf("Query(%+v) = %v, %q", tc.filter, addrs(got), next)
+		}
+		for i := range got {
+			if got[i].Addr != tc.want[i] {
+				t.Fatalf("Query(%+v) = %v, want %v", tc.filter, addrs(got), tc.want)
+			}
+		}
+	}
+
+	var seen []string
+	filter := Filter{Namespace: DefaultNamespace, Limit: 3}
+	for {
+		page, next := s.Query(filter)
+		seen = append(seen, addrs(page)...)
+		if next == "" {
+			break
+		}
+		filter.After = next
+	}
+	if len(seen) != 4 || seen[0] != "a:1" || seen[3] != "d:1" {
+		t.Fatalf("paging returned %v", seen)
+	}
+}
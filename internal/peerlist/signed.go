@@ -0,0 +1,114 @@
+package peerlist
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"p2p-chat/internal/crypto"
+	"p2p-chat/internal/network"
+)
+
+// Operations a record signature can authorize. The operation is part of the
+// signed payload, so a registration cannot be replayed as a deregistration.
+const (
+	OpRegister   = "register"
+	OpDeregister = "deregister"
+)
+
+// DefaultNamespace is used by peers that do not pick one.
+const DefaultNamespace = "default"
+
+// MaxClockSkew is how far a record timestamp may be from the server clock.
+const MaxClockSkew = 2 * time.Minute
+
+const signDomain = "p2p-chat/peer-record/v1\n"
+
+var (
+	ErrBadSignature = errors.New("bad record signature")
+	ErrStale        = errors.New("record timestamp is stale or replayed")
+	ErrAddrTaken    = errors.New("address is registered to another key")
+	ErrFull         = errors.New("namespace is full")
+	ErrNotFound     = errors.New("not registered")
+
+	namespacePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+)
+
+// SecretNamespace derives the namespace of a mesh from its shared secret, so
+// peers sharing a --secret find each other without revealing the secret.
+func SecretNamespace(secret string) string {
+	sum := sha256.Sum256([]byte("p2p-chat/namespace\n" + secret))
+	return "mesh-" + hex.EncodeToString(sum[:8])
+}
+
+// NormalizeNamespace maps the empty namespace to DefaultNamespace and
+// rejects names that are not short runs of letters, digits, dots, dashes and
+// underscores.
+func NormalizeNamespace(ns string) (string, error) {
+	if ns == "" {
+		return DefaultNamespace, nil
+	}
+	if !namespacePattern.MatchString(ns) {
+		return "", fmt.Errorf("invalid namespace %q", ns)
+	}
+	return ns, nil
+}
+
+// payload is the byte string signed for op. Fields are newline separated
+// and none of them may contain a newline; capabilities are comma separated,
+// so none of them may be empty or contain a comma.
+func (r Record) payload(op string) []byte {
+	fields := []string{
+		op,
+		r.Namespace,
+		r.Addr,
+		r.Nick,
+		r.PublicKey,
+		strings.Join(r.Capabilities, ","),
+		strconv.Itoa(r.Version),
+		strconv.FormatInt(r.Timestamp, 10),
+	}
+	return []byte(signDomain + strings.Join(fields, "\n"))
+}
+
+// Sign stamps r with the current time and signs it for op with key, filling
+// in PublicKey.
+func (r *Record) Sign(op string, key ed25519.PrivateKey) {
+	r.PublicKey = crypto.EncodeSigningKey(key.Public().(ed25519.PublicKey))
+	r.Timestamp = time.Now().UnixMilli()
+	r.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, r.payload(op)))
+}
+
+// Verify checks the signature of r for op and that a relayed address names
+// the peer ID of the signing key.
+func (r Record) Verify(op string) error {
+	for _, field := range []string{r.Namespace, r.Addr, r.Nick, r.PublicKey, strings.Join(r.Capabilities, ",")} {
+		if strings.ContainsAny(field, "\n\r") {
+			return fmt.Errorf("%w: field contains a newline", ErrBadSignature)
+		}
+	}
+	for _, capability := range r.Capabilities {
+		if capability == "" || strings.Contains(capability, ",") {
+			return fmt.Errorf("%w: invalid capability %q", ErrBadSignature, capability)
+		}
+	}
+	pub, err := crypto.ParseSigningKey(r.PublicKey)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil || !ed25519.Verify(pub, r.payload(op), sig) {
+		return ErrBadSignature
+	}
+	if _, id, ok := network.ParseCircuitAddr(r.Addr); ok && id != network.PeerID(pub) {
+		return fmt.Errorf("%w: relayed address belongs to another peer", ErrBadSignature)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package peerlist
+
+import (
+	"errors"
+	"time"
+)
+
+// Delta is what a bootstrap server hands its replicas during anti-entropy:
+// the signed registrations and deregistrations it holds. Both are verified
+// again on arrival, so a replica needs to trust its peers only to relay, not
+// to vouch for them.
+type Delta struct {
+	Records []Record `json:"records"`
+	Removed []Record `json:"removed"`
+}
+
+// Since returns the live registrations and recent deregistrations of every
+// namespace signed after since, in Unix milliseconds.
+func (s *Store) Since(since int64) Delta {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneExpired()
+	var d Delta
+	for _, space := range s.spaces {
+		for _, rec := range space {
+			if rec.Timestamp > since {
+				d.Records = append(d.Records, rec)
+			}
+		}
+	}
+	for _, rec := range s.removed {
+		if rec.Timestamp > since {
+			d.Removed = append(d.Removed, rec)
+		}
+	}
+	return d
+}
+
+// Merge applies a delta from a replica and returns how many entries changed
+// the store. Entries that are forged, stale or conflict with what this store
+// already holds are skipped. A merged registration counts as seen when it was
+// signed, so it expires everywhere at the same time.
+func (s *Store) Merge(d Delta) int {
+	now := time.Now()
+	changed := 0
+	for _, rec := range d.Records {
+		if check(rec, OpRegister, now) != nil {
+			continue
+		}
+		seen := time.UnixMilli(rec.Timestamp)
+		if seen.After(now) {
+			seen = now
+		}
+		s.mu.Lock()
+		_, err := s.registerLocked(rec, seen)
+		s.mu.Unlock()
+		if err == nil {
+			changed++
+		}
+	}
+	for _, rec := range d.Removed {
+		if check(rec, OpDeregister, now) != nil {
+			continue
+		}
+		s.mu.Lock()
+		err := s.removeLocked(rec)
+		if errors.Is(err, ErrNotFound) {
+			// Keep the tombstone anyway, in case the registration it
+			// cancels reaches us later through another replica.
+			key := removedKey(rec.Namespace, rec.Addr)
+			if rec.Timestamp > s.removed[key].Timestamp {
+				s.removed[key] = rec
+				err = nil
+			}
+		}
+		s.mu.Unlock()
+		if err == nil {
+			changed++
+		}
+	}
+	return changed
+}
@@ -0,0 +1,76 @@
+package peerlist
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMergeConvergesReplicas(t *testing.T) {
+	a, b := NewStore(time.Minute, 0), NewStore(time.Minute, 0)
+	alice, bob := newKey(t), newKey(t)
+	now := time.Now()
+	mustRegister(t, a, signAt(Record{Addr: "a:1"}, OpRegister, alice, now.Add(-time.Second)))
+	mustRegister(t, b, signAt(Record{Addr: "b:1"}, OpRegister, bob, now.Add(-time.Second)))
+
+	if n := b.Merge(a.Since(0)); n != 1 {
+		t.Fatalf("expected one merged record, got %d", n)
+	}
+	if n := a.Merge(b.Since(0)); n != 1 {
+		t.Fatalf("expected one merged record back, got %d", n)
+	}
+	if n := a.Merge(b.Since(0)); n != 0 {
+		t.Fatalf("expected a second round to change nothing, got %d", n)
+	}
+	for _, s := range []*Store{a, b} {
+		if list := s.List(DefaultNamespace); len(list) != 2 {
+			t.Fatalf("expected the merged view, got %v", list)
+		}
+	}
+
+	if err := a.Remove(signAt(Record{Addr: "a:1"}, OpDeregister, alice, now)); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	b.Merge(a.Since(0))
+	if list := b.List(DefaultNamespace); len(list) != 1 || list[0] != "b:1" {
+		t.Fatalf("expected the deregistration to replicate, got %v", list)
+	}
+
+	// A replica learning the tombstone first refuses the registration later.
+	c := NewStore(time.Minute, 0)
+	c.Merge(Delta{Removed: a.Since(0).Removed})
+	c.Merge(Delta{Records: []Record{signAt(Record{Addr: "a:1"}, OpRegister, alice, now.Add(-time.Second))}})
+	if list := c.List(DefaultNamespace); len(list) != 0 {
+		t.Fatalf("expected the cancelled registration to stay out, got %v", list)
+	}
+}
+
+func TestMergeSkipsForgedRecords(t *testing.T) {
+	s := NewStore(time.Minute, 0)
+	forged := signAt(Record{Addr: "a:1", Nick: "alice"}, OpRegister, newKey(t), time.Now())
+	forged.Nick = "mallory"
+	old := signAt(Record{Addr: "b:1"}, OpRegister, newKey(t), time.Now().Add(-time.Hour))
+	if n := s.Merge(Delta{Records: []Record{forged, old}}); n != 0 || len(s.List(DefaultNamespace)) != 0 {
+		t.Fatalf("expected forged and stale records to be skipped, merged %d", n)
+	}
+}
+
+func TestMergeKeepsNewerAddressOfKey(t *testing.T) {
+	s := NewStore(time.Minute, 0)
+	alice := newKey(t)
+	now := time.Now()
+	moved := signAt(Record{Addr: "a:2"}, OpRegister, alice, now.Add(-time.Second))
+	before := signAt(Record{Addr: "a:1"}, OpRegister, alice, now.Add(-2*time.Second))
+	if n := s.Merge(Delta{Records: []Record{moved}}); n != 1 {
+		t.Fatalf("expected the current address to merge, got %d", n)
+	}
+	if n := s.Merge(Delta{Records: []Record{before}}); n != 0 {
+		t.Fatalf("expected the older address to be refused, merged %d", n)
+	}
+	if list := s.List(DefaultNamespace); len(list) != 1 || list[0] != "a:2" {
+		t.Fatalf("expected the newer address to survive, got %v", list)
+	}
+	if _, err := s.Register(before); !errors.Is(err, ErrStale) {
+		t.Fatalf("expected a replayed old registration to be stale, got %v", err)
+	}
+}
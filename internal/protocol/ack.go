@@ -29,6 +29,7 @@ type AckTracker struct {
 	cm      broadcaster
 	mu      sync.Mutex
 	pending map[string]*pendingAck
+	expired func(message.Message)
 	quit    chan struct{}
 }
 
@@ -51,13 +52,25 @@ func (a *AckTracker) Track(msg message.Message) {
 	a.pending[msg.MsgID] = &pendingAck{msg: msg, attempts: 1, lastSend: time.Now()}
 }
 
-func (a *AckTracker) Confirm(msgID string) {
+// OnExpire registers fn to receive messages that ran out of retries instead of
+// dropping them.
+func (a *AckTracker) OnExpire(fn func(message.Message)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expired = fn
+}
+
+// Confirm stops retrying msgID and reports whether it was still waiting for
+// an ack.
+func (a *AckTracker) Confirm(msgID string) bool {
 	if msgID == "" {
-		return
+		return false
 	}
 	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.pending[msgID]
 	delete(a.pending, msgID)
-	a.mu.Unlock()
+	return ok
 }
 
 func (a *AckTracker) loop() {
@@ -75,16 +88,21 @@ func (a *AckTracker) loop() {
 
 func (a *AckTracker) rebroadcastExpired() {
 	now := time.Now()
-	var resend []message.Message
+	var resend, expired []message.Message
 
 	a.mu.Lock()
+	onExpire := a.expired
 	for id, pending := range a.pending {
 		if now.Sub(pending.lastSend) < ackTimeout {
 			continue
 		}
 		if pending.attempts >= ackMaxAttempts {
-			log.Printf("dropping msg %s after %d attempts", id, pending.attempts)
 			delete(a.pending, id)
+			if onExpire == nil {
+				log.Printf("dropping msg %s after %d attempts", id, pending.attempts)
+				continue
+			}
+			expired = append(expired, pending.msg)
 			continue
 		}
 		pending.attempts++
@@ -96,6 +114,9 @@ func (a *AckTracker) rebroadcastExpired() {
 	for _, msg := range resend {
 		a.cm.Broadcast(msg, "")
 	}
+	for _, msg := range expired {
+		onExpire(msg)
+	}
 }
 
 func (a *AckTracker) Stop() {
@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"p2p-chat/internal/message"
+	"p2p-chat/internal/network"
+	"p2p-chat/internal/storage"
+)
+
+const (
+	// addressBookSeed is how many saved peers are dialed at startup, most
+	// recently active first.
+	addressBookSeed = 64
+	// staleAfter marks saved peers not heard from in this long as stale.
+	staleAfter = 7 * 24 * time.Hour
+)
+
+// recordDial stores the outcome of a dial in the address book. Dials refused
+// by our own peer limit say nothing about the address.
+func (r *Runtime) recordDial(addr string, err error) {
+	if errors.Is(err, network.ErrPeerLimit) {
+		return
+	}
+	if err := r.book.DialResult(addr, err, time.Now()); err != nil {
+		log.Printf("address book: %v", err)
+	}
+}
+
+// rememberPeer stores the sender of a handshake in the address book.
+func (r *Runtime) rememberPeer(msg message.Message) {
+	if msg.Origin == "" || msg.Origin == r.selfAddr {
+		return
+	}
+	if err := r.book.Seen(msg.Origin, msg.From, msg.SigningKey, time.Now()); err != nil {
+		log.Printf("address book: %v", err)
+	}
+}
+
+// SeedFromAddressBook hands the saved peers to the dial scheduler, so a
+// restarted peer rejoins the mesh even when the bootstrap server is down.
+// Stale entries are left out; /dial still reaches them.
+func (r *Runtime) SeedFromAddressBook() {
+	all, err := r.book.All()
+	if err != nil {
+		log.Printf("address book: %v", err)
+		return
+	}
+	cutoff := time.Now().Add(-staleAfter)
+	var peers []storage.KnownPeer
+	for _, peer := range all {
+		if !peer.Stale(cutoff, dialMaxFailures) {
+			peers = append(peers, peer)
+		}
+	}
+	if len(peers) > addressBookSeed {
+		peers = peers[:addressBookSeed]
+	}
+	for _, peer := range peers {
+		r.dialer.Add(peer.Addr)
+	}
+	if len(peers) > 0 {
+		log.Printf("dialing %d peers from the address book", len(peers))
+	}
+}
+
+// stalePeers lists the saved peers that failed too often or have been
+// silent for staleAfter.
+func (r *Runtime) stalePeers(now time.Time) ([]storage.KnownPeer, error) {
+	return r.book.Stale(now.Add(-staleAfter), dialMaxFailures)
+}
+
+// formatStalePeers renders stale address book entries for /peers stale.
+func formatStalePeers(peers []storage.KnownPeer, now time.Time) []string {
+	if len(peers) == 0 {
+		return []string{"no stale peers in the address book"}
+	}
+	lines := make([]string, 0, len(peers)+1)
+	for _, p := range peers {
+		line := "  " + p.Addr
+		if p.Nick != "" {
+			line += " (" + p.Nick + ")"
+		}
+		if last := p.LastActive(); last.IsZero() {
+			line += " never reached"
+		} else {
+			line += fmt.Sprintf(" last active %s ago", now.Sub(last).Round(time.Minute))
+		}
+		line += fmt.Sprintf(" failures=%d", p.Failures)
+		if p.LastError != "" {
+			line += " (" + p.LastError + ")"
+		}
+		lines = append(lines, line)
+	}
+	return append(lines, "use /forget <addr> to drop an entry")
+}
@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-chat/internal/message"
+	"p2p-chat/internal/network"
+	"p2p-chat/internal/storage"
+)
+
+func TestAddressBookSeedsDialerAndListsStalePeers(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	book, err := storage.OpenAddressBook(filepath.Join(t.TempDir(), "peers.db"))
+	if err != nil {
+		t.Fatalf("open address book: %v", err)
+	}
+	t.Cleanup(func() { _ = book.Close() })
+	rt.book = book
+
+	rt.processIncoming(message.Message{MsgID: "hs1", Type: MsgTypeHandshake, From: "Bob", Origin: "10.0.0.2:9001", SigningKey: "key-b"}, "")
+	rt.recordDial("10.0.0.3:9001", nil)
+	rt.recordDial("10.0.0.3:9001", network.ErrPeerLimit)
+	for i := 0; i < dialMaxFailures; i++ {
+		rt.recordDial("10.0.0.2:9001", errors.New("refused"))
+	}
+
+	rt.SeedFromAddressBook()
+	desired := strings.Join(rt.dialer.Desired(), ",")
+	if desired != "10.0.0.3:9001" {
+		t.Fatalf("expected only the healthy saved peer to be a dial target, got %s", desired)
+	}
+
+	rt.ProcessLine("/peers stale")
+	out := strings.Join(sink.systems, "\n")
+	if !strings.Contains(out, "10.0.0.2:9001 (Bob)") || strings.Contains(out, "10.0.0.3:9001") {
+		t.Fatalf("expected only the failing peer to be stale, got %q", out)
+	}
+	if got := formatStalePeers(nil, time.Now()); len(got) != 1 {
+		t.Fatalf("unexpected empty listing %v", got)
+	}
+
+	rt.ProcessLine("/forget 10.0.0.2:9001")
+	if saved, _ := book.All(); len(saved) != 1 || saved[0].Addr != "10.0.0.3:9001" {
+		t.Fatalf("expected /forget to drop the saved peer, got %+v", saved)
+	}
+}
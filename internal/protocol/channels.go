@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"p2p-chat/internal/message"
+)
+
+// ChannelSet tracks the rooms this peer has joined and which one outgoing
+// chat lines are posted to.
+type ChannelSet struct {
+	mu     sync.RWMutex
+	joined map[string]struct{}
+	active string
+}
+
+func NewChannelSet(initial ...string) *ChannelSet {
+	cs := &ChannelSet{joined: make(map[string]struct{})}
+	for _, name := range initial {
+		cs.Join(name)
+	}
+	if cs.active == "" {
+		cs.Join(DefaultChannel)
+	}
+	return cs
+}
+
+// Join subscribes to name and makes it the active channel. It reports whether
+// the channel was newly joined.
+func (c *ChannelSet) Join(name string) bool {
+	name = NormalizeChannel(name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, exists := c.joined[name]
+	c.joined[name] = struct{}{}
+	c.active = name
+	return !exists
+}
+
+// Part leaves name. The last remaining channel cannot be left so there is
+// always somewhere to post to.
+func (c *ChannelSet) Part(name string) bool {
+	name = NormalizeChannel(name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.joined[name]; !ok || len(c.joined) == 1 {
+		return false
+	}
+	delete(c.joined, name)
+	if c.active == name {
+		if _, ok := c.joined[DefaultChannel]; ok {
+			c.active = DefaultChannel
+		} else {
+			c.active = sortedKeys(c.joined)[0]
+		}
+	}
+	return true
+}
+
+func (c *ChannelSet) Joined(name string) bool {
+	name = NormalizeChannel(name)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.joined[name]
+	return ok
+}
+
+func (c *ChannelSet) Active() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.active
+}
+
+func (c *ChannelSet) List() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return sortedKeys(c.joined)
+}
+
+// NormalizeChannel lowercases a channel name and strips a leading '#'. An
+// empty name maps to DefaultChannel.
+func NormalizeChannel(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.TrimLeft(name, "#")
+	if name == "" {
+		return DefaultChannel
+	}
+	return name
+}
+
+// channelScoped reports whether msg is a room broadcast rather than a direct
+// message or control traffic.
+func channelScoped(msg message.Message) bool {
+	if msg.To != "" || msg.ToAddr != "" {
+		return false
+	}
+	switch msg.Type {
+	case MsgTypeChat, MsgTypeFile, MsgTypeEdit, MsgTypeDelete, MsgTypeReaction:
+		return true
+	}
+	return false
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	out := make([]string, 0, len(set))
+	for key := range set {
+		out = append(out, key)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,77 @@
+package protocol
+
+import (
+	"testing"
+
+	"p2p-chat/internal/message"
+)
+
+func TestChannelSetJoinAndPart(t *testing.T) {
+	cs := NewChannelSet(DefaultChannel)
+	if !cs.Join("#Ops") {
+		t.Fatalf("expected ops to be newly joined")
+	}
+	if cs.Active() != "ops" {
+		t.Fatalf("expected join to switch active channel, got %s", cs.Active())
+	}
+	if !cs.Part("ops") {
+		t.Fatalf("expected part to succeed")
+	}
+	if cs.Active() != DefaultChannel {
+		t.Fatalf("expected fallback to default channel, got %s", cs.Active())
+	}
+	if cs.Part(DefaultChannel) {
+		t.Fatalf("last channel must not be left")
+	}
+}
+
+func TestProcessIncomingSkipsUnjoinedChannel(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	rt.processIncoming(message.Message{MsgID: "c1", From: "Bob", Channel: "ops", Content: "deploy"}, "")
+	if len(sink.messages) != 0 || len(rt.history.All()) != 0 {
+		t.Fatalf("messages for unjoined channels should only be relayed")
+	}
+	rt.channels.Join("ops")
+	rt.processIncoming(message.Message{MsgID: "c2", From: "Bob", Channel: "ops", Content: "deploy"}, "")
+	if got := rt.history.Channel("ops"); len(got) != 1 {
+		t.Fatalf("expected joined channel message stored, got %d", len(got))
+	}
+}
+
+func TestProcessIncomingDefaultsLegacyChannel(t *testing.T) {
+	rt, _, _ := newTestRuntime(t)
+	rt.processIncoming(message.Message{MsgID: "c3", From: "Bob", Content: "hi"}, "")
+	if got := rt.history.Channel(DefaultChannel); len(got) != 1 {
+		t.Fatalf("expected legacy chat to land in default channel")
+	}
+}
+
+func TestHistoryShowsDirectMessagesOnRequest(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	attachHistoryStore(t, rt)
+	rt.processIncoming(message.Message{MsgID: "c1", From: "Bob", Channel: DefaultChannel, Content: "room"}, "")
+	rt.processIncoming(message.Message{MsgID: "d1", Type: MsgTypeDM, From: "Bob", Origin: "10.0.0.2:9001", ToAddr: rt.selfAddr, Content: "psst"}, "")
+
+	shown := func(command string) []string {
+		sink.mu.Lock()
+		sink.messages = nil
+		sink.mu.Unlock()
+		rt.handleCommand(command)
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		var ids []string
+		for _, msg := range sink.messages {
+			ids = append(ids, msg.MsgID)
+		}
+		return ids
+	}
+	if got := shown("/history"); len(got) != 1 || got[0] != "c1" {
+		t.Fatalf("/history should show the active room, got %v", got)
+	}
+	if got := shown("/history dm"); len(got) != 1 || got[0] != "d1" {
+		t.Fatalf("/history dm should show direct messages, got %v", got)
+	}
+	if got := shown("/load 5 dm"); len(got) != 1 || got[0] != "d1" {
+		t.Fatalf("/load dm should replay stored direct messages, got %v", got)
+	}
+}
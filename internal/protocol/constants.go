@@ -7,4 +7,19 @@ const (
 	MsgTypePeerSync  = "peer_sync"
 	MsgTypeHandshake = "handshake"
 	MsgTypeFile      = "file"
+	MsgTypeIHave     = "ihave"
+	MsgTypeIWant     = "iwant"
+	MsgTypeRead      = "read"
+	MsgTypeSyncReq   = "sync_req"
+	MsgTypeSyncResp  = "sync_resp"
+	MsgTypeEdit      = "edit"
+	MsgTypeDelete    = "delete"
+	MsgTypeReaction  = "reaction"
+	MsgTypeFileReq   = "file_req"
+	MsgTypeFileChunk = "file_chunk"
 )
+
+// DefaultChannel is the room every peer joins on startup. Messages from peers
+// that predate channels carry no channel and are treated as belonging here;
+// the history store indexes its own such records under the same name.
+const DefaultChannel = "general"
@@ -0,0 +1,263 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"p2p-chat/internal/crypto"
+	"p2p-chat/internal/dht"
+	"p2p-chat/internal/message"
+)
+
+const (
+	// dhtWarmup gives the first connections time to come up before the node
+	// joins the DHT through them.
+	dhtWarmup        = 5 * time.Second
+	dhtLookupTimeout = 20 * time.Second
+)
+
+// DHTLoop joins the DHT through the peers we know, publishes our nickname
+// and keeps the routing table fresh until the runtime stops.
+func (r *Runtime) DHTLoop() {
+	if r.dht == nil {
+		return
+	}
+	select {
+	case <-r.ctx.Done():
+		return
+	case <-time.After(dhtWarmup):
+	}
+	contacts := r.dht.Bootstrap(r.ctx, r.dhtSeeds())
+	log.Printf("dht: joined as %s with %d contacts", r.dht.Self().ID, contacts)
+	r.publishSelf()
+	r.dht.Run(r.ctx)
+}
+
+// dhtSeeds lists the addresses to join the DHT through: our dial targets
+// and the peers in the address book.
+func (r *Runtime) dhtSeeds() []string {
+	seeds := r.dialer.Desired()
+	saved, err := r.book.All()
+	if err != nil {
+		log.Printf("address book: %v", err)
+	}
+	if len(saved) > addressBookSeed {
+		saved = saved[:addressBookSeed]
+	}
+	for _, peer := range saved {
+		seeds = append(seeds, peer.Addr)
+	}
+	return seeds
+}
+
+// learnDHTPeer adds the peer listening at addr to the routing table.
+func (r *Runtime) learnDHTPeer(addr string) {
+	if r.dht == nil || addr == "" || addr == r.selfAddr || r.dht.Known(addr) {
+		return
+	}
+	go func() {
+		if _, err := r.dht.Ping(addr); err != nil {
+			log.Printf("dht: %v", err)
+		}
+	}()
+}
+
+// publishSelf stores our nickname, address and DM key in the DHT, so peers
+// that never shook hands with us can still message us.
+func (r *Runtime) publishSelf() {
+	if r.dht == nil {
+		return
+	}
+	rec := dht.Record{Kind: dht.KindPeer, Name: r.identity.Get()}
+	if keys := r.identity.KeyPair(); keys != nil {
+		rec.BoxKey = keys.PublicKeyString()
+	}
+	ctx, cancel := context.WithTimeout(r.ctx, dhtLookupTimeout)
+	defer cancel()
+	stored, err := r.dht.Publish(ctx, rec)
+	if err != nil {
+		log.Printf("dht: publish %s: %v", rec.Name, err)
+		return
+	}
+	log.Printf("dht: published %s to %d nodes", rec.Name, stored)
+}
+
+// ambiguousNickError reports that several keys publish records for a
+// nickname nobody pinned yet, so any of them could be an impostor.
+type ambiguousNickError struct {
+	nick    string
+	records []dht.Record
+}
+
+func (e *ambiguousNickError) Error() string {
+	return fmt.Sprintf("%s is claimed by %d keys", e.nick, len(e.records))
+}
+
+// resolveNick finds the newest peer record for nick. Once a key is pinned
+// for the nickname, records signed by any other key are ignored; until then
+// the nickname only resolves if a single key claims it.
+func (r *Runtime) resolveNick(ctx context.Context, nick string) (dht.Record, error) {
+	pinned, isPinned := r.keyring.Pinned(nick)
+	records := r.dht.Get(ctx, dht.PeerKey(nick))
+	var candidates []dht.Record
+	for _, rec := range records {
+		if rec.BoxKey == "" || rec.Addr == r.selfAddr {
+			continue
+		}
+		if isPinned && rec.Publisher == pinned {
+			return rec, nil
+		}
+		if !isPinned {
+			candidates = append(candidates, rec)
+		}
+	}
+	if isPinned && len(records) > 0 {
+		return dht.Record{}, fmt.Errorf("no record for %s is signed by its pinned key", nick)
+	}
+	switch len(candidates) {
+	case 0:
+		return dht.Record{}, fmt.Errorf("%s is not in the DHT", nick)
+	case 1:
+		return candidates[0], nil
+	}
+	return dht.Record{}, &ambiguousNickError{nick: nick, records: candidates}
+}
+
+// resolveDirect looks target up in the DHT and sends the direct message once
+// its address and key are known.
+func (r *Runtime) resolveDirect(target, content string, parent *message.Message) {
+	ctx, cancel := context.WithTimeout(r.ctx, dhtLookupTimeout)
+	defer cancel()
+	rec, err := r.resolveNick(ctx, target)
+	if err == nil {
+		var key *[32]byte
+		if key, err = crypto.ParsePublicKey(rec.BoxKey); err == nil {
+			r.directory.Record(rec.Name, rec.Addr)
+			r.directory.SetPublicKey(rec.Addr, key)
+			r.directory.SetSigningKey(rec.Addr, rec.Publisher)
+		}
+	}
+	if _, ok := r.directory.PublicKey(target); err != nil || !ok {
+		if err == nil {
+			err = errors.New("lookup returned no usable key")
+		}
+		r.sink.ShowSystem(fmt.Sprintf("no encryption key known for %s: %v", target, err))
+		var ambiguous *ambiguousNickError
+		if errors.As(err, &ambiguous) {
+			r.sink.ShowSystem(fmt.Sprintf("pick the right one with /pin %s <fingerprint> and send again:", target))
+			for _, line := range formatDHTRecords(target, ambiguous.records, "", time.Now()) {
+				r.sink.ShowSystem(line)
+			}
+		}
+		return
+	}
+	r.dialer.Add(rec.Addr)
+	r.sink.ShowSystem(fmt.Sprintf("found %s at %s via the DHT", rec.Name, rec.Addr))
+	r.postDirect(target, content, parent)
+}
+
+// lookupCommand answers /lookup with the peers found for a peer ID prefix or
+// a nickname.
+func (r *Runtime) lookupCommand(token string) {
+	ctx, cancel := context.WithTimeout(r.ctx, dhtLookupTimeout)
+	defer cancel()
+	if isPeerID(token) {
+		contacts, err := r.dht.FindPeer(ctx, token)
+		if err != nil {
+			r.sink.ShowSystem(fmt.Sprintf("lookup %s: %v", token, err))
+			return
+		}
+		if len(contacts) == 0 {
+			r.sink.ShowSystem(fmt.Sprintf("no peer with id %s found", token))
+		}
+		for _, c := range contacts {
+			r.sink.ShowSystem(fmt.Sprintf("  %s at %s key=%s", c.ID, c.Addr, crypto.Fingerprint(c.Key)))
+		}
+		return
+	}
+	pinned, _ := r.keyring.Pinned(token)
+	for _, line := range formatDHTRecords(token, r.dht.Get(ctx, dht.PeerKey(token)), pinned, time.Now()) {
+		r.sink.ShowSystem(line)
+	}
+}
+
+// pinCommand answers /pin: it pins the signing key of the record for nick
+// whose fingerprint matches, so later lookups only trust that key.
+func (r *Runtime) pinCommand(nick, fingerprint string) {
+	ctx, cancel := context.WithTimeout(r.ctx, dhtLookupTimeout)
+	defer cancel()
+	want := strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+	for _, rec := range r.dht.Get(ctx, dht.PeerKey(nick)) {
+		if strings.ReplaceAll(crypto.Fingerprint(rec.Publisher), ":", "") != want {
+			continue
+		}
+		if err := r.keyring.PinName(nick, rec.Publisher); err != nil {
+			r.sink.ShowSystem(fmt.Sprintf("pin %s: %v; /unpin it first", nick, err))
+			return
+		}
+		r.sink.ShowSystem(fmt.Sprintf("pinned key %s for %s", crypto.Fingerprint(rec.Publisher), nick))
+		return
+	}
+	r.sink.ShowSystem(fmt.Sprintf("no record for %s has key %s", nick, fingerprint))
+}
+
+// rendezvous publishes us under name and dials the peers already there.
+func (r *Runtime) rendezvous(name, note string) {
+	ctx, cancel := context.WithTimeout(r.ctx, dhtLookupTimeout)
+	defer cancel()
+	if _, err := r.dht.Publish(ctx, dht.Record{Kind: dht.KindRendezvous, Name: name, Value: note}); err != nil {
+		r.sink.ShowSystem(fmt.Sprintf("rendezvous %s: %v", name, err))
+		return
+	}
+	var others []dht.Record
+	for _, rec := range r.dht.Get(ctx, dht.RendezvousKey(name)) {
+		if rec.Addr != r.selfAddr {
+			others = append(others, rec)
+			r.dialer.Add(rec.Addr)
+		}
+	}
+	for _, line := range formatDHTRecords(name, others, "", time.Now()) {
+		r.sink.ShowSystem(line)
+	}
+}
+
+// formatDHTRecords renders records found under name for /lookup and
+// /rendezvous, marking the one signed by the pinned key.
+func formatDHTRecords(name string, records []dht.Record, pinned string, now time.Time) []string {
+	if len(records) == 0 {
+		return []string{fmt.Sprintf("nobody found at %s", name)}
+	}
+	lines := make([]string, 0, len(records))
+	for _, rec := range records {
+		line := fmt.Sprintf("  %s at %s key=%s signed %s ago", rec.Name, rec.Addr,
+			crypto.Fingerprint(rec.Publisher), now.Sub(time.UnixMilli(rec.Timestamp)).Round(time.Second))
+		if rec.Value != "" {
+			line += ": " + rec.Value
+		}
+		if pinned != "" && rec.Publisher == pinned {
+			line += " (pinned)"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// isPeerID reports whether token looks like a hex node or peer ID rather
+// than a nickname.
+func isPeerID(token string) bool {
+	if len(token) < 8 || len(token) > 2*len(dht.ID{}) {
+		return false
+	}
+	return strings.Trim(strings.ToLower(token), "0123456789abcdef") == ""
+}
+
+// formatDHT renders /dht.
+func (r *Runtime) formatDHT() string {
+	contacts, records := r.dht.Size()
+	self := r.dht.Self()
+	return fmt.Sprintf("dht node %s at %s: %d contacts, %d records stored for others", self.ID, self.Addr, contacts, records)
+}
@@ -0,0 +1,222 @@
+package protocol
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"p2p-chat/internal/crypto"
+	"p2p-chat/internal/dht"
+)
+
+// dhtNet connects in-memory DHT nodes by address.
+type dhtNet struct {
+	mu    sync.Mutex
+	nodes map[string]*dht.Node
+}
+
+func (n *dhtNet) call(addr string, req []byte) ([]byte, error) {
+	n.mu.Lock()
+	node, ok := n.nodes[addr]
+	n.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	}
+	return node.HandleRPC("", req), nil
+}
+
+func (n *dhtNet) add(t *testing.T, addr string) *dht.Node {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	node := dht.New(dht.Config{Addr: addr, Key: key, Call: n.call})
+	n.mu.Lock()
+	n.nodes[addr] = node
+	n.mu.Unlock()
+	return node
+}
+
+// newDHTRuntime gives the test runtime a DHT node joined to a few others and
+// returns those others.
+func newDHTRuntime(t *testing.T, others int) (*Runtime, *recordingSink, []*dht.Node) {
+	t.Helper()
+	rt, sink, _ := newTestRuntime(t)
+	net := &dhtNet{nodes: make(map[string]*dht.Node)}
+	rt.dht = net.add(t, rt.selfAddr)
+	nodes := make([]*dht.Node, others)
+	for i := range nodes {
+		nodes[i] = net.add(t, fmt.Sprintf("10.0.0.%d:9001", i+1))
+	}
+	ctx := context.Background()
+	for _, n := range nodes {
+		n.Bootstrap(ctx, []string{rt.selfAddr})
+	}
+	time.Sleep(50 * time.Millisecond)
+	rt.dht.Bootstrap(ctx, nil)
+	return rt, sink, nodes
+}
+
+func waitForSystem(t *testing.T, sink *recordingSink, substr string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		sink.mu.Lock()
+		for _, line := range sink.systems {
+			if strings.Contains(line, substr) {
+				sink.mu.Unlock()
+				return
+			}
+		}
+		sink.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	t.Fatalf("no system line contains %q: %v", substr, sink.systems)
+}
+
+func TestDirectMessageResolvesNickThroughDHT(t *testing.T) {
+	rt, sink, nodes := newDHTRuntime(t, 6)
+	keys, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("generate keys: %v", err)
+	}
+	if _, err := nodes[2].Publish(context.Background(), dht.Record{Kind: dht.KindPeer, Name: "Alice", BoxKey: keys.PublicKeyString()}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	rt.handleCommand("/msg alice hello there")
+	waitForSystem(t, sink, "found Alice at 10.0.0.3:9001 via the DHT")
+	dm := sink.lastMessage()
+	if dm.Type != MsgTypeDM || dm.ToAddr != "10.0.0.3:9001" || dm.Content != "hello there" {
+		t.Fatalf("expected the DM to be sent to the resolved address, got %+v", dm)
+	}
+	if _, ok := rt.directory.PublicKey("alice"); !ok {
+		t.Fatalf("expected the resolved key to be kept in the directory")
+	}
+
+	rt.handleCommand("/msg nobody hi")
+	waitForSystem(t, sink, "nobody is not in the DHT")
+}
+
+func TestResolveNickHonoursPinnedKey(t *testing.T) {
+	rt, _, nodes := newDHTRuntime(t, 6)
+	ctx := context.Background()
+	for _, n := range nodes[:2] {
+		if _, err := n.Publish(ctx, dht.Record{Kind: dht.KindPeer, Name: "mallory", BoxKey: "box"}); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+	genuine := nodes[0].Self()
+	rt.keyring.mu.Lock()
+	rt.keyring.names["mallory"] = genuine.Key
+	rt.keyring.mu.Unlock()
+	rec, err := rt.resolveNick(ctx, "mallory")
+	if err != nil || rec.Publisher != genuine.Key || rec.Addr != genuine.Addr {
+		t.Fatalf("resolveNick = %+v, %v; want the record signed by the pinned key", rec, err)
+	}
+
+	rt.keyring.mu.Lock()
+	rt.keyring.names["mallory"] = nodes[5].Self().Key
+	rt.keyring.mu.Unlock()
+	if _, err := rt.resolveNick(ctx, "mallory"); err == nil || !strings.Contains(err.Error(), "pinned") {
+		t.Fatalf("expected records under another key to be refused, got %v", err)
+	}
+}
+
+func TestDirectMessageRefusesContestedNick(t *testing.T) {
+	rt, sink, nodes := newDHTRuntime(t, 6)
+	ctx := context.Background()
+	for _, n := range nodes[1:3] {
+		keys, err := crypto.GenerateKeyPair()
+		if err != nil {
+			t.Fatalf("generate keys: %v", err)
+		}
+		if _, err := n.Publish(ctx, dht.Record{Kind: dht.KindPeer, Name: "dave", BoxKey: keys.PublicKeyString()}); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	rt.handleCommand("/msg dave hi")
+	waitForSystem(t, sink, "dave is claimed by 2 keys")
+	genuine := nodes[2].Self()
+	fingerprint := crypto.Fingerprint(genuine.Key)
+	waitForSystem(t, sink, fingerprint)
+	if dm := sink.lastMessage(); dm.Type == MsgTypeDM {
+		t.Fatalf("expected no DM for a contested nickname, got %+v", dm)
+	}
+	if _, pinned := rt.keyring.Pinned("dave"); pinned {
+		t.Fatalf("nothing should be pinned before the user picks a key")
+	}
+
+	rt.handleCommand("/pin dave " + fingerprint)
+	waitForSystem(t, sink, "pinned key "+fingerprint+" for dave")
+	rt.handleCommand("/msg dave hi")
+	waitForSystem(t, sink, "found dave at "+genuine.Addr)
+	if dm := sink.lastMessage(); dm.Type != MsgTypeDM || dm.ToAddr != genuine.Addr {
+		t.Fatalf("expected the DM to go to the pinned publisher, got %+v", dm)
+	}
+}
+
+func TestDHTCommandFormatting(t *testing.T) {
+	for token, want := range map[string]bool{
+		"0123abcd":              true,
+		"0123ABCD":              true,
+		"abc":                   false,
+		"alice":                 false,
+		"deadbeefz":             false,
+		strings.Repeat("a", 41): false,
+	} {
+		if got := isPeerID(token); got != want {
+			t.Fatalf("isPeerID(%q) = %v", token, got)
+		}
+	}
+
+	now := time.Now()
+	records := []dht.Record{
+		{Name: "bob", Addr: "10.0.0.2:9001", Publisher: "key-a", Timestamp: now.Add(-time.Minute).UnixMilli(), Value: "on call"},
+		{Name: "bob", Addr: "10.0.0.9:9001", Publisher: "key-b", Timestamp: now.UnixMilli()},
+	}
+	lines := formatDHTRecords("bob", records, "key-a", now)
+	if len(lines) != 2 || !strings.Contains(lines[0], "1m0s ago: on call (pinned)") || strings.Contains(lines[1], "pinned") {
+		t.Fatalf("unexpected lines: %v", lines)
+	}
+	if lines := formatDHTRecords("standup", nil, "", now); len(lines) != 1 || lines[0] != "nobody found at standup" {
+		t.Fatalf("unexpected empty output: %v", lines)
+	}
+
+	rt, sink, _ := newTestRuntime(t)
+	rt.handleCommand("/dht")
+	waitForSystem(t, sink, "the DHT is disabled")
+}
+
+func TestSamplePeersBoundsPeerSync(t *testing.T) {
+	peers := make([]string, 40)
+	for i := range peers {
+		peers[i] = fmt.Sprintf("10.0.1.%d:9001", i)
+	}
+	sample := samplePeers(peers, peerSyncSample)
+	if len(sample) != peerSyncSample {
+		t.Fatalf("expected %d peers, got %d", peerSyncSample, len(sample))
+	}
+	seen := make(map[string]bool)
+	for _, p := range sample {
+		if seen[p] {
+			t.Fatalf("duplicate %s in sample", p)
+		}
+		seen[p] = true
+	}
+	if peers[0] != "10.0.1.0:9001" {
+		t.Fatalf("sampling should not reorder the caller's slice")
+	}
+	if got := samplePeers(peers[:3], peerSyncSample); len(got) != 3 {
+		t.Fatalf("short lists should be sent whole, got %v", got)
+	}
+}
@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"p2p-chat/internal/crypto"
+	"p2p-chat/internal/message"
+)
+
+// minRefPrefix is the shortest message ID prefix /edit and /delete accept;
+// receipts print the first eight characters.
+const minRefPrefix = 6
+
+// resolveOwnMessage finds one of our own messages by "last", full ID or ID
+// prefix, searching the in-memory history before the store.
+func (r *Runtime) resolveOwnMessage(ref string) (message.Message, bool) {
+	all := r.history.All()
+	for i := len(all) - 1; i >= 0; i-- {
+		msg := all[i]
+		if msg.Origin != r.selfAddr || msg.Deleted {
+			continue
+		}
+		if ref == "last" || msg.MsgID == ref || (len(ref) >= minRefPrefix && strings.HasPrefix(msg.MsgID, ref)) {
+			return msg, true
+		}
+	}
+	if msg, ok, err := r.store.Get(ref); err == nil && ok && msg.Origin == r.selfAddr && !msg.Deleted {
+		return msg, true
+	}
+	return message.Message{}, false
+}
+
+func (r *Runtime) editMessage(ref, content string) {
+	if content == "" {
+		r.sink.ShowSystem("message required")
+		return
+	}
+	original, ok := r.resolveOwnMessage(ref)
+	if !ok {
+		r.sink.ShowSystem(fmt.Sprintf("no message of yours matches %s", ref))
+		return
+	}
+	if err := r.sendRevision(MsgTypeEdit, original, content); err != nil {
+		r.sink.ShowSystem(fmt.Sprintf("edit failed: %v", err))
+	}
+}
+
+func (r *Runtime) deleteMessage(ref string) {
+	original, ok := r.resolveOwnMessage(ref)
+	if !ok {
+		r.sink.ShowSystem(fmt.Sprintf("no message of yours matches %s", ref))
+		return
+	}
+	if err := r.sendRevision(MsgTypeDelete, original, ""); err != nil {
+		r.sink.ShowSystem(fmt.Sprintf("delete failed: %v", err))
+	}
+}
+
+// sendRevision applies an edit or delete of original locally and publishes
+// it along the same route as the original. Edits of direct messages are
+// sealed to the recipient like the original was.
+func (r *Runtime) sendRevision(kind string, original message.Message, content string) error {
+	msg := message.Message{
+		MsgID:     NewMsgID(),
+		Type:      kind,
+		From:      r.identity.Get(),
+		Origin:    r.selfAddr,
+		To:        original.To,
+		ToAddr:    original.ToAddr,
+		Channel:   original.Channel,
+		Target:    original.MsgID,
+		Content:   content,
+		Timestamp: time.Now(),
+	}
+	local := msg
+	if original.Type == MsgTypeDM && content != "" {
+		target := original.ToAddr
+		if target == "" {
+			target = original.To
+		}
+		key, ok := r.directory.PublicKey(target)
+		if !ok {
+			return fmt.Errorf("no encryption key known for %s", original.To)
+		}
+		sealed, err := crypto.SealFor(key, []byte(content))
+		if err != nil {
+			return err
+		}
+		msg.Content = sealed
+		msg.Sealed = true
+	}
+	r.identity.Sign(&msg)
+	local.SigningKey = msg.SigningKey
+	r.cache.Seen(msg.MsgID)
+	r.applyRevision(local)
+	r.relay.Publish(msg)
+	return nil
+}
+
+// applyRevision applies an edit or delete to the buffered and stored copies
+// of its target and re-renders it. Revisions are only honoured from the
+// target's signer, or for unsigned targets from the same sender and origin.
+func (r *Runtime) applyRevision(rev message.Message) {
+	original, ok := r.history.Find(rev.Target)
+	if !ok {
+		original, ok, _ = r.store.Get(rev.Target)
+	}
+	if !ok {
+		log.Printf("%s for unknown msg %s from %s", rev.Type, rev.Target, rev.From)
+		return
+	}
+	if !sameAuthor(original, rev) {
+		log.Printf("rejecting %s of msg %s by %s (%s)", rev.Type, rev.Target, rev.From, rev.Origin)
+		r.metrics.IncRejected()
+		return
+	}
+	if original.Deleted {
+		return
+	}
+	updated := original
+	var err error
+	switch rev.Type {
+	case MsgTypeEdit:
+		updated.Content = rev.Content
+		updated.Edited = true
+		err = r.store.Edit(rev.Target, rev.Content, rev.Timestamp)
+	case MsgTypeDelete:
+		updated.Content = ""
+		updated.Attachments = nil
+		updated.Deleted = true
+		err = r.store.Delete(rev.Target)
+	}
+	if err != nil {
+		log.Printf("history %s: %v", rev.Type, err)
+	}
+	r.history.Replace(updated)
+	r.sink.UpdateMessage(updated)
+}
+
+func sameAuthor(original, rev message.Message) bool {
+	if original.SigningKey != "" {
+		return rev.SigningKey == original.SigningKey
+	}
+	return strings.EqualFold(original.From, rev.From) && original.Origin == rev.Origin
+}
@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"p2p-chat/internal/message"
+)
+
+func TestEditAndDeleteOwnMessage(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	store := attachHistoryStore(t, rt)
+	rt.sendChatMessage("helo")
+	original := sink.lastMessage()
+
+	rt.ProcessLine("/edit last hello there")
+	if len(sink.updates) != 1 || sink.updates[0].Content != "hello there" || !sink.updates[0].Edited {
+		t.Fatalf("expected edit to re-render, got %+v", sink.updates)
+	}
+	if stored, _, _ := store.Get(original.MsgID); stored.Content != "hello there" {
+		t.Fatalf("expected store to reflect edit, got %q", stored.Content)
+	}
+
+	rt.ProcessLine("/delete " + original.MsgID[:8])
+	if len(sink.updates) != 2 || !sink.updates[1].Deleted {
+		t.Fatalf("expected delete to re-render, got %+v", sink.updates)
+	}
+	buffered, _ := rt.history.Find(original.MsgID)
+	if !buffered.Deleted || buffered.Content != "" {
+		t.Fatalf("expected tombstone in history buffer, got %+v", buffered)
+	}
+}
+
+func TestEditFromAnotherSignerIsRejected(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	bob := NewIdentity("Bob", "Bob")
+	bob.SetSigningKey(newSigningKey(t))
+	mallory := NewIdentity("Bob", "Bob")
+	mallory.SetSigningKey(newSigningKey(t))
+
+	orig := message.Message{MsgID: "m1", Type: MsgTypeChat, From: "Bob", Origin: "10.0.0.2:9001", Channel: DefaultChannel, Content: "hi", Timestamp: time.Now()}
+	bob.Sign(&orig)
+	rt.processIncoming(orig, "")
+
+	forged := message.Message{MsgID: "e1", Type: MsgTypeEdit, From: "Bob", Origin: "10.0.0.9:9001", Channel: DefaultChannel, Target: "m1", Content: "pwned", Timestamp: time.Now()}
+	mallory.Sign(&forged)
+	rt.processIncoming(forged, "")
+	if len(sink.updates) != 0 {
+		t.Fatalf("forged edit should not be applied: %+v", sink.updates)
+	}
+
+	edit := message.Message{MsgID: "e2", Type: MsgTypeEdit, From: "Bob", Origin: "10.0.0.2:9001", Channel: DefaultChannel, Target: "m1", Content: "hi all", Timestamp: time.Now()}
+	bob.Sign(&edit)
+	rt.processIncoming(edit, "")
+	if len(sink.updates) != 1 || sink.updates[0].Content != "hi all" {
+		t.Fatalf("expected signer's edit to apply, got %+v", sink.updates)
+	}
+}
@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// verifyFiles re-hashes the local file store and reports files whose content
+// no longer matches their SHA-256. Flagged files are no longer served.
+func (r *Runtime) verifyFiles() {
+	if r.files == nil {
+		r.sink.ShowSystem("file store unavailable")
+		return
+	}
+	corrupt, err := r.files.Verify()
+	if err != nil {
+		r.sink.ShowSystem(fmt.Sprintf("verify failed: %v", err))
+		return
+	}
+	if len(corrupt) == 0 {
+		r.sink.ShowSystem("all stored files are intact")
+		return
+	}
+	for _, file := range corrupt {
+		r.sink.ShowSystem(fmt.Sprintf("corrupted: %s (%s, id %s): %s", file.Name, formatSize(file.Size), file.ID, file.Reason))
+	}
+}
+
+// FileGCLoop applies the file store's retention policy at startup and then
+// every FileGCInterval.
+func (r *Runtime) FileGCLoop() {
+	if r.files == nil || r.fileGCEvery <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.fileGCEvery)
+	defer ticker.Stop()
+	now := time.Now()
+	for {
+		report, err := r.files.Collect(now)
+		if err != nil {
+			log.Printf("file gc: %v", err)
+		} else if report.Expired+report.Evicted+report.KeysExpired+report.Orphans > 0 {
+			log.Printf("file gc: %d expired, %d evicted, %d share keys expired, %d orphans, %s freed",
+				report.Expired, report.Evicted, report.KeysExpired, report.Orphans, formatSize(report.Freed))
+		}
+		select {
+		case <-r.ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+	}
+}
@@ -3,57 +3,240 @@ package protocol
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"p2p-chat/internal/message"
+	"p2p-chat/internal/network"
+	"p2p-chat/internal/peerlist"
 )
 
+const (
+	// defaultHeartbeat is the re-registration interval used until the
+	// bootstrap server tells us its TTL.
+	defaultHeartbeat = 30 * time.Second
+	// maxBootstrapPages bounds how many /peers pages one fetch follows.
+	maxBootstrapPages = 20
+	// peerSyncSample bounds the addresses a PeerSync carries when the DHT
+	// can find the rest.
+	peerSyncSample = 16
+)
+
+var bootstrapClient = &http.Client{Timeout: 10 * time.Second}
+
+// capabilities lists the optional services this peer offers others.
+func (r *Runtime) capabilities() []string {
+	var caps []string
+	if r.cm != nil && r.cm.RelayService() {
+		caps = append(caps, "relay")
+	}
+	if r.holdOffline {
+		caps = append(caps, "hold-offline")
+	}
+	if r.files != nil {
+		caps = append(caps, "files")
+	}
+	if r.identity.KeyPair() != nil {
+		caps = append(caps, "dm")
+	}
+	return caps
+}
+
+// RegisterSelf announces this peer to the bootstrap servers.
 func (r *Runtime) RegisterSelf() error {
-	if r.bootstrapURL == "" {
+	every, err := r.register()
+	if err == nil {
+		r.heartbeat = every
+	}
+	return err
+}
+
+// register announces this peer to every bootstrap server at once and returns
+// how often it has to do so again to stay listed. It fails only when no
+// server accepted the registration.
+func (r *Runtime) register() (time.Duration, error) {
+	if len(r.bootstraps) == 0 {
+		return 0, nil
+	}
+	key := r.identity.SigningKey()
+	if key == nil {
+		return 0, errors.New("register: no signing key")
+	}
+	rec := peerlist.Record{
+		Namespace:    r.namespace,
+		Addr:         r.selfAddr,
+		Nick:         r.identity.Get(),
+		Capabilities: r.capabilities(),
+		Version:      network.ProtocolVersion,
+	}
+	rec.Sign(peerlist.OpRegister, key)
+	body, _ := json.Marshal(rec)
+
+	type result struct {
+		every time.Duration
+		err   error
+	}
+	results := make(chan result, len(r.bootstraps))
+	for _, base := range r.bootstraps {
+		go func(base string) {
+			every, err := registerWith(base, body)
+			results <- result{every, err}
+		}(base)
+	}
+	var heartbeat time.Duration
+	var errs []error
+	for range r.bootstraps {
+		res := <-results
+		switch {
+		case res.err != nil:
+			errs = append(errs, res.err)
+		case heartbeat == 0 || res.every < heartbeat:
+			heartbeat = res.every
+		}
+	}
+	if heartbeat == 0 {
+		return 0, errors.Join(errs...)
+	}
+	for _, err := range errs {
+		log.Printf("register: %v", err)
+	}
+	return heartbeat, nil
+}
+
+func registerWith(base string, body []byte) (time.Duration, error) {
+	resp, err := bootstrapClient.Post(strings.TrimRight(base, "/")+"/register", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		reason, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return 0, fmt.Errorf("%s: %s: %s", base, resp.Status, strings.TrimSpace(string(reason)))
+	}
+	// Older servers answer without a TTL.
+	var reply struct {
+		TTL int `json:"ttl"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil || reply.TTL <= 0 {
+		return defaultHeartbeat, nil
+	}
+	return time.Duration(reply.TTL) * time.Second / 3, nil
+}
+
+// DeregisterSelf removes this peer from every bootstrap server so others stop
+// dialing it before its registration would have expired.
+func (r *Runtime) DeregisterSelf() error {
+	if len(r.bootstraps) == 0 {
+		return nil
+	}
+	key := r.identity.SigningKey()
+	if key == nil {
 		return nil
 	}
-	payload := map[string]string{"addr": r.selfAddr}
-	body, _ := json.Marshal(payload)
-	resp, err := http.Post(strings.TrimRight(r.bootstrapURL, "/")+"/register", "application/json", bytes.NewReader(body))
+	rec := peerlist.Record{Namespace: r.namespace, Addr: r.selfAddr}
+	rec.Sign(peerlist.OpDeregister, key)
+	body, _ := json.Marshal(rec)
+
+	errs := make(chan error, len(r.bootstraps))
+	for _, base := range r.bootstraps {
+		go func(base string) { errs <- deregisterWith(base, body) }(base)
+	}
+	var all []error
+	for range r.bootstraps {
+		if err := <-errs; err != nil {
+			all = append(all, err)
+		}
+	}
+	return errors.Join(all...)
+}
+
+func deregisterWith(base string, body []byte) error {
+	req, err := http.NewRequest(http.MethodDelete, strings.TrimRight(base, "/")+"/register", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	io.Copy(io.Discard, resp.Body)
+	// A replica may have dropped the registration already when another
+	// server's deregistration reached it first.
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("%s: %s", base, resp.Status)
+	}
 	return nil
 }
 
-func fetchPeers(url string) ([]string, error) {
-	resp, err := http.Get(strings.TrimRight(url, "/") + "/peers")
-	if err != nil {
-		return nil, err
+// bootstrapPeers asks the bootstrap servers in order and returns the first
+// answer; replicated servers all serve the merged view.
+func (r *Runtime) bootstrapPeers() ([]string, error) {
+	var errs []error
+	for _, base := range r.bootstraps {
+		peers, err := fetchPeers(base, r.namespace)
+		if err == nil {
+			return peers, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", base, err))
 	}
-	defer resp.Body.Close()
+	return nil, errors.Join(errs...)
+}
+
+// fetchPeers lists every peer address the bootstrap server knows in
+// namespace, following its pages.
+func fetchPeers(base, namespace string) ([]string, error) {
 	var peers []string
-	if err := json.NewDecoder(resp.Body).Decode(&peers); err != nil {
-		return nil, err
+	after := ""
+	for page := 0; page < maxBootstrapPages; page++ {
+		query := url.Values{"namespace": {namespace}}
+		if after != "" {
+			query.Set("after", after)
+		}
+		target := strings.TrimRight(base, "/") + "/peers?" + query.Encode()
+		resp, err := bootstrapClient.Get(target)
+		if err != nil {
+			return nil, err
+		}
+		var batch []string
+		err = json.NewDecoder(resp.Body).Decode(&batch)
+		next := resp.Header.Get("X-Next-After")
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, batch...)
+		if next == "" || next == after {
+			break
+		}
+		after = next
 	}
 	return peers, nil
 }
 
 func (r *Runtime) ConnectToBootstrapPeers() {
-	if r.bootstrapURL == "" {
+	if len(r.bootstraps) == 0 {
 		return
 	}
-	peers, err := fetchPeers(r.bootstrapURL)
+	peers, err := r.bootstrapPeers()
 	if err != nil {
 		log.Printf("fetch peers: %v", err)
 		return
 	}
+	r.dialer.SyncBootstrap(peers)
 	for _, peer := range peers {
 		if peer == r.selfAddr {
 			continue
 		}
-		r.dialer.Add(peer)
 		if err := r.cm.ConnectToPeer(peer); err != nil {
 			log.Printf("connect to %s: %v", peer, err)
 		}
@@ -61,27 +244,37 @@ func (r *Runtime) ConnectToBootstrapPeers() {
 }
 
 func (r *Runtime) PollBootstrapLoop() {
-	if r.bootstrapURL == "" {
+	if len(r.bootstraps) == 0 {
 		return
 	}
 	ticker := time.NewTicker(r.pollInterval)
 	defer ticker.Stop()
+	heartbeat := r.heartbeat
+	if heartbeat <= 0 {
+		heartbeat = defaultHeartbeat
+	}
+	// Heartbeats run on their own timer: a --poll longer than the heartbeat
+	// would otherwise let the registration expire between polls.
+	renew := time.NewTimer(heartbeat)
+	defer renew.Stop()
 	for {
 		select {
 		case <-r.ctx.Done():
 			return
+		case <-renew.C:
+			if every, err := r.register(); err != nil {
+				log.Printf("re-register: %v", err)
+			} else {
+				heartbeat = every
+			}
+			renew.Reset(heartbeat)
 		case <-ticker.C:
-			peers, err := fetchPeers(r.bootstrapURL)
+			peers, err := r.bootstrapPeers()
 			if err != nil {
 				log.Printf("poll peers: %v", err)
 				continue
 			}
-			for _, peer := range peers {
-				if peer == r.selfAddr {
-					continue
-				}
-				r.dialer.Add(peer)
-			}
+			r.dialer.SyncBootstrap(peers)
 		}
 	}
 }
@@ -95,6 +288,9 @@ func (r *Runtime) GossipLoop() {
 			return
 		case <-ticker.C:
 			peers := r.dialer.Desired()
+			if r.dht != nil {
+				peers = samplePeers(peers, peerSyncSample)
+			}
 			if len(peers) == 0 {
 				continue
 			}
@@ -106,11 +302,23 @@ func (r *Runtime) GossipLoop() {
 				Timestamp: time.Now(),
 				PeerList:  peers,
 			}
+			r.identity.Sign(&msg)
 			r.cm.Broadcast(msg, "")
 		}
 	}
 }
 
+// samplePeers returns at most n of peers, picked at random so that every
+// address still spreads over a few rounds.
+func samplePeers(peers []string, n int) []string {
+	if len(peers) <= n {
+		return peers
+	}
+	out := append([]string(nil), peers...)
+	rand.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	return out[:n]
+}
+
 func (r *Runtime) UpdatePeerListLoop() {
 	ticker := time.NewTicker(3 * time.Second)
 	defer ticker.Stop()
@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"p2p-chat/internal/network"
+	"p2p-chat/internal/peerlist"
+)
+
+func TestRegisterSelfAnnouncesMetadata(t *testing.T) {
+	rt, _, _ := newTestRuntime(t)
+	var (
+		mu      sync.Mutex
+		got     peerlist.Record
+		deleted peerlist.Record
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPost:
+			_ = json.NewDecoder(r.Body).Decode(&got)
+			_, _ = w.Write([]byte(`{"ok":true,"ttl":90}`))
+		case http.MethodDelete:
+			_ = json.NewDecoder(r.Body).Decode(&deleted)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+	rt.bootstraps = []string{srv.URL}
+
+	every, err := rt.register()
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if every != 30*time.Second {
+		t.Fatalf("expected a heartbeat of a third of the TTL, got %s", every)
+	}
+	mu.Lock()
+	if got.Addr != rt.SelfAddr() || got.Nick != "tester" || got.Namespace != peerlist.DefaultNamespace || got.Version != network.ProtocolVersion {
+		t.Fatalf("unexpected registration %+v", got)
+	}
+	if err := got.Verify(peerlist.OpRegister); err != nil {
+		t.Fatalf("registration does not verify: %v", err)
+	}
+	if len(got.Capabilities) != 1 || got.Capabilities[0] != "dm" {
+		t.Fatalf("unexpected capabilities %v", got.Capabilities)
+	}
+	mu.Unlock()
+
+	if err := rt.DeregisterSelf(); err != nil {
+		t.Fatalf("deregister: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if deleted.Addr != rt.SelfAddr() || deleted.Verify(peerlist.OpDeregister) != nil {
+		t.Fatalf("expected a signed deregistration of %s, got %+v", rt.SelfAddr(), deleted)
+	}
+}
+
+func TestHeartbeatDoesNotWaitForPoll(t *testing.T) {
+	rt, _, _ := newTestRuntime(t)
+	var (
+		mu      sync.Mutex
+		renewed int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			_ = json.NewEncoder(w).Encode([]string{})
+			return
+		}
+		mu.Lock()
+		renewed++
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"ok":true,"ttl":1}`))
+	}))
+	defer srv.Close()
+	rt.bootstraps = []string{srv.URL}
+	rt.pollInterval = time.Hour
+	if err := rt.RegisterSelf(); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rt.ctx = ctx
+	done := make(chan struct{})
+	go func() {
+		rt.PollBootstrapLoop()
+		close(done)
+	}()
+	time.Sleep(time.Second)
+	cancel()
+	<-done
+	mu.Lock()
+	defer mu.Unlock()
+	if renewed < 3 {
+		t.Fatalf("expected heartbeats every third of the 1s TTL despite an hourly poll, got %d registrations", renewed)
+	}
+}
+
+func TestFetchPeersFollowsPages(t *testing.T) {
+	pages := map[string][]string{
+		"":    {"a:1", "b:1"},
+		"b:1": {"c:1"},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ns := r.URL.Query().Get("namespace"); ns != "team" {
+			t.Errorf("expected namespace team, got %q", ns)
+		}
+		after := r.URL.Query().Get("after")
+		if after == "" {
+			w.Header().Set("X-Next-After", "b:1")
+		}
+		_ = json.NewEncoder(w).Encode(pages[after])
+	}))
+	defer srv.Close()
+
+	peers, err := fetchPeers(srv.URL, "team")
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if len(peers) != 3 || peers[2] != "c:1" {
+		t.Fatalf("expected every page, got %v", peers)
+	}
+}
+
+func TestBootstrapReplicasFallBack(t *testing.T) {
+	rt, _, _ := newTestRuntime(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			_, _ = w.Write([]byte(`{"ok":true,"ttl":60}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]string{"a:1"})
+	}))
+	defer up.Close()
+	rt.bootstraps = []string{down.URL, up.URL}
+
+	every, err := rt.register()
+	if err != nil || every != 20*time.Second {
+		t.Fatalf("expected registration with the live replica, got %s, %v", every, err)
+	}
+	peers, err := rt.bootstrapPeers()
+	if err != nil || len(peers) != 1 {
+		t.Fatalf("expected peers from the live replica, got %v, %v", peers, err)
+	}
+
+	rt.bootstraps = []string{down.URL}
+	if _, err := rt.register(); err == nil {
+		t.Fatalf("expected registration to fail with every replica down")
+	}
+}
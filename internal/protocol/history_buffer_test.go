@@ -19,3 +19,17 @@ func TestHistoryBufferTrimsOldEntries(t *testing.T) {
 		t.Fatalf("unexpected order: %+v", all)
 	}
 }
+
+func TestHistoryBufferTrimsPerChannel(t *testing.T) {
+	buf := NewHistoryBuffer(2)
+	buf.Add(message.Message{MsgID: "quiet", Channel: "ops"})
+	for i := 0; i < 5; i++ {
+		buf.Add(message.Message{MsgID: string(rune('a' + i)), Channel: "general"})
+	}
+	if got := buf.Channel("ops"); len(got) != 1 || got[0].MsgID != "quiet" {
+		t.Fatalf("busy channel evicted quiet one: %+v", got)
+	}
+	if got := buf.Channel("general"); len(got) != 2 {
+		t.Fatalf("expected general trimmed to 2, got %d", len(got))
+	}
+}
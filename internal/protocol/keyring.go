@@ -0,0 +1,197 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"p2p-chat/internal/crypto"
+	"p2p-chat/internal/message"
+)
+
+var (
+	errUnsigned    = errors.New("unsigned message")
+	errBadSig      = errors.New("invalid signature")
+	errKeyMismatch = errors.New("signing key does not match pinned key")
+)
+
+// KeyRing pins the first signing key seen for each origin address and
+// nickname (trust on first use) and verifies later messages against it.
+type KeyRing struct {
+	mu            sync.Mutex
+	path          string
+	requireSigned bool
+	origins       map[string]string
+	names         map[string]string
+}
+
+type keyRingFile struct {
+	Origins map[string]string `json:"origins"`
+	Names   map[string]string `json:"names"`
+}
+
+// NewKeyRing loads pinned keys from path. An empty path keeps pins in memory
+// only. When requireSigned is set, unsigned messages are always rejected;
+// otherwise they are accepted from peers that have never signed anything.
+func NewKeyRing(path string, requireSigned bool) (*KeyRing, error) {
+	k := &KeyRing{
+		path:          path,
+		requireSigned: requireSigned,
+		origins:       make(map[string]string),
+		names:         make(map[string]string),
+	}
+	if path == "" {
+		return k, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file keyRingFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for addr, key := range file.Origins {
+		k.origins[addr] = key
+	}
+	for name, key := range file.Names {
+		k.names[name] = key
+	}
+	return k, nil
+}
+
+// Verify checks msg's signature and pins its key for the origin and sender
+// name on first use.
+func (k *KeyRing) Verify(msg message.Message) error {
+	name := strings.ToLower(msg.From)
+	if msg.Signature == "" {
+		if k.requireSigned {
+			return errUnsigned
+		}
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if _, ok := k.origins[msg.Origin]; ok && msg.Origin != "" {
+			return errUnsigned
+		}
+		if _, ok := k.names[name]; ok && name != "" {
+			return errUnsigned
+		}
+		return nil
+	}
+
+	pub, err := crypto.ParseSigningKey(msg.SigningKey)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return errBadSig
+	}
+	data, err := msg.SigningBytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, data, sig) {
+		return errBadSig
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if pinned, ok := k.origins[msg.Origin]; ok && pinned != msg.SigningKey {
+		return errKeyMismatch
+	}
+	if pinned, ok := k.names[name]; ok && pinned != msg.SigningKey {
+		return errKeyMismatch
+	}
+	changed := false
+	if msg.Origin != "" && k.origins[msg.Origin] == "" {
+		k.origins[msg.Origin] = msg.SigningKey
+		changed = true
+	}
+	if name != "" && k.names[name] == "" {
+		k.names[name] = msg.SigningKey
+		changed = true
+	}
+	if changed {
+		k.saveLocked()
+	}
+	return nil
+}
+
+// Pinned returns the key pinned for a nickname or address.
+func (k *KeyRing) Pinned(token string) (string, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.origins[token]; ok {
+		return key, true
+	}
+	key, ok := k.names[strings.ToLower(token)]
+	return key, ok
+}
+
+// PinName pins key for a nickname the user vouched for. It fails if a
+// different key is already pinned for it.
+func (k *KeyRing) PinName(name, key string) error {
+	name = strings.ToLower(name)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if pinned, ok := k.names[name]; ok {
+		if pinned == key {
+			return nil
+		}
+		return errKeyMismatch
+	}
+	k.names[name] = key
+	k.saveLocked()
+	return nil
+}
+
+// Unpin forgets the key pinned for a nickname or address so that a peer which
+// legitimately rotated its identity can be trusted again.
+func (k *KeyRing) Unpin(token string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	_, byAddr := k.origins[token]
+	_, byName := k.names[strings.ToLower(token)]
+	if !byAddr && !byName {
+		return false
+	}
+	delete(k.origins, token)
+	delete(k.names, strings.ToLower(token))
+	k.saveLocked()
+	return true
+}
+
+func (k *KeyRing) saveLocked() {
+	if k.path == "" {
+		return
+	}
+	if err := k.writeLocked(); err != nil {
+		log.Printf("keyring save: %v", err)
+	}
+}
+
+func (k *KeyRing) writeLocked() error {
+	data, err := json.MarshalIndent(keyRingFile{Origins: k.origins, Names: k.names}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(k.path), 0o755); err != nil {
+		return err
+	}
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.path)
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-chat/internal/message"
+)
+
+func signedMessage(t *testing.T, key ed25519.PrivateKey, from, origin string) message.Message {
+	t.Helper()
+	identity := NewIdentity(from, from)
+	identity.SetSigningKey(key)
+	msg := message.Message{MsgID: NewMsgID(), Type: MsgTypeChat, From: from, Origin: origin, Content: "hi", Timestamp: time.Now()}
+	identity.Sign(&msg)
+	return msg
+}
+
+func newSigningKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key
+}
+
+func TestKeyRingPinsOnFirstUse(t *testing.T) {
+	ring, _ := NewKeyRing("", false)
+	alice := newSigningKey(t)
+	if err := ring.Verify(signedMessage(t, alice, "Alice", "10.0.0.2:9001")); err != nil {
+		t.Fatalf("first signed message should be accepted: %v", err)
+	}
+	if err := ring.Verify(signedMessage(t, newSigningKey(t), "alice", "10.0.0.9:9001")); err != errKeyMismatch {
+		t.Fatalf("expected nickname spoof to be rejected, got %v", err)
+	}
+	if err := ring.Verify(signedMessage(t, newSigningKey(t), "Mallory", "10.0.0.2:9001")); err != errKeyMismatch {
+		t.Fatalf("expected origin spoof to be rejected, got %v", err)
+	}
+	unsigned := message.Message{MsgID: "u1", From: "Alice", Origin: "10.0.0.7:9001"}
+	if err := ring.Verify(unsigned); err != errUnsigned {
+		t.Fatalf("expected unsigned message for pinned name to be rejected, got %v", err)
+	}
+	if err := ring.Verify(message.Message{MsgID: "u2", From: "Carol", Origin: "10.0.0.3:9001"}); err != nil {
+		t.Fatalf("legacy unsigned peer should be accepted: %v", err)
+	}
+}
+
+func TestKeyRingRejectsTamperedMessage(t *testing.T) {
+	ring, _ := NewKeyRing("", false)
+	msg := signedMessage(t, newSigningKey(t), "Alice", "10.0.0.2:9001")
+	msg.Content = "changed"
+	if err := ring.Verify(msg); err != errBadSig {
+		t.Fatalf("expected tampered message to fail, got %v", err)
+	}
+}
+
+func TestKeyRingRequireSigned(t *testing.T) {
+	ring, _ := NewKeyRing("", true)
+	if err := ring.Verify(message.Message{MsgID: "u1", From: "Carol", Origin: "10.0.0.3:9001"}); err != errUnsigned {
+		t.Fatalf("expected unsigned message to be rejected, got %v", err)
+	}
+}
+
+func TestKeyRingPersistsAndUnpins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_keys.json")
+	ring, err := NewKeyRing(path, false)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := ring.Verify(signedMessage(t, newSigningKey(t), "Alice", "10.0.0.2:9001")); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	reloaded, err := NewKeyRing(path, false)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if _, ok := reloaded.Pinned("alice"); !ok {
+		t.Fatalf("expected pin to survive reload")
+	}
+	if !reloaded.Unpin("Alice") {
+		t.Fatalf("expected unpin to succeed")
+	}
+	if _, ok := reloaded.Pinned("alice"); ok {
+		t.Fatalf("expected pin to be removed")
+	}
+}
@@ -10,12 +10,12 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"p2p-chat/internal/authutil"
+	"p2p-chat/internal/crypto"
 	"p2p-chat/internal/message"
 	"p2p-chat/internal/storage"
 	"p2p-chat/internal/ui"
@@ -55,11 +55,94 @@ func (r *Runtime) handleCommand(line string) {
 	}
 	switch parts[0] {
 	case "/peers":
+		if len(parts) >= 2 && parts[1] == "stale" {
+			stale, err := r.stalePeers(time.Now())
+			if err != nil {
+				r.sink.ShowSystem(fmt.Sprintf("address book: %v", err))
+				return
+			}
+			for _, line := range formatStalePeers(stale, time.Now()) {
+				r.sink.ShowSystem(line)
+			}
+			return
+		}
 		conns := r.cm.ConnsList()
 		desired := r.dialer.Desired()
 		r.sink.ShowSystem(fmt.Sprintf("connected: %v | desired: %v", conns, desired))
+		for _, peer := range r.directory.Snapshot() {
+			fingerprint := peer.Fingerprint
+			if fingerprint == "" {
+				fingerprint = "unsigned"
+			}
+			r.sink.ShowSystem(fmt.Sprintf("  %s %s key=%s", peer.Name, peer.Addr, fingerprint))
+		}
+		for _, line := range formatDialTargets(r.dialer.Targets(), time.Now()) {
+			r.sink.ShowSystem(line)
+		}
+		for _, line := range formatPeerScores(r.cm.Peers(), r.cm.Pruned(), time.Now()) {
+			r.sink.ShowSystem(line)
+		}
+		if saved, err := r.book.All(); err == nil && len(saved) > 0 {
+			stale, _ := r.stalePeers(time.Now())
+			r.sink.ShowSystem(fmt.Sprintf("address book: %d saved, %d stale (/peers stale)", len(saved), len(stale)))
+		}
+	case "/dial":
+		if len(parts) < 2 {
+			r.sink.ShowSystem("usage: /dial <addr>")
+			return
+		}
+		if err := r.dialer.Dial(parts[1]); err != nil {
+			r.sink.ShowSystem(err.Error())
+			return
+		}
+		r.sink.ShowSystem(fmt.Sprintf("dialing %s", parts[1]))
+	case "/forget":
+		if len(parts) < 2 {
+			r.sink.ShowSystem("usage: /forget <addr>")
+			return
+		}
+		known := r.dialer.Forget(parts[1])
+		saved, err := r.book.Remove(parts[1])
+		if err != nil {
+			log.Printf("address book: %v", err)
+		}
+		if r.cm.Disconnect(parts[1]) || known || saved {
+			r.sink.ShowSystem(fmt.Sprintf("forgot %s", parts[1]))
+			return
+		}
+		r.sink.ShowSystem(fmt.Sprintf("%s is not a dial target or saved peer", parts[1]))
+	case "/lookup":
+		if len(parts) < 2 {
+			r.sink.ShowSystem("usage: /lookup <nick|peer-id>")
+			return
+		}
+		if r.dht == nil {
+			r.sink.ShowSystem("the DHT is disabled")
+			return
+		}
+		go r.lookupCommand(parts[1])
+	case "/rendezvous":
+		if len(parts) < 2 {
+			r.sink.ShowSystem("usage: /rendezvous <key> [note]")
+			return
+		}
+		if r.dht == nil {
+			r.sink.ShowSystem("the DHT is disabled")
+			return
+		}
+		go r.rendezvous(parts[1], strings.Join(parts[2:], " "))
+	case "/dht":
+		if r.dht == nil {
+			r.sink.ShowSystem("the DHT is disabled")
+			return
+		}
+		r.sink.ShowSystem(r.formatDHT())
 	case "/history":
-		for _, msg := range r.history.All() {
+		channel := r.channels.Active()
+		if len(parts) >= 2 && parts[1] == dmView {
+			channel = ""
+		}
+		for _, msg := range r.history.Channel(channel) {
 			r.sink.ShowMessage(msg)
 		}
 	case "/save":
@@ -74,8 +157,11 @@ func (r *Runtime) handleCommand(line string) {
 		r.sink.ShowSystem("history saved")
 	case "/load":
 		limit := 20
-		if len(parts) >= 2 {
-			if v, err := strconv.Atoi(parts[1]); err == nil {
+		channel := r.channels.Active()
+		for _, arg := range parts[1:] {
+			if arg == dmView {
+				channel = ""
+			} else if v, err := strconv.Atoi(arg); err == nil {
 				limit = v
 			}
 		}
@@ -83,14 +169,37 @@ func (r *Runtime) handleCommand(line string) {
 			r.sink.ShowSystem("history persistence disabled")
 			return
 		}
-		records, err := r.store.Recent(limit)
+		records, err := r.store.RecentChannel(channel, limit)
 		if err != nil {
 			r.sink.ShowSystem(fmt.Sprintf("load failed: %v", err))
 			return
 		}
 		for i := len(records) - 1; i >= 0; i-- {
 			r.sink.ShowMessage(records[i])
+			if records[i].Origin == r.selfAddr {
+				r.replayReceipt(records[i])
+			}
+		}
+	case "/search":
+		raw := strings.TrimSpace(strings.TrimPrefix(line, "/search"))
+		if raw == "" {
+			r.sink.ShowSystem("usage: /search <query> [from:<nick>] [before:<date>] [after:<date>]")
+			return
 		}
+		r.searchHistory(raw)
+	case "/react":
+		if len(parts) != 3 {
+			r.sink.ShowSystem("usage: /react <msgid-prefix> <emoji>")
+			return
+		}
+		r.toggleReaction(parts[1], parts[2])
+	case "/reply":
+		if len(parts) < 3 {
+			r.sink.ShowSystem("usage: /reply <msgid-prefix> <message>")
+			return
+		}
+		content := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(line, parts[0])), parts[1]))
+		r.sendReply(parts[1], content)
 	case "/msg":
 		if len(parts) < 3 {
 			r.sink.ShowSystem("usage: /msg <target> <message>")
@@ -116,6 +225,46 @@ func (r *Runtime) handleCommand(line string) {
 		if err := r.SendFileFromPath(parts[1], target); err != nil {
 			r.sink.ShowSystem(fmt.Sprintf("file send failed: %v", err))
 		}
+	case "/fetch":
+		if len(parts) != 2 {
+			r.sink.ShowSystem("usage: /fetch <file-id>")
+			return
+		}
+		r.fetchCommand(parts[1])
+	case "/verify-files":
+		r.verifyFiles()
+	case "/join":
+		if len(parts) < 2 {
+			r.sink.ShowSystem("usage: /join <channel>")
+			return
+		}
+		r.channels.Join(parts[1])
+		active := r.channels.Active()
+		r.sink.ShowSystem(fmt.Sprintf("now talking in #%s", active))
+		if r.web != nil {
+			r.web.ShowHistory(active)
+		}
+	case "/part":
+		name := r.channels.Active()
+		if len(parts) >= 2 {
+			name = NormalizeChannel(parts[1])
+		}
+		if !r.channels.Part(name) {
+			r.sink.ShowSystem(fmt.Sprintf("cannot leave #%s", name))
+			return
+		}
+		r.sink.ShowSystem(fmt.Sprintf("left #%s, now talking in #%s", name, r.channels.Active()))
+	case "/channels":
+		active := r.channels.Active()
+		names := r.channels.List()
+		for i, name := range names {
+			if name == active {
+				names[i] = "*#" + name
+			} else {
+				names[i] = "#" + name
+			}
+		}
+		r.sink.ShowSystem(fmt.Sprintf("channels: %s", strings.Join(names, " ")))
 	case "/nick":
 		if len(parts) < 2 {
 			r.sink.ShowSystem("usage: /nick <name>")
@@ -124,6 +273,7 @@ func (r *Runtime) handleCommand(line string) {
 		if r.identity.SetDisplay(parts[1]) {
 			r.sink.ShowSystem(fmt.Sprintf("nickname set to %s", parts[1]))
 			r.BroadcastHandshake()
+			go r.publishSelf()
 		}
 	case "/stats":
 		snap := r.metrics.Snapshot()
@@ -142,13 +292,85 @@ func (r *Runtime) handleCommand(line string) {
 		}
 		r.blocklist.Remove(parts[1])
 		r.sink.ShowSystem(fmt.Sprintf("unblocked %s", parts[1]))
+	case "/pin":
+		if len(parts) < 3 {
+			r.sink.ShowSystem("usage: /pin <nick> <fingerprint>")
+			return
+		}
+		if r.dht == nil {
+			r.sink.ShowSystem("the DHT is disabled")
+			return
+		}
+		go r.pinCommand(parts[1], parts[2])
+	case "/unpin":
+		if len(parts) < 2 {
+			r.sink.ShowSystem("usage: /unpin <name|addr>")
+			return
+		}
+		if !r.keyring.Unpin(parts[1]) {
+			r.sink.ShowSystem(fmt.Sprintf("no key pinned for %s", parts[1]))
+			return
+		}
+		r.sink.ShowSystem(fmt.Sprintf("forgot pinned key for %s", parts[1]))
 	case "/blocked":
 		r.sink.ShowSystem(fmt.Sprintf("blocked: %v", r.blocklist.List()))
+	case "/read":
+		if len(parts) < 2 {
+			r.sink.ShowSystem("usage: /read <msgid>")
+			return
+		}
+		r.MarkRead(parts[1])
+	case "/edit":
+		if len(parts) < 3 {
+			r.sink.ShowSystem("usage: /edit <msgid|last> <new text>")
+			return
+		}
+		content := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(line, parts[0])), parts[1]))
+		r.editMessage(parts[1], content)
+	case "/delete":
+		if len(parts) < 2 {
+			r.sink.ShowSystem("usage: /delete <msgid|last>")
+			return
+		}
+		r.deleteMessage(parts[1])
 	case "/quit":
 		r.sink.ShowSystem("bye")
 		os.Exit(0)
 	default:
-		r.sink.ShowSystem("commands: /peers /history /save /load /msg /file /nick /stats /block /unblock /blocked /quit")
+		r.sink.ShowSystem("commands: /peers /dial /forget /lookup /rendezvous /dht /history /save /load /search /reply /react /msg /file /fetch /verify-files /join /part /channels /nick /stats /block /unblock /blocked /pin /unpin /read /edit /delete /quit")
+	}
+}
+
+// dmView is the argument that points /history and /load at direct messages,
+// which are kept apart from every room.
+const dmView = "dm"
+
+// searchResultLimit bounds how many matches /search prints.
+const searchResultLimit = 20
+
+func (r *Runtime) searchHistory(raw string) {
+	if r.store == nil {
+		r.sink.ShowSystem("history persistence disabled")
+		return
+	}
+	query, err := storage.ParseSearchQuery(raw)
+	if err != nil {
+		r.sink.ShowSystem(fmt.Sprintf("search: %v", err))
+		return
+	}
+	query.Limit = searchResultLimit
+	results, err := r.store.Search(query)
+	if err != nil {
+		r.sink.ShowSystem(fmt.Sprintf("search failed: %v", err))
+		return
+	}
+	if len(results) == 0 {
+		r.sink.ShowSystem(fmt.Sprintf("no messages match %q", raw))
+		return
+	}
+	r.sink.ShowSystem(fmt.Sprintf("%d matches for %q (newest last):", len(results), raw))
+	for i := len(results) - 1; i >= 0; i-- {
+		r.sink.ShowMessage(results[i])
 	}
 }
 
@@ -157,19 +379,31 @@ func (r *Runtime) HandleIncoming() {
 		select {
 		case <-r.ctx.Done():
 			return
-		case msg, ok := <-r.cm.Incoming:
+		case in, ok := <-r.cm.Incoming:
 			if !ok {
 				return
 			}
-			r.processIncoming(msg)
+			r.processIncoming(in.Msg, in.From)
 		}
 	}
 }
 
-func (r *Runtime) processIncoming(msg message.Message) {
+// processIncoming handles a message that arrived on the connection from, which
+// is empty for messages that did not come off the wire.
+func (r *Runtime) processIncoming(msg message.Message, from string) {
 	if msg.MsgID == "" {
 		msg.MsgID = NewMsgID()
 	}
+	r.metrics.IncReceived()
+	if r.cache.Has(msg.MsgID) {
+		r.metrics.IncDuplicate()
+		return
+	}
+	if err := r.keyring.Verify(msg); err != nil {
+		log.Printf("dropping msg %s from %s (%s): %v", msg.MsgID, msg.From, msg.Origin, err)
+		r.metrics.IncRejected()
+		return
+	}
 	if r.cache.Seen(msg.MsgID) {
 		return
 	}
@@ -182,11 +416,45 @@ func (r *Runtime) processIncoming(msg message.Message) {
 
 	switch msg.Type {
 	case MsgTypeAck:
+		if msg.ToAddr == "" {
+			r.cm.ObserveAck(from, msg.AckFor)
+		}
+		if msg.ToAddr != "" && msg.ToAddr != r.selfAddr {
+			if r.holdOffline {
+				if _, _, err := r.outbox.Remove(msg.AckFor); err != nil {
+					log.Printf("outbox remove: %v", err)
+				}
+			}
+			r.relay.Forward(msg, from)
+			return
+		}
 		if msg.AckFor != "" {
-			r.ack.Confirm(msg.AckFor)
+			pending := r.ack.Confirm(msg.AckFor)
 			r.metrics.IncAck()
+			r.confirmQueued(msg)
+			if pending || r.ownsMessage(msg.AckFor) {
+				r.markReceipt(msg.AckFor, storage.ReceiptDelivered, msg.From)
+			}
 		}
 		return
+	case MsgTypeRead:
+		r.handleRead(msg, from)
+		return
+	case MsgTypeSyncReq:
+		r.serveSync(msg, from)
+		return
+	case MsgTypeSyncResp:
+		r.mergeSync(msg, from)
+		return
+	case MsgTypeFileReq:
+		r.handleFileRequest(msg, from)
+		return
+	case MsgTypeFileChunk:
+		r.handleFileChunk(msg, from)
+		return
+	case MsgTypeIHave, MsgTypeIWant:
+		r.handleGossipControl(msg, from)
+		return
 	case MsgTypePeerSync:
 		for _, peer := range msg.PeerList {
 			r.dialer.Add(peer)
@@ -201,45 +469,104 @@ func (r *Runtime) processIncoming(msg message.Message) {
 			}
 		}
 		r.directory.Record(msg.From, msg.Origin)
+		r.directory.SetSigningKey(msg.Origin, msg.SigningKey)
+		r.rememberPeer(msg)
+		r.learnDHTPeer(msg.Origin)
+		if msg.PublicKey != "" {
+			if key, err := crypto.ParsePublicKey(msg.PublicKey); err == nil {
+				r.directory.SetPublicKey(msg.Origin, key)
+			} else {
+				log.Printf("handshake key from %s: %v", msg.Origin, err)
+			}
+		}
 		r.sink.UpdatePeers(r.directory.Snapshot())
+		r.noteNeighbour(msg.Origin, from)
+		r.flushOutbox(msg.From, msg.Origin, from)
+		r.resumeTransfers(msg.Origin)
+		r.requestSync(from)
 		return
 	}
 
 	r.directory.Record(msg.From, msg.Origin)
+	r.directory.SetSigningKey(msg.Origin, msg.SigningKey)
 
 	if r.blocklist.Blocks(msg.From, msg.Origin) {
 		return
 	}
 
+	// Relays forward the message exactly as received so the signature still
+	// verifies downstream.
+	relay := msg
+	if channelScoped(msg) {
+		msg.Channel = NormalizeChannel(msg.Channel)
+		if !r.channels.Joined(msg.Channel) {
+			r.relay.Forward(relay, from)
+			return
+		}
+	}
+
 	if msg.ToAddr != "" && msg.ToAddr != r.selfAddr {
-		r.cm.Broadcast(msg, "")
+		r.holdForRecipient(relay)
+		r.relay.Forward(relay, from)
 		return
 	}
 	if msg.To != "" && !strings.EqualFold(msg.To, r.identity.Get()) && msg.ToAddr == "" {
-		r.cm.Broadcast(msg, "")
+		r.holdForRecipient(relay)
+		r.relay.Forward(relay, from)
+		return
+	}
+
+	if msg.Sealed {
+		plain, err := r.identity.KeyPair().Open(msg.Content)
+		if err != nil {
+			log.Printf("dm %s from %s: %v", msg.MsgID, msg.Origin, err)
+			return
+		}
+		msg.Content = string(plain)
+		msg.Sealed = false
+	}
+
+	if msg.Type == MsgTypeEdit || msg.Type == MsgTypeDelete {
+		r.applyRevision(msg)
+		r.relay.Forward(relay, from)
+		return
+	}
+	if msg.Type == MsgTypeReaction {
+		r.applyReaction(msg)
+		r.relay.Forward(relay, from)
 		return
 	}
 
-	r.history.Add(msg)
 	if err := r.store.Append(msg); err != nil {
 		log.Printf("history append: %v", err)
 	}
+	msg = r.withReactions(msg)
+	r.history.Add(msg)
 	r.metrics.IncSeen()
 	r.sink.ShowMessage(msg)
 	r.maybeNotify(msg)
 	r.sendAck(msg)
-	r.cm.Broadcast(msg, "")
+	r.relay.Forward(relay, from)
+	r.fetchAttachments(msg)
 }
 
 func (r *Runtime) sendChatMessage(content string) {
+	r.postChat(r.channels.Active(), content, nil)
+}
+
+// postChat sends content to channel, optionally as a reply to parent.
+func (r *Runtime) postChat(channel, content string, parent *message.Message) {
 	msg := message.Message{
 		MsgID:     NewMsgID(),
 		Type:      MsgTypeChat,
 		From:      r.identity.Get(),
 		Origin:    r.selfAddr,
+		Channel:   channel,
 		Content:   content,
 		Timestamp: time.Now(),
 	}
+	threadReply(&msg, parent)
+	r.identity.Sign(&msg)
 	r.cache.Seen(msg.MsgID)
 	r.history.Add(msg)
 	if err := r.store.Append(msg); err != nil {
@@ -247,14 +574,36 @@ func (r *Runtime) sendChatMessage(content string) {
 	}
 	r.metrics.IncSent()
 	r.sink.ShowMessage(msg)
-	r.cm.Broadcast(msg, "")
+	r.relay.Publish(msg)
+	r.cm.ExpectAck(msg.MsgID, channel)
 	r.ack.Track(msg)
+	r.markReceipt(msg.MsgID, storage.ReceiptSent, "")
 	r.persistExternal(msg, "")
 }
 
 func (r *Runtime) sendDirectMessage(target, content string) {
+	r.postDirect(target, content, nil)
+}
+
+// postDirect seals content to target, optionally as a reply to parent.
+func (r *Runtime) postDirect(target, content string, parent *message.Message) {
 	addr, resolvedName, _ := r.directory.Resolve(target)
 	recipient := chooseName(target, resolvedName)
+	key, ok := r.directory.PublicKey(target)
+	if !ok && r.dht != nil {
+		r.sink.ShowSystem(fmt.Sprintf("looking up %s in the DHT...", recipient))
+		go r.resolveDirect(target, content, parent)
+		return
+	}
+	if !ok {
+		r.sink.ShowSystem(fmt.Sprintf("no encryption key known for %s yet; wait for their handshake", recipient))
+		return
+	}
+	sealed, err := crypto.SealFor(key, []byte(content))
+	if err != nil {
+		r.sink.ShowSystem(fmt.Sprintf("dm encrypt failed: %v", err))
+		return
+	}
 	msg := message.Message{
 		MsgID:     NewMsgID(),
 		Type:      MsgTypeDM,
@@ -265,6 +614,7 @@ func (r *Runtime) sendDirectMessage(target, content string) {
 		Content:   content,
 		Timestamp: time.Now(),
 	}
+	threadReply(&msg, parent)
 	r.cache.Seen(msg.MsgID)
 	r.history.Add(msg)
 	if err := r.store.Append(msg); err != nil {
@@ -272,27 +622,16 @@ func (r *Runtime) sendDirectMessage(target, content string) {
 	}
 	r.metrics.IncSent()
 	r.sink.ShowMessage(msg)
-	r.cm.Broadcast(msg, "")
-	r.ack.Track(msg)
+	wire := msg
+	wire.Content = sealed
+	wire.Sealed = true
+	r.identity.Sign(&wire)
+	r.relay.Publish(wire)
+	r.ack.Track(wire)
+	r.markReceipt(msg.MsgID, storage.ReceiptSent, "")
 	r.persistExternal(msg, recipient)
 }
 
-func (r *Runtime) SendFileFromPath(path, target string) error {
-	if r.files == nil || r.web == nil {
-		return fmt.Errorf("file sharing requires --web")
-	}
-	file, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-	record, err := r.files.Save(filepath.Base(path), r.identity.Get(), file)
-	if err != nil {
-		return err
-	}
-	return r.ShareFile(record, target)
-}
-
 func chooseName(target, resolved string) string {
 	if resolved != "" {
 		return resolved
@@ -337,6 +676,9 @@ func (r *Runtime) persistExternal(msg message.Message, receiver string) {
 	}(url, body, token)
 }
 
+// sendAck confirms receipt to the sender. Acks for direct messages are
+// addressed so relays carry them back across the mesh; acks for room traffic
+// only go to direct neighbours.
 func (r *Runtime) sendAck(original message.Message) {
 	ackMsg := message.Message{
 		MsgID:     NewMsgID(),
@@ -344,10 +686,13 @@ func (r *Runtime) sendAck(original message.Message) {
 		From:      r.identity.Get(),
 		Origin:    r.selfAddr,
 		To:        original.From,
-		ToAddr:    original.Origin,
 		AckFor:    original.MsgID,
 		Timestamp: time.Now(),
 	}
+	if original.Type == MsgTypeDM || (original.Type == MsgTypeFile && original.ToAddr != "") {
+		ackMsg.ToAddr = original.Origin
+	}
+	r.identity.Sign(&ackMsg)
 	r.cm.Broadcast(ackMsg, "")
 }
 
@@ -362,8 +707,10 @@ func (r *Runtime) BroadcastHandshake() {
 		From:      name,
 		Origin:    r.selfAddr,
 		AuthToken: r.identity.Token(),
+		PublicKey: r.identity.KeyPair().PublicKeyString(),
 		Timestamp: time.Now(),
 	}
+	r.identity.Sign(&msg)
 	r.cm.Broadcast(msg, "")
 }
 
@@ -402,17 +749,25 @@ func saveHistoryToFile(entries []message.Message, path string) error {
 	return os.WriteFile(path, data, 0o644)
 }
 
+// ShareFile announces record to target, or to the active room when target is
+// empty. Peers fetch it in chunks over the mesh; with the web UI enabled the
+// announcement also carries a download link.
 func (r *Runtime) ShareFile(record storage.FileRecord, target string) error {
-	if r.web == nil {
-		return fmt.Errorf("file sharing unavailable (web UI disabled)")
+	if r.files == nil && r.web == nil {
+		return fmt.Errorf("file sharing unavailable (no file store)")
 	}
-	downloadURL := r.buildDownloadURL(record)
 	attachment := message.Attachment{
-		ID:   record.ID,
-		Name: record.Name,
-		Size: record.Size,
-		Mime: record.Mime,
-		URL:  downloadURL,
+		ID:     record.ID,
+		Name:   record.Name,
+		Size:   record.Size,
+		Mime:   record.Mime,
+		URL:    r.buildDownloadURL(record),
+		SHA256: record.SHA256,
+
+		Width:       record.Width,
+		Height:      record.Height,
+		ThumbWidth:  record.ThumbWidth,
+		ThumbHeight: record.ThumbHeight,
 	}
 
 	msg := message.Message{
@@ -430,9 +785,21 @@ func (r *Runtime) ShareFile(record storage.FileRecord, target string) error {
 		msg.To = recipient
 		msg.ToAddr = addr
 		msg.Content = fmt.Sprintf("sent a file to %s: %s", recipient, record.Name)
+		if r.files != nil {
+			if err := r.files.MarkShared(record.ID, recipient, addr); err != nil {
+				return err
+			}
+		}
 	} else {
+		msg.Channel = r.channels.Active()
 		msg.Content = fmt.Sprintf("shared a file: %s", record.Name)
+		if r.files != nil {
+			if err := r.files.MarkShared(record.ID, "*"); err != nil {
+				return err
+			}
+		}
 	}
+	r.identity.Sign(&msg)
 
 	r.cache.Seen(msg.MsgID)
 	r.history.Add(msg)
@@ -443,8 +810,9 @@ func (r *Runtime) ShareFile(record storage.FileRecord, target string) error {
 	}
 	r.metrics.IncSent()
 	r.sink.ShowMessage(msg)
-	r.cm.Broadcast(msg, "")
+	r.relay.Publish(msg)
 	r.ack.Track(msg)
+	r.markReceipt(msg.MsgID, storage.ReceiptSent, "")
 	return nil
 }
 
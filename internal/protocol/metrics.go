@@ -7,31 +7,51 @@ import (
 
 // Metrics captures a snapshot of sent/seen/acked counters for diagnostics.
 type Metrics struct {
-	mu    sync.Mutex
-	sent  int
-	seen  int
-	acked int
+	mu       sync.Mutex
+	sent     int
+	seen     int
+	acked    int
+	rejected int
+	received int
+	dupes    int
 }
 
 func NewMetrics() *Metrics { return &Metrics{} }
 
-func (m *Metrics) IncSent() { m.mu.Lock(); m.sent++; m.mu.Unlock() }
-func (m *Metrics) IncSeen() { m.mu.Lock(); m.seen++; m.mu.Unlock() }
-func (m *Metrics) IncAck()  { m.mu.Lock(); m.acked++; m.mu.Unlock() }
+func (m *Metrics) IncSent()      { m.mu.Lock(); m.sent++; m.mu.Unlock() }
+func (m *Metrics) IncSeen()      { m.mu.Lock(); m.seen++; m.mu.Unlock() }
+func (m *Metrics) IncAck()       { m.mu.Lock(); m.acked++; m.mu.Unlock() }
+func (m *Metrics) IncRejected()  { m.mu.Lock(); m.rejected++; m.mu.Unlock() }
+func (m *Metrics) IncReceived()  { m.mu.Lock(); m.received++; m.mu.Unlock() }
+func (m *Metrics) IncDuplicate() { m.mu.Lock(); m.dupes++; m.mu.Unlock() }
 
 func (m *Metrics) Snapshot() MetricsSnapshot {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	return MetricsSnapshot{Sent: m.sent, Seen: m.seen, Acked: m.acked}
+	return MetricsSnapshot{Sent: m.sent, Seen: m.seen, Acked: m.acked, Rejected: m.rejected, Received: m.received, Duplicates: m.dupes}
 }
 
 // MetricsSnapshot is printed in `/stats` command output.
 type MetricsSnapshot struct {
-	Sent  int
-	Seen  int
-	Acked int
+	Sent     int
+	Seen     int
+	Acked    int
+	Rejected int
+	// Received counts every frame handed to the router, Duplicates the ones
+	// that had already been seen.
+	Received   int
+	Duplicates int
+}
+
+// DuplicateRatio is the share of received frames that were redundant copies.
+func (s MetricsSnapshot) DuplicateRatio() float64 {
+	if s.Received == 0 {
+		return 0
+	}
+	return float64(s.Duplicates) / float64(s.Received)
 }
 
 func (s MetricsSnapshot) String() string {
-	return fmt.Sprintf("sent=%d seen=%d acked=%d", s.Sent, s.Seen, s.Acked)
+	return fmt.Sprintf("sent=%d seen=%d acked=%d rejected=%d received=%d duplicates=%d dup_ratio=%.2f",
+		s.Sent, s.Seen, s.Acked, s.Rejected, s.Received, s.Duplicates, s.DuplicateRatio())
 }
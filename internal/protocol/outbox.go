@@ -0,0 +1,186 @@
+package protocol
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"p2p-chat/internal/message"
+	"p2p-chat/internal/storage"
+)
+
+const (
+	outboxTTL           = 7 * 24 * time.Hour
+	outboxSweepEvery    = 10 * time.Minute
+	outboxFlushCooldown = time.Minute
+)
+
+// outboxRecipient is the key undelivered messages are filed under.
+func outboxRecipient(msg message.Message) string {
+	if msg.ToAddr != "" {
+		return msg.ToAddr
+	}
+	return strings.ToLower(msg.To)
+}
+
+// parkUndelivered receives messages the ack tracker gave up on. Direct
+// messages are kept in the outbox until the recipient reconnects; anything
+// else is dropped as before.
+func (r *Runtime) parkUndelivered(msg message.Message) {
+	if msg.Type != MsgTypeDM || r.outbox == nil {
+		log.Printf("dropping msg %s after %d attempts", msg.MsgID, ackMaxAttempts)
+		return
+	}
+	entry := storage.OutboxEntry{Recipient: outboxRecipient(msg), Msg: msg}
+	if err := r.outbox.Put(entry); err != nil {
+		log.Printf("outbox put: %v", err)
+		return
+	}
+	r.sink.ShowSystem(fmt.Sprintf("%s seems offline; message queued until they reconnect", msg.To))
+}
+
+// holdForRecipient keeps a copy of a direct message this peer is relaying so
+// it can be handed over if the recipient turns up later. Only relays started
+// with --hold-offline do this, only for sealed payloads they cannot read and
+// only while the recipient is not one of our neighbours.
+func (r *Runtime) holdForRecipient(msg message.Message) {
+	if !r.holdOffline || r.outbox == nil || msg.Type != MsgTypeDM || !msg.Sealed {
+		return
+	}
+	addr := msg.ToAddr
+	if addr == "" {
+		addr, _, _ = r.directory.Resolve(msg.To)
+	}
+	if _, ok := r.neighbourConn(addr); ok {
+		return
+	}
+	entry := storage.OutboxEntry{Recipient: outboxRecipient(msg), Relayed: true, Msg: msg}
+	if err := r.outbox.Put(entry); err != nil {
+		log.Printf("outbox hold: %v", err)
+	}
+}
+
+// noteNeighbour records that the peer listening at addr is directly
+// connected on conn. Handshakes are never relayed, so the connection one
+// arrives on leads straight to its sender.
+func (r *Runtime) noteNeighbour(addr, conn string) {
+	if addr == "" || conn == "" {
+		return
+	}
+	r.outboxMu.Lock()
+	defer r.outboxMu.Unlock()
+	r.neighbours[addr] = conn
+}
+
+// neighbourConn returns the connection to the peer listening at addr if it
+// is still open.
+func (r *Runtime) neighbourConn(addr string) (string, bool) {
+	if addr == "" {
+		return "", false
+	}
+	r.outboxMu.Lock()
+	conn, ok := r.neighbours[addr]
+	r.outboxMu.Unlock()
+	if !ok || !r.relay.Connected(conn) {
+		return "", false
+	}
+	return conn, true
+}
+
+// flushOutbox re-sends everything queued for a peer that just announced
+// itself with a handshake on connection from. Our own messages go straight
+// to it on that connection, since relays that saw them on the first attempt
+// would drop them as duplicates, and stay queued until acked. Copies held for
+// others are handed to it directly and then dropped.
+func (r *Runtime) flushOutbox(name, addr, from string) {
+	if r.outbox == nil {
+		return
+	}
+	for _, key := range []string{addr, strings.ToLower(name)} {
+		if key == "" || !r.claimFlush(key) {
+			continue
+		}
+		entries, err := r.outbox.Pending(key)
+		if err != nil {
+			log.Printf("outbox pending: %v", err)
+			continue
+		}
+		for _, entry := range entries {
+			if entry.Relayed {
+				r.handOver(entry.Msg, from)
+				continue
+			}
+			if from == "" || r.relay.Direct(from, entry.Msg) != nil {
+				r.relay.Publish(entry.Msg)
+			}
+			r.ack.Track(entry.Msg)
+		}
+		if len(entries) > 0 {
+			log.Printf("flushed %d queued messages to %s", len(entries), key)
+		}
+	}
+}
+
+// handOver delivers a held direct message to its recipient on conn and
+// forgets it.
+func (r *Runtime) handOver(msg message.Message, conn string) {
+	if conn == "" {
+		return
+	}
+	if err := r.relay.Direct(conn, msg); err != nil {
+		log.Printf("outbox hand over %s: %v", msg.MsgID, err)
+		return
+	}
+	if _, _, err := r.outbox.Remove(msg.MsgID); err != nil {
+		log.Printf("outbox remove: %v", err)
+	}
+}
+
+// claimFlush rate limits flushes per recipient since presence heartbeats
+// repeat the handshake every few seconds.
+func (r *Runtime) claimFlush(key string) bool {
+	r.outboxMu.Lock()
+	defer r.outboxMu.Unlock()
+	now := time.Now()
+	if last, ok := r.outboxFlushed[key]; ok && now.Sub(last) < outboxFlushCooldown {
+		return false
+	}
+	r.outboxFlushed[key] = now
+	return true
+}
+
+// confirmQueued clears an acked message from the outbox and tells the user
+// when one of their queued messages finally got through.
+func (r *Runtime) confirmQueued(ack message.Message) {
+	entry, ok, err := r.outbox.Remove(ack.AckFor)
+	if err != nil {
+		log.Printf("outbox remove: %v", err)
+		return
+	}
+	if !ok || entry.Relayed {
+		return
+	}
+	r.sink.ShowSystem(fmt.Sprintf("queued message to %s delivered (acked by %s)", entry.Msg.To, ack.From))
+}
+
+// OutboxLoop expires queued messages that never found their recipient.
+func (r *Runtime) OutboxLoop() {
+	if r.outbox == nil {
+		return
+	}
+	ticker := time.NewTicker(outboxSweepEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n, err := r.outbox.Expire(now.Add(-outboxTTL)); err != nil {
+				log.Printf("outbox expire: %v", err)
+			} else if n > 0 {
+				log.Printf("expired %d undelivered messages", n)
+			}
+		}
+	}
+}
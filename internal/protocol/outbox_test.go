@@ -0,0 +1,126 @@
+package protocol
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-chat/internal/message"
+	"p2p-chat/internal/storage"
+)
+
+func attachOutbox(t *testing.T, rt *Runtime) *storage.Outbox {
+	t.Helper()
+	outbox, err := storage.OpenOutbox(filepath.Join(t.TempDir(), "outbox.db"))
+	if err != nil {
+		t.Fatalf("open outbox: %v", err)
+	}
+	t.Cleanup(func() { _ = outbox.Close() })
+	rt.outbox = outbox
+	return outbox
+}
+
+func TestUndeliveredDMIsQueuedAndFlushedOnHandshake(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	outbox := attachOutbox(t, rt)
+	dm := message.Message{MsgID: "dm1", Type: MsgTypeDM, From: "tester", To: "Bob", ToAddr: "10.0.0.2:9001", Content: "sealed", Sealed: true}
+	rt.parkUndelivered(dm)
+	if pending, _ := outbox.Pending("10.0.0.2:9001"); len(pending) != 1 {
+		t.Fatalf("expected dm to be queued, got %d", len(pending))
+	}
+
+	// Relays saw dm1 on the first attempt and would drop it, so it goes to
+	// Bob on his own connection only.
+	transport := newFakeTransport("conn-bob", "conn-carol")
+	rt.relay = NewRelay(RelayFlood, 0, transport)
+	rt.processIncoming(message.Message{MsgID: "hs1", Type: MsgTypeHandshake, From: "Bob", Origin: "10.0.0.2:9001"}, "conn-bob")
+	if rt.ack.pending["dm1"] == nil {
+		t.Fatalf("expected flushed dm to be tracked again")
+	}
+	transport.mu.Lock()
+	toBob := false
+	for _, msg := range transport.sent["conn-bob"] {
+		toBob = toBob || msg.MsgID == "dm1"
+	}
+	toCarol := len(transport.sent["conn-carol"])
+	transport.mu.Unlock()
+	if !toBob || toCarol != 0 {
+		t.Fatalf("expected the dm on Bob's connection only, sent %+v", transport.sent)
+	}
+
+	rt.processIncoming(message.Message{MsgID: "ack1", Type: MsgTypeAck, From: "Bob", Origin: "10.0.0.2:9001", ToAddr: rt.selfAddr, AckFor: "dm1"}, "")
+	if pending, _ := outbox.Pending("10.0.0.2:9001"); len(pending) != 0 {
+		t.Fatalf("expected ack to clear the outbox")
+	}
+	found := false
+	for _, line := range sink.systems {
+		if strings.Contains(line, "delivered") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected delivered notice, got %v", sink.systems)
+	}
+}
+
+func TestHoldOfflineRelayKeepsSealedDMUntilAck(t *testing.T) {
+	rt, _, _ := newTestRuntime(t)
+	outbox := attachOutbox(t, rt)
+	rt.holdOffline = true
+	rt.processIncoming(message.Message{MsgID: "dm2", Type: MsgTypeDM, From: "Alice", Origin: "10.0.0.1:9001", To: "Bob", ToAddr: "10.0.0.2:9001", Content: "x", Sealed: true}, "")
+	if pending, _ := outbox.Pending("10.0.0.2:9001"); len(pending) != 1 || !pending[0].Relayed {
+		t.Fatalf("expected relay to hold the dm: %+v", pending)
+	}
+	rt.processIncoming(message.Message{MsgID: "ack2", Type: MsgTypeAck, From: "Bob", Origin: "10.0.0.2:9001", ToAddr: "10.0.0.1:9001", AckFor: "dm2"}, "")
+	if pending, _ := outbox.Pending("10.0.0.2:9001"); len(pending) != 0 {
+		t.Fatalf("expected passing ack to release the held dm")
+	}
+}
+
+func TestHoldOfflineSkipsNeighboursAndHandsOverDirectly(t *testing.T) {
+	rt, _, _ := newTestRuntime(t)
+	outbox := attachOutbox(t, rt)
+	rt.holdOffline = true
+	transport := newFakeTransport("conn-bob")
+	rt.relay = NewRelay(RelayGossip, 1, transport)
+	dm := message.Message{MsgID: "dm3", Type: MsgTypeDM, From: "Alice", Origin: "10.0.0.1:9001", To: "Bob", ToAddr: "10.0.0.2:9001", Content: "x", Sealed: true}
+
+	rt.processIncoming(message.Message{MsgID: "hs3", Type: MsgTypeHandshake, From: "Bob", Origin: "10.0.0.2:9001"}, "conn-bob")
+	rt.processIncoming(dm, "conn-alice")
+	if pending, _ := outbox.Pending("10.0.0.2:9001"); len(pending) != 0 {
+		t.Fatalf("a dm for a current neighbour should not be held: %+v", pending)
+	}
+
+	// Once Bob is gone the copy is held, and handed to him directly when he
+	// is back.
+	transport.mu.Lock()
+	transport.peers = nil
+	transport.mu.Unlock()
+	dm.MsgID = "dm4"
+	rt.processIncoming(dm, "conn-alice")
+	if pending, _ := outbox.Pending("10.0.0.2:9001"); len(pending) != 1 {
+		t.Fatalf("expected the dm to be held while Bob is away: %+v", pending)
+	}
+	// Skip the flush cooldown the first handshake started.
+	rt.outboxMu.Lock()
+	rt.outboxFlushed = make(map[string]time.Time)
+	rt.outboxMu.Unlock()
+	transport.mu.Lock()
+	transport.peers = []string{"conn-bob2"}
+	transport.sent = make(map[string][]message.Message)
+	transport.mu.Unlock()
+	rt.processIncoming(message.Message{MsgID: "hs4", Type: MsgTypeHandshake, From: "Bob", Origin: "10.0.0.2:9001"}, "conn-bob2")
+	handed := false
+	for _, msg := range transport.sent["conn-bob2"] {
+		if msg.MsgID == "dm4" {
+			handed = true
+		}
+	}
+	if !handed {
+		t.Fatalf("expected the held dm to be handed to Bob directly, sent %+v", transport.sent)
+	}
+	if pending, _ := outbox.Pending("10.0.0.2:9001"); len(pending) != 0 {
+		t.Fatalf("expected the held copy to be dropped after the hand over: %+v", pending)
+	}
+}
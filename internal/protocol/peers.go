@@ -1,11 +1,14 @@
 package protocol
 
 import (
+	"fmt"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"p2p-chat/internal/crypto"
+	"p2p-chat/internal/network"
 	"p2p-chat/internal/ui"
 )
 
@@ -59,10 +62,12 @@ func (b *BlockList) List() []string {
 }
 
 type peerEntry struct {
-	Name     string
-	Addr     string
-	Online   bool
-	LastSeen time.Time
+	Name        string
+	Addr        string
+	Online      bool
+	LastSeen    time.Time
+	PublicKey   *[32]byte
+	Fingerprint string
 }
 
 // PeerDirectory tracks known peers and their presence info.
@@ -102,6 +107,49 @@ func (p *PeerDirectory) Record(name, addr string) {
 	p.byName[key] = entry
 }
 
+// SetPublicKey stores the DM encryption key announced by the peer at addr.
+func (p *PeerDirectory) SetPublicKey(addr string, key *[32]byte) {
+	if addr == "" || key == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, ok := p.byAddr[addr]
+	if !ok {
+		entry = &peerEntry{Name: addr, Addr: addr}
+		p.byAddr[addr] = entry
+		p.byName[strings.ToLower(addr)] = entry
+	}
+	entry.PublicKey = key
+}
+
+// SetSigningKey records the fingerprint of the verified signing key used by the
+// peer at addr.
+func (p *PeerDirectory) SetSigningKey(addr, key string) {
+	if addr == "" || key == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if entry, ok := p.byAddr[addr]; ok {
+		entry.Fingerprint = crypto.Fingerprint(key)
+	}
+}
+
+// PublicKey looks up the DM encryption key for a nickname or address.
+func (p *PeerDirectory) PublicKey(token string) (*[32]byte, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	entry, ok := p.byAddr[token]
+	if !ok {
+		entry, ok = p.byName[strings.ToLower(token)]
+	}
+	if !ok || entry.PublicKey == nil {
+		return nil, false
+	}
+	return entry.PublicKey, true
+}
+
 func (p *PeerDirectory) MarkActive(addrs []string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -137,9 +185,10 @@ func (p *PeerDirectory) Snapshot() []ui.Presence {
 	list := make([]ui.Presence, 0, len(p.byAddr))
 	for _, entry := range p.byAddr {
 		list = append(list, ui.Presence{
-			Name:   entry.Name,
-			Addr:   entry.Addr,
-			Online: entry.Online,
+			Name:        entry.Name,
+			Addr:        entry.Addr,
+			Online:      entry.Online,
+			Fingerprint: entry.Fingerprint,
 		})
 	}
 	sort.Slice(list, func(i, j int) bool {
@@ -147,3 +196,34 @@ func (p *PeerDirectory) Snapshot() []ui.Presence {
 	})
 	return list
 }
+
+// formatPeerScores renders connection scores for /peers, followed by the
+// connections pruned most recently and why.
+func formatPeerScores(peers, pruned []network.PeerInfo, now time.Time) []string {
+	lines := make([]string, 0, len(peers)+len(pruned))
+	for _, p := range peers {
+		dir := "out"
+		if p.Inbound {
+			dir = "in"
+		}
+		line := fmt.Sprintf("  link %s %s score=%d up %s", p.Addr, dir, p.Score, now.Sub(p.Since).Round(time.Second))
+		if p.Latency > 0 {
+			line += fmt.Sprintf(" rtt %s", p.Latency.Round(time.Millisecond))
+		}
+		if p.AcksExpected > 0 {
+			line += fmt.Sprintf(" acks %d/%d", p.AcksSeen, p.AcksExpected)
+		}
+		if len(p.Reasons) > 0 {
+			line += " (" + strings.Join(p.Reasons, ", ") + ")"
+		}
+		lines = append(lines, line)
+	}
+	for _, p := range pruned {
+		line := fmt.Sprintf("  pruned %s %s ago score=%d", p.Addr, now.Sub(p.PrunedAt).Round(time.Second), p.Score)
+		if len(p.Reasons) > 0 {
+			line += " (" + strings.Join(p.Reasons, ", ") + ")"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -1,8 +1,11 @@
 package protocol
 
 import (
+	"strings"
 	"testing"
 	"time"
+
+	"p2p-chat/internal/network"
 )
 
 func TestBlockListAddRemove(t *testing.T) {
@@ -64,3 +67,29 @@ func TestPeerDirectoryMarkActiveAndSnapshot(t *testing.T) {
 		}
 	}
 }
+
+func TestFormatPeerScores(t *testing.T) {
+	now := time.Now()
+	lines := formatPeerScores([]network.PeerInfo{{
+		Addr:         "10.0.0.2:9001",
+		Since:        now.Add(-90 * time.Second),
+		Score:        41,
+		Latency:      900 * time.Millisecond,
+		AcksSeen:     2,
+		AcksExpected: 5,
+		Reasons:      []string{"slow (900ms)", "acked 2/5"},
+	}}, []network.PeerInfo{{
+		Addr:     "10.0.0.3:40000",
+		Inbound:  true,
+		Score:    12,
+		Reasons:  []string{"3 decrypt errors"},
+		PrunedAt: now.Add(-time.Minute),
+	}}, now)
+	want := []string{
+		"  link 10.0.0.2:9001 out score=41 up 1m30s rtt 900ms acks 2/5 (slow (900ms), acked 2/5)",
+		"  pruned 10.0.0.3:40000 1m0s ago score=12 (3 decrypt errors)",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected output:\n%s", strings.Join(lines, "\n"))
+	}
+}
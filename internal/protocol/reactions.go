@@ -0,0 +1,263 @@
+package protocol
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"p2p-chat/internal/crypto"
+	"p2p-chat/internal/message"
+	"p2p-chat/internal/ui"
+)
+
+const (
+	// maxEmojiBytes bounds a single reaction; enough for flag and skin tone
+	// sequences.
+	maxEmojiBytes = 32
+	// maxReactionKinds caps the distinct emoji kept per message.
+	maxReactionKinds = 20
+	// reactionTableSize bounds how many messages keep a tally in memory; older
+	// ones are reloaded from the store when touched again.
+	reactionTableSize = 2000
+)
+
+// validEmoji reports whether e is acceptable as a reaction: a short run of
+// symbols without spaces or control characters.
+func validEmoji(e string) bool {
+	if e == "" || len(e) > maxEmojiBytes || !utf8.ValidString(e) {
+		return false
+	}
+	for _, r := range e {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// reactionTable aggregates reactions per message ID.
+type reactionTable struct {
+	mu    sync.Mutex
+	order []string
+	byMsg map[string][]message.Reaction
+}
+
+func newReactionTable() *reactionTable {
+	return &reactionTable{byMsg: make(map[string][]message.Reaction)}
+}
+
+// tally returns the reactions on msgID, calling load the first time the
+// message is seen.
+func (t *reactionTable) tally(msgID string, load func() []message.Reaction) []message.Reaction {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return cloneReactions(t.lookup(msgID, load))
+}
+
+// set records that by has (on) or has not (!on) reacted with emoji to msgID.
+// It returns the new tally and whether anything changed.
+func (t *reactionTable) set(msgID, emoji, by string, on bool, load func() []message.Reaction) ([]message.Reaction, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := t.lookup(msgID, load)
+	idx := -1
+	for i, reaction := range list {
+		if reaction.Emoji == emoji {
+			idx = i
+			break
+		}
+	}
+	switch {
+	case on && idx < 0:
+		if len(list) >= maxReactionKinds {
+			return cloneReactions(list), false
+		}
+		list = append(list, message.Reaction{Emoji: emoji, Count: 1, By: []string{by}})
+	case on:
+		if reactedBy(list[idx], by) {
+			return cloneReactions(list), false
+		}
+		list[idx].By = append(list[idx].By, by)
+		list[idx].Count = len(list[idx].By)
+	case idx < 0 || !reactedBy(list[idx], by):
+		return cloneReactions(list), false
+	default:
+		kept := list[idx].By[:0]
+		for _, name := range list[idx].By {
+			if !strings.EqualFold(name, by) {
+				kept = append(kept, name)
+			}
+		}
+		list[idx].By = kept
+		list[idx].Count = len(kept)
+		if len(kept) == 0 {
+			list = append(list[:idx], list[idx+1:]...)
+		}
+	}
+	t.byMsg[msgID] = list
+	return cloneReactions(list), true
+}
+
+// has reports whether by currently reacts with emoji to msgID.
+func (t *reactionTable) has(msgID, emoji, by string, load func() []message.Reaction) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, reaction := range t.lookup(msgID, load) {
+		if reaction.Emoji == emoji {
+			return reactedBy(reaction, by)
+		}
+	}
+	return false
+}
+
+func (t *reactionTable) lookup(msgID string, load func() []message.Reaction) []message.Reaction {
+	if list, ok := t.byMsg[msgID]; ok {
+		return list
+	}
+	list := load()
+	t.byMsg[msgID] = list
+	t.order = append(t.order, msgID)
+	if len(t.order) > reactionTableSize {
+		delete(t.byMsg, t.order[0])
+		t.order = t.order[1:]
+	}
+	return list
+}
+
+func reactedBy(reaction message.Reaction, by string) bool {
+	for _, name := range reaction.By {
+		if strings.EqualFold(name, by) {
+			return true
+		}
+	}
+	return false
+}
+
+func cloneReactions(list []message.Reaction) []message.Reaction {
+	if len(list) == 0 {
+		return nil
+	}
+	out := make([]message.Reaction, len(list))
+	for i, reaction := range list {
+		reaction.By = append([]string(nil), reaction.By...)
+		out[i] = reaction
+	}
+	return out
+}
+
+// storedReactions loads the persisted tally for msgID.
+func (r *Runtime) storedReactions(msgID string) func() []message.Reaction {
+	return func() []message.Reaction {
+		list, err := r.store.Reactions(msgID)
+		if err != nil {
+			log.Printf("reactions %s: %v", msgID, err)
+		}
+		return list
+	}
+}
+
+// withReactions replaces whatever tally msg carries with the one this peer
+// aggregated; senders cannot inflate counts.
+func (r *Runtime) withReactions(msg message.Message) message.Message {
+	msg.Reactions = r.reactions.tally(msg.MsgID, r.storedReactions(msg.MsgID))
+	return msg
+}
+
+// toggleReaction adds our emoji reaction to the message matching ref, or
+// withdraws it if we already reacted with that emoji.
+func (r *Runtime) toggleReaction(ref, emoji string) {
+	if !validEmoji(emoji) {
+		r.sink.ShowSystem(fmt.Sprintf("react: %q is not a usable reaction", emoji))
+		return
+	}
+	target, err := r.history.ResolvePrefix(ref)
+	if err != nil {
+		r.sink.ShowSystem(fmt.Sprintf("react: %v", err))
+		return
+	}
+	if target.Deleted {
+		r.sink.ShowSystem("cannot react to a deleted message")
+		return
+	}
+	me := r.identity.Get()
+	remove := r.reactions.has(target.MsgID, emoji, me, r.storedReactions(target.MsgID))
+	if err := r.sendReaction(target, emoji, remove); err != nil {
+		r.sink.ShowSystem(fmt.Sprintf("react failed: %v", err))
+	}
+}
+
+// sendReaction applies a reaction locally and publishes it along the route
+// of its target: to the room, or sealed to the other party of a DM. A
+// reaction with Deleted set withdraws an earlier one.
+func (r *Runtime) sendReaction(target message.Message, emoji string, remove bool) error {
+	msg := message.Message{
+		MsgID:     NewMsgID(),
+		Type:      MsgTypeReaction,
+		From:      r.identity.Get(),
+		Origin:    r.selfAddr,
+		Channel:   target.Channel,
+		Target:    target.MsgID,
+		Content:   emoji,
+		Deleted:   remove,
+		Timestamp: time.Now(),
+	}
+	local := msg
+	if target.Type == MsgTypeDM {
+		msg.To, msg.ToAddr = target.From, target.Origin
+		if target.Origin == r.selfAddr {
+			msg.To, msg.ToAddr = target.To, target.ToAddr
+		}
+		peer := msg.ToAddr
+		if peer == "" {
+			peer = msg.To
+		}
+		key, ok := r.directory.PublicKey(peer)
+		if !ok {
+			return fmt.Errorf("no encryption key known for %s", msg.To)
+		}
+		sealed, err := crypto.SealFor(key, []byte(emoji))
+		if err != nil {
+			return err
+		}
+		msg.Content = sealed
+		msg.Sealed = true
+	}
+	r.identity.Sign(&msg)
+	r.cache.Seen(msg.MsgID)
+	r.applyReaction(local)
+	r.relay.Publish(msg)
+	return nil
+}
+
+// applyReaction folds a reaction into the tally of its target, persists it
+// and tells the UIs.
+func (r *Runtime) applyReaction(rx message.Message) {
+	emoji := rx.Content
+	if rx.Target == "" || !validEmoji(emoji) {
+		log.Printf("dropping malformed reaction %s from %s", rx.MsgID, rx.From)
+		r.metrics.IncRejected()
+		return
+	}
+	list, changed := r.reactions.set(rx.Target, emoji, rx.From, !rx.Deleted, r.storedReactions(rx.Target))
+	if !changed {
+		return
+	}
+	if err := r.store.SetReactions(rx.Target, list); err != nil {
+		log.Printf("history reactions: %v", err)
+	}
+	if target, ok := r.history.Find(rx.Target); ok {
+		target.Reactions = list
+		r.history.Replace(target)
+	}
+	r.sink.ShowReaction(ui.ReactionUpdate{
+		MsgID:     rx.Target,
+		Emoji:     emoji,
+		By:        rx.From,
+		Removed:   rx.Deleted,
+		Reactions: list,
+	})
+}
@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"p2p-chat/internal/message"
+)
+
+func TestReactToggleAndAggregate(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	store := attachHistoryStore(t, rt)
+	rt.sendChatMessage("ship it?")
+	target := sink.lastMessage()
+
+	rt.ProcessLine("/react " + target.MsgID[:8] + " 👍")
+	bob := message.Message{MsgID: "r1", Type: MsgTypeReaction, From: "Bob", Origin: "10.0.0.2:9001", Channel: DefaultChannel, Target: target.MsgID, Content: "👍", Timestamp: time.Now()}
+	rt.processIncoming(bob, "")
+	if len(sink.reactions) != 2 {
+		t.Fatalf("expected two reaction updates, got %+v", sink.reactions)
+	}
+	tally := sink.reactions[1].Reactions
+	if len(tally) != 1 || tally[0].Emoji != "👍" || tally[0].Count != 2 {
+		t.Fatalf("unexpected tally %+v", tally)
+	}
+	if buffered, _ := rt.history.Find(target.MsgID); len(buffered.Reactions) != 1 || buffered.Reactions[0].Count != 2 {
+		t.Fatalf("expected buffered message to carry counts, got %+v", buffered.Reactions)
+	}
+
+	rt.ProcessLine("/react " + target.MsgID + " 👍")
+	last := sink.reactions[len(sink.reactions)-1]
+	if !last.Removed || last.Reactions[0].Count != 1 || last.Reactions[0].By[0] != "Bob" {
+		t.Fatalf("expected second /react to withdraw ours, got %+v", last)
+	}
+	stored, _, _ := store.Get(target.MsgID)
+	if len(stored.Reactions) != 1 || stored.Reactions[0].Count != 1 {
+		t.Fatalf("expected persisted tally, got %+v", stored.Reactions)
+	}
+
+	rt.processIncoming(message.Message{MsgID: "r2", Type: MsgTypeReaction, From: "Bob", Origin: "10.0.0.2:9001", Channel: DefaultChannel, Target: target.MsgID, Content: "👍", Timestamp: time.Now()}, "")
+	if n := len(sink.reactions); n != 3 {
+		t.Fatalf("duplicate reaction should be ignored, got %d updates", n)
+	}
+}
+
+func TestIncomingMessageReactionsAreNotTrusted(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	msg := message.Message{
+		MsgID:     "m1",
+		Type:      MsgTypeChat,
+		From:      "Bob",
+		Origin:    "10.0.0.2:9001",
+		Channel:   DefaultChannel,
+		Content:   "popular",
+		Reactions: []message.Reaction{{Emoji: "🔥", Count: 999}},
+		Timestamp: time.Now(),
+	}
+	rt.processIncoming(msg, "")
+	if shown := sink.lastMessage(); len(shown.Reactions) != 0 {
+		t.Fatalf("sender supplied tally should be dropped, got %+v", shown.Reactions)
+	}
+}
@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"p2p-chat/internal/message"
+	"p2p-chat/internal/storage"
+	"p2p-chat/internal/ui"
+)
+
+// markReceipt persists a state change for one of our own messages and
+// surfaces it in every UI.
+func (r *Runtime) markReceipt(msgID, state, by string) {
+	rc, err := r.store.UpdateReceipt(msgID, state, by)
+	if err != nil {
+		log.Printf("receipt %s: %v", msgID, err)
+	}
+	ts := rc.UpdatedAt
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	r.sink.ShowStatus(ui.StatusUpdate{MsgID: msgID, State: state, By: by, Timestamp: ts})
+}
+
+// ownsMessage reports whether msgID is one of our messages. Peers' acks and
+// read receipts only change the state of those; anything else would let one
+// peer mark another's message as delivered or read.
+func (r *Runtime) ownsMessage(msgID string) bool {
+	if original, ok := r.history.Find(msgID); ok && original.Origin == r.selfAddr {
+		return true
+	}
+	_, ok, err := r.store.Receipt(msgID)
+	if err != nil {
+		log.Printf("receipt %s: %v", msgID, err)
+	}
+	return ok
+}
+
+// replayReceipt shows the stored state of a message loaded from disk.
+func (r *Runtime) replayReceipt(msg message.Message) {
+	rc, ok, err := r.store.Receipt(msg.MsgID)
+	if err != nil {
+		log.Printf("receipt %s: %v", msg.MsgID, err)
+		return
+	}
+	if !ok {
+		return
+	}
+	update := ui.StatusUpdate{MsgID: rc.MsgID, State: rc.State, Timestamp: rc.UpdatedAt}
+	switch rc.State {
+	case storage.ReceiptRead:
+		update.By = strings.Join(rc.ReadBy, ", ")
+	case storage.ReceiptDelivered:
+		update.By = strings.Join(rc.DeliveredTo, ", ")
+	}
+	r.sink.ShowStatus(update)
+}
+
+// MarkRead tells the author of msgID that the message was displayed. UIs call
+// it (via /read) when they render a message; our own messages and ones that
+// were already reported are ignored.
+func (r *Runtime) MarkRead(msgID string) {
+	original, ok := r.history.Find(msgID)
+	if !ok || original.Origin == r.selfAddr {
+		return
+	}
+	switch original.Type {
+	case MsgTypeChat, MsgTypeDM, MsgTypeFile:
+	default:
+		return
+	}
+	if r.reads.Seen(msgID) {
+		return
+	}
+	read := message.Message{
+		MsgID:     NewMsgID(),
+		Type:      MsgTypeRead,
+		From:      r.identity.Get(),
+		Origin:    r.selfAddr,
+		To:        original.From,
+		ToAddr:    original.Origin,
+		AckFor:    msgID,
+		Timestamp: time.Now(),
+	}
+	r.identity.Sign(&read)
+	r.cache.Seen(read.MsgID)
+	r.relay.Publish(read)
+}
+
+// handleRead records a read receipt addressed to us and forwards the rest
+// towards their recipient.
+func (r *Runtime) handleRead(msg message.Message, from string) {
+	if msg.ToAddr != "" && msg.ToAddr != r.selfAddr {
+		r.relay.Forward(msg, from)
+		return
+	}
+	if msg.AckFor == "" || r.blocklist.Blocks(msg.From, msg.Origin) || !r.ownsMessage(msg.AckFor) {
+		return
+	}
+	r.markReceipt(msg.AckFor, storage.ReceiptRead, msg.From)
+}
@@ -0,0 +1,77 @@
+package protocol
+
+import (
+	"testing"
+
+	"p2p-chat/internal/message"
+	"p2p-chat/internal/storage"
+)
+
+func TestAckAndReadReceiptsSurfaceStatus(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	rt.sendChatMessage("hello")
+	sent := sink.lastMessage()
+
+	rt.processIncoming(message.Message{MsgID: "ack1", Type: MsgTypeAck, From: "Bob", Origin: "10.0.0.2:9001", To: "tester", AckFor: sent.MsgID}, "")
+	rt.processIncoming(message.Message{MsgID: "read1", Type: MsgTypeRead, From: "Bob", Origin: "10.0.0.2:9001", To: "tester", ToAddr: rt.selfAddr, AckFor: sent.MsgID}, "")
+
+	statuses := sink.statusCopy()
+	if len(statuses) != 3 {
+		t.Fatalf("expected sent, delivered and read updates, got %+v", statuses)
+	}
+	want := []string{storage.ReceiptSent, storage.ReceiptDelivered, storage.ReceiptRead}
+	for i, update := range statuses {
+		if update.MsgID != sent.MsgID || update.State != want[i] {
+			t.Fatalf("update %d: got %+v, want state %s", i, update, want[i])
+		}
+	}
+	if statuses[1].By != "Bob" || statuses[2].By != "Bob" {
+		t.Fatalf("expected Bob to be credited, got %+v", statuses)
+	}
+}
+
+func TestReceiptsForOthersMessagesAreIgnored(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	rt.processIncoming(message.Message{MsgID: "m1", Type: MsgTypeChat, From: "Carol", Origin: "10.0.0.3:9001", Channel: DefaultChannel, Content: "hi"}, "")
+
+	rt.processIncoming(message.Message{MsgID: "ack1", Type: MsgTypeAck, From: "Bob", Origin: "10.0.0.2:9001", To: "tester", AckFor: "m1"}, "")
+	rt.processIncoming(message.Message{MsgID: "read1", Type: MsgTypeRead, From: "Bob", Origin: "10.0.0.2:9001", To: "tester", ToAddr: rt.selfAddr, AckFor: "m1"}, "")
+	rt.processIncoming(message.Message{MsgID: "read2", Type: MsgTypeRead, From: "Bob", Origin: "10.0.0.2:9001", ToAddr: rt.selfAddr, AckFor: "unknown"}, "")
+
+	if statuses := sink.statusCopy(); len(statuses) != 0 {
+		t.Fatalf("expected receipts for messages we did not send to be ignored, got %+v", statuses)
+	}
+}
+
+func TestMarkReadSendsOneReceiptToAuthor(t *testing.T) {
+	rt, _, _ := newTestRuntime(t)
+	transport := newFakeTransport("10.0.0.2:9001")
+	rt.relay = NewRelay(RelayFlood, 0, transport)
+
+	rt.processIncoming(message.Message{MsgID: "m1", Type: MsgTypeChat, From: "Bob", Origin: "10.0.0.2:9001", Channel: DefaultChannel, Content: "hi"}, "")
+	sentBefore := len(transport.sent["10.0.0.2:9001"])
+	rt.MarkRead("m1")
+	rt.MarkRead("m1")
+	rt.MarkRead("unknown")
+
+	sent := transport.sent["10.0.0.2:9001"][sentBefore:]
+	if len(sent) != 1 {
+		t.Fatalf("expected a single read receipt, got %d", len(sent))
+	}
+	read := sent[0]
+	if read.Type != MsgTypeRead || read.AckFor != "m1" || read.ToAddr != "10.0.0.2:9001" || read.Signature == "" {
+		t.Fatalf("unexpected receipt %+v", read)
+	}
+}
+
+func TestMarkReadIgnoresOwnMessages(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	transport := newFakeTransport("10.0.0.2:9001")
+	rt.relay = NewRelay(RelayFlood, 0, transport)
+	rt.sendChatMessage("mine")
+	before := len(transport.sent["10.0.0.2:9001"])
+	rt.MarkRead(sink.lastMessage().MsgID)
+	if got := len(transport.sent["10.0.0.2:9001"]); got != before {
+		t.Fatalf("expected no receipt for own message, sent %d", got-before)
+	}
+}
@@ -0,0 +1,280 @@
+package protocol
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"p2p-chat/internal/message"
+)
+
+const (
+	RelayFlood  = "flood"
+	RelayGossip = "gossip"
+
+	defaultFanout   = 3
+	ihaveFlushEvery = 500 * time.Millisecond
+	relayRecentTTL  = 2 * time.Minute
+	iwantRetryAfter = 5 * time.Second
+	maxIDsPerDigest = 256
+	relayPruneEvery = 30 * time.Second
+	maxLazyQueue    = 4 * maxIDsPerDigest
+)
+
+// relayTransport is the subset of ConnManager the relay needs.
+type relayTransport interface {
+	Broadcast(message.Message, string)
+	SendTo(string, message.Message) error
+	SendBulk(string, message.Message) error
+	ConnsList() []string
+}
+
+// Relay decides which neighbours receive a message. Flood mode forwards to
+// every connection except the sender. Gossip mode eagerly pushes to a random
+// fanout subset and only announces the message ID (IHAVE) to the rest, who
+// pull it with IWANT if no eager copy reached them.
+type Relay struct {
+	mode   string
+	fanout int
+	cm     relayTransport
+
+	mu      sync.Mutex
+	recent  map[string]recentMsg
+	lazy    map[string][]string
+	pending map[string]time.Time
+}
+
+type recentMsg struct {
+	msg message.Message
+	at  time.Time
+}
+
+// ParseRelayMode validates a --relay-mode value.
+func ParseRelayMode(mode string) (string, error) {
+	switch mode {
+	case "", RelayFlood:
+		return RelayFlood, nil
+	case RelayGossip:
+		return RelayGossip, nil
+	}
+	return "", fmt.Errorf("unknown relay mode %q (want %s or %s)", mode, RelayFlood, RelayGossip)
+}
+
+func NewRelay(mode string, fanout int, cm relayTransport) *Relay {
+	if mode == "" {
+		mode = RelayFlood
+	}
+	if fanout <= 0 {
+		fanout = defaultFanout
+	}
+	return &Relay{
+		mode:    mode,
+		fanout:  fanout,
+		cm:      cm,
+		recent:  make(map[string]recentMsg),
+		lazy:    make(map[string][]string),
+		pending: make(map[string]time.Time),
+	}
+}
+
+func (g *Relay) Mode() string { return g.mode }
+
+// Publish sends a message originated by this peer to every neighbour.
+func (g *Relay) Publish(msg message.Message) {
+	g.remember(msg)
+	g.cm.Broadcast(msg, "")
+}
+
+// Forward relays a message received from the connection from.
+func (g *Relay) Forward(msg message.Message, from string) {
+	if g.mode != RelayGossip {
+		g.cm.Broadcast(msg, from)
+		return
+	}
+	g.remember(msg)
+	peers := g.cm.ConnsList()
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	eager := 0
+	for _, peer := range peers {
+		if peer == from {
+			continue
+		}
+		if eager < g.fanout {
+			if err := g.cm.SendTo(peer, msg); err == nil {
+				eager++
+				continue
+			}
+		}
+		g.announce(peer, msg.MsgID)
+	}
+}
+
+// Unicast sends bulk traffic such as file chunks to a single neighbour,
+// waiting for room behind that neighbour's chat traffic.
+func (g *Relay) Unicast(peer string, msg message.Message) error {
+	return g.cm.SendBulk(peer, msg)
+}
+
+// Direct sends msg to the single neighbour peer.
+func (g *Relay) Direct(peer string, msg message.Message) error {
+	return g.cm.SendTo(peer, msg)
+}
+
+// Connected reports whether peer is a current connection.
+func (g *Relay) Connected(peer string) bool {
+	for _, conn := range g.cm.ConnsList() {
+		if conn == peer {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Relay) announce(peer, id string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	queue := append(g.lazy[peer], id)
+	if len(queue) > maxLazyQueue {
+		queue = queue[len(queue)-maxLazyQueue:]
+	}
+	g.lazy[peer] = queue
+}
+
+func (g *Relay) remember(msg message.Message) {
+	if g.mode != RelayGossip || msg.MsgID == "" {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.recent[msg.MsgID] = recentMsg{msg: msg, at: time.Now()}
+	delete(g.pending, msg.MsgID)
+}
+
+// Missing filters ids down to those for which a pull should be issued now,
+// using have to skip messages that already arrived.
+func (g *Relay) Missing(ids []string, have func(string) bool) []string {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var want []string
+	for _, id := range ids {
+		if id == "" || have(id) {
+			continue
+		}
+		if asked, ok := g.pending[id]; ok && now.Sub(asked) < iwantRetryAfter {
+			continue
+		}
+		g.pending[id] = now
+		want = append(want, id)
+	}
+	return want
+}
+
+// Lookup returns recently relayed messages for an IWANT request.
+func (g *Relay) Lookup(ids []string) []message.Message {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var out []message.Message
+	for _, id := range ids {
+		if entry, ok := g.recent[id]; ok {
+			out = append(out, entry.msg)
+		}
+	}
+	return out
+}
+
+// takeDigests drains the queued IHAVE announcements per peer.
+func (g *Relay) takeDigests() map[string][]string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.lazy) == 0 {
+		return nil
+	}
+	out := g.lazy
+	g.lazy = make(map[string][]string)
+	return out
+}
+
+func (g *Relay) prune(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for id, entry := range g.recent {
+		if now.Sub(entry.at) > relayRecentTTL {
+			delete(g.recent, id)
+		}
+	}
+	for id, asked := range g.pending {
+		if now.Sub(asked) > relayRecentTTL {
+			delete(g.pending, id)
+		}
+	}
+}
+
+// RelayLoop flushes batched IHAVE digests and expires the recent-message
+// cache. It is a no-op in flood mode.
+func (r *Runtime) RelayLoop() {
+	if r.relay.Mode() != RelayGossip {
+		return
+	}
+	flush := time.NewTicker(ihaveFlushEvery)
+	defer flush.Stop()
+	prune := time.NewTicker(relayPruneEvery)
+	defer prune.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case now := <-prune.C:
+			r.relay.prune(now)
+		case <-flush.C:
+			for peer, ids := range r.relay.takeDigests() {
+				for len(ids) > 0 {
+					n := len(ids)
+					if n > maxIDsPerDigest {
+						n = maxIDsPerDigest
+					}
+					r.sendControl(peer, MsgTypeIHave, ids[:n])
+					ids = ids[n:]
+				}
+			}
+		}
+	}
+}
+
+// handleGossipControl answers IHAVE digests with IWANT pulls and serves IWANT
+// requests from the recent-message cache.
+func (r *Runtime) handleGossipControl(msg message.Message, from string) {
+	if from == "" {
+		return
+	}
+	switch msg.Type {
+	case MsgTypeIHave:
+		if want := r.relay.Missing(msg.MsgIDs, r.cache.Has); len(want) > 0 {
+			r.sendControl(from, MsgTypeIWant, want)
+		}
+	case MsgTypeIWant:
+		for _, found := range r.relay.Lookup(msg.MsgIDs) {
+			if err := r.cm.SendTo(from, found); err != nil {
+				log.Printf("iwant reply to %s: %v", from, err)
+				return
+			}
+		}
+	}
+}
+
+func (r *Runtime) sendControl(peer, kind string, ids []string) {
+	msg := message.Message{
+		MsgID:     NewMsgID(),
+		Type:      kind,
+		From:      r.identity.Get(),
+		Origin:    r.selfAddr,
+		MsgIDs:    ids,
+		Timestamp: time.Now(),
+	}
+	r.identity.Sign(&msg)
+	if err := r.cm.SendTo(peer, msg); err != nil {
+		log.Printf("%s to %s: %v", kind, peer, err)
+	}
+}
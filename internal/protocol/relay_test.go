@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"sync"
+	"testing"
+
+	"p2p-chat/internal/message"
+)
+
+type fakeTransport struct {
+	mu        sync.Mutex
+	peers     []string
+	broadcast []string
+	sent      map[string][]message.Message
+}
+
+func newFakeTransport(peers ...string) *fakeTransport {
+	return &fakeTransport{peers: peers, sent: make(map[string][]message.Message)}
+}
+
+func (f *fakeTransport) Broadcast(msg message.Message, except string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, peer := range f.peers {
+		if peer != except {
+			f.sent[peer] = append(f.sent[peer], msg)
+		}
+	}
+	f.broadcast = append(f.broadcast, except)
+}
+
+func (f *fakeTransport) SendTo(peer string, msg message.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent[peer] = append(f.sent[peer], msg)
+	return nil
+}
+
+func (f *fakeTransport) SendBulk(peer string, msg message.Message) error {
+	return f.SendTo(peer, msg)
+}
+
+func (f *fakeTransport) ConnsList() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.peers...)
+}
+
+func TestFloodRelayDoesNotEchoSender(t *testing.T) {
+	transport := newFakeTransport("a", "b", "c")
+	relay := NewRelay(RelayFlood, 0, transport)
+	relay.Forward(message.Message{MsgID: "m1"}, "b")
+	if len(transport.sent["b"]) != 0 || len(transport.sent["a"]) != 1 || len(transport.sent["c"]) != 1 {
+		t.Fatalf("unexpected fan out: %+v", transport.sent)
+	}
+}
+
+func TestGossipRelayPushesFanoutAndAnnouncesRest(t *testing.T) {
+	transport := newFakeTransport("a", "b", "c", "d", "e")
+	relay := NewRelay(RelayGossip, 2, transport)
+	relay.Forward(message.Message{MsgID: "m1"}, "a")
+	eager := 0
+	for _, peer := range transport.peers {
+		eager += len(transport.sent[peer])
+	}
+	if eager != 2 || len(transport.sent["a"]) != 0 {
+		t.Fatalf("expected two eager copies and none to the sender: %+v", transport.sent)
+	}
+	digests := relay.takeDigests()
+	if len(digests) != 2 {
+		t.Fatalf("expected IHAVE for the two remaining peers, got %+v", digests)
+	}
+	if got := relay.Lookup([]string{"m1", "unknown"}); len(got) != 1 {
+		t.Fatalf("expected relayed message to be served for IWANT, got %d", len(got))
+	}
+}
+
+func TestRelayMissingAsksOnce(t *testing.T) {
+	relay := NewRelay(RelayGossip, 0, newFakeTransport())
+	have := func(id string) bool { return id == "known" }
+	if want := relay.Missing([]string{"known", "new"}, have); len(want) != 1 || want[0] != "new" {
+		t.Fatalf("unexpected want list %v", want)
+	}
+	if want := relay.Missing([]string{"new"}, have); len(want) != 0 {
+		t.Fatalf("expected pending pull to be suppressed, got %v", want)
+	}
+}
+
+func TestProcessIncomingCountsDuplicates(t *testing.T) {
+	rt, _, _ := newTestRuntime(t)
+	msg := message.Message{MsgID: "dup", From: "Bob", Content: "hi"}
+	rt.processIncoming(msg, "")
+	rt.processIncoming(msg, "")
+	snap := rt.metrics.Snapshot()
+	if snap.Received != 2 || snap.Duplicates != 1 || snap.DuplicateRatio() != 0.5 {
+		t.Fatalf("unexpected metrics %+v", snap)
+	}
+}
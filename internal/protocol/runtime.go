@@ -2,13 +2,20 @@ package protocol
 
 import (
 	"context"
+	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/base64"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"p2p-chat/internal/crypto"
+	"p2p-chat/internal/dht"
 	"p2p-chat/internal/message"
 	"p2p-chat/internal/network"
+	"p2p-chat/internal/peerlist"
 	"p2p-chat/internal/storage"
 	"p2p-chat/internal/ui"
 )
@@ -19,9 +26,19 @@ type Runtime struct {
 	ctx          context.Context
 	cm           *network.ConnManager
 	cache        *MsgCache
+	reads        *MsgCache
+	reactions    *reactionTable
+	transfers    *transferTable
 	history      *HistoryBuffer
+	channels     *ChannelSet
+	keyring      *KeyRing
+	relay        *Relay
 	store        *storage.HistoryStore
 	files        *storage.FileStore
+	outbox       *storage.Outbox
+	book         *storage.AddressBook
+	dht          *dht.Node
+	holdOffline  bool
 	blocklist    *BlockList
 	directory    *PeerDirectory
 	metrics      *Metrics
@@ -31,30 +48,60 @@ type Runtime struct {
 	identity     *Identity
 	selfAddr     string
 	web          *ui.WebBridge
-	bootstrapURL string
+	bootstraps   []string
+	namespace    string
 	pollInterval time.Duration
-	authAPI      string
+	// heartbeat is the re-registration interval the bootstrap servers asked
+	// for at startup.
+	heartbeat   time.Duration
+	authAPI     string
+	fileGCEvery time.Duration
+
+	outboxMu      sync.Mutex
+	outboxFlushed map[string]time.Time
+	// neighbours maps the address a direct neighbour announced in its
+	// handshake to the connection it arrived on.
+	neighbours map[string]string
+
+	syncer *syncLimiter
 }
 
 // RuntimeOptions describes the dependencies needed to construct Runtime.
 type RuntimeOptions struct {
-	ConnManager  *network.ConnManager
-	CacheTTL     time.Duration
-	HistorySize  int
-	Store        *storage.HistoryStore
-	Files        *storage.FileStore
-	Blocklist    *BlockList
-	Directory    *PeerDirectory
-	Metrics      *Metrics
-	Ack          *AckTracker
-	Dialer       *DialScheduler
-	Sink         ui.Sink
-	Identity     *Identity
-	SelfAddr     string
-	Web          *ui.WebBridge
-	BootstrapURL string
+	ConnManager *network.ConnManager
+	CacheTTL    time.Duration
+	HistorySize int
+	KeyRing     *KeyRing
+	RelayMode   string
+	Fanout      int
+	Store       *storage.HistoryStore
+	Files       *storage.FileStore
+	Outbox      *storage.Outbox
+	AddressBook *storage.AddressBook
+	// DHT resolves peers and nicknames this one has not heard from; nil
+	// disables lookups.
+	DHT         *dht.Node
+	HoldOffline bool
+	Blocklist   *BlockList
+	Directory   *PeerDirectory
+	Metrics     *Metrics
+	Ack         *AckTracker
+	Dialer      *DialScheduler
+	Sink        ui.Sink
+	Identity    *Identity
+	SelfAddr    string
+	Web         *ui.WebBridge
+	// BootstrapURLs are replicas of the bootstrap registry; peers register
+	// with all of them and fetch from the first that answers.
+	BootstrapURLs []string
+	// Namespace is the rendezvous namespace used on the bootstrap server;
+	// empty means peerlist.DefaultNamespace.
+	Namespace    string
 	PollInterval time.Duration
 	AuthAPI      string
+	// FileGCInterval is how often the file store retention policy is
+	// applied; zero disables the background collection.
+	FileGCInterval time.Duration
 }
 
 func NewRuntime(ctx context.Context, opts RuntimeOptions) *Runtime {
@@ -66,13 +113,31 @@ func NewRuntime(ctx context.Context, opts RuntimeOptions) *Runtime {
 	if historySize <= 0 {
 		historySize = 200
 	}
+	namespace := opts.Namespace
+	if namespace == "" {
+		namespace = peerlist.DefaultNamespace
+	}
+	keyring := opts.KeyRing
+	if keyring == nil {
+		keyring, _ = NewKeyRing("", false)
+	}
 	rt := &Runtime{
 		ctx:          ctx,
 		cm:           opts.ConnManager,
 		cache:        NewMsgCache(cache),
+		reads:        NewMsgCache(cache),
+		reactions:    newReactionTable(),
+		transfers:    newTransferTable(),
 		history:      NewHistoryBuffer(historySize),
+		channels:     NewChannelSet(DefaultChannel),
+		keyring:      keyring,
+		relay:        NewRelay(opts.RelayMode, opts.Fanout, opts.ConnManager),
 		store:        opts.Store,
 		files:        opts.Files,
+		outbox:       opts.Outbox,
+		book:         opts.AddressBook,
+		dht:          opts.DHT,
+		holdOffline:  opts.HoldOffline,
 		blocklist:    opts.Blocklist,
 		directory:    opts.Directory,
 		metrics:      opts.Metrics,
@@ -82,9 +147,22 @@ func NewRuntime(ctx context.Context, opts RuntimeOptions) *Runtime {
 		identity:     opts.Identity,
 		selfAddr:     opts.SelfAddr,
 		web:          opts.Web,
-		bootstrapURL: opts.BootstrapURL,
+		bootstraps:   opts.BootstrapURLs,
+		namespace:    namespace,
 		pollInterval: opts.PollInterval,
 		authAPI:      opts.AuthAPI,
+		fileGCEvery:  opts.FileGCInterval,
+
+		outboxFlushed: make(map[string]time.Time),
+		neighbours:    make(map[string]string),
+
+		syncer: newSyncLimiter(),
+	}
+	if rt.ack != nil {
+		rt.ack.OnExpire(rt.parkUndelivered)
+	}
+	if rt.dialer != nil && rt.book != nil {
+		rt.dialer.OnResult(rt.recordDial)
 	}
 	return rt
 }
@@ -93,8 +171,14 @@ func (r *Runtime) Context() context.Context          { return r.ctx }
 func (r *Runtime) ConnManager() *network.ConnManager { return r.cm }
 func (r *Runtime) Cache() *MsgCache                  { return r.cache }
 func (r *Runtime) History() *HistoryBuffer           { return r.history }
+func (r *Runtime) Channels() *ChannelSet             { return r.channels }
+func (r *Runtime) KeyRing() *KeyRing                 { return r.keyring }
+func (r *Runtime) Relay() *Relay                     { return r.relay }
 func (r *Runtime) Store() *storage.HistoryStore      { return r.store }
 func (r *Runtime) Files() *storage.FileStore         { return r.files }
+func (r *Runtime) Outbox() *storage.Outbox           { return r.outbox }
+func (r *Runtime) AddressBook() *storage.AddressBook { return r.book }
+func (r *Runtime) DHT() *dht.Node                    { return r.dht }
 func (r *Runtime) Blocklist() *BlockList             { return r.blocklist }
 func (r *Runtime) Directory() *PeerDirectory         { return r.directory }
 func (r *Runtime) Metrics() *Metrics                 { return r.metrics }
@@ -106,7 +190,8 @@ func (r *Runtime) Identity() *Identity               { return r.identity }
 func (r *Runtime) SelfAddr() string                  { return r.selfAddr }
 func (r *Runtime) Web() *ui.WebBridge                { return r.web }
 func (r *Runtime) SetWeb(w *ui.WebBridge)            { r.web = w }
-func (r *Runtime) BootstrapURL() string              { return r.bootstrapURL }
+func (r *Runtime) BootstrapURLs() []string           { return r.bootstraps }
+func (r *Runtime) Namespace() string                 { return r.namespace }
 func (r *Runtime) PollInterval() time.Duration       { return r.pollInterval }
 func (r *Runtime) AuthAPI() string                   { return r.authAPI }
 
@@ -124,6 +209,14 @@ func NewMsgCache(ttl time.Duration) *MsgCache {
 	return &MsgCache{seen: make(map[string]time.Time), ttl: ttl}
 }
 
+// Has reports whether id was seen recently without recording it.
+func (m *MsgCache) Has(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ts, ok := m.seen[id]
+	return ok && time.Since(ts) < m.ttl
+}
+
 func (m *MsgCache) Seen(id string) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -143,42 +236,153 @@ func (m *MsgCache) Seen(id string) bool {
 	return false
 }
 
-// HistoryBuffer keeps a sliding window of recent chat messages in memory.
+// HistoryBuffer keeps a sliding window of recent messages per channel in
+// memory. Direct messages are kept under the empty channel key.
 type HistoryBuffer struct {
-	mu     sync.Mutex
-	max    int
-	buffer []message.Message
+	mu      sync.Mutex
+	max     int
+	buffers map[string][]message.Message
 }
 
 func NewHistoryBuffer(max int) *HistoryBuffer {
 	if max <= 0 {
 		max = 50
 	}
-	return &HistoryBuffer{max: max}
+	return &HistoryBuffer{max: max, buffers: make(map[string][]message.Message)}
 }
 
 func (h *HistoryBuffer) Add(msg message.Message) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	h.buffer = append(h.buffer, msg)
-	if len(h.buffer) > h.max {
-		h.buffer = h.buffer[len(h.buffer)-h.max:]
+	buf := append(h.buffers[msg.Channel], msg)
+	if len(buf) > h.max {
+		buf = buf[len(buf)-h.max:]
+	}
+	h.buffers[msg.Channel] = buf
+}
+
+// Merge inserts older messages, such as ones fetched by history sync, keeping
+// each channel in timestamp order and skipping IDs already buffered.
+func (h *HistoryBuffer) Merge(msgs []message.Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	touched := make(map[string]bool)
+	for _, msg := range msgs {
+		buf := h.buffers[msg.Channel]
+		dup := false
+		for _, existing := range buf {
+			if existing.MsgID == msg.MsgID {
+				dup = true
+				break
+			}
+		}
+		if dup {
+			continue
+		}
+		h.buffers[msg.Channel] = append(buf, msg)
+		touched[msg.Channel] = true
+	}
+	for name := range touched {
+		buf := h.buffers[name]
+		sort.SliceStable(buf, func(i, j int) bool {
+			return buf[i].Timestamp.Before(buf[j].Timestamp)
+		})
+		if len(buf) > h.max {
+			buf = buf[len(buf)-h.max:]
+		}
+		h.buffers[name] = buf
 	}
 }
 
+// Replace swaps in an updated copy of a buffered message, matched by ID.
+func (h *HistoryBuffer) Replace(msg message.Message) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, buf := range h.buffers {
+		for i := range buf {
+			if buf[i].MsgID == msg.MsgID {
+				buf[i] = msg
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ResolvePrefix finds the buffered message whose ID starts with prefix. It
+// fails when no message or more than one message matches.
+func (h *HistoryBuffer) ResolvePrefix(prefix string) (message.Message, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var match message.Message
+	matches := 0
+	for _, buf := range h.buffers {
+		for _, msg := range buf {
+			if msg.MsgID == prefix {
+				return msg, nil
+			}
+			if prefix != "" && strings.HasPrefix(msg.MsgID, prefix) {
+				match = msg
+				matches++
+			}
+		}
+	}
+	switch matches {
+	case 0:
+		return match, fmt.Errorf("no message matches %s", prefix)
+	case 1:
+		return match, nil
+	}
+	return match, fmt.Errorf("%s matches %d messages; use a longer prefix", prefix, matches)
+}
+
+// Find returns the buffered message with the given ID.
+func (h *HistoryBuffer) Find(id string) (message.Message, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, buf := range h.buffers {
+		for i := len(buf) - 1; i >= 0; i-- {
+			if buf[i].MsgID == id {
+				return buf[i], true
+			}
+		}
+	}
+	return message.Message{}, false
+}
+
+// All returns every buffered message across channels in timestamp order.
 func (h *HistoryBuffer) All() []message.Message {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	out := make([]message.Message, len(h.buffer))
-	copy(out, h.buffer)
+	var out []message.Message
+	for _, buf := range h.buffers {
+		out = append(out, buf...)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Timestamp.Before(out[j].Timestamp)
+	})
 	return out
 }
 
-// Identity tracks the current nickname and auth token.
+// Channel returns the buffered messages for a single channel.
+func (h *HistoryBuffer) Channel(name string) []message.Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buf := h.buffers[name]
+	out := make([]message.Message, len(buf))
+	copy(out, buf)
+	return out
+}
+
+// Identity tracks the current nickname, auth token, the keypair used to
+// receive end-to-end encrypted direct messages and the Ed25519 key that signs
+// everything this peer sends.
 type Identity struct {
-	mu    sync.RWMutex
-	name  string
-	token string
+	mu     sync.RWMutex
+	name   string
+	token  string
+	keys   *crypto.KeyPair
+	signer ed25519.PrivateKey
 }
 
 func NewIdentity(initial, fallback string) *Identity {
@@ -200,6 +404,45 @@ func (i *Identity) Token() string {
 	return i.token
 }
 
+func (i *Identity) KeyPair() *crypto.KeyPair {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.keys
+}
+
+func (i *Identity) SetKeyPair(kp *crypto.KeyPair) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.keys = kp
+}
+
+func (i *Identity) SigningKey() ed25519.PrivateKey {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.signer
+}
+
+func (i *Identity) SetSigningKey(key ed25519.PrivateKey) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.signer = key
+}
+
+// Sign stamps msg with this identity's signing key. Messages are left
+// untouched when no key is configured.
+func (i *Identity) Sign(msg *message.Message) {
+	key := i.SigningKey()
+	if key == nil {
+		return
+	}
+	msg.SigningKey = crypto.EncodeSigningKey(key.Public().(ed25519.PublicKey))
+	data, err := msg.SigningBytes()
+	if err != nil {
+		return
+	}
+	msg.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+}
+
 func (i *Identity) SetDisplay(name string) bool {
 	i.mu.Lock()
 	defer i.mu.Unlock()
@@ -1,6 +1,8 @@
 package protocol
 
 import (
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"p2p-chat/internal/storage"
@@ -22,11 +24,11 @@ func TestBuildDownloadURLIncludesShareKey(t *testing.T) {
 	}
 }
 
-func TestShareFileRequiresWeb(t *testing.T) {
+func TestShareFileRequiresFileStoreOrWeb(t *testing.T) {
 	rt, _, _ := newTestRuntime(t)
 	err := rt.ShareFile(storage.FileRecord{}, "")
 	if err == nil {
-		t.Fatalf("expected error when web ui disabled")
+		t.Fatalf("expected error without a file store or web ui")
 	}
 }
 
@@ -89,3 +91,25 @@ func TestShareFileBroadcastsAttachment(t *testing.T) {
 		t.Fatalf("attachment url missing for broadcast")
 	}
 }
+
+func TestShareFileAnnouncesImageDimensions(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	files, err := storage.OpenFileStore(filepath.Join(t.TempDir(), "files.db"), filepath.Join(t.TempDir(), "files"))
+	if err != nil {
+		t.Fatalf("open file store: %v", err)
+	}
+	t.Cleanup(func() { _ = files.Close() })
+	rt.files = files
+	record, err := files.Save("cat.png", "tester", strings.NewReader("not really a png"))
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	record.Width, record.Height, record.ThumbWidth, record.ThumbHeight = 1024, 768, 320, 240
+	if err := rt.ShareFile(record, ""); err != nil {
+		t.Fatalf("ShareFile: %v", err)
+	}
+	att := sink.lastMessage().Attachments[0]
+	if att.Width != 1024 || att.Height != 768 || att.ThumbWidth != 320 || att.ThumbHeight != 240 {
+		t.Fatalf("expected dimensions on attachment, got %+v", att)
+	}
+}
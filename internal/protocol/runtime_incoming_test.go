@@ -9,7 +9,7 @@ import (
 func TestProcessIncomingStoresChat(t *testing.T) {
 	rt, sink, _ := newTestRuntime(t)
 	msg := message.Message{MsgID: "m1", From: "Bob", Content: "hi"}
-	rt.processIncoming(msg)
+	rt.processIncoming(msg, "")
 	if len(rt.history.All()) != 1 {
 		t.Fatalf("expected history to record message")
 	}
@@ -24,7 +24,7 @@ func TestProcessIncomingStoresChat(t *testing.T) {
 func TestProcessIncomingHonorsBlocklist(t *testing.T) {
 	rt, sink, _ := newTestRuntime(t)
 	rt.blocklist.Add("Bob")
-	rt.processIncoming(message.Message{MsgID: "m2", From: "Bob", Content: "hi"})
+	rt.processIncoming(message.Message{MsgID: "m2", From: "Bob", Content: "hi"}, "")
 	if len(sink.messages) != 0 {
 		t.Fatalf("blocked sender should be suppressed")
 	}
@@ -33,8 +33,25 @@ func TestProcessIncomingHonorsBlocklist(t *testing.T) {
 func TestProcessIncomingAckRemovesPending(t *testing.T) {
 	rt, _, _ := newTestRuntime(t)
 	rt.ack.pending = map[string]*pendingAck{"ackme": {msg: message.Message{MsgID: "ackme"}}}
-	rt.processIncoming(message.Message{Type: MsgTypeAck, AckFor: "ackme"})
+	rt.processIncoming(message.Message{Type: MsgTypeAck, AckFor: "ackme"}, "")
 	if len(rt.ack.pending) != 0 {
 		t.Fatalf("expected ack to remove pending message")
 	}
 }
+
+func TestProcessIncomingDropsForgedMessage(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	alice := newSigningKey(t)
+	rt.processIncoming(signedMessage(t, alice, "Alice", "10.0.0.2:9001"), "")
+	forged := signedMessage(t, newSigningKey(t), "Alice", "10.0.0.2:9001")
+	rt.processIncoming(forged, "")
+	if len(sink.messages) != 1 {
+		t.Fatalf("expected forged message to be dropped, got %d messages", len(sink.messages))
+	}
+	if snapshot := rt.metrics.Snapshot(); snapshot.Rejected != 1 {
+		t.Fatalf("expected rejected counter to increase, got %+v", snapshot)
+	}
+	if rt.cache.Has(forged.MsgID) {
+		t.Fatalf("rejected message must not poison the dedupe cache")
+	}
+}
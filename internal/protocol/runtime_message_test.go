@@ -3,10 +3,12 @@ package protocol
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"p2p-chat/internal/crypto"
 	"p2p-chat/internal/message"
 )
 
@@ -23,11 +25,20 @@ func TestSendChatMessageUpdatesState(t *testing.T) {
 	if len(rt.ack.pending) != 1 {
 		t.Fatalf("expected ack tracker to track message")
 	}
+	ring, _ := NewKeyRing("", true)
+	if err := ring.Verify(msg); err != nil {
+		t.Fatalf("expected outbound chat to carry a valid signature: %v", err)
+	}
 }
 
 func TestSendDirectMessageTargetsRecipient(t *testing.T) {
 	rt, sink, _ := newTestRuntime(t)
+	bob, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("generate keys: %v", err)
+	}
 	rt.directory.Record("Bob", "10.0.0.2:9001")
+	rt.directory.SetPublicKey("10.0.0.2:9001", &bob.Public)
 	rt.sendDirectMessage("Bob", "secret")
 	msg := sink.lastMessage()
 	if msg.Type != MsgTypeDM {
@@ -39,6 +50,36 @@ func TestSendDirectMessageTargetsRecipient(t *testing.T) {
 	if msg.Content != "secret" {
 		t.Fatalf("expected content preserved")
 	}
+	pending := rt.ack.pending[msg.MsgID]
+	if pending == nil || !pending.msg.Sealed || pending.msg.Content == "secret" {
+		t.Fatalf("expected wire copy to be sealed: %+v", pending)
+	}
+	plain, err := bob.Open(pending.msg.Content)
+	if err != nil || string(plain) != "secret" {
+		t.Fatalf("recipient could not open dm: %v", err)
+	}
+}
+
+func TestSendDirectMessageRequiresRecipientKey(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	rt.directory.Record("Bob", "10.0.0.2:9001")
+	rt.sendDirectMessage("Bob", "secret")
+	if len(sink.messages) != 0 || len(rt.ack.pending) != 0 {
+		t.Fatalf("dm without a known key must not be sent")
+	}
+}
+
+func TestProcessIncomingOpensSealedDM(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	sealed, err := crypto.SealFor(&rt.identity.KeyPair().Public, []byte("psst"))
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	rt.processIncoming(message.Message{MsgID: "dm1", Type: MsgTypeDM, From: "Bob", To: "tester", ToAddr: "127.0.0.1:9001", Content: sealed, Sealed: true}, "")
+	msg := sink.lastMessage()
+	if msg.Content != "psst" || msg.Sealed {
+		t.Fatalf("expected decrypted dm, got %+v", msg)
+	}
 }
 
 func TestPersistExternalSendsRequest(t *testing.T) {
@@ -71,3 +112,22 @@ func TestPersistExternalSendsRequest(t *testing.T) {
 		t.Fatal("external persistence timed out")
 	}
 }
+
+func TestSearchCommandPrintsMatchesOldestFirst(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	attachHistoryStore(t, rt)
+	rt.sendChatMessage("relay rollout starts")
+	rt.sendChatMessage("unrelated")
+	rt.sendChatMessage("relay rollout done")
+	before := len(sink.messages)
+
+	rt.ProcessLine("/search rollout from:tester")
+	found := sink.messages[before:]
+	if len(found) != 2 || found[0].Content != "relay rollout starts" || found[1].Content != "relay rollout done" {
+		t.Fatalf("unexpected search output %+v", found)
+	}
+	rt.ProcessLine("/search before:someday")
+	if last := sink.systems[len(sink.systems)-1]; !strings.Contains(last, "bad date") {
+		t.Fatalf("expected parse error, got %q", last)
+	}
+}
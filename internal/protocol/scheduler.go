@@ -2,57 +2,187 @@ package protocol
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
+	"sort"
 	"sync"
 	"time"
+
+	"p2p-chat/internal/network"
 )
 
-const dialQueueSize = 128
+const (
+	dialQueueSize = 128
+	// maxDesired bounds the addresses kept for dialing; gossip can name far
+	// more peers than we will ever connect to.
+	maxDesired = 256
 
-var (
+	// dialBackoff is the default wait after the first failure and between
+	// checks of a connected address. Each further failure doubles it up to
+	// dialBackoffMax.
 	dialBackoff     = 5 * time.Second
+	dialBackoffMax  = 5 * time.Minute
 	dialJitterRange = 2 * time.Second
-	randSrc         = rand.New(rand.NewSource(time.Now().UnixNano()))
-	randMu          sync.Mutex
+	// dialMaxFailures evicts an address after this many failures in a row.
+	dialMaxFailures = 8
+)
+
+var (
+	randSrc = rand.New(rand.NewSource(time.Now().UnixNano()))
+	randMu  sync.Mutex
 )
 
 type peerConnector interface {
 	ConnectToPeer(string) error
 }
 
-// DialScheduler manages peer dialing with retries and jitter.
+// dialTarget is the retry state of one desired address.
+type dialTarget struct {
+	failures int
+	next     time.Time
+	lastErr  string
+	// gen tells the pending retry timer apart from ones superseded by a
+	// newer schedule, a manual dial or a forget.
+	gen int
+	// manual addresses came from /dial and are never evicted automatically.
+	manual bool
+	// listed is set while the bootstrap server lists the address.
+	listed bool
+}
+
+// DialTarget describes a desired address for /peers.
+type DialTarget struct {
+	Addr      string
+	Failures  int
+	NextDial  time.Time
+	LastError string
+	Manual    bool
+}
+
+// DialScheduler manages peer dialing with per-address exponential backoff.
 type DialScheduler struct {
 	cm       peerConnector
 	selfAddr string
 
 	mu      sync.RWMutex
-	desired map[string]time.Time
+	desired map[string]*dialTarget
 
 	queue chan string
 	quit  chan struct{}
+
+	onResult func(addr string, err error)
+
+	// backoff, backoffMax, jitter and maxFailures tune retries; they start
+	// at the dial* defaults and must not change once Run has started.
+	backoff     time.Duration
+	backoffMax  time.Duration
+	jitter      time.Duration
+	maxFailures int
 }
 
 func NewDialScheduler(cm peerConnector, self string) *DialScheduler {
 	return &DialScheduler{
-		cm:       cm,
-		selfAddr: self,
-		desired:  make(map[string]time.Time),
-		queue:    make(chan string, dialQueueSize),
-		quit:     make(chan struct{}),
+		cm:          cm,
+		selfAddr:    self,
+		desired:     make(map[string]*dialTarget),
+		queue:       make(chan string, dialQueueSize),
+		quit:        make(chan struct{}),
+		backoff:     dialBackoff,
+		backoffMax:  dialBackoffMax,
+		jitter:      dialJitterRange,
+		maxFailures: dialMaxFailures,
 	}
 }
 
+// OnResult registers fn to be told the outcome of every dial. It must be set
+// before Run.
+func (d *DialScheduler) OnResult(fn func(addr string, err error)) {
+	d.onResult = fn
+}
+
+// Add schedules addr to be dialed and kept connected. Relayed addresses
+// (relay-addr/p/peer-id) are accepted as they are; malformed ones, such as a
+// relay reached through another relay, are ignored.
 func (d *DialScheduler) Add(addr string) {
-	if addr == "" || addr == d.selfAddr {
+	d.add(addr, false)
+}
+
+func (d *DialScheduler) add(addr string, listed bool) {
+	if !d.acceptable(addr) {
 		return
 	}
 	d.mu.Lock()
-	if _, exists := d.desired[addr]; !exists {
-		d.desired[addr] = time.Now()
-		d.enqueue(addr)
+	defer d.mu.Unlock()
+	if target, exists := d.desired[addr]; exists {
+		target.listed = target.listed || listed
+		return
+	}
+	if len(d.desired) >= maxDesired {
+		return
+	}
+	d.desired[addr] = &dialTarget{next: time.Now(), listed: listed}
+	d.enqueue(addr)
+}
+
+func (d *DialScheduler) acceptable(addr string) bool {
+	if addr == "" || addr == d.selfAddr {
+		return false
+	}
+	if _, _, ok := network.ParseCircuitAddr(addr); !ok && network.IsCircuitAddr(addr) {
+		log.Printf("ignoring malformed relayed address %s", addr)
+		return false
+	}
+	return true
+}
+
+// Dial adds addr as a manual target and dials it now, clearing any backoff.
+// Manual targets are kept until Forget, however often they fail.
+func (d *DialScheduler) Dial(addr string) error {
+	if !d.acceptable(addr) {
+		return fmt.Errorf("cannot dial %q", addr)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	target, exists := d.desired[addr]
+	if !exists {
+		target = &dialTarget{}
+		d.desired[addr] = target
+	}
+	target.manual = true
+	target.failures = 0
+	target.next = time.Now()
+	target.gen++
+	d.enqueue(addr)
+	return nil
+}
+
+// Forget stops dialing addr and reports whether it was a target.
+func (d *DialScheduler) Forget(addr string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.desired[addr]
+	delete(d.desired, addr)
+	return ok
+}
+
+// SyncBootstrap adds the addresses the bootstrap server lists and evicts those
+// it listed before but no longer does.
+func (d *DialScheduler) SyncBootstrap(addrs []string) {
+	listed := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		listed[addr] = true
+		d.add(addr, true)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for addr, target := range d.desired {
+		if target.listed && !listed[addr] && !target.manual {
+			log.Printf("bootstrap no longer lists %s, forgetting it", addr)
+			delete(d.desired, addr)
+		}
 	}
-	d.mu.Unlock()
 }
 
 func (d *DialScheduler) Desired() []string {
@@ -65,11 +195,70 @@ func (d *DialScheduler) Desired() []string {
 	return list
 }
 
+// Targets returns the retry state of every desired address, sorted by
+// address.
+func (d *DialScheduler) Targets() []DialTarget {
+	d.mu.RLock()
+	list := make([]DialTarget, 0, len(d.desired))
+	for addr, target := range d.desired {
+		list = append(list, DialTarget{
+			Addr:      addr,
+			Failures:  target.failures,
+			NextDial:  target.next,
+			LastError: target.lastErr,
+			Manual:    target.manual,
+		})
+	}
+	d.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Addr < list[j].Addr })
+	return list
+}
+
+// formatDialTargets renders the dial state of each target for /peers.
+func formatDialTargets(targets []DialTarget, now time.Time) []string {
+	lines := make([]string, 0, len(targets))
+	for _, t := range targets {
+		line := fmt.Sprintf("  dial %s failures=%d", t.Addr, t.Failures)
+		if wait := t.NextDial.Sub(now); wait > 0 {
+			line += fmt.Sprintf(" next in %s", wait.Round(time.Second))
+		} else {
+			line += " next now"
+		}
+		if t.Manual {
+			line += " manual"
+		}
+		if t.LastError != "" {
+			line += " (" + t.LastError + ")"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// enqueue queues addr for dialing. When the queue is full it tries again
+// after a retry delay, since nothing else would ever dial addr.
 func (d *DialScheduler) enqueue(addr string) {
 	select {
 	case d.queue <- addr:
 	default:
-		log.Printf("dial queue full, dropping %s", addr)
+		delay := d.retryDelay(1)
+		log.Printf("dial queue full, retrying %s in %s", addr, delay.Round(time.Millisecond))
+		time.AfterFunc(delay, func() { d.requeue(addr) })
+	}
+}
+
+// requeue queues addr again unless it was forgotten or the scheduler closed.
+func (d *DialScheduler) requeue(addr string) {
+	select {
+	case <-d.quit:
+		return
+	default:
+	}
+	d.mu.RLock()
+	_, ok := d.desired[addr]
+	d.mu.RUnlock()
+	if ok {
+		d.enqueue(addr)
 	}
 }
 
@@ -87,31 +276,76 @@ func (d *DialScheduler) Run(ctx context.Context) {
 }
 
 func (d *DialScheduler) tryDial(ctx context.Context, addr string) {
-	if err := d.cm.ConnectToPeer(addr); err != nil {
-		log.Printf("dial %s failed: %v", addr, err)
-		d.scheduleRetry(ctx, addr)
+	d.mu.RLock()
+	_, stillDesired := d.desired[addr]
+	d.mu.RUnlock()
+	if !stillDesired {
 		return
 	}
+	err := d.cm.ConnectToPeer(addr)
+	if d.onResult != nil {
+		d.onResult(addr, err)
+	}
+
 	d.mu.Lock()
-	_, stillDesired := d.desired[addr]
-	if stillDesired {
-		d.desired[addr] = time.Now()
+	target, ok := d.desired[addr]
+	if !ok {
+		d.mu.Unlock()
+		return
+	}
+	switch {
+	case err == nil:
+		target.failures = 0
+		target.lastErr = ""
+	case errors.Is(err, network.ErrPeerLimit):
+		// At the outbound quota the address simply waits its turn; that is
+		// not its fault.
+	default:
+		target.failures++
+		target.lastErr = err.Error()
+		if target.failures >= d.maxFailures && !target.manual {
+			delete(d.desired, addr)
+			d.mu.Unlock()
+			log.Printf("giving up on %s after %d failures: %v", addr, d.maxFailures, err)
+			return
+		}
+		log.Printf("dial %s failed (%d in a row): %v", addr, target.failures, err)
 	}
+	delay := d.retryDelay(target.failures)
+	target.next = time.Now().Add(delay)
+	target.gen++
+	gen := target.gen
 	d.mu.Unlock()
-	if stillDesired {
-		d.scheduleRetry(ctx, addr)
+	d.scheduleRetry(ctx, addr, gen, delay)
+}
+
+// retryDelay is the wait before the next dial after failures failures in a
+// row, plus jitter.
+func (d *DialScheduler) retryDelay(failures int) time.Duration {
+	delay := backoffDelay(failures, d.backoff, d.backoffMax)
+	if d.jitter > 0 {
+		randMu.Lock()
+		delay += time.Duration(randSrc.Int63n(int64(d.jitter)))
+		randMu.Unlock()
 	}
+	return delay
 }
 
-func (d *DialScheduler) scheduleRetry(ctx context.Context, addr string) {
+// backoffDelay is base doubled for every failure after the first, capped at
+// max.
+func backoffDelay(failures int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func (d *DialScheduler) scheduleRetry(ctx context.Context, addr string, gen int, delay time.Duration) {
 	go func() {
-		var jitter time.Duration
-		if dialJitterRange > 0 {
-			randMu.Lock()
-			jitter = time.Duration(randSrc.Int63n(int64(dialJitterRange)))
-			randMu.Unlock()
-		}
-		delay := dialBackoff + jitter
 		timer := time.NewTimer(delay)
 		defer timer.Stop()
 		select {
@@ -121,6 +355,13 @@ func (d *DialScheduler) scheduleRetry(ctx context.Context, addr string) {
 			return
 		case <-timer.C:
 		}
+		d.mu.RLock()
+		target, ok := d.desired[addr]
+		current := ok && target.gen == gen
+		d.mu.RUnlock()
+		if !current {
+			return
+		}
 		select {
 		case <-ctx.Done():
 			return
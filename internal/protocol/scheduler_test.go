@@ -3,6 +3,9 @@ package protocol
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -51,12 +54,32 @@ func TestDialSchedulerAddIgnoresInvalid(t *testing.T) {
 	}
 }
 
+func TestDialSchedulerBoundsDesired(t *testing.T) {
+	scheduler := NewDialScheduler(newMockConnector(), "self")
+	for i := 0; i < maxDesired+10; i++ {
+		scheduler.Add(fmt.Sprintf("10.0.%d.%d:9001", i/256, i%256))
+	}
+	if n := len(scheduler.Desired()); n != maxDesired {
+		t.Fatalf("expected %d desired addresses, got %d", maxDesired, n)
+	}
+}
+
+func TestDialSchedulerAcceptsRelayedAddresses(t *testing.T) {
+	scheduler := NewDialScheduler(newMockConnector(), "127.0.0.1:9002/p/self")
+	scheduler.Add("127.0.0.1:9002/p/self")
+	scheduler.Add("127.0.0.1:9001/p/abc")
+	scheduler.Add("127.0.0.1:9001/p/")
+	scheduler.Add("127.0.0.1:9001/p/abc/p/def")
+	desired := scheduler.Desired()
+	if len(desired) != 1 || desired[0] != "127.0.0.1:9001/p/abc" {
+		t.Fatalf("unexpected desired list: %+v", desired)
+	}
+}
+
 func TestDialSchedulerRunKeepsDesiredAfterSuccess(t *testing.T) {
 	connector := newMockConnector()
 	scheduler := NewDialScheduler(connector, "self")
-	originalBackoff, originalJitter := dialBackoff, dialJitterRange
-	dialBackoff, dialJitterRange = 5*time.Millisecond, 0
-	defer func() { dialBackoff, dialJitterRange = originalBackoff, originalJitter }()
+	scheduler.backoff, scheduler.jitter = 5*time.Millisecond, 0
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	go scheduler.Run(ctx)
@@ -74,9 +97,7 @@ func TestDialSchedulerRetriesAfterFailure(t *testing.T) {
 	connector := newMockConnector()
 	connector.failures["peer3"] = 1
 	scheduler := NewDialScheduler(connector, "self")
-	originalBackoff, originalJitter := dialBackoff, dialJitterRange
-	dialBackoff, dialJitterRange = 5*time.Millisecond, 0
-	defer func() { dialBackoff, dialJitterRange = originalBackoff, originalJitter }()
+	scheduler.backoff, scheduler.jitter = 5*time.Millisecond, 0
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -86,6 +107,21 @@ func TestDialSchedulerRetriesAfterFailure(t *testing.T) {
 	scheduler.Close()
 }
 
+func TestDialSchedulerRetriesWhenQueueIsFull(t *testing.T) {
+	connector := newMockConnector()
+	scheduler := NewDialScheduler(connector, "self")
+	scheduler.backoff, scheduler.jitter = 5*time.Millisecond, 0
+	scheduler.queue = make(chan string, 1)
+	scheduler.Add("peer4")
+	scheduler.Add("peer5")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx)
+	waitFor(t, func() bool { return connector.Calls("peer4") >= 1 && connector.Calls("peer5") >= 1 })
+	scheduler.Close()
+}
+
 func waitFor(t *testing.T, cond func() bool) {
 	t.Helper()
 	deadline := time.Now().Add(2 * time.Second)
@@ -97,3 +133,72 @@ func waitFor(t *testing.T, cond func() bool) {
 	}
 	t.Fatalf("condition not met before deadline")
 }
+
+func TestBackoffDelayDoublesUpToCap(t *testing.T) {
+	for failures, want := range map[int]time.Duration{0: time.Second, 1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 40: 10 * time.Second} {
+		if got := backoffDelay(failures, time.Second, 10*time.Second); got != want {
+			t.Errorf("backoffDelay(%d) = %s, want %s", failures, got, want)
+		}
+	}
+}
+
+func TestDialSchedulerEvictsFailingAddresses(t *testing.T) {
+	connector := newMockConnector()
+	connector.failures["dead"] = 100
+	connector.failures["pinned"] = 100
+	scheduler := NewDialScheduler(connector, "self")
+	scheduler.backoff, scheduler.jitter, scheduler.maxFailures = time.Millisecond, 0, 3
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx)
+	scheduler.Add("dead")
+	if err := scheduler.Dial("pinned"); err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	waitFor(t, func() bool { return connector.Calls("dead") == 3 && connector.Calls("pinned") > 3 })
+	desired := scheduler.Desired()
+	if len(desired) != 1 || desired[0] != "pinned" {
+		t.Fatalf("expected only the manual target to survive, got %v", desired)
+	}
+	targets := scheduler.Targets()
+	if targets[0].Failures < 3 || targets[0].LastError != "dial error" || !targets[0].Manual {
+		t.Fatalf("unexpected target state %+v", targets[0])
+	}
+
+	if !scheduler.Forget("pinned") || scheduler.Forget("pinned") {
+		t.Fatalf("expected forget to report the target once")
+	}
+	time.Sleep(50 * time.Millisecond)
+	calls := connector.Calls("pinned")
+	time.Sleep(50 * time.Millisecond)
+	if connector.Calls("pinned") != calls {
+		t.Fatalf("forgotten address is still dialed")
+	}
+	scheduler.Close()
+}
+
+func TestDialSchedulerSyncBootstrap(t *testing.T) {
+	scheduler := NewDialScheduler(newMockConnector(), "self")
+	scheduler.Add("gossiped")
+	scheduler.SyncBootstrap([]string{"self", "a", "b"})
+	_ = scheduler.Dial("b")
+	scheduler.SyncBootstrap([]string{"self"})
+	got := scheduler.Desired()
+	sort.Strings(got)
+	if strings.Join(got, ",") != "b,gossiped" {
+		t.Fatalf("expected unlisted bootstrap peers to be dropped, got %v", got)
+	}
+}
+
+func TestFormatDialTargets(t *testing.T) {
+	now := time.Now()
+	lines := formatDialTargets([]DialTarget{
+		{Addr: "10.0.0.2:9001", Failures: 2, NextDial: now.Add(40 * time.Second), LastError: "connection refused"},
+		{Addr: "10.0.0.3:9001", NextDial: now, Manual: true},
+	}, now)
+	want := "  dial 10.0.0.2:9001 failures=2 next in 40s (connection refused)|  dial 10.0.0.3:9001 failures=0 next now manual"
+	if got := strings.Join(lines, "|"); got != want {
+		t.Fatalf("unexpected output %q", got)
+	}
+}
@@ -0,0 +1,241 @@
+package protocol
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"p2p-chat/internal/message"
+)
+
+const (
+	// syncPageSize bounds the messages returned in one sync_resp.
+	syncPageSize = 50
+	// syncMaxPages bounds how many follow-up pages are pulled per room from
+	// one neighbour in a single catch-up.
+	syncMaxPages = 20
+	// syncCooldown spaces out catch-ups with the same neighbour since
+	// presence heartbeats repeat the handshake.
+	syncCooldown = 2 * time.Minute
+	// syncServeBurst requests per syncServeWindow are answered per neighbour;
+	// the rest are ignored.
+	syncServeBurst  = 30
+	syncServeWindow = time.Minute
+	// syncMaxCursors caps the rooms a single request may ask about.
+	syncMaxCursors = 32
+)
+
+// syncLimiter keeps the per-neighbour bookkeeping for history sync: when we
+// last asked them, how many pages we pulled, and how often they asked us.
+type syncLimiter struct {
+	mu     sync.Mutex
+	asked  map[string]time.Time
+	pages  map[string]int
+	served map[string][]time.Time
+}
+
+func newSyncLimiter() *syncLimiter {
+	return &syncLimiter{
+		asked:  make(map[string]time.Time),
+		pages:  make(map[string]int),
+		served: make(map[string][]time.Time),
+	}
+}
+
+// claimSession reports whether a new catch-up with peer may start now and
+// resets its page counters if so.
+func (l *syncLimiter) claimSession(peer string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if last, ok := l.asked[peer]; ok && now.Sub(last) < syncCooldown {
+		return false
+	}
+	l.asked[peer] = now
+	for key := range l.pages {
+		if strings.HasPrefix(key, peer+"|") {
+			delete(l.pages, key)
+		}
+	}
+	return true
+}
+
+// claimPage reports whether another page for channel may be pulled from peer.
+func (l *syncLimiter) claimPage(peer, channel string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := peer + "|" + channel
+	if l.pages[key] >= syncMaxPages {
+		return false
+	}
+	l.pages[key]++
+	return true
+}
+
+// allowServe reports whether a request from peer fits its rate budget.
+func (l *syncLimiter) allowServe(peer string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	recent := l.served[peer][:0]
+	for _, at := range l.served[peer] {
+		if now.Sub(at) < syncServeWindow {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) >= syncServeBurst {
+		l.served[peer] = recent
+		return false
+	}
+	l.served[peer] = append(recent, now)
+	return true
+}
+
+// requestSync asks the neighbour on connection peer for room history newer
+// than what we hold.
+func (r *Runtime) requestSync(peer string) {
+	if peer == "" || !r.syncer.claimSession(peer, time.Now()) {
+		return
+	}
+	r.sendSyncRequest(peer, r.syncCursors())
+}
+
+// syncCursors summarises the newest stored message in every joined room.
+func (r *Runtime) syncCursors() []message.SyncCursor {
+	var cursors []message.SyncCursor
+	for _, name := range r.channels.List() {
+		cursor := message.SyncCursor{Channel: name}
+		latest, err := r.store.RecentChannel(name, 1)
+		if err != nil {
+			log.Printf("sync cursor %s: %v", name, err)
+		}
+		if len(latest) > 0 {
+			cursor.Since = latest[0].Timestamp
+			cursor.MsgID = latest[0].MsgID
+		}
+		cursors = append(cursors, cursor)
+	}
+	return cursors
+}
+
+func (r *Runtime) sendSyncRequest(peer string, cursors []message.SyncCursor) {
+	if len(cursors) == 0 {
+		return
+	}
+	req := message.Message{
+		MsgID:     NewMsgID(),
+		Type:      MsgTypeSyncReq,
+		From:      r.identity.Get(),
+		Origin:    r.selfAddr,
+		Cursors:   cursors,
+		Timestamp: time.Now(),
+	}
+	r.identity.Sign(&req)
+	if err := r.cm.SendTo(peer, req); err != nil {
+		log.Printf("sync_req to %s: %v", peer, err)
+	}
+}
+
+// serveSync answers a sync_req on connection from, subject to rate limits.
+func (r *Runtime) serveSync(req message.Message, from string) {
+	if from == "" {
+		return
+	}
+	if !r.syncer.allowServe(from, time.Now()) {
+		log.Printf("sync_req from %s rate limited", from)
+		return
+	}
+	for _, resp := range r.syncPages(req) {
+		r.identity.Sign(&resp)
+		if err := r.cm.SendTo(from, resp); err != nil {
+			log.Printf("sync_resp to %s: %v", from, err)
+			return
+		}
+	}
+}
+
+// syncPages builds one sync_resp per requested room that has newer messages.
+// A response carries a follow-up cursor when the room has more to send.
+func (r *Runtime) syncPages(req message.Message) []message.Message {
+	cursors := req.Cursors
+	if len(cursors) > syncMaxCursors {
+		cursors = cursors[:syncMaxCursors]
+	}
+	var out []message.Message
+	for _, cursor := range cursors {
+		channel := NormalizeChannel(cursor.Channel)
+		page, more, err := r.store.Since(channel, cursor.Since, cursor.MsgID, syncPageSize)
+		if err != nil {
+			log.Printf("sync %s: %v", channel, err)
+			continue
+		}
+		if len(page) == 0 {
+			continue
+		}
+		resp := message.Message{
+			MsgID:     NewMsgID(),
+			Type:      MsgTypeSyncResp,
+			From:      r.identity.Get(),
+			Origin:    r.selfAddr,
+			To:        req.From,
+			Channel:   channel,
+			Batch:     page,
+			Timestamp: time.Now(),
+		}
+		if more {
+			last := page[len(page)-1]
+			resp.Cursors = []message.SyncCursor{{Channel: channel, Since: last.Timestamp, MsgID: last.MsgID}}
+		}
+		out = append(out, resp)
+	}
+	return out
+}
+
+// syncable reports whether msg may arrive in a sync_resp: only plain room
+// posts are stored as history, never edits, reactions, DMs or batches.
+func syncable(msg message.Message) bool {
+	return (msg.Type == MsgTypeChat || msg.Type == MsgTypeFile) && len(msg.Batch) == 0
+}
+
+// mergeSync stores the messages of a sync_resp we were missing and asks for
+// the next page if the neighbour has more.
+func (r *Runtime) mergeSync(resp message.Message, from string) {
+	channel := NormalizeChannel(resp.Channel)
+	if !r.channels.Joined(channel) {
+		return
+	}
+	batch := append([]message.Message(nil), resp.Batch...)
+	sort.SliceStable(batch, func(i, j int) bool {
+		return batch[i].Timestamp.Before(batch[j].Timestamp)
+	})
+	var merged []message.Message
+	for _, msg := range batch {
+		if msg.MsgID == "" || !syncable(msg) || NormalizeChannel(msg.Channel) != channel || r.cache.Has(msg.MsgID) {
+			continue
+		}
+		if err := r.keyring.Verify(msg); err != nil {
+			log.Printf("sync: dropping msg %s from %s: %v", msg.MsgID, msg.From, err)
+			r.metrics.IncRejected()
+			continue
+		}
+		if r.blocklist.Blocks(msg.From, msg.Origin) || r.cache.Seen(msg.MsgID) {
+			continue
+		}
+		msg.Channel = channel
+		if err := r.store.Append(msg); err != nil {
+			log.Printf("history append: %v", err)
+		}
+		merged = append(merged, r.withReactions(msg))
+	}
+	if len(merged) > 0 {
+		r.history.Merge(merged)
+		r.sink.ShowSystem(fmt.Sprintf("caught up on %d messages in #%s from %s", len(merged), channel, resp.From))
+		if r.web != nil && channel == r.channels.Active() {
+			r.web.ShowHistory(channel)
+		}
+	}
+	if len(resp.Cursors) > 0 && from != "" && r.syncer.claimPage(from, channel) {
+		r.sendSyncRequest(from, resp.Cursors)
+	}
+}
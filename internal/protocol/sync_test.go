@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-chat/internal/message"
+	"p2p-chat/internal/storage"
+)
+
+func attachHistoryStore(t *testing.T, rt *Runtime) *storage.HistoryStore {
+	t.Helper()
+	store, err := storage.OpenHistoryStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("open history: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	rt.store = store
+	return store
+}
+
+func TestHistorySyncCatchesUpMissingMessages(t *testing.T) {
+	alice, _, _ := newTestRuntime(t)
+	aliceStore := attachHistoryStore(t, alice)
+	bob, sink, _ := newTestRuntime(t)
+	bobStore := attachHistoryStore(t, bob)
+
+	carol := NewIdentity("Carol", "Carol")
+	carol.SetSigningKey(newSigningKey(t))
+	base := time.Now().Add(-time.Hour)
+	var sent []message.Message
+	for i := 0; i < syncPageSize+5; i++ {
+		msg := message.Message{
+			MsgID:     NewMsgID(),
+			Type:      MsgTypeChat,
+			From:      "Carol",
+			Origin:    "10.0.0.3:9001",
+			Channel:   DefaultChannel,
+			Content:   "backlog",
+			Timestamp: base.Add(time.Duration(i) * time.Second),
+		}
+		carol.Sign(&msg)
+		if err := aliceStore.Append(msg); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		sent = append(sent, msg)
+	}
+	// Bob already has the first message.
+	if err := bobStore.Append(sent[0]); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	req := message.Message{Type: MsgTypeSyncReq, From: "bob", Cursors: bob.syncCursors()}
+	pages := alice.syncPages(req)
+	if len(pages) != 1 || len(pages[0].Batch) != syncPageSize || len(pages[0].Cursors) != 1 {
+		t.Fatalf("expected one full page with a follow-up cursor, got %+v", pages)
+	}
+	bob.mergeSync(pages[0], "")
+	bob.mergeSync(pages[0], "")
+
+	req.Cursors = pages[0].Cursors
+	rest := alice.syncPages(req)
+	if len(rest) != 1 || len(rest[0].Batch) != 4 || len(rest[0].Cursors) != 0 {
+		t.Fatalf("expected final page of 4, got %+v", rest)
+	}
+	bob.mergeSync(rest[0], "")
+
+	stored, err := bobStore.RecentChannel(DefaultChannel, 100)
+	if err != nil {
+		t.Fatalf("recent: %v", err)
+	}
+	if len(stored) != len(sent) {
+		t.Fatalf("expected %d stored messages, got %d", len(sent), len(stored))
+	}
+	buffered := bob.history.Channel(DefaultChannel)
+	if len(buffered) != len(sent)-1 {
+		t.Fatalf("expected %d buffered messages, got %d", len(sent)-1, len(buffered))
+	}
+	for i := 1; i < len(buffered); i++ {
+		if buffered[i].Timestamp.Before(buffered[i-1].Timestamp) {
+			t.Fatalf("history buffer out of order at %d", i)
+		}
+	}
+	if len(sink.systems) != 2 {
+		t.Fatalf("expected one catch-up notice per new page, got %v", sink.systems)
+	}
+}
+
+func TestHistorySyncDropsForgedMessages(t *testing.T) {
+	rt, _, _ := newTestRuntime(t)
+	store := attachHistoryStore(t, rt)
+	forged := signedMessage(t, newSigningKey(t), "Carol", "10.0.0.3:9001")
+	forged.Channel = DefaultChannel
+	forged.Content = "tampered"
+	rt.mergeSync(message.Message{Type: MsgTypeSyncResp, Channel: DefaultChannel, Batch: []message.Message{forged}}, "")
+	if stored, _ := store.RecentChannel(DefaultChannel, 10); len(stored) != 0 {
+		t.Fatalf("forged message should not be merged: %+v", stored)
+	}
+	if rt.metrics.Snapshot().Rejected != 1 {
+		t.Fatalf("expected the forgery to be counted as rejected")
+	}
+}
+
+func TestHistorySyncOnlyMergesRoomPosts(t *testing.T) {
+	rt, _, _ := newTestRuntime(t)
+	store := attachHistoryStore(t, rt)
+	carol := NewIdentity("Carol", "Carol")
+	carol.SetSigningKey(newSigningKey(t))
+	entry := func(id, kind string, batch []message.Message) message.Message {
+		msg := message.Message{MsgID: id, Type: kind, From: "Carol", Origin: "10.0.0.3:9001", Channel: DefaultChannel, Content: "x", Timestamp: time.Now(), Batch: batch}
+		carol.Sign(&msg)
+		return msg
+	}
+	plain := entry("chat1", MsgTypeChat, nil)
+	batch := []message.Message{
+		plain,
+		entry("edit1", MsgTypeEdit, nil),
+		entry("react1", MsgTypeReaction, nil),
+		entry("dm1", MsgTypeDM, nil),
+		entry("nested1", MsgTypeChat, []message.Message{entry("inner1", MsgTypeChat, nil)}),
+	}
+	rt.mergeSync(message.Message{Type: MsgTypeSyncResp, Channel: DefaultChannel, Batch: batch}, "")
+	stored, _ := store.RecentChannel(DefaultChannel, 10)
+	if len(stored) != 1 || stored[0].MsgID != "chat1" {
+		t.Fatalf("expected only the plain post to be merged, got %+v", stored)
+	}
+}
+
+func TestSyncLimiterBoundsRequests(t *testing.T) {
+	limiter := newSyncLimiter()
+	now := time.Now()
+	for i := 0; i < syncServeBurst; i++ {
+		if !limiter.allowServe("peer", now) {
+			t.Fatalf("request %d should be served", i)
+		}
+	}
+	if limiter.allowServe("peer", now) {
+		t.Fatalf("expected burst limit to apply")
+	}
+	if !limiter.allowServe("peer", now.Add(syncServeWindow)) {
+		t.Fatalf("expected budget to refill after the window")
+	}
+	if !limiter.claimSession("peer", now) || limiter.claimSession("peer", now.Add(time.Second)) {
+		t.Fatalf("expected catch-ups to be spaced by the cooldown")
+	}
+}
@@ -2,10 +2,13 @@ package protocol
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"sync"
 	"testing"
 	"time"
 
+	"p2p-chat/internal/crypto"
 	"p2p-chat/internal/message"
 	"p2p-chat/internal/network"
 	"p2p-chat/internal/storage"
@@ -18,6 +21,9 @@ type recordingSink struct {
 	systems       []string
 	peerSnapshots [][]ui.Presence
 	notifications []ui.Notification
+	statuses      []ui.StatusUpdate
+	updates       []message.Message
+	reactions     []ui.ReactionUpdate
 }
 
 func (s *recordingSink) ShowMessage(msg message.Message) {
@@ -46,6 +52,32 @@ func (s *recordingSink) ShowNotification(n ui.Notification) {
 	s.notifications = append(s.notifications, n)
 }
 
+func (s *recordingSink) ShowStatus(update ui.StatusUpdate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses = append(s.statuses, update)
+}
+
+func (s *recordingSink) UpdateMessage(msg message.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updates = append(s.updates, msg)
+}
+
+func (s *recordingSink) ShowReaction(u ui.ReactionUpdate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reactions = append(s.reactions, u)
+}
+
+func (s *recordingSink) statusCopy() []ui.StatusUpdate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]ui.StatusUpdate, len(s.statuses))
+	copy(out, s.statuses)
+	return out
+}
+
 func (s *recordingSink) lastMessage() message.Message {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -86,26 +118,37 @@ func newTestRuntime(t *testing.T) (*Runtime, *recordingSink, *recordingBroadcast
 	t.Helper()
 	sink := &recordingSink{}
 	broadcaster := &recordingBroadcaster{}
-	cm := &network.ConnManager{Incoming: make(chan message.Message, 1)}
+	cm := &network.ConnManager{Incoming: make(chan network.Inbound, 1)}
 	dialer := NewDialScheduler(cm, "127.0.0.1:9001")
 	ack := NewAckTracker(broadcaster)
+	keys, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("generate keys: %v", err)
+	}
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate signing key: %v", err)
+	}
+	identity := NewIdentity("tester", "tester")
+	identity.SetKeyPair(keys)
+	identity.SetSigningKey(signingKey)
 	rt := NewRuntime(context.Background(), RuntimeOptions{
-		ConnManager:  cm,
-		CacheTTL:     10 * time.Minute,
-		HistorySize:  128,
-		Store:        &storage.HistoryStore{},
-		Files:        nil,
-		Blocklist:    NewBlockList(),
-		Directory:    NewPeerDirectory(),
-		Metrics:      NewMetrics(),
-		Ack:          ack,
-		Dialer:       dialer,
-		Sink:         sink,
-		Identity:     NewIdentity("tester", "tester"),
-		SelfAddr:     "127.0.0.1:9001",
-		BootstrapURL: "http://localhost:8000",
-		PollInterval: time.Second,
-		AuthAPI:      "",
+		ConnManager:   cm,
+		CacheTTL:      10 * time.Minute,
+		HistorySize:   128,
+		Store:         &storage.HistoryStore{},
+		Files:         nil,
+		Blocklist:     NewBlockList(),
+		Directory:     NewPeerDirectory(),
+		Metrics:       NewMetrics(),
+		Ack:           ack,
+		Dialer:        dialer,
+		Sink:          sink,
+		Identity:      identity,
+		SelfAddr:      "127.0.0.1:9001",
+		BootstrapURLs: []string{"http://localhost:8000"},
+		PollInterval:  time.Second,
+		AuthAPI:       "",
 	})
 	t.Cleanup(func() {
 		if ack := rt.AckTracker(); ack != nil {
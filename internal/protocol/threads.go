@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+
+	"p2p-chat/internal/message"
+)
+
+// threadReply points msg at parent. Replies to a reply join the parent's
+// thread so every message in a thread shares one root.
+func threadReply(msg *message.Message, parent *message.Message) {
+	if parent == nil {
+		return
+	}
+	msg.ReplyTo = parent.MsgID
+	msg.ThreadRoot = parent.ThreadRoot
+	if msg.ThreadRoot == "" {
+		msg.ThreadRoot = parent.MsgID
+	}
+}
+
+// sendReply answers the buffered message matching prefix in the same place
+// it was posted: its room, or privately for direct messages.
+func (r *Runtime) sendReply(prefix, content string) {
+	if content == "" {
+		r.sink.ShowSystem("message required")
+		return
+	}
+	parent, err := r.history.ResolvePrefix(prefix)
+	if err != nil {
+		r.sink.ShowSystem(fmt.Sprintf("reply: %v", err))
+		return
+	}
+	if parent.Deleted {
+		r.sink.ShowSystem("cannot reply to a deleted message")
+		return
+	}
+	if parent.Type != MsgTypeDM {
+		r.postChat(NormalizeChannel(parent.Channel), content, &parent)
+		return
+	}
+	target := parent.Origin
+	if target == r.selfAddr {
+		target = parent.ToAddr
+		if target == "" {
+			target = parent.To
+		}
+	}
+	if strings.TrimSpace(target) == "" {
+		r.sink.ShowSystem("reply: cannot tell who to answer")
+		return
+	}
+	r.postDirect(target, content, &parent)
+}
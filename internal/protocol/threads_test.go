@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-chat/internal/message"
+)
+
+func TestReplyThreadsUnderRoot(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	store := attachHistoryStore(t, rt)
+	rt.sendChatMessage("lunch?")
+	root := sink.lastMessage()
+
+	rt.ProcessLine("/reply " + root.MsgID[:8] + " sure")
+	first := sink.lastMessage()
+	if first.ReplyTo != root.MsgID || first.ThreadRoot != root.MsgID {
+		t.Fatalf("expected reply to point at root, got %+v", first)
+	}
+	if first.Channel != root.Channel {
+		t.Fatalf("expected reply in #%s, got #%s", root.Channel, first.Channel)
+	}
+
+	rt.ProcessLine("/reply " + first.MsgID + " noon works")
+	second := sink.lastMessage()
+	if second.ReplyTo != first.MsgID || second.ThreadRoot != root.MsgID {
+		t.Fatalf("expected nested reply to keep the thread root, got %+v", second)
+	}
+
+	thread, err := store.Thread(root.MsgID)
+	if err != nil {
+		t.Fatalf("thread: %v", err)
+	}
+	if thread.Root == nil || len(thread.Replies) != 2 || thread.Replies[1].Content != "noon works" {
+		t.Fatalf("unexpected thread %+v", thread)
+	}
+}
+
+func TestReplyRejectsAmbiguousPrefix(t *testing.T) {
+	rt, sink, _ := newTestRuntime(t)
+	now := time.Now()
+	rt.history.Add(message.Message{MsgID: "abcdef01", Type: MsgTypeChat, From: "bob", Channel: "general", Content: "one", Timestamp: now})
+	rt.history.Add(message.Message{MsgID: "abcdef02", Type: MsgTypeChat, From: "bob", Channel: "general", Content: "two", Timestamp: now})
+
+	rt.ProcessLine("/reply abcdef yes")
+	if len(sink.messages) != 0 {
+		t.Fatalf("expected no reply to be sent, got %+v", sink.messages)
+	}
+	if last := sink.systems[len(sink.systems)-1]; !strings.Contains(last, "matches 2 messages") {
+		t.Fatalf("expected ambiguity error, got %q", last)
+	}
+
+	rt.ProcessLine("/reply abcdef02 yes")
+	if reply := sink.lastMessage(); reply.ReplyTo != "abcdef02" {
+		t.Fatalf("expected reply to abcdef02, got %+v", reply)
+	}
+}
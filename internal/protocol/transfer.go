@@ -0,0 +1,540 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"p2p-chat/internal/crypto"
+	"p2p-chat/internal/message"
+	"p2p-chat/internal/storage"
+)
+
+const (
+	// fileChunkSize is the payload of one file_chunk. Even sealed and in
+	// JSON it stays far below the default frame limit.
+	fileChunkSize = 16 << 10
+	// fileWindow is how many chunks a receiver asks for at once. A new window
+	// is only requested once the previous one has arrived.
+	fileWindow = 8
+	// maxAutoFetch caps the size of files fetched without being asked;
+	// bigger ones wait for /fetch.
+	maxAutoFetch = 64 << 20
+	// fileStallAfter re-requests a window that made no progress for this long.
+	fileStallAfter = 20 * time.Second
+	// fileMaxRetries parks a stalled transfer until its source reconnects.
+	fileMaxRetries = 5
+	fileSweepEvery = 5 * time.Second
+	// fileRouteTTL bounds how long relays remember where a file_req came from.
+	fileRouteTTL = 10 * time.Minute
+)
+
+// transfer is a file this peer is receiving.
+type transfer struct {
+	in          storage.IncomingFile
+	outstanding int
+	progressAt  time.Time
+	retries     int
+	parked      bool
+}
+
+// fileRoute remembers the connection a relayed file_req arrived on so the
+// chunks can follow it back instead of flooding the mesh.
+type fileRoute struct {
+	conn string
+	at   time.Time
+}
+
+// transferTable tracks incoming transfers, chunk windows being served and
+// reverse routes for relayed chunks.
+type transferTable struct {
+	mu      sync.Mutex
+	active  map[string]*transfer
+	serving map[string]bool
+	routes  map[string]fileRoute
+}
+
+func newTransferTable() *transferTable {
+	return &transferTable{
+		active:  make(map[string]*transfer),
+		serving: make(map[string]bool),
+		routes:  make(map[string]fileRoute),
+	}
+}
+
+func routeKey(fileID, requester string) string {
+	return fileID + "|" + requester
+}
+
+func (t *transferTable) noteRoute(fileID, requester, conn string) {
+	if conn == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.routes[routeKey(fileID, requester)] = fileRoute{conn: conn, at: time.Now()}
+}
+
+func (t *transferTable) route(fileID, requester string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.routes[routeKey(fileID, requester)]
+	return r.conn, ok
+}
+
+// claimServe reports whether the window identified by key may be served now;
+// a retried request does not start a second copy of a window in flight.
+func (t *transferTable) claimServe(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.serving[key] {
+		return false
+	}
+	t.serving[key] = true
+	return true
+}
+
+func (t *transferTable) releaseServe(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.serving, key)
+}
+
+// SendFileFromPath stores the file at path and shares it with target, or with
+// the active room when target is empty.
+func (r *Runtime) SendFileFromPath(path, target string) error {
+	if r.files == nil {
+		return fmt.Errorf("file store unavailable")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	record, err := r.files.Save(filepath.Base(path), r.identity.Get(), file)
+	if err != nil {
+		return err
+	}
+	return r.ShareFile(record, target)
+}
+
+// fetchAttachments starts receiving the files announced by msg. Files over
+// maxAutoFetch wait for /fetch.
+func (r *Runtime) fetchAttachments(msg message.Message) {
+	if r.files == nil || msg.Type != MsgTypeFile || msg.Origin == r.selfAddr {
+		return
+	}
+	for _, att := range msg.Attachments {
+		if att.ID == "" || att.SHA256 == "" {
+			continue
+		}
+		if att.Size > maxAutoFetch {
+			r.sink.ShowSystem(fmt.Sprintf("not fetching %s from %s: %s is over the %s limit, use /fetch %s to fetch it anyway", att.Name, msg.From, formatSize(att.Size), formatSize(maxAutoFetch), att.ID))
+			continue
+		}
+		r.fetchAttachment(msg, att)
+	}
+}
+
+// fetchCommand starts receiving the file with id from the announcement still
+// in the history buffer, whatever its size.
+func (r *Runtime) fetchCommand(id string) {
+	if r.files == nil {
+		r.sink.ShowSystem("file store unavailable")
+		return
+	}
+	all := r.history.All()
+	for i := len(all) - 1; i >= 0; i-- {
+		msg := all[i]
+		if msg.Type != MsgTypeFile || msg.Origin == r.selfAddr {
+			continue
+		}
+		for _, att := range msg.Attachments {
+			if att.ID == id && att.SHA256 != "" {
+				r.fetchAttachment(msg, att)
+				return
+			}
+		}
+	}
+	r.sink.ShowSystem(fmt.Sprintf("no file %s announced by another peer in recent history", id))
+}
+
+// fetchAttachment starts receiving att from the peer that announced it in
+// msg, unless it is already stored or on its way.
+func (r *Runtime) fetchAttachment(msg message.Message, att message.Attachment) {
+	in, err := r.files.BeginIncoming(storage.IncomingFile{
+		Record: storage.FileRecord{
+			ID:       att.ID,
+			Name:     att.Name,
+			Size:     att.Size,
+			Mime:     att.Mime,
+			Uploader: msg.From,
+			SHA256:   att.SHA256,
+		},
+		ChunkSize:  fileChunkSize,
+		Source:     msg.Origin,
+		SourceName: msg.From,
+		MsgID:      msg.MsgID,
+	})
+	if errors.Is(err, storage.ErrFileExists) {
+		return
+	}
+	if errors.Is(err, storage.ErrQuotaExceeded) || errors.Is(err, storage.ErrStoreFull) {
+		r.sink.ShowSystem(fmt.Sprintf("not fetching %s from %s: %v", att.Name, msg.From, err))
+		return
+	}
+	if err != nil {
+		log.Printf("file %s from %s: %v", att.ID, msg.From, err)
+		return
+	}
+	r.transfers.mu.Lock()
+	_, running := r.transfers.active[in.Record.ID]
+	if !running {
+		r.transfers.active[in.Record.ID] = &transfer{in: in, progressAt: time.Now()}
+	}
+	r.transfers.mu.Unlock()
+	if running {
+		return
+	}
+	r.sink.ShowSystem(fmt.Sprintf("fetching %s (%s) from %s", att.Name, formatSize(att.Size), msg.From))
+	r.requestChunks(in.Record.ID)
+}
+
+// requestChunks asks the source of fileID for the next window of chunks, or
+// completes the file if nothing is missing.
+func (r *Runtime) requestChunks(fileID string) {
+	r.transfers.mu.Lock()
+	tr, ok := r.transfers.active[fileID]
+	if !ok {
+		r.transfers.mu.Unlock()
+		return
+	}
+	first := tr.in.FirstMissing()
+	total := tr.in.Total()
+	count := fileWindow
+	if first >= 0 && total-first < count {
+		count = total - first
+	}
+	tr.outstanding = count
+	tr.progressAt = time.Now()
+	tr.parked = false
+	in := tr.in
+	r.transfers.mu.Unlock()
+
+	if first < 0 {
+		r.finishTransfer(fileID)
+		return
+	}
+	req := message.Message{
+		MsgID:     NewMsgID(),
+		Type:      MsgTypeFileReq,
+		From:      r.identity.Get(),
+		Origin:    r.selfAddr,
+		To:        in.SourceName,
+		ToAddr:    in.Source,
+		Chunk:     &message.FileChunk{FileID: fileID, Index: first, Count: count, Total: total},
+		Timestamp: time.Now(),
+	}
+	r.identity.Sign(&req)
+	r.cache.Seen(req.MsgID)
+	r.relay.Publish(req)
+}
+
+// handleFileRequest serves a window of chunks to the requester, or passes a
+// request meant for another peer along while remembering where it came from.
+func (r *Runtime) handleFileRequest(req message.Message, from string) {
+	chunk := req.Chunk
+	if chunk == nil || chunk.FileID == "" {
+		return
+	}
+	if req.ToAddr != r.selfAddr {
+		r.transfers.noteRoute(chunk.FileID, req.Origin, from)
+		r.relay.Forward(req, from)
+		return
+	}
+	if r.files == nil || r.blocklist.Blocks(req.From, req.Origin) {
+		return
+	}
+	if !r.files.SharedWith(chunk.FileID, req.From, req.Origin) {
+		log.Printf("file_req for %s from %s (%s) refused", chunk.FileID, req.From, req.Origin)
+		r.metrics.IncRejected()
+		return
+	}
+	key := fmt.Sprintf("%s|%d", routeKey(chunk.FileID, req.Origin), chunk.Index)
+	if !r.transfers.claimServe(key) {
+		return
+	}
+	go func() {
+		defer r.transfers.releaseServe(key)
+		r.serveChunks(req, from)
+	}()
+}
+
+// serveChunks sends the requested window one chunk at a time on the bulk
+// queue of the connection the request arrived on.
+func (r *Runtime) serveChunks(req message.Message, from string) {
+	chunk := req.Chunk
+	count := chunk.Count
+	if count <= 0 || count > fileWindow {
+		count = fileWindow
+	}
+	// Files shared to a room travel in the clear like room chat; files sent
+	// to one peer are sealed to them.
+	var sealTo *[32]byte
+	if !r.files.SharedWith(chunk.FileID, "*", "") {
+		key, ok := r.directory.PublicKey(req.Origin)
+		if !ok {
+			log.Printf("file_req from %s: no encryption key known", req.From)
+			return
+		}
+		sealTo = key
+	}
+	entry, err := r.files.Get(chunk.FileID)
+	if err != nil {
+		log.Printf("file_req %s: %v", chunk.FileID, err)
+		return
+	}
+	total := int((entry.Size + fileChunkSize - 1) / fileChunkSize)
+	for i := chunk.Index; i < chunk.Index+count && i < total; i++ {
+		if r.ctx.Err() != nil {
+			return
+		}
+		data, err := r.files.ReadChunk(chunk.FileID, i, fileChunkSize)
+		if err != nil {
+			log.Printf("file %s chunk %d: %v", chunk.FileID, i, err)
+			return
+		}
+		sum := sha256.Sum256(data)
+		msg := message.Message{
+			MsgID:     NewMsgID(),
+			Type:      MsgTypeFileChunk,
+			From:      r.identity.Get(),
+			Origin:    r.selfAddr,
+			To:        req.From,
+			ToAddr:    req.Origin,
+			Chunk:     &message.FileChunk{FileID: chunk.FileID, Index: i, Total: total, SHA256: hex.EncodeToString(sum[:]), Data: data},
+			Timestamp: time.Now(),
+		}
+		if sealTo != nil {
+			sealed, err := crypto.SealFor(sealTo, data)
+			if err != nil {
+				log.Printf("file %s seal: %v", chunk.FileID, err)
+				return
+			}
+			msg.Chunk.Data = []byte(sealed)
+			msg.Sealed = true
+		}
+		r.identity.Sign(&msg)
+		r.cache.Seen(msg.MsgID)
+		r.sendBulk(from, msg)
+	}
+}
+
+// sendBulk sends a chunk to the neighbour peer, falling back to the relay if
+// that connection is gone.
+func (r *Runtime) sendBulk(peer string, msg message.Message) {
+	if peer != "" {
+		err := r.relay.Unicast(peer, msg)
+		if err == nil {
+			return
+		}
+		log.Printf("chunk to %s: %v", peer, err)
+	}
+	r.relay.Publish(msg)
+}
+
+// handleFileChunk stores a chunk of a file we asked for, or routes a chunk
+// meant for someone else back along the path its request took.
+func (r *Runtime) handleFileChunk(msg message.Message, from string) {
+	chunk := msg.Chunk
+	if chunk == nil || chunk.FileID == "" {
+		return
+	}
+	if msg.ToAddr != r.selfAddr {
+		if conn, ok := r.transfers.route(chunk.FileID, msg.ToAddr); ok && conn != from {
+			r.sendBulk(conn, msg)
+			return
+		}
+		r.relay.Forward(msg, from)
+		return
+	}
+	data := chunk.Data
+	if msg.Sealed {
+		plain, err := r.identity.KeyPair().Open(string(data))
+		if err != nil {
+			log.Printf("file %s chunk %d: %v", chunk.FileID, chunk.Index, err)
+			return
+		}
+		data = plain
+	}
+	sum := sha256.Sum256(data)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), chunk.SHA256) {
+		log.Printf("file %s chunk %d from %s: checksum mismatch", chunk.FileID, chunk.Index, msg.From)
+		r.metrics.IncRejected()
+		return
+	}
+
+	r.transfers.mu.Lock()
+	tr, ok := r.transfers.active[chunk.FileID]
+	if !ok || tr.in.Source != msg.Origin {
+		r.transfers.mu.Unlock()
+		return
+	}
+	if !tr.in.Has(chunk.Index) {
+		if err := r.files.WriteChunk(&tr.in, chunk.Index, data); err != nil {
+			r.transfers.mu.Unlock()
+			log.Printf("file %s chunk %d: %v", chunk.FileID, chunk.Index, err)
+			return
+		}
+	}
+	tr.outstanding--
+	tr.progressAt = time.Now()
+	tr.retries = 0
+	windowDone := tr.outstanding <= 0
+	in := tr.in
+	r.transfers.mu.Unlock()
+
+	if !windowDone {
+		return
+	}
+	if err := r.files.SaveIncoming(in); err != nil {
+		log.Printf("file %s progress: %v", chunk.FileID, err)
+	}
+	r.requestChunks(chunk.FileID)
+}
+
+// finishTransfer verifies a fully received file and points its announcement
+// at the local copy.
+func (r *Runtime) finishTransfer(fileID string) {
+	r.transfers.mu.Lock()
+	tr, ok := r.transfers.active[fileID]
+	delete(r.transfers.active, fileID)
+	r.transfers.mu.Unlock()
+	if !ok {
+		return
+	}
+	record, err := r.files.FinishIncoming(tr.in)
+	if err != nil {
+		r.sink.ShowSystem(fmt.Sprintf("file %s from %s failed: %v", tr.in.Record.Name, tr.in.SourceName, err))
+		return
+	}
+	where := record.ID
+	if entry, err := r.files.Get(record.ID); err == nil {
+		where = entry.Path
+	}
+	r.sink.ShowSystem(fmt.Sprintf("received %s (%s) from %s: %s", record.Name, formatSize(record.Size), tr.in.SourceName, where))
+	if r.web == nil || tr.in.MsgID == "" {
+		return
+	}
+	announced, ok := r.history.Find(tr.in.MsgID)
+	if !ok {
+		return
+	}
+	announced.Attachments = append([]message.Attachment(nil), announced.Attachments...)
+	for i := range announced.Attachments {
+		if announced.Attachments[i].ID == record.ID {
+			announced.Attachments[i].URL = r.buildDownloadURL(record)
+		}
+	}
+	r.history.Replace(announced)
+	r.sink.UpdateMessage(announced)
+}
+
+// resumeTransfers restarts stalled or parked transfers from source, typically
+// after it reconnects.
+func (r *Runtime) resumeTransfers(source string) {
+	var ids []string
+	r.transfers.mu.Lock()
+	for id, tr := range r.transfers.active {
+		if tr.in.Source == source && (tr.parked || time.Since(tr.progressAt) > fileStallAfter) {
+			tr.retries = 0
+			ids = append(ids, id)
+		}
+	}
+	r.transfers.mu.Unlock()
+	for _, id := range ids {
+		r.requestChunks(id)
+	}
+}
+
+// loadTransfers picks up transfers interrupted by a restart. They stay parked
+// until their source shows up.
+func (r *Runtime) loadTransfers() {
+	pending, err := r.files.PendingIncoming()
+	if err != nil {
+		log.Printf("pending transfers: %v", err)
+		return
+	}
+	r.transfers.mu.Lock()
+	defer r.transfers.mu.Unlock()
+	for _, in := range pending {
+		if _, ok := r.transfers.active[in.Record.ID]; !ok {
+			r.transfers.active[in.Record.ID] = &transfer{in: in, parked: true}
+		}
+	}
+}
+
+// TransferLoop re-requests stalled windows and expires relay routes.
+func (r *Runtime) TransferLoop() {
+	if r.files == nil {
+		return
+	}
+	r.loadTransfers()
+	ticker := time.NewTicker(fileSweepEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.sweepTransfers(now)
+		}
+	}
+}
+
+func (r *Runtime) sweepTransfers(now time.Time) {
+	var stalled []string
+	r.transfers.mu.Lock()
+	for id, tr := range r.transfers.active {
+		if tr.parked || now.Sub(tr.progressAt) < fileStallAfter {
+			continue
+		}
+		tr.retries++
+		if tr.retries > fileMaxRetries {
+			tr.parked = true
+			log.Printf("file %s parked until %s reconnects", tr.in.Record.Name, tr.in.SourceName)
+			continue
+		}
+		stalled = append(stalled, id)
+	}
+	for key, route := range r.transfers.routes {
+		if now.Sub(route.at) > fileRouteTTL {
+			delete(r.transfers.routes, key)
+		}
+	}
+	r.transfers.mu.Unlock()
+	for _, id := range stalled {
+		r.requestChunks(id)
+	}
+}
+
+// formatSize renders n bytes for people.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,243 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-chat/internal/message"
+	"p2p-chat/internal/storage"
+)
+
+// transferPeer is a runtime with its own file store wired to a fake link.
+type transferPeer struct {
+	rt        *Runtime
+	sink      *recordingSink
+	files     *storage.FileStore
+	transport *fakeTransport
+}
+
+func newTransferPeer(t *testing.T, name, addr string) *transferPeer {
+	t.Helper()
+	rt, sink, _ := newTestRuntime(t)
+	rt.identity.SetDisplay(name)
+	rt.selfAddr = addr
+	base := t.TempDir()
+	files, err := storage.OpenFileStore(filepath.Join(base, "files.db"), filepath.Join(base, "files"))
+	if err != nil {
+		t.Fatalf("open file store: %v", err)
+	}
+	t.Cleanup(func() { _ = files.Close() })
+	rt.files = files
+	transport := newFakeTransport("link")
+	rt.relay = NewRelay(RelayFlood, 0, transport)
+	return &transferPeer{rt: rt, sink: sink, files: files, transport: transport}
+}
+
+func (p *transferPeer) drain() []message.Message {
+	p.transport.mu.Lock()
+	defer p.transport.mu.Unlock()
+	out := p.transport.sent["link"]
+	delete(p.transport.sent, "link")
+	return out
+}
+
+// pump delivers traffic between a and b until the link has been quiet for a
+// while. drop may discard messages in flight.
+func pump(a, b *transferPeer, drop func(message.Message) bool) {
+	quietSince := time.Now()
+	for time.Since(quietSince) < 100*time.Millisecond {
+		moved := false
+		for _, pair := range [][2]*transferPeer{{a, b}, {b, a}} {
+			for _, msg := range pair[0].drain() {
+				moved = true
+				if drop != nil && drop(msg) {
+					continue
+				}
+				pair[1].rt.processIncoming(msg, "link")
+			}
+		}
+		if moved {
+			quietSince = time.Now()
+			continue
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func writeTempFile(t *testing.T, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("random data: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "payload.bin")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write payload: %v", err)
+	}
+	return path, data
+}
+
+func receivedFile(t *testing.T, p *transferPeer, id string) []byte {
+	t.Helper()
+	entry, err := p.files.Get(id)
+	if err != nil {
+		t.Fatalf("file %s not stored on receiver: %v", id, err)
+	}
+	data, err := os.ReadFile(entry.Path)
+	if err != nil {
+		t.Fatalf("read received file: %v", err)
+	}
+	return data
+}
+
+func TestFileCommandTransfersOverMeshWithoutWeb(t *testing.T) {
+	alice := newTransferPeer(t, "Alice", "10.0.0.1:9001")
+	bob := newTransferPeer(t, "Bob", "10.0.0.2:9001")
+	path, data := writeTempFile(t, 20*fileChunkSize+123)
+
+	alice.rt.ProcessLine("/file " + path)
+	announced := alice.sink.lastMessage()
+	if announced.Type != MsgTypeFile || len(announced.Attachments) != 1 {
+		t.Fatalf("expected file announcement, got %+v", announced)
+	}
+	att := announced.Attachments[0]
+	if att.URL != "" || att.SHA256 == "" {
+		t.Fatalf("expected checksum and no web url, got %+v", att)
+	}
+
+	pump(alice, bob, nil)
+	if got := receivedFile(t, bob, att.ID); !bytes.Equal(got, data) {
+		t.Fatalf("received file differs (%d bytes, want %d)", len(got), len(data))
+	}
+	if !strings.HasPrefix(bob.sink.systems[len(bob.sink.systems)-1], "received payload.bin") {
+		t.Fatalf("expected completion notice, got %v", bob.sink.systems)
+	}
+	if pending, _ := bob.files.PendingIncoming(); len(pending) != 0 {
+		t.Fatalf("expected no partial transfers left, got %d", len(pending))
+	}
+}
+
+func TestFetchCommandFetchesSkippedFile(t *testing.T) {
+	alice := newTransferPeer(t, "Alice", "10.0.0.1:9001")
+	bob := newTransferPeer(t, "Bob", "10.0.0.2:9001")
+	path, data := writeTempFile(t, 3*fileChunkSize)
+
+	alice.rt.ProcessLine("/file " + path)
+	alice.drain()
+	announced := alice.sink.lastMessage()
+	att := announced.Attachments[0]
+	// As if the announcement had been skipped for its size.
+	bob.rt.history.Add(announced)
+
+	bob.rt.ProcessLine("/fetch nope")
+	if last := bob.sink.systems[len(bob.sink.systems)-1]; !strings.Contains(last, "no file nope") {
+		t.Fatalf("expected an unknown id to be reported, got %q", last)
+	}
+	bob.rt.ProcessLine("/fetch " + att.ID)
+	pump(alice, bob, nil)
+	if got := receivedFile(t, bob, att.ID); !bytes.Equal(got, data) {
+		t.Fatalf("received file differs (%d bytes, want %d)", len(got), len(data))
+	}
+}
+
+func TestFileTransferResumesAfterLostChunks(t *testing.T) {
+	alice := newTransferPeer(t, "Alice", "10.0.0.1:9001")
+	bob := newTransferPeer(t, "Bob", "10.0.0.2:9001")
+	path, data := writeTempFile(t, 3*fileWindow*fileChunkSize)
+	alice.rt.ProcessLine("/file " + path)
+	id := alice.sink.lastMessage().Attachments[0].ID
+
+	// Lose every chunk after the first window, as if the link went down.
+	delivered := 0
+	pump(alice, bob, func(msg message.Message) bool {
+		if msg.Type != MsgTypeFileChunk {
+			return false
+		}
+		delivered++
+		return delivered > fileWindow
+	})
+	in, ok, err := bob.files.Incoming(id)
+	if err != nil || !ok {
+		t.Fatalf("expected saved progress, ok=%v err=%v", ok, err)
+	}
+	if in.Received() != fileWindow {
+		t.Fatalf("expected %d chunks saved, got %d", fileWindow, in.Received())
+	}
+
+	bob.rt.sweepTransfers(time.Now().Add(fileStallAfter + time.Second))
+	pump(alice, bob, nil)
+	if got := receivedFile(t, bob, id); !bytes.Equal(got, data) {
+		t.Fatalf("resumed file differs")
+	}
+}
+
+func TestDirectFileIsSealedAndRefusedToOthers(t *testing.T) {
+	alice := newTransferPeer(t, "Alice", "10.0.0.1:9001")
+	bob := newTransferPeer(t, "Bob", "10.0.0.2:9001")
+	alice.rt.directory.Record("Bob", bob.rt.selfAddr)
+	alice.rt.directory.SetPublicKey(bob.rt.selfAddr, &bob.rt.identity.KeyPair().Public)
+	bob.rt.directory.Record("Alice", alice.rt.selfAddr)
+	bob.rt.directory.SetPublicKey(alice.rt.selfAddr, &alice.rt.identity.KeyPair().Public)
+	path, data := writeTempFile(t, 2*fileChunkSize)
+
+	alice.rt.ProcessLine("/file " + path + " Bob")
+	id := alice.sink.lastMessage().Attachments[0].ID
+
+	sealed := true
+	pump(alice, bob, func(msg message.Message) bool {
+		if msg.Type == MsgTypeFileChunk && !msg.Sealed {
+			sealed = false
+		}
+		return false
+	})
+	if !sealed {
+		t.Fatalf("expected chunks of a direct file to be sealed")
+	}
+	if got := receivedFile(t, bob, id); !bytes.Equal(got, data) {
+		t.Fatalf("received file differs")
+	}
+
+	alice.rt.processIncoming(message.Message{
+		MsgID:     "req-mallory",
+		Type:      MsgTypeFileReq,
+		From:      "Mallory",
+		Origin:    "10.0.0.9:9001",
+		ToAddr:    alice.rt.selfAddr,
+		Chunk:     &message.FileChunk{FileID: id, Count: fileWindow},
+		Timestamp: time.Now(),
+	}, "link")
+	time.Sleep(50 * time.Millisecond)
+	for _, msg := range alice.drain() {
+		if msg.Type == MsgTypeFileChunk {
+			t.Fatalf("file served to a peer it was not shared with")
+		}
+	}
+}
+
+func TestKnownContentIsLinkedWithoutTransfer(t *testing.T) {
+	alice := newTransferPeer(t, "Alice", "10.0.0.1:9001")
+	bob := newTransferPeer(t, "Bob", "10.0.0.2:9001")
+	path, data := writeTempFile(t, 3*fileChunkSize)
+	if _, err := bob.files.Save("mine.bin", "Bob", bytes.NewReader(data)); err != nil {
+		t.Fatalf("save local copy: %v", err)
+	}
+	alice.rt.ProcessLine("/file " + path)
+	id := alice.sink.lastMessage().Attachments[0].ID
+
+	requested := false
+	pump(alice, bob, func(msg message.Message) bool {
+		requested = requested || msg.Type == MsgTypeFileReq
+		return false
+	})
+	if requested {
+		t.Fatalf("content already stored locally should not be fetched")
+	}
+	if got := receivedFile(t, bob, id); !bytes.Equal(got, data) {
+		t.Fatalf("linked record has wrong content")
+	}
+}
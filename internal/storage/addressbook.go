@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	addressBookBucket = "peers"
+
+	// addressBookMax bounds the book; when it is full the entry heard from
+	// least recently is dropped.
+	addressBookMax = 1024
+)
+
+// KnownPeer is what the address book remembers about a peer address.
+type KnownPeer struct {
+	Addr       string    `json:"addr"`
+	Nick       string    `json:"nick,omitempty"`
+	SigningKey string    `json:"signing_key,omitempty"`
+	FirstSeen  time.Time `json:"first_seen"`
+	// LastSeen is the last handshake received from the peer.
+	LastSeen time.Time `json:"last_seen,omitempty"`
+	// LastSuccess is the last time a dial to the address succeeded.
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	// Failures counts failed dials since the last success.
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// LastActive is the later of LastSeen and LastSuccess.
+func (p KnownPeer) LastActive() time.Time {
+	if p.LastSuccess.After(p.LastSeen) {
+		return p.LastSuccess
+	}
+	return p.LastSeen
+}
+
+// Stale reports whether the entry failed maxFailures dials in a row or was
+// last active before cutoff.
+func (p KnownPeer) Stale(cutoff time.Time, maxFailures int) bool {
+	return p.Failures >= maxFailures || p.LastActive().Before(cutoff)
+}
+
+// AddressBook persists the peers this one has connected to, so it can rejoin
+// the mesh after a restart without the bootstrap server.
+type AddressBook struct {
+	db *bbolt.DB
+}
+
+func OpenAddressBook(path string) (*AddressBook, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(addressBookBucket))
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &AddressBook{db: db}, nil
+}
+
+func (b *AddressBook) Close() error {
+	if b == nil || b.db == nil {
+		return nil
+	}
+	return b.db.Close()
+}
+
+// update applies fn to the entry for addr. Missing entries are created only
+// when create is set; fn is not called otherwise.
+func (b *AddressBook) update(addr string, create bool, fn func(*KnownPeer)) error {
+	if b == nil || b.db == nil || addr == "" {
+		return nil
+	}
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(addressBookBucket))
+		var peer KnownPeer
+		data := bucket.Get([]byte(addr))
+		switch {
+		case data != nil:
+			if err := json.Unmarshal(data, &peer); err != nil {
+				return err
+			}
+		case !create:
+			return nil
+		default:
+			if err := evictOldest(bucket); err != nil {
+				return err
+			}
+			peer = KnownPeer{Addr: addr, FirstSeen: time.Now()}
+		}
+		fn(&peer)
+		data, err := json.Marshal(peer)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(addr), data)
+	})
+}
+
+// evictOldest makes room for one more entry when the book is full.
+func evictOldest(bucket *bbolt.Bucket) error {
+	count := 0
+	var oldest []byte
+	var oldestAt time.Time
+	err := bucket.ForEach(func(k, v []byte) error {
+		count++
+		var peer KnownPeer
+		_ = json.Unmarshal(v, &peer)
+		if oldest == nil || peer.LastActive().Before(oldestAt) {
+			oldest, oldestAt = append([]byte(nil), k...), peer.LastActive()
+		}
+		return nil
+	})
+	if err != nil || count < addressBookMax {
+		return err
+	}
+	return bucket.Delete(oldest)
+}
+
+// Seen records a handshake from the peer at addr.
+func (b *AddressBook) Seen(addr, nick, signingKey string, at time.Time) error {
+	return b.update(addr, true, func(p *KnownPeer) {
+		p.LastSeen = at
+		if nick != "" {
+			p.Nick = nick
+		}
+		if signingKey != "" {
+			p.SigningKey = signingKey
+		}
+	})
+}
+
+// DialResult records the outcome of a dial to addr. A success adds the
+// address to the book; a failure only counts against addresses already in
+// it.
+func (b *AddressBook) DialResult(addr string, dialErr error, at time.Time) error {
+	if dialErr == nil {
+		return b.update(addr, true, func(p *KnownPeer) {
+			p.LastSuccess = at
+			p.Failures = 0
+			p.LastError = ""
+		})
+	}
+	return b.update(addr, false, func(p *KnownPeer) {
+		p.Failures++
+		p.LastError = dialErr.Error()
+	})
+}
+
+// All returns every entry, most recently active first.
+func (b *AddressBook) All() ([]KnownPeer, error) {
+	if b == nil || b.db == nil {
+		return nil, nil
+	}
+	var out []KnownPeer
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(addressBookBucket)).ForEach(func(_, v []byte) error {
+			var peer KnownPeer
+			if err := json.Unmarshal(v, &peer); err != nil {
+				return err
+			}
+			out = append(out, peer)
+			return nil
+		})
+	})
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].LastActive().After(out[j].LastActive())
+	})
+	return out, err
+}
+
+// Stale returns the entries that failed maxFailures dials in a row or were
+// last active before cutoff, least recently active first.
+func (b *AddressBook) Stale(cutoff time.Time, maxFailures int) ([]KnownPeer, error) {
+	all, err := b.All()
+	if err != nil {
+		return nil, err
+	}
+	var out []KnownPeer
+	for i := len(all) - 1; i >= 0; i-- {
+		if all[i].Stale(cutoff, maxFailures) {
+			out = append(out, all[i])
+		}
+	}
+	return out, nil
+}
+
+// Remove drops addr from the book and reports whether it was there.
+func (b *AddressBook) Remove(addr string) (bool, error) {
+	if b == nil || b.db == nil {
+		return false, nil
+	}
+	found := false
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(addressBookBucket))
+		if bucket.Get([]byte(addr)) == nil {
+			return nil
+		}
+		found = true
+		return bucket.Delete([]byte(addr))
+	})
+	return found, err
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAddressBookRecordsPeers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.db")
+	book, err := OpenAddressBook(path)
+	if err != nil {
+		t.Fatalf("OpenAddressBook: %v", err)
+	}
+	now := time.Now()
+	if err := book.DialResult("10.0.0.9:9001", errors.New("refused"), now); err != nil {
+		t.Fatalf("dial result: %v", err)
+	}
+	if err := book.Seen("10.0.0.2:9001", "Bob", "key-b", now.Add(-time.Hour)); err != nil {
+		t.Fatalf("seen: %v", err)
+	}
+	if err := book.DialResult("10.0.0.3:9001", nil, now); err != nil {
+		t.Fatalf("dial result: %v", err)
+	}
+	if err := book.DialResult("10.0.0.2:9001", errors.New("timeout"), now); err != nil {
+		t.Fatalf("dial result: %v", err)
+	}
+	if err := book.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// The book survives a restart.
+	book, err = OpenAddressBook(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	t.Cleanup(func() { _ = book.Close() })
+	all, err := book.All()
+	if err != nil {
+		t.Fatalf("all: %v", err)
+	}
+	if len(all) != 2 || all[0].Addr != "10.0.0.3:9001" || all[1].Addr != "10.0.0.2:9001" {
+		t.Fatalf("expected only reached peers, most recent first, got %+v", all)
+	}
+	bob := all[1]
+	if bob.Nick != "Bob" || bob.SigningKey != "key-b" || bob.Failures != 1 || bob.LastError != "timeout" {
+		t.Fatalf("unexpected entry %+v", bob)
+	}
+
+	stale, err := book.Stale(now.Add(-time.Minute), 3)
+	if err != nil || len(stale) != 1 || stale[0].Addr != "10.0.0.2:9001" {
+		t.Fatalf("expected the silent peer to be stale, got %+v %v", stale, err)
+	}
+	if ok, err := book.Remove("10.0.0.2:9001"); err != nil || !ok {
+		t.Fatalf("remove: %v %v", ok, err)
+	}
+	if ok, _ := book.Remove("10.0.0.2:9001"); ok {
+		t.Fatalf("second remove should report nothing")
+	}
+}
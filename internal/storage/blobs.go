@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// blobBucket maps a SHA-256 digest to the blob holding that content. Records
+// in filesBucket point at blobs, so identical uploads share one copy on disk.
+const blobBucket = "blobs"
+
+// ErrCorrupt is returned when a file's blob failed verification.
+var ErrCorrupt = errors.New("file content is corrupted")
+
+// blobEntry counts the records referencing a blob. Corrupt is set by Verify
+// and cleared by a later passing check or when intact content for the same
+// digest is stored again. Images also keep their dimensions and those of the
+// thumbnail stored next to the blob.
+type blobEntry struct {
+	Size        int64     `json:"size"`
+	Refs        int       `json:"refs"`
+	Corrupt     bool      `json:"corrupt,omitempty"`
+	VerifiedAt  time.Time `json:"verified_at,omitempty"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	ThumbWidth  int       `json:"thumb_width,omitempty"`
+	ThumbHeight int       `json:"thumb_height,omitempty"`
+}
+
+// CorruptFile names a stored file whose content no longer matches its digest.
+type CorruptFile struct {
+	FileRecord
+	Reason string `json:"reason"`
+}
+
+func (s *FileStore) blobPath(digest string) string {
+	return filepath.Join(s.dir, "blobs", digest[:2], digest)
+}
+
+func loadBlob(tx *bbolt.Tx, digest string) (blobEntry, bool) {
+	var blob blobEntry
+	data := tx.Bucket([]byte(blobBucket)).Get([]byte(digest))
+	if data == nil {
+		return blob, false
+	}
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return blob, false
+	}
+	return blob, true
+}
+
+func putBlob(tx *bbolt.Tx, digest string, blob blobEntry) error {
+	data, err := json.Marshal(blob)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(blobBucket)).Put([]byte(digest), data)
+}
+
+// adoptBlob files the content at tmp, already hashed to digest, under its
+// blob path and adds a reference to it. If the blob exists tmp is discarded,
+// unless the stored copy was flagged corrupt, in which case tmp replaces it.
+func (s *FileStore) adoptBlob(tx *bbolt.Tx, tmp, digest string, size int64) (string, error) {
+	path := s.blobPath(digest)
+	blob, ok := loadBlob(tx, digest)
+	if ok && !blob.Corrupt {
+		if err := os.Remove(tmp); err != nil {
+			return "", err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return "", err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return "", err
+		}
+		blob.Size = size
+		blob.Corrupt = false
+		blob.VerifiedAt = time.Now().UTC()
+	}
+	blob.Refs++
+	return path, putBlob(tx, digest, blob)
+}
+
+// linkBlob adds entry as another reference to an intact blob already holding
+// its content. It reports false when there is no such blob.
+func (s *FileStore) linkBlob(entry fileEntry) (bool, error) {
+	linked := false
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		blob, ok := loadBlob(tx, entry.SHA256)
+		if !ok || blob.Corrupt || blob.Size != entry.Size {
+			return nil
+		}
+		if err := s.checkRoom(tx, entry.Uploader, entry.Size, entry.SHA256); err != nil {
+			return err
+		}
+		blob.Refs++
+		if err := putBlob(tx, entry.SHA256, blob); err != nil {
+			return err
+		}
+		blob.copyDims(&entry.FileRecord)
+		entry.Path = s.blobPath(entry.SHA256)
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		linked = true
+		return tx.Bucket([]byte(filesBucket)).Put([]byte(entry.ID), data)
+	})
+	return linked, err
+}
+
+// releaseBlob drops a reference to digest and deletes the blob entry with the
+// last one, reporting whether it did. The files stay on disk until the caller
+// has committed and passes the digest to dropBlobFiles.
+func (s *FileStore) releaseBlob(tx *bbolt.Tx, digest string) (bool, error) {
+	blob, ok := loadBlob(tx, digest)
+	if !ok {
+		return false, nil
+	}
+	blob.Refs--
+	if blob.Refs > 0 {
+		return false, putBlob(tx, digest, blob)
+	}
+	return true, tx.Bucket([]byte(blobBucket)).Delete([]byte(digest))
+}
+
+// dropBlobFiles deletes the files of blobs whose entries a committed
+// transaction removed. It holds the write lock while doing so and skips any
+// digest an upload has stored again in the meantime.
+func (s *FileStore) dropBlobFiles(digests []string) error {
+	if len(digests) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		for _, digest := range digests {
+			if _, ok := loadBlob(tx, digest); ok {
+				continue
+			}
+			if err := s.removeBlobFiles(digest); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// removeBlobFiles deletes a blob and its thumbnail from disk.
+func (s *FileStore) removeBlobFiles(digest string) error {
+	for _, path := range []string{s.blobPath(digest), s.thumbPath(digest)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobCorrupt reports whether the blob behind digest was flagged by Verify.
+func (s *FileStore) blobCorrupt(digest string) bool {
+	corrupt := false
+	_ = s.db.View(func(tx *bbolt.Tx) error {
+		blob, _ := loadBlob(tx, digest)
+		corrupt = blob.Corrupt
+		return nil
+	})
+	return corrupt
+}
+
+// migrateToBlobs moves files saved under per-upload IDs into the blob store.
+// It runs once when an older database without a blob bucket is opened.
+func (s *FileStore) migrateToBlobs(tx *bbolt.Tx) error {
+	files := tx.Bucket([]byte(filesBucket))
+	var entries []fileEntry
+	err := files.ForEach(func(_, v []byte) error {
+		var entry fileEntry
+		if err := json.Unmarshal(v, &entry); err == nil {
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		digest, err := fileDigest(entry.Path)
+		if err != nil {
+			continue
+		}
+		entry.SHA256 = digest
+		if entry.Path, err = s.adoptBlob(tx, entry.Path, digest, entry.Size); err != nil {
+			return err
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := files.Put([]byte(entry.ID), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove deletes the record id. Its blob goes away once no other record
+// references the same content.
+func (s *FileStore) Remove(id string) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("file store not initialized")
+	}
+	var dropped string
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		files := tx.Bucket([]byte(filesBucket))
+		data := files.Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("file not found")
+		}
+		var entry fileEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		if err := files.Delete([]byte(id)); err != nil {
+			return err
+		}
+		if entry.SHA256 == "" {
+			return nil
+		}
+		last, err := s.releaseBlob(tx, entry.SHA256)
+		if last {
+			dropped = entry.SHA256
+		}
+		return err
+	})
+	if err != nil || dropped == "" {
+		return err
+	}
+	return s.dropBlobFiles([]string{dropped})
+}
+
+// Verify re-hashes every blob and flags those whose content no longer matches
+// their digest or that went missing; blobs that check out again are cleared.
+// It returns the records whose content is corrupted.
+func (s *FileStore) Verify() ([]CorruptFile, error) {
+	if s == nil || s.db == nil {
+		return nil, nil
+	}
+	var digests []string
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(blobBucket)).ForEach(func(k, _ []byte) error {
+			digests = append(digests, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Hash outside any transaction; large stores take a while to read.
+	reasons := make(map[string]string)
+	for _, digest := range digests {
+		sum, err := fileDigest(s.blobPath(digest))
+		switch {
+		case os.IsNotExist(err):
+			reasons[digest] = "missing"
+		case err != nil:
+			reasons[digest] = err.Error()
+		case sum != digest:
+			reasons[digest] = "checksum mismatch"
+		}
+	}
+	now := time.Now().UTC()
+	var out []CorruptFile
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		for _, digest := range digests {
+			blob, ok := loadBlob(tx, digest)
+			if !ok {
+				continue
+			}
+			_, bad := reasons[digest]
+			blob.Corrupt = bad
+			if !bad {
+				blob.VerifiedAt = now
+			}
+			if err := putBlob(tx, digest, blob); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket([]byte(filesBucket)).ForEach(func(_, v []byte) error {
+			var entry fileEntry
+			if err := json.Unmarshal(v, &entry); err != nil || entry.SHA256 == "" {
+				return nil
+			}
+			if reason, bad := reasons[entry.SHA256]; bad {
+				out = append(out, CorruptFile{FileRecord: entry.FileRecord, Reason: reason})
+			}
+			return nil
+		})
+	})
+	return out, err
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"p2p-chat/internal/message"
+)
+
+const (
+	// idBucket maps message IDs to their history key.
+	idBucket = "ids"
+	// editBucket holds an overlay per edited or deleted message. The stored
+	// original is never rewritten so its signature stays valid for sync.
+	editBucket = "edits"
+)
+
+// Revision is an earlier version of an edited message.
+type Revision struct {
+	Content    string    `json:"content"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// overlay records what happened to a message after it was stored.
+type overlay struct {
+	Content   string     `json:"content"`
+	Revisions []Revision `json:"revisions,omitempty"`
+	Deleted   bool       `json:"deleted,omitempty"`
+}
+
+// apply returns msg as it should be displayed.
+func (o overlay) apply(msg message.Message) message.Message {
+	if o.Deleted {
+		msg.Content = ""
+		msg.Attachments = nil
+		msg.Reactions = nil
+		msg.Deleted = true
+		return msg
+	}
+	if len(o.Revisions) > 0 {
+		msg.Content = o.Content
+		msg.Edited = true
+	}
+	return msg
+}
+
+func loadOverlay(tx *bbolt.Tx, msgID string) (overlay, bool) {
+	var o overlay
+	data := tx.Bucket([]byte(editBucket)).Get([]byte(msgID))
+	if data == nil {
+		return o, false
+	}
+	if err := json.Unmarshal(data, &o); err != nil {
+		return o, false
+	}
+	return o, true
+}
+
+// withOverlay applies any stored edit or tombstone to msg and attaches its
+// reaction tally. Tallies are always taken from the store, never from the
+// sender.
+func withOverlay(tx *bbolt.Tx, msg message.Message) message.Message {
+	msg.Reactions = loadReactions(tx, msg.MsgID)
+	if o, ok := loadOverlay(tx, msg.MsgID); ok {
+		return o.apply(msg)
+	}
+	return msg
+}
+
+// backfillIDs builds the message ID lookup for databases written before it
+// existed.
+func backfillIDs(tx *bbolt.Tx) error {
+	ids := tx.Bucket([]byte(idBucket))
+	return tx.Bucket([]byte(historyBucket)).ForEach(func(k, v []byte) error {
+		var msg message.Message
+		if err := json.Unmarshal(v, &msg); err != nil || msg.MsgID == "" {
+			return nil
+		}
+		return ids.Put([]byte(msg.MsgID), k)
+	})
+}
+
+// Get returns the stored message with msgID, with edits applied.
+func (s *HistoryStore) Get(msgID string) (message.Message, bool, error) {
+	var msg message.Message
+	if s == nil || s.db == nil {
+		return msg, false, nil
+	}
+	found := false
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		key := tx.Bucket([]byte(idBucket)).Get([]byte(msgID))
+		if key == nil {
+			return nil
+		}
+		data := tx.Bucket([]byte(historyBucket)).Get(key)
+		if data == nil {
+			return nil
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return err
+		}
+		msg = withOverlay(tx, msg)
+		found = true
+		return nil
+	})
+	return msg, found, err
+}
+
+// Edit replaces the content of msgID, keeping the previous text as a
+// revision. The new content is added to the search index.
+func (s *HistoryStore) Edit(msgID, content string, at time.Time) error {
+	return s.updateOverlay(msgID, func(tx *bbolt.Tx, key []byte, msg message.Message, o *overlay) error {
+		if o.Deleted {
+			return nil
+		}
+		previous := msg.Content
+		if len(o.Revisions) > 0 {
+			previous = o.Content
+		}
+		o.Revisions = append(o.Revisions, Revision{Content: previous, ReplacedAt: at})
+		o.Content = content
+		msg.Content = content
+		return indexMessage(tx, key, msg)
+	})
+}
+
+// Delete leaves a tombstone for msgID. The original stays on disk but is no
+// longer returned with its content.
+func (s *HistoryStore) Delete(msgID string) error {
+	return s.updateOverlay(msgID, func(_ *bbolt.Tx, _ []byte, _ message.Message, o *overlay) error {
+		o.Deleted = true
+		o.Content = ""
+		o.Revisions = nil
+		return nil
+	})
+}
+
+// Revisions returns the earlier versions of msgID, oldest first.
+func (s *HistoryStore) Revisions(msgID string) ([]Revision, error) {
+	if s == nil || s.db == nil {
+		return nil, nil
+	}
+	var out []Revision
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if o, ok := loadOverlay(tx, msgID); ok {
+			out = o.Revisions
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (s *HistoryStore) updateOverlay(msgID string, fn func(*bbolt.Tx, []byte, message.Message, *overlay) error) error {
+	if s == nil || s.db == nil {
+		return nil
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		key := tx.Bucket([]byte(idBucket)).Get([]byte(msgID))
+		if key == nil {
+			return fmt.Errorf("message %s not stored", msgID)
+		}
+		var msg message.Message
+		if err := json.Unmarshal(tx.Bucket([]byte(historyBucket)).Get(key), &msg); err != nil {
+			return err
+		}
+		o, _ := loadOverlay(tx, msgID)
+		if err := fn(tx, key, msg, &o); err != nil {
+			return err
+		}
+		data, err := json.Marshal(o)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(editBucket)).Put([]byte(msgID), data)
+	})
+}
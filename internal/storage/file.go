@@ -2,6 +2,8 @@ package storage
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -19,25 +21,41 @@ const filesBucket = "files"
 
 // FileRecord is exported to UIs so downloads can be surfaced in chat history.
 type FileRecord struct {
-	ID        string    `json:"id"`
-	Name      string    `json:"name"`
-	Size      int64     `json:"size"`
-	Uploader  string    `json:"uploader"`
-	Mime      string    `json:"mime,omitempty"`
-	ShareKey  string    `json:"share_key,omitempty"`
-	CreatedAt time.Time `json:"created_at"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Uploader string `json:"uploader"`
+	Mime     string `json:"mime,omitempty"`
+	ShareKey string `json:"share_key,omitempty"`
+	// ShareKeyExpires is when ShareKey stops opening the file; zero means
+	// never.
+	ShareKeyExpires time.Time `json:"share_key_expires"`
+	SHA256          string    `json:"sha256,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	// Width and Height are the pixel size of an image; ThumbWidth and
+	// ThumbHeight that of its preview.
+	Width       int `json:"width,omitempty"`
+	Height      int `json:"height,omitempty"`
+	ThumbWidth  int `json:"thumb_width,omitempty"`
+	ThumbHeight int `json:"thumb_height,omitempty"`
 }
 
-// fileEntry keeps the on-disk path private to the store.
+// fileEntry keeps the on-disk path private to the store. Path is the blob
+// holding the content, shared by every record with the same SHA256. Audience
+// lists who may fetch the file over the mesh; "*" stands for anyone in the
+// room it was shared to.
 type fileEntry struct {
 	FileRecord
-	Path string `json:"path"`
+	Path     string   `json:"path"`
+	Audience []string `json:"audience,omitempty"`
 }
 
-// FileStore persists uploads on disk and records their metadata in BoltDB.
+// FileStore persists uploads on disk, one blob per distinct SHA-256, and
+// records their metadata in BoltDB.
 type FileStore struct {
-	db  *bbolt.DB
-	dir string
+	db     *bbolt.DB
+	dir    string
+	policy RetentionPolicy
 }
 
 func OpenFileStore(dbPath, dir string) (*FileStore, error) {
@@ -51,15 +69,24 @@ func OpenFileStore(dbPath, dir string) (*FileStore, error) {
 	if err != nil {
 		return nil, err
 	}
+	store := &FileStore{db: db, dir: dir}
 	err = db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(filesBucket))
-		return err
+		needsBlobs := tx.Bucket([]byte(blobBucket)) == nil
+		for _, name := range []string{filesBucket, partialBucket, blobBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		if needsBlobs {
+			return store.migrateToBlobs(tx)
+		}
+		return nil
 	})
 	if err != nil {
 		_ = db.Close()
 		return nil, err
 	}
-	return &FileStore{db: db, dir: dir}, nil
+	return store, nil
 }
 
 func (s *FileStore) Close() error {
@@ -77,42 +104,123 @@ func (s *FileStore) Save(originalName, uploader string, src io.Reader) (FileReco
 	if cleaned == "" {
 		cleaned = "upload.bin"
 	}
-	id := newFileID()
-	path := filepath.Join(s.dir, id)
-	dst, err := os.Create(path)
+	dst, err := os.CreateTemp(s.dir, ".upload-*")
 	if err != nil {
 		return FileRecord{}, err
 	}
-	defer dst.Close()
-	size, err := io.Copy(dst, src)
+	tmp := dst.Name()
+	digest := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, digest), src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		_ = os.Remove(tmp)
 		return FileRecord{}, err
 	}
-	mime := detectMime(path)
+	now := time.Now().UTC()
 	entry := fileEntry{
 		FileRecord: FileRecord{
-			ID:        id,
+			ID:        newFileID(),
 			Name:      cleaned,
 			Size:      size,
 			Uploader:  uploader,
-			Mime:      mime,
-			ShareKey:  newShareKey(),
-			CreatedAt: time.Now().UTC(),
+			Mime:      detectMime(tmp),
+			SHA256:    hex.EncodeToString(digest.Sum(nil)),
+			CreatedAt: now,
 		},
-		Path: path,
 	}
+	s.issueShareKey(&entry, now)
+	if err := s.storeEntry(&entry, tmp); err != nil {
+		_ = os.Remove(tmp)
+		return FileRecord{}, err
+	}
+	_ = s.ensureThumb(&entry)
+	return entry.FileRecord, nil
+}
+
+// storeEntry adds entry with the content at tmp, hashed to entry.SHA256, in
+// one transaction so the blob's reference count matches the records. It
+// enforces the retention limits.
+func (s *FileStore) storeEntry(entry *fileEntry, tmp string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if err := s.checkRoom(tx, entry.Uploader, entry.Size, entry.SHA256); err != nil {
+			return err
+		}
+		path, err := s.adoptBlob(tx, tmp, entry.SHA256, entry.Size)
+		if err != nil {
+			return err
+		}
+		entry.Path = path
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(filesBucket)).Put([]byte(entry.ID), data)
+	})
+}
+
+func (s *FileStore) putEntry(entry fileEntry) error {
 	data, err := json.Marshal(entry)
 	if err != nil {
-		return FileRecord{}, err
+		return err
 	}
-	err = s.db.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(filesBucket))
-		return bucket.Put([]byte(entry.ID), data)
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(filesBucket)).Put([]byte(entry.ID), data)
 	})
+}
+
+// MarkShared records that the file may be fetched by each of who, a peer name
+// or address, or by anyone when who is "*".
+func (s *FileStore) MarkShared(id string, who ...string) error {
+	entry, err := s.Get(id)
 	if err != nil {
-		return FileRecord{}, err
+		return err
 	}
-	return entry.FileRecord, nil
+	for _, w := range who {
+		if w != "" && !entry.sharedWith(w) {
+			entry.Audience = append(entry.Audience, strings.ToLower(w))
+		}
+	}
+	return s.putEntry(*entry)
+}
+
+// SharedWith reports whether the peer named name at addr may fetch file id.
+func (s *FileStore) SharedWith(id, name, addr string) bool {
+	entry, err := s.Get(id)
+	if err != nil {
+		return false
+	}
+	return entry.sharedWith("*") || entry.sharedWith(name) || entry.sharedWith(addr)
+}
+
+func (e *fileEntry) sharedWith(who string) bool {
+	for _, w := range e.Audience {
+		if w == strings.ToLower(who) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadChunk returns chunk index of file id when it is split into pieces of
+// chunkSize bytes.
+func (s *FileStore) ReadChunk(id string, index, chunkSize int) ([]byte, error) {
+	entry, f, err := s.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	offset := int64(index) * int64(chunkSize)
+	if index < 0 || offset >= entry.Size {
+		return nil, fmt.Errorf("chunk %d out of range", index)
+	}
+	buf := make([]byte, chunkSize)
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf[:n], nil
 }
 
 func (s *FileStore) List(limit int) ([]FileRecord, error) {
@@ -177,11 +285,16 @@ func (s *FileStore) Get(id string) (*fileEntry, error) {
 	return result, nil
 }
 
+// Open returns the record id and its content. It fails with ErrCorrupt when
+// Verify flagged the blob.
 func (s *FileStore) Open(id string) (*fileEntry, *os.File, error) {
 	entry, err := s.Get(id)
 	if err != nil {
 		return nil, nil, err
 	}
+	if entry.SHA256 != "" && s.blobCorrupt(entry.SHA256) {
+		return nil, nil, ErrCorrupt
+	}
 	f, err := os.Open(entry.Path)
 	if err != nil {
 		return nil, nil, err
@@ -1,10 +1,21 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
 	"io"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
 )
 
 func TestFileStoreSaveAndRetrieve(t *testing.T) {
@@ -62,3 +73,353 @@ func TestSanitizeFileName(t *testing.T) {
 		t.Fatalf("expected empty for root tokens, got %s", got)
 	}
 }
+
+func TestFileStoreIncomingResumeAndVerify(t *testing.T) {
+	base := t.TempDir()
+	dbPath, dir := filepath.Join(base, "files.db"), filepath.Join(base, "files")
+	store, err := OpenFileStore(dbPath, dir)
+	if err != nil {
+		t.Fatalf("OpenFileStore error: %v", err)
+	}
+	content := "abcdefghij"
+	sum := sha256.Sum256([]byte(content))
+	in, err := store.BeginIncoming(IncomingFile{
+		Record:    FileRecord{ID: "00ff", Name: "letters.txt", Size: int64(len(content)), SHA256: hex.EncodeToString(sum[:])},
+		ChunkSize: 4,
+		Source:    "10.0.0.2:9001",
+	})
+	if err != nil {
+		t.Fatalf("begin incoming: %v", err)
+	}
+	if err := store.WriteChunk(&in, 2, []byte("ijk")); err == nil {
+		t.Fatalf("expected short last chunk to be enforced")
+	}
+	if err := store.WriteChunk(&in, 1, []byte("efgh")); err != nil {
+		t.Fatalf("write chunk: %v", err)
+	}
+	if err := store.SaveIncoming(in); err != nil {
+		t.Fatalf("save progress: %v", err)
+	}
+	_ = store.Close()
+
+	store, err = OpenFileStore(dbPath, dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	in, err = store.BeginIncoming(IncomingFile{Record: FileRecord{ID: "00ff", Size: 10}, ChunkSize: 4})
+	if err != nil || !in.Has(1) || in.FirstMissing() != 0 {
+		t.Fatalf("expected resumed progress, got %+v err=%v", in, err)
+	}
+	for i, chunk := range []string{"abcd", "", "ij"} {
+		if chunk == "" {
+			continue
+		}
+		if err := store.WriteChunk(&in, i, []byte(chunk)); err != nil {
+			t.Fatalf("write chunk %d: %v", i, err)
+		}
+	}
+	rec, err := store.FinishIncoming(in)
+	if err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+	if _, err := store.BeginIncoming(IncomingFile{Record: rec, ChunkSize: 4}); err != ErrFileExists {
+		t.Fatalf("expected ErrFileExists, got %v", err)
+	}
+	entry, file, err := store.Open(rec.ID)
+	if err != nil {
+		t.Fatalf("open received: %v", err)
+	}
+	defer file.Close()
+	if data, _ := io.ReadAll(file); string(data) != content || entry.ShareKey == "" {
+		t.Fatalf("unexpected received file %q (%+v)", data, entry.FileRecord)
+	}
+
+	bad, err := store.BeginIncoming(IncomingFile{
+		Record:    FileRecord{ID: "0abc", Name: "bad.txt", Size: 4, SHA256: hex.EncodeToString(sum[:])},
+		ChunkSize: 4,
+	})
+	if err != nil {
+		t.Fatalf("begin second: %v", err)
+	}
+	if err := store.WriteChunk(&bad, 0, []byte("nope")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := store.FinishIncoming(bad); err == nil {
+		t.Fatalf("expected checksum mismatch")
+	}
+	if _, err := store.Get("0abc"); err == nil {
+		t.Fatalf("corrupt file should not be stored")
+	}
+	if pending, _ := store.PendingIncoming(); len(pending) != 0 {
+		t.Fatalf("expected no pending transfers, got %d", len(pending))
+	}
+	if _, err := store.BeginIncoming(IncomingFile{Record: FileRecord{ID: "../x", Size: 1}, ChunkSize: 4}); err == nil {
+		t.Fatalf("expected path-like id to be rejected")
+	}
+}
+
+func TestFileStoreDeduplicatesAndVerifiesBlobs(t *testing.T) {
+	base := t.TempDir()
+	store, err := OpenFileStore(filepath.Join(base, "files.db"), filepath.Join(base, "files"))
+	if err != nil {
+		t.Fatalf("OpenFileStore error: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	first, err := store.Save("a.txt", "alice", strings.NewReader("same bytes"))
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	second, err := store.Save("b.txt", "bob", strings.NewReader("same bytes"))
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	sum := sha256.Sum256([]byte("same bytes"))
+	if first.ID == second.ID || first.SHA256 != hex.EncodeToString(sum[:]) || second.SHA256 != first.SHA256 {
+		t.Fatalf("expected two records sharing a digest, got %+v / %+v", first, second)
+	}
+	a, _ := store.Get(first.ID)
+	b, _ := store.Get(second.ID)
+	if a.Path != b.Path {
+		t.Fatalf("expected one blob, got %s and %s", a.Path, b.Path)
+	}
+
+	if err := store.Remove(first.ID); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := os.Stat(b.Path); err != nil {
+		t.Fatalf("blob should survive while referenced: %v", err)
+	}
+
+	if err := os.WriteFile(b.Path, []byte("rotten bytes"), 0o644); err != nil {
+		t.Fatalf("corrupt blob: %v", err)
+	}
+	corrupt, err := store.Verify()
+	if err != nil || len(corrupt) != 1 || corrupt[0].ID != second.ID {
+		t.Fatalf("expected %s flagged, got %+v err=%v", second.ID, corrupt, err)
+	}
+	if _, _, err := store.Open(second.ID); err != ErrCorrupt {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	if _, err := store.Save("c.txt", "carol", strings.NewReader("same bytes")); err != nil {
+		t.Fatalf("save repair: %v", err)
+	}
+	if corrupt, _ := store.Verify(); len(corrupt) != 0 {
+		t.Fatalf("expected fresh upload to repair the blob, got %+v", corrupt)
+	}
+
+	if err := store.Remove(second.ID); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	list, _ := store.List(10)
+	if err := store.Remove(list[0].ID); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := os.Stat(b.Path); !os.IsNotExist(err) {
+		t.Fatalf("expected blob removed with its last record, got %v", err)
+	}
+}
+
+func TestFileStoreMigratesLegacyFiles(t *testing.T) {
+	base := t.TempDir()
+	dbPath, dir := filepath.Join(base, "files.db"), filepath.Join(base, "files")
+	store, err := OpenFileStore(dbPath, dir)
+	if err != nil {
+		t.Fatalf("OpenFileStore error: %v", err)
+	}
+	legacy := filepath.Join(dir, "0123")
+	if err := os.WriteFile(legacy, []byte("old upload"), 0o644); err != nil {
+		t.Fatalf("write legacy file: %v", err)
+	}
+	if err := store.putEntry(fileEntry{FileRecord: FileRecord{ID: "0123", Name: "old.txt", Size: 10}, Path: legacy}); err != nil {
+		t.Fatalf("put legacy entry: %v", err)
+	}
+	err = store.db.Update(func(tx *bbolt.Tx) error {
+		return tx.DeleteBucket([]byte(blobBucket))
+	})
+	if err != nil {
+		t.Fatalf("drop blob bucket: %v", err)
+	}
+	_ = store.Close()
+
+	store, err = OpenFileStore(dbPath, dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	entry, file, err := store.Open("0123")
+	if err != nil {
+		t.Fatalf("open migrated: %v", err)
+	}
+	defer file.Close()
+	sum := sha256.Sum256([]byte("old upload"))
+	if entry.SHA256 != hex.EncodeToString(sum[:]) || entry.Path != store.blobPath(entry.SHA256) {
+		t.Fatalf("expected entry moved into blob store, got %+v", entry)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatalf("expected legacy file moved, got %v", err)
+	}
+}
+
+func TestFileStoreRetention(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "files")
+	store, err := OpenFileStore(filepath.Join(base, "files.db"), dir)
+	if err != nil {
+		t.Fatalf("OpenFileStore error: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	store.SetRetention(RetentionPolicy{UserQuota: 10, MaxTotalBytes: 16, ShareKeyTTL: time.Hour})
+
+	old, err := store.Save("old.txt", "alice", strings.NewReader("aaaaaa"))
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if old.ShareKeyExpires.IsZero() || !old.ShareKeyValid(old.ShareKey, time.Now()) {
+		t.Fatalf("expected an expiring share key, got %+v", old)
+	}
+	if old.ShareKeyValid(old.ShareKey, time.Now().Add(2*time.Hour)) {
+		t.Fatalf("share key should expire")
+	}
+	if _, err := store.Save("more.txt", "alice", strings.NewReader("bbbbbb")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected quota error, got %v", err)
+	}
+	if _, err := store.Save("copy.txt", "alice", strings.NewReader("aaaa")); err != nil {
+		t.Fatalf("save within quota: %v", err)
+	}
+	if _, err := store.Save("big.txt", "bob", strings.NewReader("cccccccc")); !errors.Is(err, ErrStoreFull) {
+		t.Fatalf("expected store full, got %v", err)
+	}
+	fresh, err := store.Save("new.txt", "bob", strings.NewReader("dddddd"))
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("expected only the blobs dir after rejected uploads, got %d entries", len(entries))
+	}
+
+	if err := store.RevokeShareKey(fresh.ID); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if got, _ := store.Get(fresh.ID); got.ShareKeyValid(fresh.ShareKey, time.Now()) {
+		t.Fatalf("revoked key still opens the file")
+	}
+
+	orphan := filepath.Join(dir, "blobs", "ff", strings.Repeat("f", 64))
+	if err := os.MkdirAll(filepath.Dir(orphan), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(orphan, []byte("lost"), 0o644); err != nil {
+		t.Fatalf("write orphan: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "abcd.part"), []byte("x"), 0o644); err != nil {
+		t.Fatalf("write stale partial: %v", err)
+	}
+	// Files the store did not create are never swept, however old.
+	foreign := []string{filepath.Join(dir, "notes.txt"), filepath.Join(dir, "photos", "cat.jpg")}
+	for _, path := range foreign {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("mine"), 0o644); err != nil {
+			t.Fatalf("write user file: %v", err)
+		}
+	}
+	stale := time.Now().Add(-2 * time.Hour)
+	for _, path := range append([]string{orphan, filepath.Join(dir, "abcd.part")}, foreign...) {
+		if err := os.Chtimes(path, stale, stale); err != nil {
+			t.Fatalf("backdate %s: %v", path, err)
+		}
+	}
+	landing := filepath.Join(dir, "blobs", "ee", strings.Repeat("e", 64))
+	if err := os.MkdirAll(filepath.Dir(landing), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(landing, []byte("just saved"), 0o644); err != nil {
+		t.Fatalf("write fresh blob: %v", err)
+	}
+
+	store.SetRetention(RetentionPolicy{MaxAge: time.Hour, MaxTotalBytes: 6, ShareKeyTTL: time.Hour})
+	report, err := store.Collect(time.Now().Add(30 * time.Minute))
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	if report.Evicted != 2 || report.Orphans != 2 || report.KeysExpired != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if _, err := store.Get(old.ID); err == nil {
+		t.Fatalf("oldest file should have been evicted")
+	}
+	if _, err := store.Get(fresh.ID); err != nil {
+		t.Fatalf("newest file should survive: %v", err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatalf("orphaned blob should be removed")
+	}
+	if _, err := os.Stat(landing); err != nil {
+		t.Fatalf("a blob written after the metadata snapshot should survive: %v", err)
+	}
+	for _, path := range foreign {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("user file %s should survive: %v", path, err)
+		}
+	}
+
+	report, err = store.Collect(time.Now().Add(2 * time.Hour))
+	if err != nil || report.Expired != 1 || report.Orphans != 1 || report.Freed != 16 {
+		t.Fatalf("expected the last file to expire and the unclaimed blob to go, got %+v err=%v", report, err)
+	}
+}
+
+func TestFileStoreThumbnails(t *testing.T) {
+	base := t.TempDir()
+	store, err := OpenFileStore(filepath.Join(base, "files.db"), filepath.Join(base, "files"))
+	if err != nil {
+		t.Fatalf("OpenFileStore error: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	img := image.NewRGBA(image.Rect(0, 0, 800, 400))
+	for x := 0; x < 800; x++ {
+		img.Set(x, x%400, color.RGBA{R: 255, A: 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	rec, err := store.Save("wide.png", "alice", bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if rec.Width != 800 || rec.Height != 400 || rec.ThumbWidth != thumbMaxSide || rec.ThumbHeight != thumbMaxSide/2 {
+		t.Fatalf("unexpected dimensions %+v", rec)
+	}
+	_, thumb, err := store.Thumbnail(rec.ID)
+	if err != nil {
+		t.Fatalf("thumbnail: %v", err)
+	}
+	cfg, err := png.DecodeConfig(thumb)
+	_ = thumb.Close()
+	if err != nil || cfg.Width != rec.ThumbWidth || cfg.Height != rec.ThumbHeight {
+		t.Fatalf("thumbnail is %dx%d (err %v), want %dx%d", cfg.Width, cfg.Height, err, rec.ThumbWidth, rec.ThumbHeight)
+	}
+
+	dup, err := store.Save("again.png", "bob", bytes.NewReader(buf.Bytes()))
+	if err != nil || dup.ThumbWidth != rec.ThumbWidth {
+		t.Fatalf("expected duplicate to reuse the thumbnail, got %+v err=%v", dup, err)
+	}
+	text, err := store.Save("notes.txt", "alice", strings.NewReader("no pictures here"))
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if _, _, err := store.Thumbnail(text.ID); !errors.Is(err, ErrNoThumbnail) {
+		t.Fatalf("expected ErrNoThumbnail for text, got %v", err)
+	}
+
+	_ = store.Remove(rec.ID)
+	_ = store.Remove(dup.ID)
+	if _, err := os.Stat(store.thumbPath(rec.SHA256)); !os.IsNotExist(err) {
+		t.Fatalf("thumbnail should go with its blob, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -12,7 +13,70 @@ import (
 	"p2p-chat/internal/message"
 )
 
-const historyBucket = "messages"
+const (
+	historyBucket = "messages"
+	channelBucket = "channels"
+	receiptBucket = "receipts"
+	// legacyBucket marks a store whose records from before rooms existed
+	// have been indexed under legacyChannel.
+	legacyBucket = "channels-legacy"
+	// legacyChannel is the room those records belong to, the default room
+	// every peer joins.
+	legacyChannel = "general"
+)
+
+// Receipt states, in the order a sent message moves through them.
+const (
+	ReceiptSent      = "sent"
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// Receipt tracks how far one of our own messages has got and which peers
+// confirmed it.
+type Receipt struct {
+	MsgID       string    `json:"msg_id"`
+	State       string    `json:"state"`
+	DeliveredTo []string  `json:"delivered_to,omitempty"`
+	ReadBy      []string  `json:"read_by,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func receiptRank(state string) int {
+	switch state {
+	case ReceiptSent:
+		return 1
+	case ReceiptDelivered:
+		return 2
+	case ReceiptRead:
+		return 3
+	}
+	return 0
+}
+
+// apply merges a state change reported by peer into the receipt. States never
+// move backwards; a read also counts as a delivery.
+func (rc *Receipt) apply(state, by string, at time.Time) {
+	if receiptRank(state) > receiptRank(rc.State) {
+		rc.State = state
+	}
+	if by != "" && receiptRank(state) >= receiptRank(ReceiptDelivered) {
+		rc.DeliveredTo = appendUnique(rc.DeliveredTo, by)
+	}
+	if by != "" && state == ReceiptRead {
+		rc.ReadBy = appendUnique(rc.ReadBy, by)
+	}
+	rc.UpdatedAt = at
+}
+
+func appendUnique(list []string, v string) []string {
+	for _, existing := range list {
+		if existing == v {
+			return list
+		}
+	}
+	return append(list, v)
+}
 
 // HistoryStore persists chat history using BoltDB so peers can reload recent
 // conversations on restart.
@@ -29,8 +93,28 @@ func OpenHistoryStore(path string) (*HistoryStore, error) {
 		return nil, err
 	}
 	err = db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(historyBucket))
-		return err
+		needsIndex := tx.Bucket([]byte(searchBucket)) == nil
+		needsIDs := tx.Bucket([]byte(idBucket)) == nil
+		needsLegacy := tx.Bucket([]byte(legacyBucket)) == nil
+		for _, name := range []string{historyBucket, channelBucket, receiptBucket, searchBucket, searchCountBucket, idBucket, editBucket, threadBucket, reactionBucket, legacyBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		if needsIDs {
+			if err := backfillIDs(tx); err != nil {
+				return err
+			}
+		}
+		if needsLegacy {
+			if err := backfillLegacyChannel(tx); err != nil {
+				return err
+			}
+		}
+		if needsIndex {
+			return backfillSearchIndex(tx)
+		}
+		return nil
 	})
 	if err != nil {
 		_ = db.Close()
@@ -39,6 +123,38 @@ func OpenHistoryStore(path string) (*HistoryStore, error) {
 	return &HistoryStore{db: db}, nil
 }
 
+// roomless reports whether msg is a room post stored before rooms existed:
+// it names neither a room nor a recipient.
+func roomless(msg message.Message) bool {
+	return msg.Channel == "" && msg.To == "" && msg.ToAddr == ""
+}
+
+// backfillLegacyChannel indexes the roomless records under legacyChannel so
+// /history and /load still show them.
+func backfillLegacyChannel(tx *bbolt.Tx) error {
+	var keys [][]byte
+	err := tx.Bucket([]byte(historyBucket)).ForEach(func(k, v []byte) error {
+		var msg message.Message
+		if err := json.Unmarshal(v, &msg); err == nil && roomless(msg) {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	index, err := tx.Bucket([]byte(channelBucket)).CreateBucketIfNotExists([]byte(legacyChannel))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := index.Put(key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *HistoryStore) Close() error {
 	if s == nil || s.db == nil {
 		return nil
@@ -56,8 +172,35 @@ func (s *HistoryStore) Append(msg message.Message) error {
 	}
 	return s.db.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(historyBucket))
-		key := []byte(fmt.Sprintf("%020d-%s", msg.Timestamp.UnixNano(), msg.MsgID))
-		return bucket.Put(key, data)
+		key := historyKey(msg)
+		if err := bucket.Put(key, data); err != nil {
+			return err
+		}
+		if err := indexMessage(tx, key, msg); err != nil {
+			return err
+		}
+		if msg.MsgID != "" {
+			if err := tx.Bucket([]byte(idBucket)).Put([]byte(msg.MsgID), key); err != nil {
+				return err
+			}
+		}
+		if msg.ThreadRoot != "" {
+			thread, err := tx.Bucket([]byte(threadBucket)).CreateBucketIfNotExists([]byte(msg.ThreadRoot))
+			if err != nil {
+				return err
+			}
+			if err := thread.Put(key, nil); err != nil {
+				return err
+			}
+		}
+		if msg.Channel == "" {
+			return nil
+		}
+		index, err := tx.Bucket([]byte(channelBucket)).CreateBucketIfNotExists([]byte(msg.Channel))
+		if err != nil {
+			return err
+		}
+		return index.Put(key, nil)
 	})
 }
 
@@ -78,7 +221,54 @@ func (s *HistoryStore) Recent(limit int) ([]message.Message, error) {
 		for k, v := cursor.Last(); k != nil && limit > 0; k, v = cursor.Prev() {
 			var msg message.Message
 			if err := json.Unmarshal(v, &msg); err == nil {
-				out = append(out, msg)
+				out = append(out, withOverlay(tx, msg))
+			}
+			limit--
+		}
+		return nil
+	})
+	return out, err
+}
+
+// RecentChannel returns up to limit messages posted to channel, newest first.
+// The empty channel holds direct messages; they are not indexed, so they are
+// found by scanning back through the whole history. Room posts from before
+// rooms existed are listed under legacyChannel, not here.
+func (s *HistoryStore) RecentChannel(channel string, limit int) ([]message.Message, error) {
+	if s == nil || s.db == nil {
+		return nil, nil
+	}
+	if limit <= 0 {
+		return nil, nil
+	}
+	var out []message.Message
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		messages := tx.Bucket([]byte(historyBucket))
+		channels := tx.Bucket([]byte(channelBucket))
+		if messages == nil || channels == nil {
+			return nil
+		}
+		if channel == "" {
+			cursor := messages.Cursor()
+			for k, v := cursor.Last(); k != nil && limit > 0; k, v = cursor.Prev() {
+				var msg message.Message
+				if err := json.Unmarshal(v, &msg); err != nil || msg.Channel != "" || roomless(msg) {
+					continue
+				}
+				out = append(out, withOverlay(tx, msg))
+				limit--
+			}
+			return nil
+		}
+		index := channels.Bucket([]byte(channel))
+		if index == nil {
+			return nil
+		}
+		cursor := index.Cursor()
+		for k, _ := cursor.Last(); k != nil && limit > 0; k, _ = cursor.Prev() {
+			var msg message.Message
+			if err := json.Unmarshal(messages.Get(k), &msg); err == nil {
+				out = append(out, withOverlay(tx, msg))
 			}
 			limit--
 		}
@@ -86,3 +276,95 @@ func (s *HistoryStore) Recent(limit int) ([]message.Message, error) {
 	})
 	return out, err
 }
+
+// Since returns up to limit messages posted to channel after the message
+// identified by ts and msgID, oldest first, and whether more remain. A zero
+// ts starts from the beginning of the room. Messages are returned as
+// originally signed; deleted ones are left out.
+func (s *HistoryStore) Since(channel string, ts time.Time, msgID string, limit int) ([]message.Message, bool, error) {
+	if s == nil || s.db == nil || limit <= 0 {
+		return nil, false, nil
+	}
+	var out []message.Message
+	more := false
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		messages := tx.Bucket([]byte(historyBucket))
+		index := tx.Bucket([]byte(channelBucket)).Bucket([]byte(channel))
+		if index == nil {
+			return nil
+		}
+		cursor := index.Cursor()
+		k, _ := cursor.First()
+		if !ts.IsZero() {
+			after := historyKey(message.Message{Timestamp: ts, MsgID: msgID})
+			k, _ = cursor.Seek(after)
+			if k != nil && bytes.Equal(k, after) {
+				k, _ = cursor.Next()
+			}
+		}
+		for ; k != nil; k, _ = cursor.Next() {
+			if len(out) == limit {
+				more = true
+				return nil
+			}
+			var msg message.Message
+			if err := json.Unmarshal(messages.Get(k), &msg); err != nil {
+				continue
+			}
+			if o, ok := loadOverlay(tx, msg.MsgID); ok && o.Deleted {
+				continue
+			}
+			out = append(out, msg)
+		}
+		return nil
+	})
+	return out, more, err
+}
+
+// UpdateReceipt records that msgID reached state, confirmed by peer by, and
+// returns the merged receipt. Without a database the result only reflects
+// this single update.
+func (s *HistoryStore) UpdateReceipt(msgID, state, by string) (Receipt, error) {
+	rc := Receipt{MsgID: msgID}
+	if s == nil || s.db == nil {
+		rc.apply(state, by, time.Now())
+		return rc, nil
+	}
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(receiptBucket))
+		if existing := bucket.Get([]byte(msgID)); existing != nil {
+			if err := json.Unmarshal(existing, &rc); err != nil {
+				return err
+			}
+		}
+		rc.apply(state, by, time.Now())
+		data, err := json.Marshal(rc)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(msgID), data)
+	})
+	return rc, err
+}
+
+// Receipt returns the stored receipt for msgID, if any.
+func (s *HistoryStore) Receipt(msgID string) (Receipt, bool, error) {
+	var rc Receipt
+	if s == nil || s.db == nil {
+		return rc, false, nil
+	}
+	found := false
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket([]byte(receiptBucket)).Get([]byte(msgID))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &rc)
+	})
+	return rc, found, err
+}
+
+func historyKey(msg message.Message) []byte {
+	return []byte(fmt.Sprintf("%020d-%s", msg.Timestamp.UnixNano(), msg.MsgID))
+}
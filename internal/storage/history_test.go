@@ -5,6 +5,8 @@ import (
 	"testing"
 	"time"
 
+	"go.etcd.io/bbolt"
+
 	"p2p-chat/internal/message"
 )
 
@@ -51,3 +53,136 @@ func TestHistoryStoreRecentLimitZero(t *testing.T) {
 		t.Fatalf("expected nil slice when limit <= 0, got %v", msgs)
 	}
 }
+
+func TestHistoryStoreRecentChannel(t *testing.T) {
+	store, err := OpenHistoryStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("OpenHistoryStore: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	base := time.Now()
+	msgs := []message.Message{
+		{MsgID: "a", Channel: "general", Timestamp: base.Add(-3 * time.Second)},
+		{MsgID: "b", Channel: "ops", Timestamp: base.Add(-2 * time.Second)},
+		{MsgID: "c", Channel: "general", Timestamp: base.Add(-1 * time.Second)},
+	}
+	for _, msg := range msgs {
+		if err := store.Append(msg); err != nil {
+			t.Fatalf("append %s: %v", msg.MsgID, err)
+		}
+	}
+	recent, err := store.RecentChannel("general", 10)
+	if err != nil {
+		t.Fatalf("recent channel: %v", err)
+	}
+	if len(recent) != 2 || recent[0].MsgID != "c" || recent[1].MsgID != "a" {
+		t.Fatalf("unexpected channel history: %+v", recent)
+	}
+
+	if err := store.Append(message.Message{MsgID: "dm", Type: "dm", To: "bob", Timestamp: base}); err != nil {
+		t.Fatalf("append dm: %v", err)
+	}
+	direct, err := store.RecentChannel("", 10)
+	if err != nil || len(direct) != 1 || direct[0].MsgID != "dm" {
+		t.Fatalf("expected direct messages under the empty channel, got %+v, %v", direct, err)
+	}
+}
+
+func TestHistoryStoreIndexesPostsFromBeforeRooms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	store, err := OpenHistoryStore(path)
+	if err != nil {
+		t.Fatalf("OpenHistoryStore: %v", err)
+	}
+	base := time.Now()
+	for _, msg := range []message.Message{
+		{MsgID: "old", Type: "chat", Timestamp: base.Add(-2 * time.Second)},
+		{MsgID: "dm", Type: "dm", To: "bob", Timestamp: base.Add(-time.Second)},
+	} {
+		if err := store.Append(msg); err != nil {
+			t.Fatalf("append %s: %v", msg.MsgID, err)
+		}
+	}
+	// Drop the marker as if the database predated the channel index.
+	err = store.db.Update(func(tx *bbolt.Tx) error {
+		return tx.DeleteBucket([]byte(legacyBucket))
+	})
+	if err != nil {
+		t.Fatalf("drop marker: %v", err)
+	}
+	_ = store.Close()
+
+	store, err = OpenHistoryStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	room, err := store.RecentChannel(legacyChannel, 10)
+	if err != nil || len(room) != 1 || room[0].MsgID != "old" {
+		t.Fatalf("expected the old post under %s, got %+v, %v", legacyChannel, room, err)
+	}
+	direct, err := store.RecentChannel("", 10)
+	if err != nil || len(direct) != 1 || direct[0].MsgID != "dm" {
+		t.Fatalf("expected only the dm under the empty channel, got %+v, %v", direct, err)
+	}
+}
+
+func TestHistoryStoreReceiptsOnlyMoveForward(t *testing.T) {
+	store, err := OpenHistoryStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("OpenHistoryStore: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	if _, err := store.UpdateReceipt("m1", ReceiptSent, ""); err != nil {
+		t.Fatalf("sent: %v", err)
+	}
+	if _, err := store.UpdateReceipt("m1", ReceiptRead, "bob"); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	rc, err := store.UpdateReceipt("m1", ReceiptDelivered, "carol")
+	if err != nil {
+		t.Fatalf("delivered: %v", err)
+	}
+	if rc.State != ReceiptRead {
+		t.Fatalf("late delivery downgraded state to %q", rc.State)
+	}
+	stored, ok, err := store.Receipt("m1")
+	if err != nil || !ok {
+		t.Fatalf("receipt lookup: ok=%v err=%v", ok, err)
+	}
+	if len(stored.DeliveredTo) != 2 || len(stored.ReadBy) != 1 || stored.ReadBy[0] != "bob" {
+		t.Fatalf("unexpected receipt %+v", stored)
+	}
+	if _, ok, _ := store.Receipt("missing"); ok {
+		t.Fatalf("expected no receipt for unknown message")
+	}
+}
+
+func TestHistoryStoreSincePages(t *testing.T) {
+	store, err := OpenHistoryStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("OpenHistoryStore: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	base := time.Now()
+	for i, id := range []string{"a", "b", "c", "d"} {
+		msg := message.Message{MsgID: id, Channel: "general", Timestamp: base.Add(time.Duration(i) * time.Second)}
+		if err := store.Append(msg); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	page, more, err := store.Since("general", time.Time{}, "", 2)
+	if err != nil || !more || len(page) != 2 || page[0].MsgID != "a" || page[1].MsgID != "b" {
+		t.Fatalf("first page: %v more=%v err=%v", page, more, err)
+	}
+	page, more, err = store.Since("general", page[1].Timestamp, page[1].MsgID, 2)
+	if err != nil || more || len(page) != 2 || page[0].MsgID != "c" || page[1].MsgID != "d" {
+		t.Fatalf("second page: %v more=%v err=%v", page, more, err)
+	}
+	if page, _, _ := store.Since("other", time.Time{}, "", 2); len(page) != 0 {
+		t.Fatalf("expected empty room, got %v", page)
+	}
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"p2p-chat/internal/message"
+)
+
+const (
+	outboxBucket      = "outbox"
+	outboxIndexBucket = "outbox_ids"
+
+	// outboxPerRecipient bounds how many undelivered messages are kept for a
+	// single recipient; the oldest are discarded first.
+	outboxPerRecipient = 500
+)
+
+// OutboxEntry is an undelivered direct message waiting for its recipient to
+// come back online.
+type OutboxEntry struct {
+	Recipient string          `json:"recipient"`
+	QueuedAt  time.Time       `json:"queued_at"`
+	Relayed   bool            `json:"relayed,omitempty"`
+	Msg       message.Message `json:"msg"`
+}
+
+// Outbox persists undelivered messages per recipient in BoltDB. Entries are
+// either this peer's own messages or, on relays that opted in, messages held
+// on behalf of other peers.
+type Outbox struct {
+	db *bbolt.DB
+}
+
+func OpenOutbox(path string) (*Outbox, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range []string{outboxBucket, outboxIndexBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &Outbox{db: db}, nil
+}
+
+func (o *Outbox) Close() error {
+	if o == nil || o.db == nil {
+		return nil
+	}
+	return o.db.Close()
+}
+
+// Put queues entry for its recipient. Re-queuing a message that is already
+// stored is a no-op.
+func (o *Outbox) Put(entry OutboxEntry) error {
+	if o == nil || o.db == nil {
+		return nil
+	}
+	if entry.Recipient == "" || entry.Msg.MsgID == "" {
+		return fmt.Errorf("outbox entry needs a recipient and msg id")
+	}
+	if entry.QueuedAt.IsZero() {
+		entry.QueuedAt = time.Now()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return o.db.Update(func(tx *bbolt.Tx) error {
+		index := tx.Bucket([]byte(outboxIndexBucket))
+		if index.Get([]byte(entry.Msg.MsgID)) != nil {
+			return nil
+		}
+		bucket, err := tx.Bucket([]byte(outboxBucket)).CreateBucketIfNotExists([]byte(entry.Recipient))
+		if err != nil {
+			return err
+		}
+		key := []byte(fmt.Sprintf("%020d-%s", entry.QueuedAt.UnixNano(), entry.Msg.MsgID))
+		if err := bucket.Put(key, data); err != nil {
+			return err
+		}
+		if err := index.Put([]byte(entry.Msg.MsgID), []byte(entry.Recipient)); err != nil {
+			return err
+		}
+		count := 0
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			count++
+		}
+		for ; count > outboxPerRecipient; count-- {
+			oldest, value := bucket.Cursor().First()
+			var dropped OutboxEntry
+			if err := json.Unmarshal(value, &dropped); err == nil {
+				_ = index.Delete([]byte(dropped.Msg.MsgID))
+			}
+			if err := bucket.Delete(oldest); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Pending returns the queued entries for recipient in send order.
+func (o *Outbox) Pending(recipient string) ([]OutboxEntry, error) {
+	if o == nil || o.db == nil {
+		return nil, nil
+	}
+	var out []OutboxEntry
+	err := o.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(outboxBucket)).Bucket([]byte(recipient))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, v []byte) error {
+			var entry OutboxEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			out = append(out, entry)
+			return nil
+		})
+	})
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Msg.Timestamp.Before(out[j].Msg.Timestamp)
+	})
+	return out, err
+}
+
+// Remove drops the entry for msgID, typically once its ack arrives. It
+// reports the removed entry, if any.
+func (o *Outbox) Remove(msgID string) (OutboxEntry, bool, error) {
+	var removed OutboxEntry
+	if o == nil || o.db == nil || msgID == "" {
+		return removed, false, nil
+	}
+	found := false
+	err := o.db.Update(func(tx *bbolt.Tx) error {
+		index := tx.Bucket([]byte(outboxIndexBucket))
+		recipient := index.Get([]byte(msgID))
+		if recipient == nil {
+			return nil
+		}
+		bucket := tx.Bucket([]byte(outboxBucket)).Bucket(recipient)
+		if err := index.Delete([]byte(msgID)); err != nil {
+			return err
+		}
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var entry OutboxEntry
+			if err := json.Unmarshal(v, &entry); err != nil || entry.Msg.MsgID != msgID {
+				continue
+			}
+			removed, found = entry, true
+			return bucket.Delete(k)
+		}
+		return nil
+	})
+	return removed, found, err
+}
+
+// Expire drops entries queued before cutoff and returns how many were removed.
+func (o *Outbox) Expire(cutoff time.Time) (int, error) {
+	if o == nil || o.db == nil {
+		return 0, nil
+	}
+	limit := []byte(fmt.Sprintf("%020d", cutoff.UnixNano()))
+	removed := 0
+	err := o.db.Update(func(tx *bbolt.Tx) error {
+		index := tx.Bucket([]byte(outboxIndexBucket))
+		root := tx.Bucket([]byte(outboxBucket))
+		return root.ForEach(func(name, _ []byte) error {
+			bucket := root.Bucket(name)
+			if bucket == nil {
+				return nil
+			}
+			var stale [][]byte
+			c := bucket.Cursor()
+			for k, v := c.First(); k != nil && bytes.Compare(k[:len(limit)], limit) < 0; k, v = c.Next() {
+				var entry OutboxEntry
+				if err := json.Unmarshal(v, &entry); err == nil {
+					_ = index.Delete([]byte(entry.Msg.MsgID))
+				}
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			for _, k := range stale {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+				removed++
+			}
+			return nil
+		})
+	})
+	return removed, err
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-chat/internal/message"
+)
+
+func TestOutboxPutPendingRemove(t *testing.T) {
+	outbox, err := OpenOutbox(filepath.Join(t.TempDir(), "outbox.db"))
+	if err != nil {
+		t.Fatalf("OpenOutbox: %v", err)
+	}
+	t.Cleanup(func() { _ = outbox.Close() })
+
+	base := time.Now()
+	for i, id := range []string{"b", "a"} {
+		msg := message.Message{MsgID: id, To: "Bob", Timestamp: base.Add(time.Duration(i) * time.Second)}
+		if err := outbox.Put(OutboxEntry{Recipient: "10.0.0.2:9001", Msg: msg}); err != nil {
+			t.Fatalf("put %s: %v", id, err)
+		}
+	}
+	if err := outbox.Put(OutboxEntry{Recipient: "10.0.0.2:9001", Msg: message.Message{MsgID: "a"}}); err != nil {
+		t.Fatalf("re-put: %v", err)
+	}
+	pending, err := outbox.Pending("10.0.0.2:9001")
+	if err != nil {
+		t.Fatalf("pending: %v", err)
+	}
+	if len(pending) != 2 || pending[0].Msg.MsgID != "b" || pending[1].Msg.MsgID != "a" {
+		t.Fatalf("unexpected pending entries: %+v", pending)
+	}
+	entry, ok, err := outbox.Remove("b")
+	if err != nil || !ok || entry.Msg.To != "Bob" {
+		t.Fatalf("remove: %v %v %+v", err, ok, entry)
+	}
+	if _, ok, _ := outbox.Remove("b"); ok {
+		t.Fatalf("second remove should report nothing")
+	}
+	if pending, _ := outbox.Pending("10.0.0.2:9001"); len(pending) != 1 {
+		t.Fatalf("expected one entry left, got %d", len(pending))
+	}
+}
+
+func TestOutboxExpire(t *testing.T) {
+	outbox, err := OpenOutbox(filepath.Join(t.TempDir(), "outbox.db"))
+	if err != nil {
+		t.Fatalf("OpenOutbox: %v", err)
+	}
+	t.Cleanup(func() { _ = outbox.Close() })
+
+	old := OutboxEntry{Recipient: "bob", QueuedAt: time.Now().Add(-48 * time.Hour), Msg: message.Message{MsgID: "old"}}
+	fresh := OutboxEntry{Recipient: "bob", Msg: message.Message{MsgID: "fresh"}}
+	for _, entry := range []OutboxEntry{old, fresh} {
+		if err := outbox.Put(entry); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	n, err := outbox.Expire(time.Now().Add(-24 * time.Hour))
+	if err != nil || n != 1 {
+		t.Fatalf("expire: %d %v", n, err)
+	}
+	if _, ok, _ := outbox.Remove("old"); ok {
+		t.Fatalf("expired entry should be gone from the index")
+	}
+}
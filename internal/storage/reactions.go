@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"encoding/json"
+
+	"go.etcd.io/bbolt"
+
+	"p2p-chat/internal/message"
+)
+
+// reactionBucket holds the current reaction tally per message ID.
+const reactionBucket = "reactions"
+
+func loadReactions(tx *bbolt.Tx, msgID string) []message.Reaction {
+	data := tx.Bucket([]byte(reactionBucket)).Get([]byte(msgID))
+	if data == nil {
+		return nil
+	}
+	var out []message.Reaction
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil
+	}
+	return out
+}
+
+// SetReactions replaces the stored tally for msgID. An empty tally removes it.
+func (s *HistoryStore) SetReactions(msgID string, reactions []message.Reaction) error {
+	if s == nil || s.db == nil {
+		return nil
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(reactionBucket))
+		if len(reactions) == 0 {
+			return bucket.Delete([]byte(msgID))
+		}
+		data, err := json.Marshal(reactions)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(msgID), data)
+	})
+}
+
+// Reactions returns the stored tally for msgID.
+func (s *HistoryStore) Reactions(msgID string) ([]message.Reaction, error) {
+	if s == nil || s.db == nil {
+		return nil, nil
+	}
+	var out []message.Reaction
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		out = loadReactions(tx, msgID)
+		return nil
+	})
+	return out, err
+}
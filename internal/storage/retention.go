@@ -0,0 +1,335 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// staleUploadAge is how old an unreferenced file must be before GC removes
+// it; younger ones may belong to an upload or download still in progress.
+const staleUploadAge = time.Hour
+
+var (
+	// ErrQuotaExceeded is returned when a file would take its uploader over
+	// RetentionPolicy.UserQuota.
+	ErrQuotaExceeded = errors.New("upload quota exceeded")
+	// ErrStoreFull is returned when a file would take the store over
+	// RetentionPolicy.MaxTotalBytes.
+	ErrStoreFull = errors.New("file store is full")
+)
+
+// RetentionPolicy bounds what the file store keeps. A zero field disables
+// that limit.
+type RetentionPolicy struct {
+	// MaxAge is how long a file is kept after it was stored.
+	MaxAge time.Duration
+	// MaxTotalBytes caps the disk used by blobs. Uploads that do not fit are
+	// refused, and GC evicts the oldest files if the store is over the cap.
+	MaxTotalBytes int64
+	// UserQuota caps the bytes stored per uploader.
+	UserQuota int64
+	// ShareKeyTTL makes share keys expire this long after they are issued.
+	ShareKeyTTL time.Duration
+}
+
+// GCReport summarises one Collect run.
+type GCReport struct {
+	Expired     int   `json:"expired"`
+	Evicted     int   `json:"evicted"`
+	KeysExpired int   `json:"keys_expired"`
+	Orphans     int   `json:"orphans"`
+	Freed       int64 `json:"freed"`
+}
+
+// SetRetention installs the limits enforced by Save and Collect. Call it
+// before the store is shared between goroutines.
+func (s *FileStore) SetRetention(p RetentionPolicy) {
+	if s == nil {
+		return
+	}
+	s.policy = p
+}
+
+// ShareKeyValid reports whether key opens the record at now.
+func (r FileRecord) ShareKeyValid(key string, now time.Time) bool {
+	if key == "" || r.ShareKey == "" || key != r.ShareKey {
+		return false
+	}
+	return r.ShareKeyExpires.IsZero() || now.Before(r.ShareKeyExpires)
+}
+
+// issueShareKey gives entry a fresh share key, expiring per the policy.
+func (s *FileStore) issueShareKey(entry *fileEntry, now time.Time) {
+	entry.ShareKey = newShareKey()
+	entry.ShareKeyExpires = time.Time{}
+	if s.policy.ShareKeyTTL > 0 {
+		entry.ShareKeyExpires = now.Add(s.policy.ShareKeyTTL)
+	}
+}
+
+// RevokeShareKey removes the share key of id; downloads then need a session.
+func (s *FileStore) RevokeShareKey(id string) error {
+	entry, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	entry.ShareKey = ""
+	entry.ShareKeyExpires = time.Time{}
+	return s.putEntry(*entry)
+}
+
+// checkRoom fails if storing size bytes for uploader under digest would break
+// the quota or the total cap. Content already held as an intact blob only
+// counts against the quota.
+func (s *FileStore) checkRoom(tx *bbolt.Tx, uploader string, size int64, digest string) error {
+	p := s.policy
+	if p.UserQuota <= 0 && p.MaxTotalBytes <= 0 {
+		return nil
+	}
+	if p.UserQuota > 0 {
+		used := int64(0)
+		_ = tx.Bucket([]byte(filesBucket)).ForEach(func(_, v []byte) error {
+			var entry fileEntry
+			if json.Unmarshal(v, &entry) == nil && strings.EqualFold(entry.Uploader, uploader) {
+				used += entry.Size
+			}
+			return nil
+		})
+		if used+size > p.UserQuota {
+			return fmt.Errorf("%w: %s has %d of %d bytes", ErrQuotaExceeded, uploader, used, p.UserQuota)
+		}
+	}
+	if p.MaxTotalBytes > 0 {
+		if blob, ok := loadBlob(tx, digest); ok && !blob.Corrupt {
+			return nil
+		}
+		if used := blobBytes(tx); used+size > p.MaxTotalBytes {
+			return fmt.Errorf("%w: %d of %d bytes used", ErrStoreFull, used, p.MaxTotalBytes)
+		}
+	}
+	return nil
+}
+
+// CheckRoom reports whether a file of size bytes from uploader would be
+// accepted, so transfers can be refused before any data arrives.
+func (s *FileStore) CheckRoom(uploader string, size int64, digest string) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("file store not initialized")
+	}
+	return s.db.View(func(tx *bbolt.Tx) error {
+		return s.checkRoom(tx, uploader, size, digest)
+	})
+}
+
+func blobBytes(tx *bbolt.Tx) int64 {
+	total := int64(0)
+	_ = tx.Bucket([]byte(blobBucket)).ForEach(func(_, v []byte) error {
+		var blob blobEntry
+		if json.Unmarshal(v, &blob) == nil {
+			total += blob.Size
+		}
+		return nil
+	})
+	return total
+}
+
+// Collect applies the retention policy at now: it drops files past MaxAge,
+// evicts the oldest files while the store is over MaxTotalBytes, clears
+// expired share keys, re-counts blob references and deletes files on disk
+// that no metadata points to.
+func (s *FileStore) Collect(now time.Time) (GCReport, error) {
+	var report GCReport
+	if s == nil || s.db == nil {
+		return report, nil
+	}
+	var dropped []string
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		files := tx.Bucket([]byte(filesBucket))
+		var entries []fileEntry
+		err := files.ForEach(func(_, v []byte) error {
+			var entry fileEntry
+			if json.Unmarshal(v, &entry) == nil {
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+		})
+
+		kept := entries[:0]
+		for _, entry := range entries {
+			if s.policy.MaxAge > 0 && now.Sub(entry.CreatedAt) > s.policy.MaxAge {
+				if err := files.Delete([]byte(entry.ID)); err != nil {
+					return err
+				}
+				report.Expired++
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		unused, err := s.recount(tx, kept, &report)
+		if err != nil {
+			return err
+		}
+		dropped = unused
+		for len(kept) > 0 && s.policy.MaxTotalBytes > 0 && blobBytes(tx) > s.policy.MaxTotalBytes {
+			oldest := kept[0]
+			kept = kept[1:]
+			if err := files.Delete([]byte(oldest.ID)); err != nil {
+				return err
+			}
+			if oldest.SHA256 != "" {
+				if blob, ok := loadBlob(tx, oldest.SHA256); ok && blob.Refs == 1 {
+					report.Freed += blob.Size
+				}
+				last, err := s.releaseBlob(tx, oldest.SHA256)
+				if err != nil {
+					return err
+				}
+				if last {
+					dropped = append(dropped, oldest.SHA256)
+				}
+			}
+			report.Evicted++
+		}
+		for _, entry := range kept {
+			if entry.ShareKey == "" || entry.ShareKeyExpires.IsZero() || now.Before(entry.ShareKeyExpires) {
+				continue
+			}
+			entry.ShareKey = ""
+			entry.ShareKeyExpires = time.Time{}
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := files.Put([]byte(entry.ID), data); err != nil {
+				return err
+			}
+			report.KeysExpired++
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	if err := s.dropBlobFiles(dropped); err != nil {
+		return report, err
+	}
+	return report, s.sweepOrphans(now, &report)
+}
+
+// recount sets every blob's reference count from the records in entries and
+// deletes the entries of blobs nothing refers to any more, returning their
+// digests so the files can go once the transaction has committed.
+func (s *FileStore) recount(tx *bbolt.Tx, entries []fileEntry, report *GCReport) ([]string, error) {
+	refs := make(map[string]int)
+	for _, entry := range entries {
+		if entry.SHA256 != "" {
+			refs[entry.SHA256]++
+		}
+	}
+	blobs := tx.Bucket([]byte(blobBucket))
+	var digests []string
+	err := blobs.ForEach(func(k, _ []byte) error {
+		digests = append(digests, string(k))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var unused []string
+	for _, digest := range digests {
+		blob, _ := loadBlob(tx, digest)
+		if refs[digest] > 0 {
+			if blob.Refs != refs[digest] {
+				blob.Refs = refs[digest]
+				if err := putBlob(tx, digest, blob); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if err := blobs.Delete([]byte(digest)); err != nil {
+			return nil, err
+		}
+		unused = append(unused, digest)
+		report.Freed += blob.Size
+	}
+	return unused, nil
+}
+
+// sweepOrphans deletes files the store created that no metadata refers to:
+// blobs and thumbnails without a blob entry, partial downloads nobody is
+// receiving and abandoned upload temps. Anything else in the directory, which
+// the user may have chosen, is left alone. The metadata is read before the
+// walk, so only files older than staleUploadAge are removed; a younger one
+// may belong to a save or download that committed in between.
+func (s *FileStore) sweepOrphans(now time.Time, report *GCReport) error {
+	known := make(map[string]bool)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		for _, name := range []string{blobBucket, partialBucket} {
+			err := tx.Bucket([]byte(name)).ForEach(func(k, _ []byte) error {
+				known[string(k)] = true
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	dir := filepath.Clean(s.dir)
+	blobs := filepath.Join(dir, "blobs")
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		path = filepath.Clean(path)
+		if info.IsDir() {
+			if path != dir && path != blobs && !strings.HasPrefix(path, blobs+string(filepath.Separator)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if now.Sub(info.ModTime()) < staleUploadAge || !orphaned(path, dir, blobs, known) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return nil
+		}
+		report.Orphans++
+		report.Freed += info.Size()
+		return nil
+	})
+}
+
+// orphaned reports whether path is a file the store creates, under blobs or
+// at the top of dir, that none of the known digests and transfer IDs claims.
+func orphaned(path, dir, blobs string, known map[string]bool) bool {
+	name := filepath.Base(path)
+	switch {
+	case strings.HasPrefix(path, blobs+string(filepath.Separator)):
+		return !known[strings.TrimSuffix(name, thumbSuffix)]
+	case filepath.Dir(path) != dir:
+		return false
+	case strings.HasSuffix(name, ".part"):
+		return !known[strings.TrimSuffix(name, ".part")]
+	default:
+		return strings.HasPrefix(name, ".upload-")
+	}
+}
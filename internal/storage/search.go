@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.etcd.io/bbolt"
+
+	"p2p-chat/internal/message"
+)
+
+const (
+	// searchBucket holds one nested bucket per indexed term whose keys are the
+	// history keys of the messages containing it.
+	searchBucket = "search"
+	// searchCountBucket keeps how many messages contain each term so the
+	// rarest term can drive a query without walking the index.
+	searchCountBucket = "search_counts"
+
+	defaultSearchLimit = 50
+	maxSearchLimit     = 500
+	maxTermBytes       = 64
+)
+
+// SearchQuery filters persisted history. Every term must appear in a message
+// for it to match; From, Before and After are optional. After is inclusive and
+// Before exclusive.
+type SearchQuery struct {
+	Terms  []string
+	From   string
+	Before time.Time
+	After  time.Time
+	Limit  int
+}
+
+// ParseSearchQuery reads the "/search" syntax: free text plus optional
+// from:<nick>, before:<date> and after:<date> filters. Dates are either
+// YYYY-MM-DD in local time or RFC 3339.
+func ParseSearchQuery(raw string) (SearchQuery, error) {
+	var q SearchQuery
+	var text []string
+	for _, field := range strings.Fields(raw) {
+		key, value, ok := strings.Cut(field, ":")
+		if !ok || value == "" {
+			text = append(text, field)
+			continue
+		}
+		var err error
+		switch strings.ToLower(key) {
+		case "from":
+			q.From = value
+		case "before":
+			q.Before, err = parseSearchDate(value)
+		case "after":
+			q.After, err = parseSearchDate(value)
+		default:
+			text = append(text, field)
+		}
+		if err != nil {
+			return q, err
+		}
+	}
+	q.Terms = searchTerms(strings.Join(text, " "))
+	if len(q.Terms) == 0 && q.From == "" && q.Before.IsZero() && q.After.IsZero() {
+		return q, fmt.Errorf("search needs some text or a from:/before:/after: filter")
+	}
+	return q, nil
+}
+
+func parseSearchDate(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("bad date %q (want YYYY-MM-DD)", value)
+}
+
+// searchTerms splits text into lowercase index terms. Words shorter than two
+// characters are skipped, except Han characters which are indexed one by one
+// since those scripts do not separate words with spaces.
+func searchTerms(text string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	add := func(term string) {
+		if len(term) > maxTermBytes || seen[term] {
+			return
+		}
+		seen[term] = true
+		terms = append(terms, term)
+	}
+	var word []rune
+	flush := func() {
+		if len(word) >= 2 {
+			add(string(word))
+		}
+		word = word[:0]
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			flush()
+			add(string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return terms
+}
+
+// containsTerms reports whether every term occurs in text. Edited messages
+// stay indexed under their old words, so matches are re-checked.
+func containsTerms(text string, terms []string) bool {
+	have := make(map[string]bool)
+	for _, term := range searchTerms(text) {
+		have[term] = true
+	}
+	for _, term := range terms {
+		if !have[term] {
+			return false
+		}
+	}
+	return true
+}
+
+// indexMessage adds the message stored under key to the search index.
+func indexMessage(tx *bbolt.Tx, key []byte, msg message.Message) error {
+	root := tx.Bucket([]byte(searchBucket))
+	counts := tx.Bucket([]byte(searchCountBucket))
+	for _, term := range searchTerms(msg.Content) {
+		bucket, err := root.CreateBucketIfNotExists([]byte(term))
+		if err != nil {
+			return err
+		}
+		if bucket.Get(key) != nil {
+			continue
+		}
+		if err := bucket.Put(key, []byte{1}); err != nil {
+			return err
+		}
+		n, _ := binary.Uvarint(counts.Get([]byte(term)))
+		if err := counts.Put([]byte(term), binary.AppendUvarint(nil, n+1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillSearchIndex indexes every stored message; it runs once when an
+// older database without a search index is opened.
+func backfillSearchIndex(tx *bbolt.Tx) error {
+	return tx.Bucket([]byte(historyBucket)).ForEach(func(k, v []byte) error {
+		var msg message.Message
+		if err := json.Unmarshal(v, &msg); err != nil {
+			return nil
+		}
+		return indexMessage(tx, k, msg)
+	})
+}
+
+// Search returns messages matching q, newest first. The rarest term drives
+// the scan and the remaining terms are checked by key lookups, so queries stay
+// cheap on large histories.
+func (s *HistoryStore) Search(q SearchQuery) ([]message.Message, error) {
+	if s == nil || s.db == nil {
+		return nil, nil
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	var out []message.Message
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		messages := tx.Bucket([]byte(historyBucket))
+		driver := messages
+		var others []*bbolt.Bucket
+		if len(q.Terms) > 0 {
+			root := tx.Bucket([]byte(searchBucket))
+			counts := tx.Bucket([]byte(searchCountBucket))
+			driver = nil
+			rarest := uint64(0)
+			for _, term := range q.Terms {
+				bucket := root.Bucket([]byte(term))
+				if bucket == nil {
+					return nil
+				}
+				n, _ := binary.Uvarint(counts.Get([]byte(term)))
+				if driver == nil || n < rarest {
+					if driver != nil {
+						others = append(others, driver)
+					}
+					driver, rarest = bucket, n
+					continue
+				}
+				others = append(others, bucket)
+			}
+		}
+
+		cursor := driver.Cursor()
+		var k []byte
+		if q.Before.IsZero() {
+			k, _ = cursor.Last()
+		} else if k, _ = cursor.Seek(timeKey(q.Before)); k == nil {
+			k, _ = cursor.Last()
+		} else {
+			k, _ = cursor.Prev()
+		}
+		var lower []byte
+		if !q.After.IsZero() {
+			lower = timeKey(q.After)
+		}
+	scan:
+		for ; k != nil; k, _ = cursor.Prev() {
+			if lower != nil && bytes.Compare(k, lower) < 0 {
+				break
+			}
+			for _, bucket := range others {
+				if bucket.Get(k) == nil {
+					continue scan
+				}
+			}
+			var msg message.Message
+			if err := json.Unmarshal(messages.Get(k), &msg); err != nil {
+				continue
+			}
+			if q.From != "" && !strings.EqualFold(msg.From, q.From) {
+				continue
+			}
+			if o, ok := loadOverlay(tx, msg.MsgID); ok {
+				msg = o.apply(msg)
+				if msg.Deleted || (msg.Edited && !containsTerms(msg.Content, q.Terms)) {
+					continue
+				}
+			}
+			out = append(out, msg)
+			if len(out) == limit {
+				break
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+// timeKey is the history key prefix for t; every key at or after t sorts at
+// or above it.
+func timeKey(t time.Time) []byte {
+	return []byte(fmt.Sprintf("%020d", t.UnixNano()))
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-chat/internal/message"
+)
+
+func TestHistoryStoreSearch(t *testing.T) {
+	store, err := OpenHistoryStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("OpenHistoryStore: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	day := time.Date(2024, 3, 10, 12, 0, 0, 0, time.Local)
+	msgs := []message.Message{
+		{MsgID: "1", From: "alice", Content: "Deploy the relay tonight", Timestamp: day},
+		{MsgID: "2", From: "bob", Content: "relay deploy failed, rolling back", Timestamp: day.Add(24 * time.Hour)},
+		{MsgID: "3", From: "alice", Content: "lunch?", Timestamp: day.Add(48 * time.Hour)},
+		{MsgID: "4", From: "carol", Content: "明天部署", Timestamp: day.Add(72 * time.Hour)},
+	}
+	for _, msg := range msgs {
+		if err := store.Append(msg); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		{"deploy relay", []string{"2", "1"}},
+		{"DEPLOY from:alice", []string{"1"}},
+		{"relay after:2024-03-11", []string{"2"}},
+		{"relay before:2024-03-11", []string{"1"}},
+		{"from:alice", []string{"3", "1"}},
+		{"部署", []string{"4"}},
+		{"nothing", nil},
+	}
+	for _, tc := range cases {
+		q, err := ParseSearchQuery(tc.query)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tc.query, err)
+		}
+		got, err := store.Search(q)
+		if err != nil {
+			t.Fatalf("search %q: %v", tc.query, err)
+		}
+		if len(got) != len(tc.want) {
+			t.Fatalf("search %q: got %d results, want %v", tc.query, len(got), tc.want)
+		}
+		for i, msg := range got {
+			if msg.MsgID != tc.want[i] {
+				t.Fatalf("search %q: result %d = %s, want %s", tc.query, i, msg.MsgID, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestParseSearchQueryRejectsEmptyAndBadDates(t *testing.T) {
+	if _, err := ParseSearchQuery("  "); err == nil {
+		t.Fatalf("expected empty query to be rejected")
+	}
+	if _, err := ParseSearchQuery("relay before:yesterday"); err == nil {
+		t.Fatalf("expected bad date to be rejected")
+	}
+}
+
+func TestHistoryStoreEditsAndTombstones(t *testing.T) {
+	store, err := OpenHistoryStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("OpenHistoryStore: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	now := time.Now()
+	for _, msg := range []message.Message{
+		{MsgID: "a", Channel: "general", Content: "meet at noon", Timestamp: now},
+		{MsgID: "b", Channel: "general", Content: "secret plans", Timestamp: now.Add(time.Second)},
+	} {
+		if err := store.Append(msg); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	if err := store.Edit("a", "meet at three", now); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	if err := store.Delete("b"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := store.Edit("missing", "x", now); err == nil {
+		t.Fatalf("expected edit of unknown message to fail")
+	}
+
+	got, ok, err := store.Get("a")
+	if err != nil || !ok || got.Content != "meet at three" || !got.Edited {
+		t.Fatalf("unexpected edited message %+v ok=%v err=%v", got, ok, err)
+	}
+	revs, _ := store.Revisions("a")
+	if len(revs) != 1 || revs[0].Content != "meet at noon" {
+		t.Fatalf("unexpected revisions %+v", revs)
+	}
+	recent, _ := store.RecentChannel("general", 10)
+	if len(recent) != 2 || !recent[0].Deleted || recent[0].Content != "" {
+		t.Fatalf("expected tombstone in recent history, got %+v", recent)
+	}
+	if page, _, _ := store.Since("general", time.Time{}, "", 10); len(page) != 1 || page[0].Content != "meet at noon" {
+		t.Fatalf("sync should serve the signed original and skip deletions, got %+v", page)
+	}
+	for query, want := range map[string]int{"noon": 0, "three": 1, "secret": 0} {
+		q, _ := ParseSearchQuery(query)
+		if res, _ := store.Search(q); len(res) != want {
+			t.Fatalf("search %q: got %d results, want %d", query, len(res), want)
+		}
+	}
+}
+
+func TestHistoryStoreThreadIndex(t *testing.T) {
+	store, err := OpenHistoryStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("OpenHistoryStore: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	now := time.Now()
+	for _, msg := range []message.Message{
+		{MsgID: "root", Content: "release today?", Timestamp: now},
+		{MsgID: "r2", ReplyTo: "r1", ThreadRoot: "root", Content: "agreed", Timestamp: now.Add(2 * time.Second)},
+		{MsgID: "r1", ReplyTo: "root", ThreadRoot: "root", Content: "after lunch", Timestamp: now.Add(time.Second)},
+		{MsgID: "other", Content: "unrelated", Timestamp: now.Add(3 * time.Second)},
+	} {
+		if err := store.Append(msg); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	thread, err := store.Thread("root")
+	if err != nil || thread.Root == nil || thread.Root.MsgID != "root" {
+		t.Fatalf("unexpected root %+v err=%v", thread.Root, err)
+	}
+	if len(thread.Replies) != 2 || thread.Replies[0].MsgID != "r1" || thread.Replies[1].MsgID != "r2" {
+		t.Fatalf("expected replies in timestamp order, got %+v", thread.Replies)
+	}
+	if other, _ := store.Thread("other"); other.Root == nil || len(other.Replies) != 0 {
+		t.Fatalf("expected a message without replies to have an empty thread")
+	}
+}
+
+func TestHistoryStoreReactions(t *testing.T) {
+	store, err := OpenHistoryStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("OpenHistoryStore: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	msg := message.Message{MsgID: "a", Channel: "general", Content: "hi", Timestamp: time.Now()}
+	if err := store.Append(msg); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	tally := []message.Reaction{{Emoji: "🎉", Count: 1, By: []string{"bob"}}}
+	if err := store.SetReactions("a", tally); err != nil {
+		t.Fatalf("SetReactions: %v", err)
+	}
+	recent, _ := store.RecentChannel("general", 10)
+	if len(recent) != 1 || len(recent[0].Reactions) != 1 || recent[0].Reactions[0].Emoji != "🎉" {
+		t.Fatalf("expected reactions on recent history, got %+v", recent)
+	}
+	if err := store.SetReactions("a", nil); err != nil {
+		t.Fatalf("SetReactions clear: %v", err)
+	}
+	if got, _ := store.Reactions("a"); len(got) != 0 {
+		t.Fatalf("expected cleared tally, got %+v", got)
+	}
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"encoding/json"
+
+	"go.etcd.io/bbolt"
+
+	"p2p-chat/internal/message"
+)
+
+// threadBucket holds one nested bucket per thread root whose keys are the
+// history keys of every reply in that thread.
+const threadBucket = "threads"
+
+// Thread is a root message and the replies that reference it.
+type Thread struct {
+	Root    *message.Message  `json:"root,omitempty"`
+	Replies []message.Message `json:"replies"`
+}
+
+// Thread returns the root message of a thread, if stored, and its replies in
+// timestamp order. Edits and deletions are applied.
+func (s *HistoryStore) Thread(rootID string) (Thread, error) {
+	thread := Thread{Replies: []message.Message{}}
+	if s == nil || s.db == nil {
+		return thread, nil
+	}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		messages := tx.Bucket([]byte(historyBucket))
+		if key := tx.Bucket([]byte(idBucket)).Get([]byte(rootID)); key != nil {
+			var root message.Message
+			if err := json.Unmarshal(messages.Get(key), &root); err == nil {
+				root = withOverlay(tx, root)
+				thread.Root = &root
+			}
+		}
+		index := tx.Bucket([]byte(threadBucket)).Bucket([]byte(rootID))
+		if index == nil {
+			return nil
+		}
+		return index.ForEach(func(k, _ []byte) error {
+			var msg message.Message
+			if err := json.Unmarshal(messages.Get(k), &msg); err == nil {
+				thread.Replies = append(thread.Replies, withOverlay(tx, msg))
+			}
+			return nil
+		})
+	})
+	return thread, err
+}
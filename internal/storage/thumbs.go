@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // register the GIF decoder with image.Decode
+	"image/jpeg"
+	"image/png"
+	"os"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// thumbMaxSide bounds the longer edge of a thumbnail in pixels.
+	thumbMaxSide = 320
+	// thumbMaxPixels refuses to decode images larger than this; a small file
+	// can declare enormous dimensions.
+	thumbMaxPixels = 24 << 20
+	thumbSuffix    = ".thumb"
+)
+
+// ErrNoThumbnail is returned for files that have no preview image.
+var ErrNoThumbnail = errors.New("no thumbnail for this file")
+
+// thumbnailable reports whether mime is an image format we can preview.
+func thumbnailable(mime string) bool {
+	switch mime {
+	case "image/png", "image/jpeg", "image/gif":
+		return true
+	}
+	return false
+}
+
+func (s *FileStore) thumbPath(digest string) string {
+	return s.blobPath(digest) + thumbSuffix
+}
+
+// copyDims fills the image and thumbnail dimensions of r from the blob.
+func (b blobEntry) copyDims(r *FileRecord) {
+	r.Width, r.Height = b.Width, b.Height
+	r.ThumbWidth, r.ThumbHeight = b.ThumbWidth, b.ThumbHeight
+}
+
+// ensureThumb makes sure the blob behind entry has a thumbnail and records its
+// dimensions on entry. Files that are not images, or fail to decode, are left
+// without one.
+func (s *FileStore) ensureThumb(entry *fileEntry) error {
+	if !thumbnailable(entry.Mime) || entry.SHA256 == "" {
+		return ErrNoThumbnail
+	}
+	var blob blobEntry
+	_ = s.db.View(func(tx *bbolt.Tx) error {
+		blob, _ = loadBlob(tx, entry.SHA256)
+		return nil
+	})
+	if blob.ThumbWidth == 0 {
+		w, h, tw, th, err := makeThumb(s.blobPath(entry.SHA256), s.thumbPath(entry.SHA256))
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrNoThumbnail, err)
+		}
+		err = s.db.Update(func(tx *bbolt.Tx) error {
+			current, ok := loadBlob(tx, entry.SHA256)
+			if !ok {
+				return nil
+			}
+			current.Width, current.Height, current.ThumbWidth, current.ThumbHeight = w, h, tw, th
+			blob = current
+			return putBlob(tx, entry.SHA256, current)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if entry.ThumbWidth == blob.ThumbWidth && entry.ThumbHeight == blob.ThumbHeight {
+		return nil
+	}
+	blob.copyDims(&entry.FileRecord)
+	return s.putEntry(*entry)
+}
+
+// Thumbnail opens the preview image of id, generating it on first use for
+// files stored before thumbnails existed.
+func (s *FileStore) Thumbnail(id string) (*fileEntry, *os.File, error) {
+	entry, err := s.Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.blobCorrupt(entry.SHA256) {
+		return nil, nil, ErrCorrupt
+	}
+	if err := s.ensureThumb(entry); err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(s.thumbPath(entry.SHA256))
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry, f, nil
+}
+
+// makeThumb decodes the image at src and writes a downscaled copy to dst, as
+// JPEG for JPEG sources and PNG otherwise so transparency survives. It
+// returns the source and thumbnail dimensions.
+func makeThumb(src, dst string) (w, h, tw, th int, err error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	defer f.Close()
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > thumbMaxPixels {
+		return 0, 0, 0, 0, fmt.Errorf("image is %dx%d", cfg.Width, cfg.Height)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return 0, 0, 0, 0, err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	thumb := downscale(img, thumbMaxSide)
+
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	if format == "jpeg" {
+		err = jpeg.Encode(out, thumb, &jpeg.Options{Quality: 80})
+	} else {
+		err = png.Encode(out, thumb)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return 0, 0, 0, 0, err
+	}
+	b := thumb.Bounds()
+	return cfg.Width, cfg.Height, b.Dx(), b.Dy(), nil
+}
+
+// downscale shrinks img so its longer edge is at most side, averaging the
+// source pixels that fall into each target pixel. Smaller images are copied
+// unchanged.
+func downscale(img image.Image, side int) *image.RGBA {
+	sb := img.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+	src := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(src, src.Bounds(), img, sb.Min, draw.Src)
+	if sw <= side && sh <= side {
+		return src
+	}
+	dw, dh := side, sh*side/sw
+	if sh > sw {
+		dw, dh = sw*side/sh, side
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, (y+1)*sh/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, (x+1)*sw/dw
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					b += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			o := dst.Pix[y*dst.Stride+x*4:]
+			o[0], o[1], o[2], o[3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// partialBucket holds the progress of files being received from peers.
+const partialBucket = "partials"
+
+// ErrFileExists is returned by BeginIncoming when the file was already
+// received.
+var ErrFileExists = errors.New("file already stored")
+
+// IncomingFile is a file being received from another peer in fixed-size
+// chunks. Have is a bitmap of the chunks already written to the partial file.
+type IncomingFile struct {
+	Record     FileRecord `json:"record"`
+	ChunkSize  int        `json:"chunk_size"`
+	Source     string     `json:"source"`
+	SourceName string     `json:"source_name"`
+	MsgID      string     `json:"msg_id,omitempty"`
+	Have       []byte     `json:"have"`
+	StartedAt  time.Time  `json:"started_at"`
+}
+
+// Total is the number of chunks in the file.
+func (in IncomingFile) Total() int {
+	if in.ChunkSize <= 0 {
+		return 0
+	}
+	return int((in.Record.Size + int64(in.ChunkSize) - 1) / int64(in.ChunkSize))
+}
+
+// Has reports whether chunk i was received.
+func (in IncomingFile) Has(i int) bool {
+	return i >= 0 && i/8 < len(in.Have) && in.Have[i/8]&(1<<(i%8)) != 0
+}
+
+// Received counts the chunks written so far.
+func (in IncomingFile) Received() int {
+	n := 0
+	for i := 0; i < in.Total(); i++ {
+		if in.Has(i) {
+			n++
+		}
+	}
+	return n
+}
+
+// FirstMissing returns the lowest chunk not yet received, or -1 when the file
+// is complete.
+func (in IncomingFile) FirstMissing() int {
+	for i := 0; i < in.Total(); i++ {
+		if !in.Has(i) {
+			return i
+		}
+	}
+	return -1
+}
+
+// chunkLen is the exact size chunk i must have.
+func (in IncomingFile) chunkLen(i int) int {
+	rest := in.Record.Size - int64(i)*int64(in.ChunkSize)
+	if rest > int64(in.ChunkSize) {
+		return in.ChunkSize
+	}
+	return int(rest)
+}
+
+func (s *FileStore) partialPath(id string) string {
+	return filepath.Join(s.dir, id+".part")
+}
+
+// BeginIncoming starts receiving in.Record, or returns the saved progress if
+// an earlier attempt was interrupted. It returns ErrFileExists when the file
+// is stored already, including under another ID with the same SHA-256; in
+// that case the record is added without a transfer.
+func (s *FileStore) BeginIncoming(in IncomingFile) (IncomingFile, error) {
+	if s == nil || s.db == nil {
+		return in, fmt.Errorf("file store not initialized")
+	}
+	id := in.Record.ID
+	if !validFileID(id) || in.ChunkSize <= 0 || in.Record.Size < 0 {
+		return in, fmt.Errorf("invalid incoming file %q", id)
+	}
+	if _, err := s.Get(id); err == nil {
+		return in, ErrFileExists
+	}
+	if err := s.CheckRoom(in.Record.Uploader, in.Record.Size, in.Record.SHA256); err != nil {
+		return in, err
+	}
+	if validDigest(in.Record.SHA256) {
+		linked, err := s.linkBlob(s.receivedEntry(in.Record))
+		if err != nil {
+			return in, err
+		}
+		if linked {
+			return in, ErrFileExists
+		}
+	}
+	if saved, ok, err := s.Incoming(id); err != nil || ok {
+		return saved, err
+	}
+	f, err := os.Create(s.partialPath(id))
+	if err != nil {
+		return in, err
+	}
+	if err := f.Truncate(in.Record.Size); err != nil {
+		_ = f.Close()
+		return in, err
+	}
+	if err := f.Close(); err != nil {
+		return in, err
+	}
+	in.Have = make([]byte, (in.Total()+7)/8)
+	if in.StartedAt.IsZero() {
+		in.StartedAt = time.Now().UTC()
+	}
+	return in, s.SaveIncoming(in)
+}
+
+// WriteChunk stores chunk i of in and marks it received. The caller persists
+// the progress with SaveIncoming.
+func (s *FileStore) WriteChunk(in *IncomingFile, i int, data []byte) error {
+	if i < 0 || i >= in.Total() {
+		return fmt.Errorf("chunk %d out of range", i)
+	}
+	if len(data) != in.chunkLen(i) {
+		return fmt.Errorf("chunk %d has %d bytes, want %d", i, len(data), in.chunkLen(i))
+	}
+	f, err := os.OpenFile(s.partialPath(in.Record.ID), os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(data, int64(i)*int64(in.ChunkSize)); err != nil {
+		return err
+	}
+	in.Have[i/8] |= 1 << (i % 8)
+	return nil
+}
+
+// SaveIncoming persists the progress of in.
+func (s *FileStore) SaveIncoming(in IncomingFile) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(partialBucket)).Put([]byte(in.Record.ID), data)
+	})
+}
+
+// Incoming returns the saved progress for file id.
+func (s *FileStore) Incoming(id string) (IncomingFile, bool, error) {
+	var in IncomingFile
+	if s == nil || s.db == nil {
+		return in, false, nil
+	}
+	found := false
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket([]byte(partialBucket)).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &in)
+	})
+	return in, found, err
+}
+
+// PendingIncoming lists every unfinished incoming file.
+func (s *FileStore) PendingIncoming() ([]IncomingFile, error) {
+	if s == nil || s.db == nil {
+		return nil, nil
+	}
+	var out []IncomingFile
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(partialBucket)).ForEach(func(_, v []byte) error {
+			var in IncomingFile
+			if err := json.Unmarshal(v, &in); err == nil {
+				out = append(out, in)
+			}
+			return nil
+		})
+	})
+	return out, err
+}
+
+// receivedEntry prepares the record of a file received from a peer; the
+// share key is local and never taken from the sender.
+func (s *FileStore) receivedEntry(record FileRecord) fileEntry {
+	entry := fileEntry{FileRecord: record}
+	entry.Name = sanitizeFileName(entry.Name)
+	if entry.Name == "" {
+		entry.Name = "download.bin"
+	}
+	entry.CreatedAt = time.Now().UTC()
+	s.issueShareKey(&entry, entry.CreatedAt)
+	return entry
+}
+
+// FinishIncoming checks the received file against its SHA-256 and adds it to
+// the blob store under its original ID. A file that fails the check is
+// discarded.
+func (s *FileStore) FinishIncoming(in IncomingFile) (FileRecord, error) {
+	id := in.Record.ID
+	partial := s.partialPath(id)
+	sum, err := fileDigest(partial)
+	if err == nil && sum != in.Record.SHA256 {
+		err = fmt.Errorf("checksum mismatch for %s", in.Record.Name)
+	}
+	if err == nil {
+		entry := s.receivedEntry(in.Record)
+		entry.Mime = detectMime(partial)
+		if err = s.storeEntry(&entry, partial); err == nil {
+			_ = s.ensureThumb(&entry)
+		}
+		in.Record = entry.FileRecord
+	}
+	if err != nil {
+		_ = os.Remove(partial)
+	}
+	if dropErr := s.dropIncoming(id); err == nil {
+		err = dropErr
+	}
+	return in.Record, err
+}
+
+// CancelIncoming forgets an unfinished file and removes its partial data.
+func (s *FileStore) CancelIncoming(id string) error {
+	if s == nil || s.db == nil {
+		return nil
+	}
+	_ = os.Remove(s.partialPath(id))
+	return s.dropIncoming(id)
+}
+
+func (s *FileStore) dropIncoming(id string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(partialBucket)).Delete([]byte(id))
+	})
+}
+
+// validFileID accepts the hex IDs newFileID generates so a peer cannot pick a
+// path outside the files directory.
+func validFileID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func validDigest(digest string) bool {
+	return len(digest) == sha256.Size*2 && validFileID(digest)
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -17,22 +17,25 @@ const (
 	ansiName  = "\x1b[33m"
 	ansiDM    = "\x1b[35m"
 	ansiSys   = "\x1b[32m"
+	ansiChan  = "\x1b[34m"
 )
 
 // CLIDisplay renders chat events to stdout.
 type CLIDisplay struct {
-	color bool
-	mu    sync.Mutex
+	color  bool
+	mu     sync.Mutex
+	quotes *quoteMemo
 }
 
 func NewCLIDisplay(color bool) *CLIDisplay {
-	return &CLIDisplay{color: color}
+	return &CLIDisplay{color: color, quotes: newQuoteMemo()}
 }
 
 func (c *CLIDisplay) ShowMessage(msg message.Message) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	fmt.Println(c.formatLine(msg))
+	c.quotes.remember(msg)
 }
 
 func (c *CLIDisplay) ShowSystem(text string) {
@@ -84,6 +87,34 @@ func (c *CLIDisplay) ShowNotification(n Notification) {
 	fmt.Println(line)
 }
 
+// UpdateMessage reprints a message that was edited or deleted; a terminal
+// cannot rewrite the earlier line.
+func (c *CLIDisplay) UpdateMessage(msg message.Message) {
+	c.ShowMessage(msg)
+}
+
+func (c *CLIDisplay) ShowStatus(s StatusUpdate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ts := s.Timestamp.Format("15:04:05")
+	if c.color {
+		fmt.Printf("%s[%s]%s %s%s%s\n", ansiTime, ts, ansiReset, ansiSys, describeStatus(s), ansiReset)
+		return
+	}
+	fmt.Printf("[%s] %s\n", ts, describeStatus(s))
+}
+
+func (c *CLIDisplay) ShowReaction(u ReactionUpdate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	line := describeReaction(u, c.quotes.quote(u.MsgID))
+	if c.color {
+		fmt.Printf("%s%s%s\n", ansiSys, line, ansiReset)
+		return
+	}
+	fmt.Println(line)
+}
+
 func (c *CLIDisplay) formatLine(msg message.Message) string {
 	ts := msg.Timestamp.Format("15:04:05")
 	label := ""
@@ -93,18 +124,33 @@ func (c *CLIDisplay) formatLine(msg message.Message) string {
 	case "file":
 		label = " (file)"
 	}
+	indent, body := "", displayContent(msg)
+	if quote := c.quotes.replyContext(msg); quote != "" {
+		indent, body = "  ↳ ", "("+quote+") "+body
+	}
+	if len(msg.Reactions) > 0 {
+		body += " [" + describeReactions(msg.Reactions) + "]"
+	}
 	if c.color {
 		nameColor := ansiName
 		if msg.Type == "dm" {
 			nameColor = ansiDM
 		}
-		line := fmt.Sprintf("%s[%s]%s %s%s%s%s: %s", ansiTime, ts, ansiReset, nameColor, msg.From, label, ansiReset, msg.Content)
+		room := ""
+		if msg.Channel != "" {
+			room = fmt.Sprintf("%s#%s%s ", ansiChan, msg.Channel, ansiReset)
+		}
+		line := fmt.Sprintf("%s%s[%s]%s %s%s%s%s%s: %s", indent, ansiTime, ts, ansiReset, room, nameColor, msg.From, label, ansiReset, body)
 		if extras := formatAttachments(msg); extras != "" {
 			line += " " + extras
 		}
 		return line
 	}
-	line := fmt.Sprintf("[%s] %s%s: %s", ts, msg.From, label, msg.Content)
+	room := ""
+	if msg.Channel != "" {
+		room = "#" + msg.Channel + " "
+	}
+	line := fmt.Sprintf("%s[%s] %s%s%s: %s", indent, ts, room, msg.From, label, body)
 	if extras := formatAttachments(msg); extras != "" {
 		line += " " + extras
 	}
@@ -1,16 +1,21 @@
 package ui
 
 import (
+	"fmt"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"p2p-chat/internal/message"
 )
 
 // Presence describes the availability of a peer so each UI can display it.
 type Presence struct {
-	Name   string `json:"name"`
-	Addr   string `json:"addr"`
-	Online bool   `json:"online"`
+	Name        string `json:"name"`
+	Addr        string `json:"addr"`
+	Online      bool   `json:"online"`
+	Fingerprint string `json:"fingerprint,omitempty"`
 }
 
 // Notification is used for system level alerts such as mentions or DMs.
@@ -22,12 +27,150 @@ type Notification struct {
 	From      string    `json:"from"`
 }
 
+// StatusUpdate reports progress of a message this peer sent: "sent" once it
+// left, "delivered" when a peer acked it and "read" when a peer's UI rendered
+// it. By names the peer that confirmed the delivery or read.
+type StatusUpdate struct {
+	MsgID     string    `json:"msg_id"`
+	State     string    `json:"state"`
+	By        string    `json:"by,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ReactionUpdate reports that By added or withdrew Emoji on message MsgID.
+// Reactions is the resulting tally for that message.
+type ReactionUpdate struct {
+	MsgID     string             `json:"msg_id"`
+	Emoji     string             `json:"emoji"`
+	By        string             `json:"by"`
+	Removed   bool               `json:"removed,omitempty"`
+	Reactions []message.Reaction `json:"reactions"`
+}
+
+// describeReactions renders a tally such as "👍 2 · 🎉 1" for text UIs.
+func describeReactions(reactions []message.Reaction) string {
+	parts := make([]string, 0, len(reactions))
+	for _, reaction := range reactions {
+		parts = append(parts, fmt.Sprintf("%s %d", reaction.Emoji, reaction.Count))
+	}
+	return strings.Join(parts, " · ")
+}
+
+// describeReaction renders a reaction update as a single line for text UIs.
+// target names the message reacted to.
+func describeReaction(u ReactionUpdate, target string) string {
+	verb := "reacted"
+	if u.Removed {
+		verb = "withdrew"
+	}
+	line := fmt.Sprintf("%s %s %s to %s", u.By, verb, u.Emoji, target)
+	if len(u.Reactions) > 0 {
+		line += " [" + describeReactions(u.Reactions) + "]"
+	}
+	return line
+}
+
+// describeStatus renders a status update as a single line for text UIs.
+func describeStatus(s StatusUpdate) string {
+	id := s.MsgID
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	switch {
+	case s.By == "":
+		return fmt.Sprintf("message %s %s", id, s.State)
+	case s.State == "read":
+		return fmt.Sprintf("message %s read by %s", id, s.By)
+	default:
+		return fmt.Sprintf("message %s %s to %s", id, s.State, s.By)
+	}
+}
+
+// displayContent is the text shown for msg, accounting for edits and
+// deletions.
+func displayContent(msg message.Message) string {
+	switch {
+	case msg.Deleted:
+		return "[message deleted]"
+	case msg.Edited:
+		return msg.Content + " (edited)"
+	}
+	return msg.Content
+}
+
+const (
+	// quoteMemoSize bounds how many shown messages text UIs remember for
+	// quoting the parent of a reply.
+	quoteMemoSize = 500
+	// quoteSnippetRunes is how much of the parent a reply quotes.
+	quoteSnippetRunes = 40
+)
+
+// quoteMemo remembers recently shown messages so text UIs can quote the parent
+// of a reply without asking the runtime.
+type quoteMemo struct {
+	mu    sync.Mutex
+	order []string
+	byID  map[string]message.Message
+}
+
+func newQuoteMemo() *quoteMemo {
+	return &quoteMemo{byID: make(map[string]message.Message)}
+}
+
+func (m *quoteMemo) remember(msg message.Message) {
+	if msg.MsgID == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.byID[msg.MsgID]; !ok {
+		m.order = append(m.order, msg.MsgID)
+		if len(m.order) > quoteMemoSize {
+			delete(m.byID, m.order[0])
+			m.order = m.order[1:]
+		}
+	}
+	m.byID[msg.MsgID] = msg
+}
+
+// replyContext describes the parent of msg for a reply line. Messages that
+// are not replies get an empty string.
+func (m *quoteMemo) replyContext(msg message.Message) string {
+	if msg.ReplyTo == "" {
+		return ""
+	}
+	return "re " + m.quote(msg.ReplyTo)
+}
+
+// quote names message id by author and opening words when it was shown
+// recently, and by its short ID otherwise.
+func (m *quoteMemo) quote(id string) string {
+	m.mu.Lock()
+	msg, ok := m.byID[id]
+	m.mu.Unlock()
+	if !ok {
+		if len(id) > 8 {
+			id = id[:8]
+		}
+		return id
+	}
+	snippet := displayContent(msg)
+	if utf8.RuneCountInString(snippet) > quoteSnippetRunes {
+		snippet = string([]rune(snippet)[:quoteSnippetRunes]) + "…"
+	}
+	return fmt.Sprintf("%s: %q", msg.From, snippet)
+}
+
 // Sink is the unified interface every UI surface must satisfy.
 type Sink interface {
 	ShowMessage(message.Message)
 	ShowSystem(string)
 	UpdatePeers([]Presence)
 	ShowNotification(Notification)
+	ShowStatus(StatusUpdate)
+	UpdateMessage(message.Message)
+	ShowReaction(ReactionUpdate)
 }
 
 type multiSink struct {
@@ -70,3 +213,27 @@ func (m *multiSink) ShowNotification(n Notification) {
 		}
 	}
 }
+
+func (m *multiSink) ShowStatus(s StatusUpdate) {
+	for _, sink := range m.sinks {
+		if sink != nil {
+			sink.ShowStatus(s)
+		}
+	}
+}
+
+func (m *multiSink) UpdateMessage(msg message.Message) {
+	for _, sink := range m.sinks {
+		if sink != nil {
+			sink.UpdateMessage(msg)
+		}
+	}
+}
+
+func (m *multiSink) ShowReaction(u ReactionUpdate) {
+	for _, sink := range m.sinks {
+		if sink != nil {
+			sink.ShowReaction(u)
+		}
+	}
+}
@@ -20,6 +20,7 @@ type TUIDisplay struct {
 	peers    *tview.List
 	send     func(string)
 	once     sync.Once
+	quotes   *quoteMemo
 }
 
 func NewTUIDisplay(send func(string)) *TUIDisplay {
@@ -42,6 +43,7 @@ func NewTUIDisplay(send func(string)) *TUIDisplay {
 		input:    input,
 		peers:    peers,
 		send:     send,
+		quotes:   newQuoteMemo(),
 	}
 
 	input.SetDoneFunc(func(key tcell.Key) {
@@ -85,7 +87,19 @@ func (t *TUIDisplay) ShowMessage(msg message.Message) {
 	case "file":
 		label = " [FILE]"
 	}
-	content := fmt.Sprintf("[yellow][%s][-] [lightgreen]%s%s[-]: %s", ts, msg.From, label, msg.Content)
+	room := ""
+	if msg.Channel != "" {
+		room = fmt.Sprintf("[blue]#%s[-] ", msg.Channel)
+	}
+	indent, body := "", displayContent(msg)
+	if quote := t.quotes.replyContext(msg); quote != "" {
+		indent, body = "  ↳ ", fmt.Sprintf("[gray](%s)[-] %s", tview.Escape(quote), body)
+	}
+	t.quotes.remember(msg)
+	if len(msg.Reactions) > 0 {
+		body += fmt.Sprintf(" [gray]%s[-]", tview.Escape("["+describeReactions(msg.Reactions)+"]"))
+	}
+	content := fmt.Sprintf("%s[yellow][%s][-] %s[lightgreen]%s%s[-]: %s", indent, ts, room, msg.From, label, body)
 	if len(msg.Attachments) > 0 {
 		names := make([]string, 0, len(msg.Attachments))
 		for _, att := range msg.Attachments {
@@ -100,9 +114,19 @@ func (t *TUIDisplay) ShowMessage(msg message.Message) {
 	content += "\n"
 	t.app.QueueUpdateDraw(func() {
 		fmt.Fprint(t.messages, content)
+		t.markRead(msg)
 	})
 }
 
+// markRead reports a message as read once it has actually been drawn. The
+// runtime ignores our own messages and ones it already acknowledged.
+func (t *TUIDisplay) markRead(msg message.Message) {
+	if msg.MsgID == "" || t.send == nil {
+		return
+	}
+	go t.send("/read " + msg.MsgID)
+}
+
 func (t *TUIDisplay) ShowSystem(text string) {
 	content := fmt.Sprintf("[green]>>> %s[-]\n", text)
 	t.app.QueueUpdateDraw(func() {
@@ -133,3 +157,22 @@ func (t *TUIDisplay) ShowNotification(n Notification) {
 		fmt.Fprint(t.messages, content)
 	})
 }
+
+// UpdateMessage redraws an edited or deleted message below the original.
+func (t *TUIDisplay) UpdateMessage(msg message.Message) {
+	t.ShowMessage(msg)
+}
+
+func (t *TUIDisplay) ShowStatus(s StatusUpdate) {
+	content := fmt.Sprintf("[gray]%s[-]\n", describeStatus(s))
+	t.app.QueueUpdateDraw(func() {
+		fmt.Fprint(t.messages, content)
+	})
+}
+
+func (t *TUIDisplay) ShowReaction(u ReactionUpdate) {
+	content := fmt.Sprintf("[gray]%s[-]\n", tview.Escape(describeReaction(u, t.quotes.quote(u.MsgID))))
+	t.app.QueueUpdateDraw(func() {
+		fmt.Fprint(t.messages, content)
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -29,6 +30,13 @@ var webFS embed.FS
 // the ui package to a specific runtime implementation.
 type HistoryProvider interface {
 	All() []message.Message
+	Channel(name string) []message.Message
+}
+
+// HistoryIndex answers search and thread queries over persisted history.
+type HistoryIndex interface {
+	Search(storage.SearchQuery) ([]message.Message, error)
+	Thread(rootID string) (storage.Thread, error)
 }
 
 // WebBridge wires the embedded web UI to the runtime via HTTP, WS and SSE.
@@ -37,6 +45,7 @@ type WebBridge struct {
 	srv        *http.Server
 	upgrader   websocket.Upgrader
 	history    HistoryProvider
+	index      HistoryIndex
 	submit     func(string)
 	files      *storage.FileStore
 	share      func(storage.FileRecord, string) error
@@ -79,6 +88,8 @@ func NewWebBridge(addr string, history HistoryProvider, submit func(string), onS
 	mux.HandleFunc("/api/files", wb.handleFiles)
 	mux.HandleFunc("/api/files/", wb.handleFileDownload)
 	mux.HandleFunc("/api/push/subscribe", wb.handlePushSubscribe)
+	mux.HandleFunc("/api/search", wb.handleSearch)
+	mux.HandleFunc("/api/threads/", wb.handleThread)
 	wb.srv = &http.Server{Addr: addr, Handler: mux}
 	return wb, nil
 }
@@ -111,6 +122,11 @@ func (wb *WebBridge) Close() {
 	wb.sseMu.Unlock()
 }
 
+// SetHistoryIndex enables GET /api/search and /api/threads backed by idx.
+func (wb *WebBridge) SetHistoryIndex(idx HistoryIndex) {
+	wb.index = idx
+}
+
 // Addr exposes the bound address so other layers can build public URLs.
 func (wb *WebBridge) Addr() string {
 	return wb.addr
@@ -144,22 +160,34 @@ func (wb *WebBridge) handleFileDownload(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "file storage disabled", http.StatusServiceUnavailable)
 		return
 	}
-	id := strings.TrimPrefix(r.URL.Path, "/api/files/")
-	if id == "" {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/files/"), "/")
+	if id == "" || (sub != "" && sub != "share-key" && sub != "thumb") {
 		http.NotFound(w, r)
 		return
 	}
+	if r.Method == http.MethodDelete && sub != "thumb" {
+		wb.deleteFile(w, r, id, sub == "share-key")
+		return
+	}
+	if sub == "share-key" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if sub == "thumb" {
+		wb.serveThumb(w, r, id)
+		return
+	}
 	entry, file, err := wb.files.Open(id)
+	if errors.Is(err, storage.ErrCorrupt) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	if err != nil {
 		http.Error(w, "file not found", http.StatusNotFound)
 		return
 	}
 	defer file.Close()
-	authorized := false
-	if key := r.URL.Query().Get("key"); key != "" && entry.ShareKey != "" && key == entry.ShareKey {
-		authorized = true
-	}
-	if !authorized {
+	if !entry.ShareKeyValid(r.URL.Query().Get("key"), time.Now()) {
 		if _, err := wb.requireAuth(r); err != nil {
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
@@ -171,16 +199,139 @@ func (wb *WebBridge) handleFileDownload(w http.ResponseWriter, r *http.Request)
 		contentType = "application/octet-stream"
 	}
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Length", strconv.FormatInt(entry.Size, 10))
 	w.Header().Set("X-Filename", filename)
 	disposition := "inline"
 	if strings.EqualFold(r.URL.Query().Get("download"), "1") {
 		disposition = "attachment"
 	}
 	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=\"%s\"", disposition, url.PathEscape(filename)))
-	if _, err := io.Copy(w, file); err != nil {
-		log.Printf("file download %s: %v", id, err)
+	// The content never changes under a digest, so it doubles as the ETag;
+	// ServeContent answers If-None-Match, If-Range and Range from it.
+	if entry.SHA256 != "" {
+		w.Header().Set("ETag", `"`+entry.SHA256+`"`)
+	}
+	http.ServeContent(w, r, filename, entry.CreatedAt, file)
+}
+
+// serveThumb answers GET /api/files/{id}/thumb with the preview of an image,
+// under the same share key or session rules as the file itself.
+func (wb *WebBridge) serveThumb(w http.ResponseWriter, r *http.Request, id string) {
+	entry, thumb, err := wb.files.Thumbnail(id)
+	switch {
+	case errors.Is(err, storage.ErrCorrupt):
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	case err != nil:
+		http.Error(w, "no thumbnail", http.StatusNotFound)
+		return
+	}
+	defer thumb.Close()
+	if !entry.ShareKeyValid(r.URL.Query().Get("key"), time.Now()) {
+		if _, err := wb.requireAuth(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
 	}
+	w.Header().Set("ETag", `"`+entry.SHA256+`-thumb"`)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(w, r, "", entry.CreatedAt, thumb)
+}
+
+// deleteFile handles DELETE /api/files/{id}, which removes the file, and
+// DELETE /api/files/{id}/share-key, which revokes its share link. Only the
+// uploader may do either.
+func (wb *WebBridge) deleteFile(w http.ResponseWriter, r *http.Request, id string, keyOnly bool) {
+	username, err := wb.requireAuth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	entry, err := wb.files.Get(id)
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if !strings.EqualFold(entry.Uploader, username) {
+		http.Error(w, "only the uploader can do that", http.StatusForbidden)
+		return
+	}
+	if keyOnly {
+		err = wb.files.RevokeShareKey(id)
+	} else {
+		err = wb.files.Remove(id)
+	}
+	if err != nil {
+		log.Printf("file delete %s: %v", id, err)
+		http.Error(w, "delete failed", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSearch answers GET /api/search?q=<query>[&limit=N] using the same
+// syntax as the /search command. Results are newest first.
+func (wb *WebBridge) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := wb.requireAuth(r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if wb.index == nil {
+		http.Error(w, "history persistence disabled", http.StatusServiceUnavailable)
+		return
+	}
+	query, err := storage.ParseSearchQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil {
+		query.Limit = limit
+	}
+	results, err := wb.index.Search(query)
+	if err != nil {
+		http.Error(w, "search failed", http.StatusInternalServerError)
+		return
+	}
+	if results == nil {
+		results = []message.Message{}
+	}
+	wb.writeJSON(w, http.StatusOK, results)
+}
+
+// handleThread answers GET /api/threads/{id} with the root message and every
+// reply stored under it, oldest first.
+func (wb *WebBridge) handleThread(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := wb.requireAuth(r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if wb.index == nil {
+		http.Error(w, "history persistence disabled", http.StatusServiceUnavailable)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/threads/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	thread, err := wb.index.Thread(id)
+	if err != nil {
+		http.Error(w, "thread lookup failed", http.StatusInternalServerError)
+		return
+	}
+	if thread.Root == nil && len(thread.Replies) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	wb.writeJSON(w, http.StatusOK, thread)
 }
 
 func (wb *WebBridge) listFiles(w http.ResponseWriter, r *http.Request) {
@@ -215,6 +366,10 @@ func (wb *WebBridge) uploadFile(w http.ResponseWriter, r *http.Request) {
 	defer file.Close()
 	target := strings.TrimSpace(r.FormValue("target"))
 	record, err := wb.files.Save(header.Filename, username, file)
+	if errors.Is(err, storage.ErrQuotaExceeded) || errors.Is(err, storage.ErrStoreFull) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
 	if err != nil {
 		http.Error(w, "upload failed", http.StatusInternalServerError)
 		return
@@ -315,7 +470,7 @@ func (wb *WebBridge) handleWS(w http.ResponseWriter, r *http.Request) {
 	}
 	wb.register(conn)
 	go wb.readLoop(conn)
-	wb.sendHistory(conn)
+	wb.sendHistory(conn, r.URL.Query().Get("channel"))
 }
 
 func (wb *WebBridge) handleSSE(w http.ResponseWriter, r *http.Request) {
@@ -387,11 +542,22 @@ func (wb *WebBridge) readLoop(conn *websocket.Conn) {
 	}
 }
 
-func (wb *WebBridge) sendHistory(conn *websocket.Conn) {
-	event := webEvent{Kind: "history", History: wb.history.All()}
+func (wb *WebBridge) sendHistory(conn *websocket.Conn, channel string) {
+	event := webEvent{Kind: "history", Channel: channel}
+	if channel != "" {
+		event.History = wb.history.Channel(channel)
+	} else {
+		event.History = wb.history.All()
+	}
 	wb.sendEventTo(conn, event)
 }
 
+// ShowHistory replays the backlog of channel to every connected client, used
+// when the peer switches rooms.
+func (wb *WebBridge) ShowHistory(channel string) {
+	wb.sendEvent(webEvent{Kind: "history", Channel: channel, History: wb.history.Channel(channel)})
+}
+
 func (wb *WebBridge) sendEvent(evt webEvent) {
 	data, err := json.Marshal(evt)
 	if err != nil {
@@ -462,12 +628,30 @@ func (wb *WebBridge) ShowNotification(n Notification) {
 	wb.sendEvent(evt)
 }
 
+// UpdateMessage tells web clients to replace a message they already render.
+func (wb *WebBridge) UpdateMessage(msg message.Message) {
+	wb.sendEvent(webEvent{Kind: "update", Message: msg})
+}
+
+func (wb *WebBridge) ShowStatus(s StatusUpdate) {
+	wb.sendEvent(webEvent{Kind: "status", Status: s})
+}
+
+// ShowReaction sends the new tally for a message so clients can update it in
+// place.
+func (wb *WebBridge) ShowReaction(u ReactionUpdate) {
+	wb.sendEvent(webEvent{Kind: "reaction", Reaction: u})
+}
+
 type webEvent struct {
 	Kind         string             `json:"kind"`
 	Message      message.Message    `json:"message,omitempty"`
 	Text         string             `json:"text,omitempty"`
+	Channel      string             `json:"channel,omitempty"`
 	Users        []Presence         `json:"users,omitempty"`
 	History      []message.Message  `json:"history,omitempty"`
 	Notification Notification       `json:"notification,omitempty"`
 	File         storage.FileRecord `json:"file,omitempty"`
+	Status       StatusUpdate       `json:"status,omitempty"`
+	Reaction     ReactionUpdate     `json:"reaction,omitempty"`
 }
@@ -8,9 +8,19 @@
 /**
  * @param {object} message - message payload from the store.
  * @param {string} currentUser - username of the authenticated user.
+ * @param {object} [receipt] - delivery state for our own messages.
+ * @param {object} [actions] - optional `onEdit` / `onDelete` callbacks offered
+ *   on our own messages, plus `onReply` and `onReact(message, emoji)` offered
+ *   on every message and `onFetch(attachment)` offered on files too large to
+ *   be fetched automatically.
+ * @param {object} [parent] - the message this one replies to, when loaded.
  * @returns {HTMLElement}
  */
-export function createMessageBubble(message, currentUser) {
+// AUTO_FETCH_LIMIT mirrors maxAutoFetch in internal/protocol/transfer.go:
+// other peers' files above it are only fetched on request.
+const AUTO_FETCH_LIMIT = 64 * 1024 * 1024;
+
+export function createMessageBubble(message, currentUser, receipt, actions = {}, parent) {
   const bubble = document.createElement('article');
   bubble.className = 'message';
   if (message.from && message.from === currentUser) {
@@ -26,12 +36,44 @@ export function createMessageBubble(message, currentUser) {
     meta.textContent = 'System';
   } else {
     const target = message.to ? ` → ${message.to}` : '';
-    meta.textContent = `${message.from || 'unknown'}${target} · ${ts}`;
+    const room = message.channel ? `#${message.channel} · ` : '';
+    meta.textContent = `${room}${message.from || 'unknown'}${target} · ${ts}`;
   }
   const body = document.createElement('div');
   body.className = 'body';
-  body.textContent = message.content || '';
+  if (message.reply_to) {
+    bubble.classList.add('reply');
+    bubble.appendChild(buildQuote(message, parent));
+  }
+  if (message.deleted) {
+    bubble.classList.add('deleted');
+    body.textContent = 'message deleted';
+  } else {
+    body.textContent = message.content || '';
+    if (message.edited) {
+      const edited = document.createElement('span');
+      edited.className = 'edited';
+      edited.textContent = ' (edited)';
+      body.appendChild(edited);
+    }
+  }
   bubble.append(meta, body);
+  const mine = message.from && message.from === currentUser;
+  if (!message.deleted && message.type !== 'system') {
+    if (message.reactions?.length) {
+      bubble.appendChild(buildReactions(message, currentUser, actions.onReact));
+    }
+    const bar = buildActions(message, mine ? actions : { onReply: actions.onReply, onReact: actions.onReact });
+    if (bar.childElementCount) {
+      bubble.appendChild(bar);
+    }
+  }
+  if (receipt?.state) {
+    const status = document.createElement('div');
+    status.className = `receipt ${receipt.state}`;
+    status.textContent = describeReceipt(receipt);
+    bubble.appendChild(status);
+  }
   if (message.attachments?.length) {
     const attachments = document.createElement('div');
     attachments.className = 'attachments';
@@ -39,7 +81,9 @@ export function createMessageBubble(message, currentUser) {
       const item = document.createElement('div');
       item.className = 'attachment-item';
       const downloadUrl = buildDownloadURL(attachment);
-      if (attachment.mime && attachment.mime.startsWith('image/') && attachment.url) {
+      if (attachment.thumb_width && attachment.thumb_height) {
+        item.appendChild(buildPreview(attachment));
+      } else if (attachment.mime && attachment.mime.startsWith('image/') && attachment.url) {
         const img = document.createElement('img');
         img.src = attachment.url;
         img.alt = attachment.name || 'Image';
@@ -62,6 +106,15 @@ export function createMessageBubble(message, currentUser) {
         chip.rel = 'noopener noreferrer';
       }
       item.appendChild(chip);
+      if (actions.onFetch && !mine && !attachment.url && attachment.size > AUTO_FETCH_LIMIT) {
+        const fetchButton = document.createElement('button');
+        fetchButton.type = 'button';
+        fetchButton.className = 'attachment-chip';
+        fetchButton.textContent = 'Fetch';
+        fetchButton.title = 'Too large to fetch automatically';
+        fetchButton.addEventListener('click', () => actions.onFetch(attachment));
+        item.appendChild(fetchButton);
+      }
       attachments.appendChild(item);
     });
     bubble.appendChild(attachments);
@@ -69,6 +122,111 @@ export function createMessageBubble(message, currentUser) {
   return bubble;
 }
 
+function buildQuote(message, parent) {
+  const quote = document.createElement('div');
+  quote.className = 'reply-quote';
+  if (!parent) {
+    quote.textContent = `replying to ${message.reply_to.slice(0, 8)}`;
+    return quote;
+  }
+  const text = parent.deleted ? 'message deleted' : parent.content || '';
+  const snippet = text.length > 60 ? `${text.slice(0, 60)}…` : text;
+  quote.textContent = `replying to ${parent.from || 'unknown'}: ${snippet}`;
+  return quote;
+}
+
+function buildReactions(message, currentUser, onReact) {
+  const row = document.createElement('div');
+  row.className = 'reactions';
+  message.reactions.forEach((reaction) => {
+    const chip = document.createElement('button');
+    chip.type = 'button';
+    chip.className = 'reaction-chip';
+    if ((reaction.by || []).includes(currentUser)) {
+      chip.classList.add('mine');
+    }
+    chip.textContent = `${reaction.emoji} ${reaction.count}`;
+    chip.title = (reaction.by || []).join(', ');
+    if (onReact) {
+      chip.addEventListener('click', () => onReact(message, reaction.emoji));
+    }
+    row.appendChild(chip);
+  });
+  return row;
+}
+
+function buildActions(message, { onEdit, onDelete, onReply, onReact }) {
+  const bar = document.createElement('div');
+  bar.className = 'message-actions';
+  if (onReact) {
+    const react = document.createElement('button');
+    react.type = 'button';
+    react.textContent = 'React';
+    react.addEventListener('click', () => onReact(message));
+    bar.appendChild(react);
+  }
+  if (onReply) {
+    const reply = document.createElement('button');
+    reply.type = 'button';
+    reply.textContent = 'Reply';
+    reply.addEventListener('click', () => onReply(message));
+    bar.appendChild(reply);
+  }
+  if (onEdit && message.type !== 'file') {
+    const edit = document.createElement('button');
+    edit.type = 'button';
+    edit.textContent = 'Edit';
+    edit.addEventListener('click', () => onEdit(message));
+    bar.appendChild(edit);
+  }
+  if (onDelete) {
+    const remove = document.createElement('button');
+    remove.type = 'button';
+    remove.textContent = 'Delete';
+    remove.addEventListener('click', () => onDelete(message));
+    bar.appendChild(remove);
+  }
+  return bar;
+}
+
+function describeReceipt(receipt) {
+  switch (receipt.state) {
+    case 'read':
+      return `✓✓ read by ${receipt.readBy.join(', ')}`;
+    case 'delivered':
+      return `✓✓ delivered to ${receipt.deliveredTo.join(', ')}`;
+    default:
+      return '✓ sent';
+  }
+}
+
+// buildPreview sizes the preview from the announced thumbnail dimensions so
+// the layout does not jump. Until the file has a URL here (it is still being
+// fetched from the sender) a placeholder of the same size is shown.
+function buildPreview(attachment) {
+  const width = attachment.thumb_width;
+  const height = attachment.thumb_height;
+  if (!attachment.url) {
+    const placeholder = document.createElement('div');
+    placeholder.className = 'attachment-preview pending';
+    placeholder.style.width = `${width}px`;
+    placeholder.style.aspectRatio = `${width} / ${height}`;
+    placeholder.title = `${attachment.name || 'Image'} (${attachment.width}×${attachment.height})`;
+    return placeholder;
+  }
+  const url = new URL(attachment.url, window.location.origin);
+  url.pathname = `${url.pathname.replace(/\/$/, '')}/thumb`;
+  const img = document.createElement('img');
+  img.src = url.toString();
+  img.width = width;
+  img.height = height;
+  img.alt = attachment.name || 'Image';
+  img.className = 'attachment-preview';
+  img.loading = 'lazy';
+  img.addEventListener('click', () => window.open(attachment.url, '_blank'));
+  return img;
+}
+
 function buildDownloadURL(attachment) {
   if (!attachment || !attachment.url) return '';
   const url = new URL(attachment.url, window.location.origin);
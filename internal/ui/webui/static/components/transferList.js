@@ -8,8 +8,9 @@
  * @param {object} options
  * @param {string} options.filter - 'uploads' | 'downloads' | 'all'
  * @param {(transfer: object) => void} [options.onRetry]
+ * @param {(transfer: object) => void} [options.onDelete] - offered on your own stored uploads
  */
-export function renderTransferList(container, transfers = [], { filter = 'all', onRetry } = {}) {
+export function renderTransferList(container, transfers = [], { filter = 'all', onRetry, onDelete } = {}) {
   container.innerHTML = '';
   const subset = transfers.filter((item) => {
     if (filter === 'all') return true;
@@ -48,6 +49,13 @@ export function renderTransferList(container, transfers = [], { filter = 'all',
       });
       actions.appendChild(download);
     }
+    if (onDelete && item.direction === 'uploads' && item.status !== 'uploading' && !String(item.id).startsWith('local-')) {
+      const remove = document.createElement('button');
+      remove.className = 'pill';
+      remove.textContent = 'Delete';
+      remove.addEventListener('click', () => onDelete(item));
+      actions.appendChild(remove);
+    }
 
     const progress = document.createElement('div');
     progress.className = 'transfer-progress';
@@ -9,7 +9,9 @@ const listeners = new Map();
 const defaultState = () => ({
   auth: { username: '', token: '', authApi: '' },
   peers: [],
+  channel: '',
   messages: [],
+  receipts: {},
   notifications: {
     system: [],
     mentions: [],
@@ -68,11 +70,61 @@ export function appendMessage(msg, { prepend = false } = {}) {
   emit('messages', state.messages);
 }
 
+/**
+ * Swaps in a new version of a message (after an edit or delete), matched by
+ * msg_id.
+ */
+export function replaceMessage(msg) {
+  if (!msg || !msg.msg_id) return;
+  const idx = state.messages.findIndex((item) => item.msg_id === msg.msg_id);
+  if (idx < 0) return;
+  state.messages[idx] = msg;
+  emit('messages', state.messages);
+}
+
+/**
+ * Stores the latest reaction tally the peer reported for a message.
+ */
+export function applyReaction(update) {
+  if (!update || !update.msg_id) return;
+  const idx = state.messages.findIndex((item) => item.msg_id === update.msg_id);
+  if (idx < 0) return;
+  state.messages[idx] = { ...state.messages[idx], reactions: update.reactions || [] };
+  emit('messages', state.messages);
+}
+
 export function replaceHistory(history) {
   state.messages = history.slice();
   emit('messages', state.messages);
 }
 
+const RECEIPT_RANK = { sent: 1, delivered: 2, read: 3 };
+
+/**
+ * Merges a delivery/read status update for one of our own messages. States
+ * never move backwards and every peer that confirmed is remembered.
+ */
+export function applyStatus(update) {
+  if (!update || !update.msg_id) return;
+  const current = state.receipts[update.msg_id] || { state: '', deliveredTo: [], readBy: [] };
+  const next = { ...current, deliveredTo: current.deliveredTo.slice(), readBy: current.readBy.slice() };
+  if ((RECEIPT_RANK[update.state] || 0) > (RECEIPT_RANK[next.state] || 0)) {
+    next.state = update.state;
+  }
+  const peers = update.by ? update.by.split(', ') : [];
+  peers.forEach((peer) => {
+    if (!next.deliveredTo.includes(peer)) next.deliveredTo.push(peer);
+    if (update.state === 'read' && !next.readBy.includes(peer)) next.readBy.push(peer);
+  });
+  state.receipts[update.msg_id] = next;
+  emit('messages', state.messages);
+}
+
+export function setChannel(channel) {
+  state.channel = channel;
+  emit('channel', state.channel);
+}
+
 export function setPeers(peers) {
   state.peers = peers;
   emit('peers', state.peers);
@@ -130,6 +182,11 @@ export function upsertTransfer(entry) {
   emit('transfers', state.transfers);
 }
 
+export function removeTransfer(id) {
+  state.transfers = state.transfers.filter((item) => item.id !== id);
+  emit('transfers', state.transfers);
+}
+
 export function setTransfers(entries) {
   state.transfers = entries.slice();
   emit('transfers', state.transfers);
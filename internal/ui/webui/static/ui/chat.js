@@ -4,7 +4,7 @@
 // behavior (emoji picker, file uploads, send button invocation).
 
 import { subscribe, getState, appendMessage, setActivePanel } from '../state.js';
-import { sendLine } from '../ws.js';
+import { sendLine, sendReadReceipt } from '../ws.js';
 import { uploadFile } from './files.js';
 import { mountComposerControls } from '../components/composer.js';
 import { createMessageBubble } from '../components/messageBubble.js';
@@ -82,16 +82,61 @@ function mountMessages() {
   renderMessages(list, getState().messages);
 }
 
+const MESSAGE_ACTIONS = {
+  onReact: (msg, emoji) => {
+    const choice = emoji || window.prompt(`React with (${QUICK_EMOJIS.join(' ')})`, QUICK_EMOJIS[4]);
+    if (choice && choice.trim()) {
+      sendLine(`/react ${msg.msg_id} ${choice.trim()}`);
+    }
+  },
+  onReply: (msg) => {
+    const text = window.prompt(`Reply to ${msg.from || 'message'}`, '');
+    if (text && text.trim()) {
+      sendLine(`/reply ${msg.msg_id} ${text.trim()}`);
+    }
+  },
+  onEdit: (msg) => {
+    const text = window.prompt('Edit message', msg.content || '');
+    if (text && text.trim() && text !== msg.content) {
+      sendLine(`/edit ${msg.msg_id} ${text.trim()}`);
+    }
+  },
+  onDelete: (msg) => {
+    if (window.confirm('Delete this message for everyone?')) {
+      sendLine(`/delete ${msg.msg_id}`);
+    }
+  },
+  onFetch: (attachment) => {
+    sendLine(`/fetch ${attachment.id}`);
+  },
+};
+
+// Message IDs we already reported as read; the peer dedupes as well but this
+// keeps re-renders from flooding the socket.
+const reportedReads = new Set();
+
 function renderMessages(list, messages = []) {
   list.innerHTML = '';
-  const currentUser = getState().auth.username;
+  const { auth, receipts } = getState();
+  const currentUser = auth.username;
+  const byId = new Map(messages.map((msg) => [msg.msg_id, msg]));
   messages.forEach((msg) => {
-    const bubble = createMessageBubble(msg, currentUser);
+    const parent = msg.reply_to ? byId.get(msg.reply_to) : undefined;
+    const bubble = createMessageBubble(msg, currentUser, receipts[msg.msg_id], MESSAGE_ACTIONS, parent);
     list.appendChild(bubble);
+    reportRead(msg, currentUser);
   });
   list.scrollTop = list.scrollHeight;
 }
 
+function reportRead(msg, currentUser) {
+  if (!msg.msg_id || msg.type === 'system' || msg.from === currentUser) return;
+  if (reportedReads.has(msg.msg_id)) return;
+  if (sendReadReceipt(msg.msg_id)) {
+    reportedReads.add(msg.msg_id);
+  }
+}
+
 function mountComposer() {
   const targetField = document.getElementById('target');
   const emojiPanel = document.getElementById('emoji-panel');
@@ -4,7 +4,7 @@
 // reporting, and surface download buttons + notifications when transfers
 // finish.
 
-import { subscribe, getState, setTransfers, upsertTransfer, pushNotification } from '../state.js';
+import { subscribe, getState, setTransfers, upsertTransfer, removeTransfer, pushNotification } from '../state.js';
 import { renderTransferList } from '../components/transferList.js';
 
 let activeFilter = 'all';
@@ -16,17 +16,21 @@ export function initFilesUI() {
   filterButtons.forEach((btn) => {
     btn.addEventListener('click', () => {
       activeFilter = btn.dataset.filter || 'all';
-      renderTransferList(container, getState().transfers, { filter: mapFilter(activeFilter), onRetry: retryTransfer });
+      renderTransferList(container, getState().transfers, listOptions());
     });
   });
 
   subscribe('transfers', (evt) => {
-    renderTransferList(container, evt.detail, { filter: mapFilter(activeFilter), onRetry: retryTransfer });
+    renderTransferList(container, evt.detail, listOptions());
   });
-  renderTransferList(container, getState().transfers, { filter: mapFilter(activeFilter), onRetry: retryTransfer });
+  renderTransferList(container, getState().transfers, listOptions());
   bootstrapTransfers();
 }
 
+function listOptions() {
+  return { filter: mapFilter(activeFilter), onRetry: retryTransfer, onDelete: deleteTransfer };
+}
+
 function mapFilter(filter) {
   if (filter === 'uploads' || filter === 'downloads') return filter;
   return 'all';
@@ -46,7 +50,10 @@ async function bootstrapTransfers() {
 
 function enrichTransfer(entry) {
   const { auth } = getState();
-  const key = entry.share_key;
+  const expires = entry.share_key_expires ? Date.parse(entry.share_key_expires) : NaN;
+  // Go encodes a share key without expiry as year 1.
+  const expired = expires > 0 && expires <= Date.now();
+  const key = expired ? '' : entry.share_key;
   const direction = entry.uploader === auth.username ? 'uploads' : 'downloads';
   const tokenized = `/api/files/${encodeURIComponent(entry.id)}?username=${encodeURIComponent(auth.username)}&token=${encodeURIComponent(
     auth.token
@@ -123,6 +130,23 @@ function retryTransfer(entry) {
   alert('Please select the file again to retry the upload.');
 }
 
+async function deleteTransfer(entry) {
+  if (!window.confirm(`Delete ${entry.name} from this peer?`)) return;
+  try {
+    const res = await fetch(`/api/files/${encodeURIComponent(entry.id)}`, {
+      method: 'DELETE',
+      headers: buildAuthHeaders(),
+    });
+    if (!res.ok) {
+      pushNotification('system', { title: 'Delete failed', text: await res.text(), timestamp: new Date().toISOString() });
+      return;
+    }
+    removeTransfer(entry.id);
+  } catch (err) {
+    console.error('file delete failed', err);
+  }
+}
+
 function buildAuthHeaders() {
   const { auth } = getState();
   return { Authorization: `Bearer ${auth.token}` };
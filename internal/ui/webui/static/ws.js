@@ -3,7 +3,7 @@
 // Handles WebSocket lifecycle + event fan-out. Messages feed the chat store,
 // peer lists, notifications, and transfer updates.
 
-import { appendMessage, replaceHistory, setPeers, getState, pushNotification, upsertTransfer } from './state.js';
+import { appendMessage, applyReaction, applyStatus, replaceHistory, replaceMessage, setPeers, getState, pushNotification, upsertTransfer, setChannel } from './state.js';
 
 let socket;
 
@@ -12,9 +12,12 @@ let socket;
  * reconnects when the socket closes unexpectedly.
  */
 export function initTransport({ onDisconnect }) {
-  const { auth } = getState();
+  const { auth, channel } = getState();
   const proto = location.protocol === 'https:' ? 'wss' : 'ws';
-  const url = `${proto}://${location.host}/ws?username=${encodeURIComponent(auth.username)}&token=${encodeURIComponent(auth.token)}`;
+  let url = `${proto}://${location.host}/ws?username=${encodeURIComponent(auth.username)}&token=${encodeURIComponent(auth.token)}`;
+  if (channel) {
+    url += `&channel=${encodeURIComponent(channel)}`;
+  }
   socket = new WebSocket(url);
 
   socket.addEventListener('message', (evt) => handleEvent(evt));
@@ -36,10 +39,22 @@ function handleEvent(evt) {
       case 'system':
         appendMessage({ type: 'system', content: payload.text, timestamp: new Date().toISOString() });
         break;
+      case 'update':
+        replaceMessage(payload.message);
+        break;
+      case 'status':
+        applyStatus(payload.status);
+        break;
+      case 'reaction':
+        applyReaction(payload.reaction);
+        break;
       case 'peers':
         setPeers(payload.users || []);
         break;
       case 'history':
+        if (payload.channel) {
+          setChannel(payload.channel);
+        }
         replaceHistory(payload.history || []);
         break;
       case 'notification':
@@ -109,3 +124,13 @@ export function sendLine(text) {
   }
   socket.send(text);
 }
+
+/**
+ * Reports that a message was rendered. Receipts are best effort, so nothing is
+ * queued or surfaced while the socket is down.
+ */
+export function sendReadReceipt(msgID) {
+  if (!socket || socket.readyState !== WebSocket.OPEN) return false;
+  socket.send(`/read ${msgID}`);
+  return true;
+}